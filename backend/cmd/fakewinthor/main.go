@@ -0,0 +1,49 @@
+// Command fakewinthor runs a stand-in for the Winthor picking API so the
+// backend can be pointed at it (winthor_api_url) with use_mock_winthor off.
+//
+//	go run ./cmd/fakewinthor -addr :9090 -error-rate 0.1 -latency 200ms
+//
+// Besides the contract endpoints it exposes:
+//
+//	GET  /_fake/requests        recorded API requests
+//	GET  /_fake/stock?filial=01 current stock of a filial
+//	PUT  /_fake/stock?filial=01 replace the stock of a filial
+//	POST /_fake/reset           regenerate stock from the seed
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"aprovapedido/winthorfake"
+)
+
+func main() {
+	cfg := winthorfake.DefaultConfig()
+	addr := flag.String("addr", ":9090", "listen address")
+	filiais := flag.String("filiais", strings.Join(cfg.Filiais, ","), "comma-separated filiais to generate")
+	flag.StringVar(&cfg.APIKey, "api-key", "", "required bearer token (empty = no auth)")
+	flag.DurationVar(&cfg.Latency, "latency", 100*time.Millisecond, "base latency per request")
+	flag.DurationVar(&cfg.Jitter, "jitter", 50*time.Millisecond, "random extra latency per request")
+	flag.Float64Var(&cfg.ErrorRate, "error-rate", 0.05, "fraction of requests answered with 503")
+	flag.Int64Var(&cfg.Seed, "seed", cfg.Seed, "seed for generated stock and depletion")
+	flag.IntVar(&cfg.LocationsPerFilial, "locations", cfg.LocationsPerFilial, "locations generated per filial")
+	flag.Float64Var(&cfg.DepletionFactor, "depletion", cfg.DepletionFactor, "depletion multiplier per stock read")
+	flag.Parse()
+
+	cfg.Filiais = nil
+	for _, f := range strings.Split(*filiais, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			cfg.Filiais = append(cfg.Filiais, f)
+		}
+	}
+
+	log.Printf("[FakeWinthor] listening on %s (filiais=%v, locations=%d, error_rate=%.2f, seed=%d)",
+		*addr, cfg.Filiais, cfg.LocationsPerFilial, cfg.ErrorRate, cfg.Seed)
+	if err := http.ListenAndServe(*addr, winthorfake.New(cfg)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -2,14 +2,14 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
-	"io"
+	"fmt"
 	"math"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
+
+	"aprovapedido/services"
 )
 
 // --- Dashboard ---
@@ -149,11 +149,19 @@ type FragmentationPoint struct {
 }
 
 type FragmentationResponse struct {
-	Filial       string               `json:"filial"`
-	CurrentScore float64              `json:"current_score"`
-	Trend        float64              `json:"trend_per_day"`
-	DaysToAlert  int                  `json:"days_to_alert"`
-	History      []FragmentationPoint `json:"history"`
+	Filial       string  `json:"filial"`
+	CurrentScore float64 `json:"current_score"`
+	Threshold    float64 `json:"threshold"`
+	AlertActive  bool    `json:"alert_active"`
+	Trend        float64 `json:"trend_per_day"`
+	TrendLower   float64 `json:"trend_lower"`
+	TrendUpper   float64 `json:"trend_upper"`
+	TrendR2      float64 `json:"trend_r2"`
+	TrendPoints  int     `json:"trend_points"`
+	DaysToAlert  int     `json:"days_to_alert"`
+	// Days to alert at the upper bound of the trend (worst case)
+	DaysToAlertMin int                  `json:"days_to_alert_min"`
+	History        []FragmentationPoint `json:"history"`
 }
 
 func GetFragmentationHandler(db *sql.DB) http.HandlerFunc {
@@ -164,6 +172,7 @@ func GetFragmentationHandler(db *sql.DB) http.HandlerFunc {
 		if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 {
 			days = d
 		}
+		params := LoadFragmentationParams(r.Context(), db, companyID)
 
 		query := `
 			SELECT filial, score, locations_below_min, total_active_locations, recorded_at
@@ -185,8 +194,9 @@ func GetFragmentationHandler(db *sql.DB) http.HandlerFunc {
 		defer rows.Close()
 
 		byFilial := map[string][]FragmentationPoint{}
+		recordedAts := map[string][]time.Time{}
 		for rows.Next() {
-			var f, filialCode string
+			var filialCode string
 			var score float64
 			var belowMin, total int
 			var recordedAt time.Time
@@ -197,9 +207,11 @@ func GetFragmentationHandler(db *sql.DB) http.HandlerFunc {
 				BelowMin:   belowMin,
 				Total:      total,
 			})
-			_ = f
+			recordedAts[filialCode] = append(recordedAts[filialCode], recordedAt)
 		}
 
+		now := time.Now()
+		windowStart := now.AddDate(0, 0, -params.TrendWindowDays)
 		var results []FragmentationResponse
 		for fil, points := range byFilial {
 			var current float64
@@ -207,35 +219,34 @@ func GetFragmentationHandler(db *sql.DB) http.HandlerFunc {
 				current = points[len(points)-1].Score
 			}
 
-			// Simple linear trend (last 7 points)
-			trend := 0.0
-			if len(points) >= 2 {
-				n := len(points)
-				start := 0
-				if n > 7 {
-					start = n - 7
-				}
-				pts := points[start:]
-				if len(pts) >= 2 {
-					first := pts[0].Score
-					last := pts[len(pts)-1].Score
-					trend = (last - first) / float64(len(pts))
+			// Least-squares trend over the configured window, x in days
+			var xs, ys []float64
+			for i, at := range recordedAts[fil] {
+				if at.Before(windowStart) {
+					continue
 				}
+				xs = append(xs, at.Sub(now).Hours()/24)
+				ys = append(ys, points[i].Score)
 			}
+			fit := services.LinearTrend(xs, ys)
 
-			// Days until alert (score >= 60)
-			daysToAlert := 0
-			if trend > 0 && current < 60 {
-				daysToAlert = int(math.Ceil((60 - current) / trend))
-			}
-
-			results = append(results, FragmentationResponse{
+			res := FragmentationResponse{
 				Filial:       fil,
 				CurrentScore: current,
-				Trend:        trend,
-				DaysToAlert:  daysToAlert,
+				Threshold:    params.AlertThreshold,
+				AlertActive:  current >= params.AlertThreshold,
+				Trend:        math.Round(fit.Slope*100) / 100,
+				TrendLower:   math.Round(fit.SlopeLower*100) / 100,
+				TrendUpper:   math.Round(fit.SlopeUpper*100) / 100,
+				TrendR2:      math.Round(fit.R2*1000) / 1000,
+				TrendPoints:  fit.N,
 				History:      points,
-			})
+			}
+			if current < params.AlertThreshold {
+				res.DaysToAlert = daysToReach(current, params.AlertThreshold, fit.Slope)
+				res.DaysToAlertMin = daysToReach(current, params.AlertThreshold, fit.SlopeUpper)
+			}
+			results = append(results, res)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -243,6 +254,15 @@ func GetFragmentationHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// daysToReach returns the days until current reaches threshold at perDay,
+// or 0 when it is not increasing.
+func daysToReach(current, threshold, perDay float64) int {
+	if perDay <= 0 || math.IsInf(perDay, 0) {
+		return 0
+	}
+	return int(math.Ceil((threshold - current) / perDay))
+}
+
 // --- Picking Locations List ---
 
 type PickingStockItem struct {
@@ -258,6 +278,9 @@ type PickingStockItem struct {
 	ABCClass    string  `json:"abc_class"`
 	OccupancyPct float64 `json:"occupancy_pct"`
 	LastSyncAt  *string `json:"last_sync_at"`
+	ConsumptionPerHour float64  `json:"consumption_per_hour"`
+	HoursToMin         *float64 `json:"hours_to_min"`
+	PredictedMinAt     *string  `json:"predicted_min_at"`
 }
 
 func ListPickingLocationsHandler(db *sql.DB) http.HandlerFunc {
@@ -279,6 +302,9 @@ func ListPickingLocationsHandler(db *sql.DB) http.HandlerFunc {
 			query += " AND ps.filial=$2"
 			args = append(args, filial)
 		}
+		if r.URL.Query().Get("include_inactive") != "true" {
+			query += " AND COALESCE(pl.is_active, TRUE)"
+		}
 		query += " ORDER BY CASE ps.abc_class WHEN 'A' THEN 1 WHEN 'B' THEN 2 ELSE 3 END, pl.location_code"
 
 		rows, err := db.Query(query, args...)
@@ -288,6 +314,12 @@ func ListPickingLocationsHandler(db *sql.DB) http.HandlerFunc {
 		}
 		defer rows.Close()
 
+		var windowDays int
+		db.QueryRow(`SELECT COALESCE(consumption_window_days, 7) FROM settings WHERE company_id=$1`,
+			companyID).Scan(&windowDays)
+		rates, _ := LoadConsumptionRates(r.Context(), db, companyID, filial, windowDays)
+		now := time.Now()
+
 		var items []PickingStockItem
 		for rows.Next() {
 			var item PickingStockItem
@@ -303,6 +335,16 @@ func ListPickingLocationsHandler(db *sql.DB) http.HandlerFunc {
 				s := lastSync.Time.Format(time.RFC3339)
 				item.LastSyncAt = &s
 			}
+			if rate, ok := rates[item.ID]; ok {
+				item.ConsumptionPerHour = math.Round(rate.PerHour*100) / 100
+			}
+			if item.MinQty > 0 {
+				item.HoursToMin = HoursToMin(item.CurrentQty, item.MinQty, rates[item.ID].PerHour)
+				if item.HoursToMin != nil {
+					at := now.Add(time.Duration(*item.HoursToMin * float64(time.Hour))).Format(time.RFC3339)
+					item.PredictedMinAt = &at
+				}
+			}
 			items = append(items, item)
 		}
 
@@ -311,154 +353,69 @@ func ListPickingLocationsHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// --- Import Picking CSV ---
+// --- Delete Location ---
 
-func ImportPickingCSVHandler(db *sql.DB) http.HandlerFunc {
+// DeletePickingLocationHandler deactivates a location instead of deleting
+// it, so its stock rows and movement history are kept.
+func DeletePickingLocationHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		companyID := GetCompanyIDFromContext(r)
-
-		if err := r.ParseMultipartForm(10 << 20); err != nil {
-			http.Error(w, "File too large", http.StatusBadRequest)
+		locationID, err := locationIDFromPath(r)
+		if err != nil {
+			http.Error(w, "Invalid location ID", http.StatusBadRequest)
 			return
 		}
 
-		file, _, err := r.FormFile("file")
+		tx, err := db.Begin()
 		if err != nil {
-			http.Error(w, "No file provided", http.StatusBadRequest)
+			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-		defer file.Close()
+		defer tx.Rollback()
 
-		reader := csv.NewReader(file)
-		reader.Comma = ';'
-		reader.TrimLeadingSpace = true
-
-		imported, skipped, errs := 0, 0, []string{}
-
-		// Skip header
-		if _, err := reader.Read(); err != nil {
-			http.Error(w, "Empty file", http.StatusBadRequest)
+		inactive := false
+		n, err := applyLocationChanges(tx, companyID, []int{locationID}, locationChanges{IsActive: &inactive})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		for lineNum := 2; ; lineNum++ {
-			record, err := reader.Read()
-			if err == io.EOF {
-				break
-			}
-			if err != nil || len(record) < 7 {
-				skipped++
-				continue
-			}
-
-			filial := strings.TrimSpace(record[0])
-			locationCode := strings.TrimSpace(record[1])
-			productCode := strings.TrimSpace(record[2])
-			productDesc := strings.TrimSpace(record[3])
-			minQty, _ := strconv.ParseFloat(strings.TrimSpace(record[4]), 64)
-			maxQty, _ := strconv.ParseFloat(strings.TrimSpace(record[5]), 64)
-			abcClass := strings.ToUpper(strings.TrimSpace(record[6]))
-
-			if filial == "" || locationCode == "" || productCode == "" {
-				skipped++
-				continue
-			}
-			if abcClass != "A" && abcClass != "B" && abcClass != "C" {
-				abcClass = "C"
-			}
-
-			// Parse location code into components (e.g., A-01-02-1)
-			parts := strings.Split(locationCode, "-")
-			aisle := ""
-			bay, level, position := 0, 1, 1
-			if len(parts) >= 1 {
-				aisle = parts[0]
-			}
-			if len(parts) >= 2 {
-				bay, _ = strconv.Atoi(parts[1])
-			}
-			if len(parts) >= 3 {
-				level, _ = strconv.Atoi(parts[2])
-			}
-			if len(parts) >= 4 {
-				position, _ = strconv.Atoi(parts[3])
-			}
-
-			// Upsert picking_location
-			var locationID int
-			err = db.QueryRow(`
-				INSERT INTO picking_locations (company_id, filial, location_code, aisle, bay, level, position)
-				VALUES ($1,$2,$3,$4,$5,$6,$7)
-				ON CONFLICT (company_id, filial, location_code) DO UPDATE
-				  SET aisle=EXCLUDED.aisle, bay=EXCLUDED.bay, level=EXCLUDED.level, position=EXCLUDED.position
-				RETURNING id
-			`, companyID, filial, locationCode, aisle, bay, level, position).Scan(&locationID)
-			if err != nil {
-				errs = append(errs, "Linha "+strconv.Itoa(lineNum)+": "+err.Error())
-				skipped++
-				continue
-			}
-
-			// Upsert picking_stock
-			_, err = db.Exec(`
-				INSERT INTO picking_stock
-				  (company_id, filial, location_id, product_code, product_description, current_qty, min_qty, max_qty, abc_class, last_sync_at)
-				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,NOW())
-				ON CONFLICT (company_id, filial, location_id, product_code) DO UPDATE
-				  SET min_qty=EXCLUDED.min_qty, max_qty=EXCLUDED.max_qty, abc_class=EXCLUDED.abc_class,
-				      product_description=EXCLUDED.product_description
-			`, companyID, filial, locationID, productCode, productDesc, maxQty, minQty, maxQty, abcClass)
-			if err != nil {
-				errs = append(errs, "Linha "+strconv.Itoa(lineNum)+": "+err.Error())
-				skipped++
-				continue
-			}
-			imported++
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
 		}
-
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"imported": imported,
-			"skipped":  skipped,
-			"errors":   errs,
-			"message":  strconv.Itoa(imported) + " enderecos importados com sucesso.",
-		})
+		json.NewEncoder(w).Encode(map[string]interface{}{"deactivated": n})
 	}
 }
 
-// --- Delete Location ---
+// --- Sync Now ---
 
-func DeletePickingLocationHandler(db *sql.DB) http.HandlerFunc {
+// SyncNowHandler starts a sync of the company in the background and returns
+// the job run id to poll at GET /api/scheduler/runs/:id. When a run is
+// already in progress its id is returned instead of starting another.
+func SyncNowHandler(db *sql.DB, runNow func(companyID string, userID *int) (int64, bool, error)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		companyID := GetCompanyIDFromContext(r)
-		idStr := strings.TrimPrefix(r.URL.Path, "/api/picking/locations/")
-		locationID, err := strconv.Atoi(idStr)
-		if err != nil {
-			http.Error(w, "Invalid location ID", http.StatusBadRequest)
-			return
+		var userID *int
+		if uid, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+			userID = &uid
 		}
-
-		res, err := db.Exec(`
-			DELETE FROM picking_locations WHERE id=$1 AND company_id=$2
-		`, locationID, companyID)
+		jobID, started, err := runNow(companyID, userID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		deleted, _ := res.RowsAffected()
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted})
-	}
-}
-
-// --- Sync Now ---
-
-func SyncNowHandler(db *sql.DB, runNow func(companyID string)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		companyID := GetCompanyIDFromContext(r)
-		go runNow(companyID)
+		message := "Sincronizacao iniciada em segundo plano."
+		if !started {
+			message = "Sincronizacao ja em andamento."
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"message": "Sincronizacao iniciada em segundo plano."})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"job_id":     jobID,
+			"started":    started,
+			"message":    message,
+			"status_url": fmt.Sprintf("/api/scheduler/runs/%d", jobID),
+		})
 	}
 }
 
@@ -472,6 +429,11 @@ type SyncLogEntry struct {
 	RecordsProcessed int    `json:"records_processed"`
 	ErrorMessage     string `json:"error_message"`
 	DurationMs       int    `json:"duration_ms"`
+	RecordsInserted  int    `json:"records_inserted"`
+	RecordsUpdated   int    `json:"records_updated"`
+	RecordsMissing   int    `json:"records_missing"`
+	Attempt          int    `json:"attempt"`
+	IdempotencyKey   string `json:"idempotency_key"`
 	SyncedAt         string `json:"synced_at"`
 }
 
@@ -481,7 +443,10 @@ func GetSyncLogHandler(db *sql.DB) http.HandlerFunc {
 
 		rows, err := db.Query(`
 			SELECT id, COALESCE(filial,''), sync_type, status, records_processed,
-			       COALESCE(error_message,''), duration_ms, synced_at
+			       COALESCE(error_message,''), duration_ms,
+			       COALESCE(records_inserted,0), COALESCE(records_updated,0), COALESCE(records_missing,0),
+			       COALESCE(attempt,1),
+			       COALESCE(idempotency_key,''), synced_at
 			FROM winthor_sync_log WHERE company_id=$1
 			ORDER BY synced_at DESC LIMIT 50
 		`, companyID)
@@ -496,7 +461,9 @@ func GetSyncLogHandler(db *sql.DB) http.HandlerFunc {
 			var e SyncLogEntry
 			var syncedAt time.Time
 			rows.Scan(&e.ID, &e.Filial, &e.SyncType, &e.Status, &e.RecordsProcessed,
-				&e.ErrorMessage, &e.DurationMs, &syncedAt)
+				&e.ErrorMessage, &e.DurationMs,
+				&e.RecordsInserted, &e.RecordsUpdated, &e.RecordsMissing,
+				&e.Attempt, &e.IdempotencyKey, &syncedAt)
 			e.SyncedAt = syncedAt.Format(time.RFC3339)
 			entries = append(entries, e)
 		}
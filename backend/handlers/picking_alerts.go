@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Fragmentation Model ---
+
+type FragmentationParams struct {
+	WeightA         float64
+	WeightB         float64
+	WeightC         float64
+	AlertThreshold  float64
+	TrendWindowDays int
+}
+
+func LoadFragmentationParams(ctx context.Context, db *sql.DB, companyID string) FragmentationParams {
+	p := FragmentationParams{WeightA: 3, WeightB: 2, WeightC: 1, AlertThreshold: 60, TrendWindowDays: 7}
+	db.QueryRowContext(ctx, `
+		SELECT COALESCE(frag_weight_a,3), COALESCE(frag_weight_b,2), COALESCE(frag_weight_c,1),
+		       COALESCE(frag_alert_threshold,60), COALESCE(frag_trend_window_days,7)
+		FROM settings WHERE company_id=$1
+	`, companyID).Scan(&p.WeightA, &p.WeightB, &p.WeightC, &p.AlertThreshold, &p.TrendWindowDays)
+	return p
+}
+
+// Weight returns the score weight of an ABC class.
+func (p FragmentationParams) Weight(abc string) float64 {
+	switch abc {
+	case "A":
+		return p.WeightA
+	case "B":
+		return p.WeightB
+	default:
+		return p.WeightC
+	}
+}
+
+// --- Alerts ---
+
+const (
+	AlertFragmentationHigh   = "fragmentation_high"
+	AlertFragmentationNormal = "fragmentation_normal"
+)
+
+// CheckFragmentationAlert records an alert when a filial's score crosses the
+// threshold: fragmentation_high going up, fragmentation_normal coming back
+// down. previous is nil for the first score of a filial.
+func CheckFragmentationAlert(ctx context.Context, db *sql.DB, companyID, filial string, previous *float64, score, threshold float64) {
+	var alertType, message string
+	switch {
+	case score >= threshold && (previous == nil || *previous < threshold):
+		alertType = AlertFragmentationHigh
+		message = fmt.Sprintf("Fragmentacao da filial %s atingiu %.1f (limite %.1f)", filial, score, threshold)
+	case score < threshold && previous != nil && *previous >= threshold:
+		alertType = AlertFragmentationNormal
+		message = fmt.Sprintf("Fragmentacao da filial %s voltou para %.1f (limite %.1f)", filial, score, threshold)
+	default:
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO picking_alerts (company_id, filial, alert_type, score, previous_score, threshold, message)
+		VALUES ($1,$2,$3,$4,$5,$6,$7)
+	`, companyID, filial, alertType, score, previous, threshold, message); err != nil {
+		log.Printf("[Picking] alert company=%s filial=%s: %v", companyID, filial, err)
+		return
+	}
+	log.Printf("[Picking] ALERT company=%s: %s", companyID, message)
+}
+
+type PickingAlert struct {
+	ID             int      `json:"id"`
+	Filial         string   `json:"filial"`
+	AlertType      string   `json:"alert_type"`
+	Score          float64  `json:"score"`
+	PreviousScore  *float64 `json:"previous_score"`
+	Threshold      float64  `json:"threshold"`
+	Message        string   `json:"message"`
+	AcknowledgedBy *string  `json:"acknowledged_by"`
+	AcknowledgedAt *string  `json:"acknowledged_at"`
+	CreatedAt      string   `json:"created_at"`
+}
+
+// ListPickingAlertsHandler handles GET /api/picking/alerts?filial=01&pending=true
+func ListPickingAlertsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+
+		query := `
+			SELECT a.id, a.filial, a.alert_type, a.score, a.previous_score, a.threshold,
+			       COALESCE(a.message,''), u.full_name, a.acknowledged_at, a.created_at
+			FROM picking_alerts a
+			LEFT JOIN users u ON u.id = a.acknowledged_by
+			WHERE a.company_id=$1
+		`
+		args := []interface{}{companyID}
+		if filial := r.URL.Query().Get("filial"); filial != "" {
+			args = append(args, filial)
+			query += " AND a.filial=$" + strconv.Itoa(len(args))
+		}
+		if r.URL.Query().Get("pending") == "true" {
+			query += " AND a.acknowledged_at IS NULL"
+		}
+		query += " ORDER BY a.created_at DESC LIMIT 100"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		alerts := []PickingAlert{}
+		for rows.Next() {
+			var a PickingAlert
+			var prev sql.NullFloat64
+			var ackBy sql.NullString
+			var ackAt sql.NullTime
+			var createdAt time.Time
+			if err := rows.Scan(&a.ID, &a.Filial, &a.AlertType, &a.Score, &prev, &a.Threshold,
+				&a.Message, &ackBy, &ackAt, &createdAt); err != nil {
+				continue
+			}
+			if prev.Valid {
+				a.PreviousScore = &prev.Float64
+			}
+			if ackBy.Valid {
+				a.AcknowledgedBy = &ackBy.String
+			}
+			if ackAt.Valid {
+				s := ackAt.Time.Format(time.RFC3339)
+				a.AcknowledgedAt = &s
+			}
+			a.CreatedAt = createdAt.Format(time.RFC3339)
+			alerts = append(alerts, a)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"alerts": alerts})
+	}
+}
+
+// AckPickingAlertHandler handles POST /api/picking/alerts/:id/ack
+func AckPickingAlertHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+		idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/picking/alerts/"), "/ack")
+		alertID, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid alert ID", http.StatusBadRequest)
+			return
+		}
+
+		var userID *int
+		if id, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+			userID = &id
+		}
+		res, err := db.Exec(`
+			UPDATE picking_alerts SET acknowledged_by=$1, acknowledged_at=NOW()
+			WHERE id=$2 AND company_id=$3 AND acknowledged_at IS NULL
+		`, userID, alertID, companyID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, _ := res.RowsAffected()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"acknowledged": n})
+	}
+}
@@ -0,0 +1,757 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// --- Picking CSV Import ---
+//
+// File layout (';' separated, first line is a header):
+//   filial;location_code;product_code;product_description;min_qty;max_qty;abc_class
+//
+// The import runs in two phases: a preview parses and validates the file,
+// computes the diff against the current locations and stores it as a
+// batch; a commit applies the batch in a single transaction.
+
+const importPreviewTTL = 24 * time.Hour
+
+// locationCodePattern is AISLE-BAY[-LEVEL[-POSITION]], e.g. A-01-02-1.
+var locationCodePattern = regexp.MustCompile(`^[A-Za-z0-9]{1,5}(-[0-9]{1,6}){1,3}$`)
+
+type ImportValues struct {
+	ProductDesc string  `json:"product_description"`
+	MinQty      float64 `json:"min_qty"`
+	MaxQty      float64 `json:"max_qty"`
+	ABCClass    string  `json:"abc_class"`
+}
+
+type importRow struct {
+	Line         int    `json:"line"`
+	Filial       string `json:"filial"`
+	LocationCode string `json:"location_code"`
+	ProductCode  string `json:"product_code"`
+	ImportValues
+}
+
+type ImportLineError struct {
+	Line    int    `json:"line"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportLocationChange struct {
+	Filial       string `json:"filial"`
+	LocationCode string `json:"location_code"`
+}
+
+type ImportProductChange struct {
+	Line         int           `json:"line,omitempty"`
+	StockID      int           `json:"stock_id,omitempty"`
+	Filial       string        `json:"filial"`
+	LocationCode string        `json:"location_code"`
+	ProductCode  string        `json:"product_code"`
+	Before       *ImportValues `json:"before,omitempty"`
+	After        *ImportValues `json:"after,omitempty"`
+}
+
+// ImportDiff compares a file with the current locations of the filiais it
+// mentions. Removed entries are only acted on with remove_missing.
+type ImportDiff struct {
+	NewLocations         []ImportLocationChange `json:"new_locations"`
+	ReactivatedLocations []ImportLocationChange `json:"reactivated_locations"`
+	RemovedLocations     []ImportLocationChange `json:"removed_locations"`
+	NewProducts          []ImportProductChange  `json:"new_products"`
+	ChangedProducts      []ImportProductChange  `json:"changed_products"`
+	RemovedProducts      []ImportProductChange  `json:"removed_products"`
+	Unchanged            int                    `json:"unchanged"`
+}
+
+type ImportBatch struct {
+	ID            int               `json:"id"`
+	Filename      string            `json:"filename"`
+	Status        string            `json:"status"`
+	RemoveMissing bool              `json:"remove_missing"`
+	TotalLines    int               `json:"total_lines"`
+	ValidLines    int               `json:"valid_lines"`
+	ErrorLines    int               `json:"error_lines"`
+	Errors        []ImportLineError `json:"errors"`
+	Diff          ImportDiff        `json:"diff"`
+	CreatedAt     string            `json:"created_at"`
+	AppliedAt     *string           `json:"applied_at"`
+}
+
+// parsePickingCSV reads and validates the file. Lines with errors are left
+// out of rows; total counts the data lines (header excluded).
+func parsePickingCSV(f io.Reader) (rows []importRow, errs []ImportLineError, total int, err error) {
+	reader := csv.NewReader(f)
+	reader.Comma = ';'
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	if _, err := reader.Read(); err != nil {
+		return nil, nil, 0, fmt.Errorf("arquivo vazio")
+	}
+
+	seen := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		total++
+		if err != nil {
+			line := 0
+			if pe, ok := err.(*csv.ParseError); ok {
+				line = pe.StartLine
+			}
+			errs = append(errs, ImportLineError{Line: line, Message: "linha invalida: " + err.Error()})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) < 7 {
+			errs = append(errs, ImportLineError{Line: line,
+				Message: fmt.Sprintf("esperadas 7 colunas, encontradas %d", len(record))})
+			continue
+		}
+
+		row := importRow{
+			Line:         line,
+			Filial:       strings.TrimSpace(record[0]),
+			LocationCode: strings.ToUpper(strings.TrimSpace(record[1])),
+			ProductCode:  strings.TrimSpace(record[2]),
+		}
+		row.ProductDesc = strings.TrimSpace(record[3])
+		row.ABCClass = strings.ToUpper(strings.TrimSpace(record[6]))
+
+		lineErrs := len(errs)
+		fail := func(field, msg string) {
+			errs = append(errs, ImportLineError{Line: line, Field: field, Message: msg})
+		}
+		switch {
+		case row.Filial == "":
+			fail("filial", "filial obrigatoria")
+		case len(row.Filial) > 5:
+			fail("filial", "filial com mais de 5 caracteres")
+		}
+		switch {
+		case row.LocationCode == "":
+			fail("location_code", "endereco obrigatorio")
+		case len(row.LocationCode) > 20 || !locationCodePattern.MatchString(row.LocationCode):
+			fail("location_code", "endereco malformado (esperado CORREDOR-PREDIO-NIVEL-POSICAO, ex. A-01-02-1)")
+		}
+		switch {
+		case row.ProductCode == "":
+			fail("product_code", "codigo do produto obrigatorio")
+		case len(row.ProductCode) > 50:
+			fail("product_code", "codigo do produto com mais de 50 caracteres")
+		}
+		if len([]rune(row.ProductDesc)) > 500 {
+			fail("product_description", "descricao com mais de 500 caracteres")
+		}
+		minOK, maxOK := true, true
+		if row.MinQty, err = parseImportQty(record[4]); err != nil {
+			fail("min_qty", "min_qty invalido: "+strings.TrimSpace(record[4]))
+			minOK = false
+		}
+		if row.MaxQty, err = parseImportQty(record[5]); err != nil {
+			fail("max_qty", "max_qty invalido: "+strings.TrimSpace(record[5]))
+			maxOK = false
+		}
+		if minOK && maxOK && row.MinQty > row.MaxQty {
+			fail("min_qty", fmt.Sprintf("min_qty (%g) maior que max_qty (%g)", row.MinQty, row.MaxQty))
+		}
+		if row.ABCClass == "" {
+			row.ABCClass = "C"
+		}
+		if row.ABCClass != "A" && row.ABCClass != "B" && row.ABCClass != "C" {
+			fail("abc_class", "abc_class deve ser A, B ou C")
+		}
+
+		key := row.Filial + "|" + row.LocationCode + "|" + row.ProductCode
+		if first, ok := seen[key]; ok {
+			fail("", fmt.Sprintf("duplicado: mesmo endereco e produto da linha %d", first))
+		} else if row.Filial != "" && row.LocationCode != "" && row.ProductCode != "" {
+			seen[key] = line
+		}
+
+		if len(errs) == lineErrs {
+			rows = append(rows, row)
+		}
+	}
+	return rows, errs, total, nil
+}
+
+// parseImportQty accepts both 1234.5 and the Brazilian 1.234,5.
+func parseImportQty(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ",") {
+		s = strings.ReplaceAll(strings.ReplaceAll(s, ".", ""), ",", ".")
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	switch {
+	case err != nil:
+	case math.IsNaN(v) || math.IsInf(v, 0):
+		// ParseFloat takes "NaN" and "Inf", which compare false to any bound
+		err = fmt.Errorf("not a number")
+	case v < 0:
+		err = fmt.Errorf("negative")
+	}
+	return v, err
+}
+
+// errorLineCount counts distinct lines with errors.
+func errorLineCount(errs []ImportLineError) int {
+	lines := map[int]bool{}
+	for _, e := range errs {
+		lines[e.Line] = true
+	}
+	return len(lines)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type existingLocation struct {
+	ID     int
+	Active bool
+}
+
+type existingStock struct {
+	ID           int
+	Filial       string
+	LocationCode string
+	ProductCode  string
+	ImportValues
+}
+
+// loadImportState reads the current locations and stock of the filiais.
+func loadImportState(q queryer, companyID string, filiais []string) (map[string]existingLocation, map[string]existingStock, error) {
+	locations := map[string]existingLocation{}
+	rows, err := q.Query(`
+		SELECT id, filial, location_code, COALESCE(is_active, TRUE)
+		FROM picking_locations WHERE company_id = $1 AND filial = ANY($2)
+	`, companyID, pq.Array(filiais))
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var l existingLocation
+		var filial, code string
+		if err := rows.Scan(&l.ID, &filial, &code, &l.Active); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		locations[filial+"|"+code] = l
+	}
+	rows.Close()
+
+	stock := map[string]existingStock{}
+	rows, err = q.Query(`
+		SELECT ps.id, ps.filial, pl.location_code, ps.product_code, COALESCE(ps.product_description,''),
+		       ps.min_qty, ps.max_qty, COALESCE(ps.abc_class,'C')
+		FROM picking_stock ps
+		JOIN picking_locations pl ON pl.id = ps.location_id
+		WHERE ps.company_id = $1 AND ps.filial = ANY($2)
+	`, companyID, pq.Array(filiais))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s existingStock
+		if err := rows.Scan(&s.ID, &s.Filial, &s.LocationCode, &s.ProductCode, &s.ProductDesc,
+			&s.MinQty, &s.MaxQty, &s.ABCClass); err != nil {
+			return nil, nil, err
+		}
+		stock[s.Filial+"|"+s.LocationCode+"|"+s.ProductCode] = s
+	}
+	return locations, stock, rows.Err()
+}
+
+func importFiliais(rows []importRow) []string {
+	set := map[string]bool{}
+	var out []string
+	for _, r := range rows {
+		if !set[r.Filial] {
+			set[r.Filial] = true
+			out = append(out, r.Filial)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// computeImportDiff compares the valid rows with the database. Locations
+// and products of the file's filiais that the file does not mention are
+// reported as removed.
+func computeImportDiff(q queryer, companyID string, rows []importRow) (ImportDiff, error) {
+	diff := ImportDiff{
+		NewLocations: []ImportLocationChange{}, ReactivatedLocations: []ImportLocationChange{},
+		RemovedLocations: []ImportLocationChange{}, NewProducts: []ImportProductChange{},
+		ChangedProducts: []ImportProductChange{}, RemovedProducts: []ImportProductChange{},
+	}
+	if len(rows) == 0 {
+		return diff, nil
+	}
+	locations, stock, err := loadImportState(q, companyID, importFiliais(rows))
+	if err != nil {
+		return diff, err
+	}
+
+	inFileLoc := map[string]bool{}
+	inFileStock := map[string]bool{}
+	for _, r := range rows {
+		locKey := r.Filial + "|" + r.LocationCode
+		if !inFileLoc[locKey] {
+			inFileLoc[locKey] = true
+			change := ImportLocationChange{Filial: r.Filial, LocationCode: r.LocationCode}
+			if l, ok := locations[locKey]; !ok {
+				diff.NewLocations = append(diff.NewLocations, change)
+			} else if !l.Active {
+				diff.ReactivatedLocations = append(diff.ReactivatedLocations, change)
+			}
+		}
+
+		key := locKey + "|" + r.ProductCode
+		inFileStock[key] = true
+		after := r.ImportValues
+		change := ImportProductChange{Line: r.Line, Filial: r.Filial, LocationCode: r.LocationCode,
+			ProductCode: r.ProductCode, After: &after}
+		s, ok := stock[key]
+		switch {
+		case !ok:
+			diff.NewProducts = append(diff.NewProducts, change)
+		case s.ImportValues != r.ImportValues:
+			before := s.ImportValues
+			change.StockID, change.Before = s.ID, &before
+			diff.ChangedProducts = append(diff.ChangedProducts, change)
+		default:
+			diff.Unchanged++
+		}
+	}
+
+	for key, l := range locations {
+		if !inFileLoc[key] && l.Active {
+			parts := strings.SplitN(key, "|", 2)
+			diff.RemovedLocations = append(diff.RemovedLocations,
+				ImportLocationChange{Filial: parts[0], LocationCode: parts[1]})
+		}
+	}
+	for key, s := range stock {
+		if !inFileStock[key] {
+			before := s.ImportValues
+			diff.RemovedProducts = append(diff.RemovedProducts, ImportProductChange{StockID: s.ID,
+				Filial: s.Filial, LocationCode: s.LocationCode, ProductCode: s.ProductCode, Before: &before})
+		}
+	}
+	sort.Slice(diff.RemovedLocations, func(i, j int) bool {
+		return diff.RemovedLocations[i].Filial+diff.RemovedLocations[i].LocationCode <
+			diff.RemovedLocations[j].Filial+diff.RemovedLocations[j].LocationCode
+	})
+	sort.Slice(diff.RemovedProducts, func(i, j int) bool {
+		a, b := diff.RemovedProducts[i], diff.RemovedProducts[j]
+		return a.Filial+a.LocationCode+a.ProductCode < b.Filial+b.LocationCode+b.ProductCode
+	})
+	return diff, nil
+}
+
+// applyImport writes the rows inside tx and returns the diff it applied.
+// New products start with zero quantity (the next sync brings the real
+// one) and min/max changes are audited with source "csv". With
+// removeMissing, locations missing from the file are deactivated and
+// products missing from it get min/max zeroed, so they stop generating
+// tasks without losing their history.
+func applyImport(tx *sql.Tx, companyID string, rows []importRow, removeMissing bool, userID *int) (ImportDiff, error) {
+	diff, err := computeImportDiff(tx, companyID, rows)
+	if err != nil {
+		return diff, err
+	}
+
+	locationIDs := map[string]int{}
+	for _, r := range rows {
+		locKey := r.Filial + "|" + r.LocationCode
+		if _, ok := locationIDs[locKey]; ok {
+			continue
+		}
+		aisle, bay, level, position := parseLocationCode(r.LocationCode)
+		var id int
+		if err := tx.QueryRow(`
+			INSERT INTO picking_locations (company_id, filial, location_code, aisle, bay, level, position)
+			VALUES ($1,$2,$3,$4,$5,$6,$7)
+			ON CONFLICT (company_id, filial, location_code) DO UPDATE
+			  SET aisle=EXCLUDED.aisle, bay=EXCLUDED.bay, level=EXCLUDED.level, position=EXCLUDED.position,
+			      is_active=TRUE, deactivated_at=NULL, updated_at=NOW()
+			RETURNING id
+		`, companyID, r.Filial, r.LocationCode, aisle, bay, level, position).Scan(&id); err != nil {
+			return diff, fmt.Errorf("linha %d: %w", r.Line, err)
+		}
+		locationIDs[locKey] = id
+	}
+
+	for _, r := range rows {
+		locationID := locationIDs[r.Filial+"|"+r.LocationCode]
+		var stockID int
+		var min, max float64
+		err := tx.QueryRow(`
+			SELECT id, min_qty, max_qty FROM picking_stock
+			WHERE company_id=$1 AND filial=$2 AND location_id=$3 AND product_code=$4
+			FOR UPDATE
+		`, companyID, r.Filial, locationID, r.ProductCode).Scan(&stockID, &min, &max)
+		if err == sql.ErrNoRows {
+			if _, err := tx.Exec(`
+				INSERT INTO picking_stock
+				  (company_id, filial, location_id, product_code, product_description, current_qty, min_qty, max_qty, abc_class)
+				VALUES ($1,$2,$3,$4,$5,0,$6,$7,$8)
+			`, companyID, r.Filial, locationID, r.ProductCode, r.ProductDesc, r.MinQty, r.MaxQty, r.ABCClass); err != nil {
+				return diff, fmt.Errorf("linha %d: %w", r.Line, err)
+			}
+			continue
+		}
+		if err != nil {
+			return diff, fmt.Errorf("linha %d: %w", r.Line, err)
+		}
+		if min != r.MinQty || max != r.MaxQty {
+			if err := setStockMinMax(tx, companyID, stockID, r.MinQty, r.MaxQty, "csv", nil, userID); err != nil {
+				return diff, fmt.Errorf("linha %d: %w", r.Line, err)
+			}
+		}
+		if _, err := tx.Exec(`
+			UPDATE picking_stock SET product_description=$2, abc_class=$3, updated_at=NOW() WHERE id=$1
+		`, stockID, r.ProductDesc, r.ABCClass); err != nil {
+			return diff, fmt.Errorf("linha %d: %w", r.Line, err)
+		}
+	}
+
+	if !removeMissing {
+		return diff, nil
+	}
+	if len(diff.RemovedLocations) > 0 {
+		var ids []int
+		for _, l := range diff.RemovedLocations {
+			var id int
+			if err := tx.QueryRow(`
+				SELECT id FROM picking_locations WHERE company_id=$1 AND filial=$2 AND location_code=$3
+			`, companyID, l.Filial, l.LocationCode).Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		inactive := false
+		if _, err := applyLocationChanges(tx, companyID, ids, locationChanges{IsActive: &inactive}); err != nil {
+			return diff, err
+		}
+	}
+	for _, p := range diff.RemovedProducts {
+		if p.Before.MinQty == 0 && p.Before.MaxQty == 0 {
+			continue
+		}
+		if err := setStockMinMax(tx, companyID, p.StockID, 0, 0, "csv", nil, userID); err != nil {
+			return diff, err
+		}
+	}
+	return diff, nil
+}
+
+func importUserID(r *http.Request) *int {
+	if id, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+		return &id
+	}
+	return nil
+}
+
+// readImportUpload parses the uploaded file of a multipart request.
+func readImportUpload(w http.ResponseWriter, r *http.Request) (rows []importRow, errs []ImportLineError, total int, filename string, ok bool) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "File too large", http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "No file provided", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	rows, errs, total, err = parsePickingCSV(file)
+	if err != nil {
+		http.Error(w, "Empty file", http.StatusBadRequest)
+		return
+	}
+	return rows, errs, total, header.Filename, true
+}
+
+// ImportPickingCSVHandler handles POST /api/picking/import (multipart "file").
+// One-shot import: the file is applied in a single transaction only when
+// every line is valid; otherwise nothing changes and the line errors are
+// returned. Use the preview/commit endpoints to review the diff first.
+func ImportPickingCSVHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		rows, errs, total, _, ok := readImportUpload(w, r)
+		if !ok {
+			return
+		}
+		if len(errs) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":    fmt.Sprintf("%d linhas com erro; nada foi importado", errorLineCount(errs)),
+				"imported": 0,
+				"skipped":  total - len(rows),
+				"errors":   errs,
+			})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		diff, err := applyImport(tx, companyID, rows, r.FormValue("remove_missing") == "true", importUserID(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"imported": len(rows),
+			"skipped":  0,
+			"errors":   []ImportLineError{},
+			"diff":     diff,
+			"message":  strconv.Itoa(len(rows)) + " enderecos importados com sucesso.",
+		})
+	}
+}
+
+// PreviewPickingImportHandler handles POST /api/picking/import/preview
+// (multipart "file", optional "remove_missing=true"). Nothing is applied;
+// the returned batch id is committed with POST /api/picking/import/:id/commit.
+func PreviewPickingImportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+		rows, errs, total, filename, ok := readImportUpload(w, r)
+		if !ok {
+			return
+		}
+		if errs == nil {
+			errs = []ImportLineError{}
+		}
+		removeMissing := r.FormValue("remove_missing") == "true"
+
+		diff, err := computeImportDiff(db, companyID, rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowsJSON, _ := json.Marshal(rows)
+		errsJSON, _ := json.Marshal(errs)
+		diffJSON, _ := json.Marshal(diff)
+		var id int
+		if err := db.QueryRow(`
+			INSERT INTO picking_import_batches
+			  (company_id, filename, remove_missing, total_lines, valid_lines, error_lines, rows, errors, diff, created_by)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) RETURNING id
+		`, companyID, filename, removeMissing, total, len(rows), errorLineCount(errs),
+			string(rowsJSON), string(errsJSON), string(diffJSON), importUserID(r)).Scan(&id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		batch, err := loadImportBatch(db, companyID, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batch)
+	}
+}
+
+func loadImportBatch(db *sql.DB, companyID string, id int) (ImportBatch, error) {
+	var b ImportBatch
+	var errsJSON, diffJSON string
+	var createdAt time.Time
+	var appliedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, COALESCE(filename,''), status, remove_missing, total_lines, valid_lines, error_lines,
+		       errors, diff, created_at, applied_at
+		FROM picking_import_batches WHERE id=$1 AND company_id=$2
+	`, id, companyID).Scan(&b.ID, &b.Filename, &b.Status, &b.RemoveMissing, &b.TotalLines,
+		&b.ValidLines, &b.ErrorLines, &errsJSON, &diffJSON, &createdAt, &appliedAt)
+	if err != nil {
+		return b, err
+	}
+	json.Unmarshal([]byte(errsJSON), &b.Errors)
+	json.Unmarshal([]byte(diffJSON), &b.Diff)
+	b.CreatedAt = createdAt.Format(time.RFC3339)
+	if appliedAt.Valid {
+		s := appliedAt.Time.Format(time.RFC3339)
+		b.AppliedAt = &s
+	}
+	return b, nil
+}
+
+// PickingImportBatchHandler handles GET /api/picking/import/:id,
+// POST /api/picking/import/:id/commit and POST /api/picking/import/:id/discard.
+// Commit body (optional): {"ignore_errors": true} to apply the valid lines
+// of a file that has errors.
+func PickingImportBatchHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/picking/import/"), "/"), "/")
+		batchID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid batch ID", http.StatusBadRequest)
+			return
+		}
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			batch, err := loadImportBatch(db, companyID, batchID)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Importacao nao encontrada", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(batch)
+		case action == "commit" && r.Method == http.MethodPost:
+			commitImportBatch(w, r, db, companyID, batchID)
+		case action == "discard" && r.Method == http.MethodPost:
+			res, err := db.Exec(`
+				UPDATE picking_import_batches SET status='descartado'
+				WHERE id=$1 AND company_id=$2 AND status='preview'
+			`, batchID, companyID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "Importacao nao encontrada ou ja aplicada", http.StatusConflict)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "descartado"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// commitImportBatch applies a previewed batch in one transaction. The diff
+// is recomputed at commit time, so changes made since the preview are taken
+// into account, and the stored diff is replaced by the one applied.
+func commitImportBatch(w http.ResponseWriter, r *http.Request, db *sql.DB, companyID string, batchID int) {
+	var req struct {
+		IgnoreErrors bool `json:"ignore_errors"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var status, rowsJSON string
+	var removeMissing bool
+	var errorLines int
+	var createdAt time.Time
+	err = tx.QueryRow(`
+		SELECT status, rows, remove_missing, error_lines, created_at
+		FROM picking_import_batches WHERE id=$1 AND company_id=$2 FOR UPDATE
+	`, batchID, companyID).Scan(&status, &rowsJSON, &removeMissing, &errorLines, &createdAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Importacao nao encontrada", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != "preview" {
+		http.Error(w, "Importacao ja "+status, http.StatusConflict)
+		return
+	}
+	if time.Since(createdAt) > importPreviewTTL {
+		http.Error(w, "Pre-visualizacao expirada; envie o arquivo novamente", http.StatusConflict)
+		return
+	}
+	if errorLines > 0 && !req.IgnoreErrors {
+		http.Error(w, fmt.Sprintf("%d linhas com erro; corrija o arquivo ou confirme com ignore_errors", errorLines),
+			http.StatusUnprocessableEntity)
+		return
+	}
+
+	var rows []importRow
+	if err := json.Unmarshal([]byte(rowsJSON), &rows); err != nil {
+		http.Error(w, "Importacao corrompida", http.StatusInternalServerError)
+		return
+	}
+	userID := importUserID(r)
+	diff, err := applyImport(tx, companyID, rows, removeMissing, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	diffJSON, _ := json.Marshal(diff)
+	if _, err := tx.Exec(`
+		UPDATE picking_import_batches
+		SET status='aplicado', diff=$2, applied_by=$3, applied_at=NOW()
+		WHERE id=$1
+	`, batchID, string(diffJSON), userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "aplicado",
+		"imported": len(rows),
+		"diff":     diff,
+		"message":  strconv.Itoa(len(rows)) + " enderecos importados com sucesso.",
+	})
+}
@@ -0,0 +1,456 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// --- Picking KPIs ---
+
+const maxKPIRangeDays = 92
+
+// PickingKPIRow holds the KPIs of one filial on one day. Means are nil when
+// there was nothing to measure.
+type PickingKPIRow struct {
+	Filial                 string   `json:"filial"`
+	Date                   string   `json:"date,omitempty"`
+	StockoutMinutes        float64  `json:"stockout_minutes"`
+	BelowMinEvents         int      `json:"below_min_events"`
+	Recoveries             int      `json:"recoveries"`
+	MeanRecoveryMinutes    *float64 `json:"mean_recovery_minutes"`
+	Waves                  int      `json:"waves"`
+	MeanGeneratedToSentMin *float64 `json:"mean_generated_to_sent_minutes"`
+	MeanSentToCompletedMin *float64 `json:"mean_sent_to_completed_minutes"`
+	MeanLeadTimeMin        *float64 `json:"mean_lead_time_minutes"`
+	TasksCompleted         int      `json:"tasks_completed"`
+	ActiveHours            int      `json:"active_hours"`
+	TasksPerHour           *float64 `json:"tasks_per_hour"`
+	WinthorCalls           int      `json:"winthor_calls"`
+	WinthorErrors          int      `json:"winthor_errors"`
+	WinthorErrorRate       *float64 `json:"winthor_error_rate"`
+
+	// running sums behind the means, so totals can be weighted correctly
+	recoverySum, toSentSum, toCompletedSum, leadSum float64
+	toSentN, toCompletedN, leadN                    int
+}
+
+func (k *PickingKPIRow) add(o *PickingKPIRow) {
+	k.StockoutMinutes += o.StockoutMinutes
+	k.BelowMinEvents += o.BelowMinEvents
+	k.Recoveries += o.Recoveries
+	k.recoverySum += o.recoverySum
+	k.Waves += o.Waves
+	k.toSentSum += o.toSentSum
+	k.toSentN += o.toSentN
+	k.toCompletedSum += o.toCompletedSum
+	k.toCompletedN += o.toCompletedN
+	k.leadSum += o.leadSum
+	k.leadN += o.leadN
+	k.TasksCompleted += o.TasksCompleted
+	k.ActiveHours += o.ActiveHours
+	k.WinthorCalls += o.WinthorCalls
+	k.WinthorErrors += o.WinthorErrors
+}
+
+// finish turns the running sums into the reported means and rates.
+func (k *PickingKPIRow) finish() {
+	mean := func(sum float64, n int) *float64 {
+		if n == 0 {
+			return nil
+		}
+		v := math.Round(sum/float64(n)*10) / 10
+		return &v
+	}
+	k.StockoutMinutes = math.Round(k.StockoutMinutes*10) / 10
+	k.MeanRecoveryMinutes = mean(k.recoverySum, k.Recoveries)
+	k.MeanGeneratedToSentMin = mean(k.toSentSum, k.toSentN)
+	k.MeanSentToCompletedMin = mean(k.toCompletedSum, k.toCompletedN)
+	k.MeanLeadTimeMin = mean(k.leadSum, k.leadN)
+	k.TasksPerHour = mean(float64(k.TasksCompleted), k.ActiveHours)
+	if k.WinthorCalls > 0 {
+		v := math.Round(float64(k.WinthorErrors)/float64(k.WinthorCalls)*10000) / 100
+		k.WinthorErrorRate = &v
+	}
+}
+
+type LocationStockout struct {
+	Filial       string  `json:"filial"`
+	LocationCode string  `json:"location_code"`
+	ProductCode  string  `json:"product_code"`
+	Minutes      float64 `json:"minutes"`
+}
+
+// kpiRange parses ?from=YYYY-MM-DD&to=YYYY-MM-DD (both inclusive, default
+// the last 7 days) into a half-open [from, to) interval of days in loc.
+func kpiRange(r *http.Request, loc *time.Location) (time.Time, time.Time, string) {
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	from, to := today.AddDate(0, 0, -6), today
+	if s := r.URL.Query().Get("from"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return from, to, "from invalido (use AAAA-MM-DD)"
+		}
+		from = t
+	}
+	if s := r.URL.Query().Get("to"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return from, to, "to invalido (use AAAA-MM-DD)"
+		}
+		to = t
+	}
+	if to.Before(from) {
+		return from, to, "to deve ser igual ou posterior a from"
+	}
+	if to.Sub(from) > maxKPIRangeDays*24*time.Hour {
+		return from, to, "periodo maximo de " + strconv.Itoa(maxKPIRangeDays) + " dias"
+	}
+	return from, to.AddDate(0, 0, 1), ""
+}
+
+// GetPickingKPIsHandler handles GET /api/picking/kpis?filial=01&from=2024-01-01&to=2024-01-31&format=csv
+//
+//   - stockout minutes: time each location spent at zero, from the stock movements
+//   - recovery: time from dropping to or below min until back above min
+//   - wave lead time: generated -> sent -> completed
+//   - tasks per hour: completed tasks over the hours in which tasks were completed
+//   - Winthor error rate: failed stock fetches and wave sends over all of them
+func GetPickingKPIsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		filial := r.URL.Query().Get("filial")
+		// Days are the company's, in the range and in the SQL buckets alike
+		loc := RCACompanyLocation(r.Context(), db, companyID)
+		from, to, msg := kpiRange(r, loc)
+		if msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		rows, err := loadPickingKPIs(db, companyID, filial, from, to, loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		totals := map[string]*PickingKPIRow{}
+		var filiais []string
+		for _, k := range rows {
+			t, ok := totals[k.Filial]
+			if !ok {
+				t = &PickingKPIRow{Filial: k.Filial}
+				totals[k.Filial] = t
+				filiais = append(filiais, k.Filial)
+			}
+			t.add(k)
+		}
+		for _, k := range rows {
+			k.finish()
+		}
+		sort.Strings(filiais)
+		totalRows := make([]*PickingKPIRow, 0, len(filiais))
+		for _, f := range filiais {
+			totals[f].finish()
+			totalRows = append(totalRows, totals[f])
+		}
+
+		if r.URL.Query().Get("format") == "csv" {
+			writeKPICSV(w, rows, from, to)
+			return
+		}
+
+		stockouts, err := topStockouts(db, companyID, filial, from, to, 20)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"from":          from.Format("2006-01-02"),
+			"to":            to.AddDate(0, 0, -1).Format("2006-01-02"),
+			"series":        rows,
+			"totals":        totalRows,
+			"top_stockouts": stockouts,
+		})
+	}
+}
+
+// loadPickingKPIs returns one row per filial and day of loc with any
+// activity, ordered by filial and date.
+func loadPickingKPIs(db *sql.DB, companyID, filial string, from, to time.Time, loc *time.Location) ([]*PickingKPIRow, error) {
+	byKey := map[string]*PickingKPIRow{}
+	row := func(f string, day time.Time) *PickingKPIRow {
+		key := f + "|" + day.Format("2006-01-02")
+		k, ok := byKey[key]
+		if !ok {
+			k = &PickingKPIRow{Filial: f, Date: day.Format("2006-01-02")}
+			byKey[key] = k
+		}
+		return k
+	}
+	args := []interface{}{companyID, from, to, filial, loc.String()}
+
+	// Stockout minutes: each movement's quantity holds until the next one;
+	// intervals at zero are clipped to the range and split per local day.
+	rows, err := db.Query(`
+		WITH `+stockoutMovementsCTE+`, o AS (
+			SELECT filial, GREATEST(start_at, $2) AS s, LEAST(end_at, $3, NOW()) AS e
+			FROM m WHERE qty_after <= 0 AND end_at > $2
+		)
+		SELECT o.filial, d::date,
+		       SUM(EXTRACT(EPOCH FROM LEAST(o.e, (d + INTERVAL '1 day') AT TIME ZONE $5)
+		                              - GREATEST(o.s, d AT TIME ZONE $5)) / 60)
+		FROM o, generate_series(date_trunc('day', o.s AT TIME ZONE $5), o.e AT TIME ZONE $5, INTERVAL '1 day') d
+		WHERE o.e > o.s AND d AT TIME ZONE $5 < o.e
+		GROUP BY 1, 2
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var f string
+		var day time.Time
+		var minutes float64
+		if rows.Scan(&f, &day, &minutes) == nil {
+			row(f, day).StockoutMinutes += minutes
+		}
+	}
+	rows.Close()
+
+	// Below-min events, counted on the day the location dropped
+	rows, err = db.Query(`
+		SELECT filial, (created_at AT TIME ZONE $5)::date, COUNT(*)
+		FROM picking_stock_movements
+		WHERE company_id = $1 AND ($4 = '' OR filial = $4) AND created_at >= $2 AND created_at < $3
+		  AND min_qty > 0 AND qty_before > min_qty AND qty_after <= min_qty
+		GROUP BY 1, 2
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var f string
+		var day time.Time
+		var n int
+		if rows.Scan(&f, &day, &n) == nil {
+			row(f, day).BelowMinEvents += n
+		}
+	}
+	rows.Close()
+
+	// Recoveries, counted on the day the location went back above min
+	rows, err = db.Query(`
+		SELECT d.filial, (r.created_at AT TIME ZONE $5)::date, COUNT(*),
+		       SUM(EXTRACT(EPOCH FROM r.created_at - d.created_at) / 60)
+		FROM picking_stock_movements d
+		JOIN LATERAL (
+			SELECT n.created_at FROM picking_stock_movements n
+			WHERE n.stock_id = d.stock_id AND n.created_at > d.created_at AND n.qty_after > n.min_qty
+			ORDER BY n.created_at LIMIT 1
+		) r ON TRUE
+		WHERE d.company_id = $1 AND ($4 = '' OR d.filial = $4)
+		  AND d.created_at >= $2::timestamptz - INTERVAL '30 days' AND d.created_at < $3
+		  AND d.min_qty > 0 AND d.qty_before > d.min_qty AND d.qty_after <= d.min_qty
+		  AND r.created_at >= $2 AND r.created_at < $3
+		GROUP BY 1, 2
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var f string
+		var day time.Time
+		var n int
+		var sum float64
+		if rows.Scan(&f, &day, &n, &sum) == nil {
+			k := row(f, day)
+			k.Recoveries += n
+			k.recoverySum += sum
+		}
+	}
+	rows.Close()
+
+	// Wave lead times, by generation day
+	rows, err = db.Query(`
+		SELECT filial, (generated_at AT TIME ZONE $5)::date, COUNT(*),
+		       COALESCE(SUM(EXTRACT(EPOCH FROM sent_to_winthor_at - generated_at) / 60), 0),
+		       COUNT(sent_to_winthor_at),
+		       COALESCE(SUM(EXTRACT(EPOCH FROM completed_at - sent_to_winthor_at) / 60)
+		                FILTER (WHERE status = 'concluida' AND sent_to_winthor_at IS NOT NULL), 0),
+		       COUNT(*) FILTER (WHERE status = 'concluida' AND sent_to_winthor_at IS NOT NULL AND completed_at IS NOT NULL),
+		       COALESCE(SUM(EXTRACT(EPOCH FROM completed_at - generated_at) / 60) FILTER (WHERE status = 'concluida'), 0),
+		       COUNT(*) FILTER (WHERE status = 'concluida' AND completed_at IS NOT NULL)
+		FROM replenishment_waves
+		WHERE company_id = $1 AND ($4 = '' OR filial = $4) AND generated_at >= $2 AND generated_at < $3
+		GROUP BY 1, 2
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var f string
+		var day time.Time
+		var n, sentN, completedN, leadN int
+		var sentSum, completedSum, leadSum float64
+		if rows.Scan(&f, &day, &n, &sentSum, &sentN, &completedSum, &completedN, &leadSum, &leadN) == nil {
+			k := row(f, day)
+			k.Waves += n
+			k.toSentSum += sentSum
+			k.toSentN += sentN
+			k.toCompletedSum += completedSum
+			k.toCompletedN += completedN
+			k.leadSum += leadSum
+			k.leadN += leadN
+		}
+	}
+	rows.Close()
+
+	// Completed tasks and the hours in which tasks were completed
+	rows, err = db.Query(`
+		SELECT filial, (completed_at AT TIME ZONE $5)::date, COUNT(*),
+		       COUNT(DISTINCT date_trunc('hour', completed_at AT TIME ZONE $5))
+		FROM replenishment_tasks
+		WHERE company_id = $1 AND ($4 = '' OR filial = $4) AND status = 'concluido'
+		  AND completed_at >= $2 AND completed_at < $3
+		GROUP BY 1, 2
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var f string
+		var day time.Time
+		var n, hours int
+		if rows.Scan(&f, &day, &n, &hours) == nil {
+			k := row(f, day)
+			k.TasksCompleted += n
+			k.ActiveHours += hours
+		}
+	}
+	rows.Close()
+
+	// Winthor calls: stock fetches and wave sends
+	rows, err = db.Query(`
+		SELECT filial, (synced_at AT TIME ZONE $5)::date, COUNT(*), COUNT(*) FILTER (WHERE status = 'error')
+		FROM winthor_sync_log
+		WHERE company_id = $1 AND ($4 = '' OR filial = $4) AND synced_at >= $2 AND synced_at < $3
+		  AND sync_type IN ('stock_fetch', 'wave_send') AND filial <> ''
+		GROUP BY 1, 2
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var f string
+		var day time.Time
+		var n, errs int
+		if rows.Scan(&f, &day, &n, &errs) == nil {
+			k := row(f, day)
+			k.WinthorCalls += n
+			k.WinthorErrors += errs
+		}
+	}
+	rows.Close()
+
+	out := make([]*PickingKPIRow, 0, len(byKey))
+	for _, k := range byKey {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Filial != out[j].Filial {
+			return out[i].Filial < out[j].Filial
+		}
+		return out[i].Date < out[j].Date
+	})
+	return out, nil
+}
+
+// stockoutMovementsCTE defines m: the movements of the range plus, per
+// location, the last one before it (the quantity it entered the range
+// with), each holding until the next. Taking that one through the stock
+// index keeps older history out of the scan.
+const stockoutMovementsCTE = `m0 AS (
+			SELECT id, stock_id, filial, qty_after, created_at
+			FROM picking_stock_movements
+			WHERE company_id = $1 AND ($4 = '' OR filial = $4) AND created_at >= $2 AND created_at < $3
+			UNION ALL
+			SELECT p.id, p.stock_id, p.filial, p.qty_after, p.created_at
+			FROM picking_stock ps
+			JOIN LATERAL (
+				SELECT id, stock_id, filial, qty_after, created_at FROM picking_stock_movements
+				WHERE stock_id = ps.id AND created_at < $2
+				ORDER BY created_at DESC, id DESC LIMIT 1
+			) p ON TRUE
+			WHERE ps.company_id = $1 AND ($4 = '' OR ps.filial = $4)
+		), m AS (
+			SELECT stock_id, filial, qty_after, created_at AS start_at,
+			       COALESCE(LEAD(created_at) OVER (PARTITION BY stock_id ORDER BY created_at, id), NOW()) AS end_at
+			FROM m0
+		)`
+
+// topStockouts returns the locations with the most minutes at zero in the range.
+func topStockouts(db *sql.DB, companyID, filial string, from, to time.Time, limit int) ([]LocationStockout, error) {
+	rows, err := db.Query(`
+		WITH `+stockoutMovementsCTE+`
+		SELECT m.filial, pl.location_code, ps.product_code,
+		       SUM(EXTRACT(EPOCH FROM LEAST(m.end_at, $3, NOW()) - GREATEST(m.start_at, $2)) / 60) AS minutes
+		FROM m
+		JOIN picking_stock ps ON ps.id = m.stock_id
+		JOIN picking_locations pl ON pl.id = ps.location_id
+		WHERE m.qty_after <= 0 AND m.end_at > $2 AND LEAST(m.end_at, $3, NOW()) > GREATEST(m.start_at, $2)
+		GROUP BY 1, 2, 3
+		ORDER BY minutes DESC
+		LIMIT $5
+	`, companyID, from, to, filial, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []LocationStockout{}
+	for rows.Next() {
+		var s LocationStockout
+		if rows.Scan(&s.Filial, &s.LocationCode, &s.ProductCode, &s.Minutes) == nil {
+			s.Minutes = math.Round(s.Minutes*10) / 10
+			out = append(out, s)
+		}
+	}
+	return out, rows.Err()
+}
+
+func writeKPICSV(w http.ResponseWriter, rows []*PickingKPIRow, from, to time.Time) {
+	num := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	filename := "kpis-picking-" + from.Format("20060102") + "-" + to.AddDate(0, 0, -1).Format("20060102") + ".csv"
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+
+	cw := csv.NewWriter(w)
+	cw.Comma = ';'
+	cw.Write([]string{"filial", "data", "minutos_ruptura", "eventos_abaixo_min", "recuperacoes",
+		"media_recuperacao_min", "ondas", "media_geracao_envio_min", "media_envio_conclusao_min",
+		"media_lead_time_min", "tarefas_concluidas", "horas_ativas", "tarefas_por_hora",
+		"chamadas_winthor", "erros_winthor", "taxa_erro_winthor_pct"})
+	for _, k := range rows {
+		cw.Write([]string{k.Filial, k.Date,
+			strconv.FormatFloat(k.StockoutMinutes, 'f', -1, 64),
+			strconv.Itoa(k.BelowMinEvents), strconv.Itoa(k.Recoveries), num(k.MeanRecoveryMinutes),
+			strconv.Itoa(k.Waves), num(k.MeanGeneratedToSentMin), num(k.MeanSentToCompletedMin),
+			num(k.MeanLeadTimeMin), strconv.Itoa(k.TasksCompleted), strconv.Itoa(k.ActiveHours),
+			num(k.TasksPerHour), strconv.Itoa(k.WinthorCalls), strconv.Itoa(k.WinthorErrors),
+			num(k.WinthorErrorRate)})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,747 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// --- Types ---
+
+type PickingLocation struct {
+	ID            int     `json:"id"`
+	Filial        string  `json:"filial"`
+	LocationCode  string  `json:"location_code"`
+	Aisle         string  `json:"aisle"`
+	Bay           int     `json:"bay"`
+	Level         int     `json:"level"`
+	Position      int     `json:"position"`
+	Zone          string  `json:"zone"`
+	CapacityBoxes int     `json:"capacity_boxes"`
+	IsActive      bool    `json:"is_active"`
+	DeactivatedAt *string `json:"deactivated_at"`
+	Products      int     `json:"products"`
+}
+
+const locationColumns = `
+	pl.id, pl.filial, pl.location_code, COALESCE(pl.aisle,''), COALESCE(pl.bay,0),
+	COALESCE(pl.level,1), COALESCE(pl.position,1), COALESCE(pl.zone,''),
+	COALESCE(pl.capacity_boxes,0), COALESCE(pl.is_active,TRUE), pl.deactivated_at,
+	(SELECT COUNT(*) FROM picking_stock ps WHERE ps.location_id = pl.id)`
+
+func scanLocation(row interface{ Scan(...interface{}) error }) (PickingLocation, error) {
+	var l PickingLocation
+	var deactivatedAt sql.NullTime
+	err := row.Scan(&l.ID, &l.Filial, &l.LocationCode, &l.Aisle, &l.Bay,
+		&l.Level, &l.Position, &l.Zone, &l.CapacityBoxes, &l.IsActive, &deactivatedAt, &l.Products)
+	if deactivatedAt.Valid {
+		s := deactivatedAt.Time.Format(time.RFC3339)
+		l.DeactivatedAt = &s
+	}
+	return l, err
+}
+
+// parseLocationCode splits an AISLE-BAY-LEVEL-POSITION code (e.g. A-01-02-1)
+// into its parts; missing or non-numeric parts keep their defaults.
+func parseLocationCode(code string) (aisle string, bay, level, position int) {
+	parts := strings.Split(code, "-")
+	bay, level, position = 0, 1, 1
+	if len(parts) >= 1 {
+		aisle = parts[0]
+	}
+	if len(parts) >= 2 {
+		bay, _ = strconv.Atoi(parts[1])
+	}
+	if len(parts) >= 3 {
+		level, _ = strconv.Atoi(parts[2])
+	}
+	if len(parts) >= 4 {
+		position, _ = strconv.Atoi(parts[3])
+	}
+	return
+}
+
+// --- Location Catalog ---
+
+// ListLocationCatalogHandler handles GET /api/picking/locations/catalog?filial=01&aisle=A&include_inactive=true
+// Unlike ListPickingLocationsHandler it lists locations, including empty ones.
+func ListLocationCatalogHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		q := r.URL.Query()
+
+		query := `SELECT ` + locationColumns + ` FROM picking_locations pl WHERE pl.company_id=$1`
+		args := []interface{}{companyID}
+		if filial := q.Get("filial"); filial != "" {
+			args = append(args, filial)
+			query += " AND pl.filial=$" + strconv.Itoa(len(args))
+		}
+		if aisle := q.Get("aisle"); aisle != "" {
+			args = append(args, aisle)
+			query += " AND pl.aisle=$" + strconv.Itoa(len(args))
+		}
+		if q.Get("include_inactive") != "true" {
+			query += " AND COALESCE(pl.is_active, TRUE)"
+		}
+		query += " ORDER BY pl.filial, pl.aisle, pl.bay, pl.level, pl.position, pl.location_code"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		locations := []PickingLocation{}
+		for rows.Next() {
+			l, err := scanLocation(rows)
+			if err != nil {
+				continue
+			}
+			locations = append(locations, l)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"locations": locations, "total": len(locations)})
+	}
+}
+
+// --- Create Location ---
+
+// CreatePickingLocationHandler handles POST /api/picking/locations
+// Body: {"filial":"01","location_code":"A-01-02-1","zone":"picking","capacity_boxes":40}
+// aisle/bay/level/position are taken from the code unless given.
+func CreatePickingLocationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+
+		var req struct {
+			Filial        string  `json:"filial"`
+			LocationCode  string  `json:"location_code"`
+			Aisle         *string `json:"aisle"`
+			Bay           *int    `json:"bay"`
+			Level         *int    `json:"level"`
+			Position      *int    `json:"position"`
+			Zone          string  `json:"zone"`
+			CapacityBoxes int     `json:"capacity_boxes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		req.Filial = strings.TrimSpace(req.Filial)
+		req.LocationCode = strings.TrimSpace(req.LocationCode)
+		if req.Filial == "" || req.LocationCode == "" {
+			http.Error(w, "filial e location_code sao obrigatorios", http.StatusBadRequest)
+			return
+		}
+		if len(req.Filial) > 5 || len(req.LocationCode) > 20 || len(req.Zone) > 20 {
+			http.Error(w, "filial, location_code ou zone muito longos", http.StatusBadRequest)
+			return
+		}
+		if req.CapacityBoxes < 0 {
+			http.Error(w, "capacity_boxes deve ser >= 0", http.StatusBadRequest)
+			return
+		}
+
+		aisle, bay, level, position := parseLocationCode(req.LocationCode)
+		if req.Aisle != nil {
+			aisle = *req.Aisle
+		}
+		if req.Bay != nil {
+			bay = *req.Bay
+		}
+		if req.Level != nil {
+			level = *req.Level
+		}
+		if req.Position != nil {
+			position = *req.Position
+		}
+		if len(aisle) > 5 {
+			http.Error(w, "aisle muito longo", http.StatusBadRequest)
+			return
+		}
+		if req.Zone == "" {
+			req.Zone = "picking"
+		}
+
+		var id int
+		err := db.QueryRow(`
+			INSERT INTO picking_locations
+			  (company_id, filial, location_code, aisle, bay, level, position, zone, capacity_boxes)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+			ON CONFLICT (company_id, filial, location_code) DO NOTHING
+			RETURNING id
+		`, companyID, req.Filial, req.LocationCode, aisle, bay, level, position,
+			req.Zone, req.CapacityBoxes).Scan(&id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Endereco ja cadastrado", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		loc, _ := scanLocation(db.QueryRow(`SELECT `+locationColumns+` FROM picking_locations pl WHERE pl.id=$1`, id))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(loc)
+	}
+}
+
+// --- Location Detail / Update ---
+
+func locationIDFromPath(r *http.Request) (int, error) {
+	return strconv.Atoi(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/picking/locations/"), "/"))
+}
+
+// GetPickingLocationHandler handles GET /api/picking/locations/:id
+func GetPickingLocationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		locationID, err := locationIDFromPath(r)
+		if err != nil {
+			http.Error(w, "Invalid location ID", http.StatusBadRequest)
+			return
+		}
+
+		loc, err := scanLocation(db.QueryRow(`SELECT `+locationColumns+`
+			FROM picking_locations pl WHERE pl.id=$1 AND pl.company_id=$2`, locationID, companyID))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Location not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT ps.id, ps.location_id, ps.filial, $2::text, ps.product_code, ps.product_description,
+			       ps.current_qty, ps.min_qty, ps.max_qty, ps.abc_class, ps.last_sync_at
+			FROM picking_stock ps WHERE ps.location_id=$1 ORDER BY ps.product_code
+		`, locationID, loc.LocationCode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		stock := []PickingStockItem{}
+		for rows.Next() {
+			var item PickingStockItem
+			var lastSync sql.NullTime
+			rows.Scan(&item.ID, &item.LocationID, &item.Filial, &item.LocationCode,
+				&item.ProductCode, &item.ProductDesc,
+				&item.CurrentQty, &item.MinQty, &item.MaxQty, &item.ABCClass, &lastSync)
+			if item.MaxQty > 0 {
+				item.OccupancyPct = item.CurrentQty / item.MaxQty * 100
+			}
+			if lastSync.Valid {
+				s := lastSync.Time.Format(time.RFC3339)
+				item.LastSyncAt = &s
+			}
+			stock = append(stock, item)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"location": loc, "stock": stock})
+	}
+}
+
+type locationChanges struct {
+	Zone          *string `json:"zone"`
+	CapacityBoxes *int    `json:"capacity_boxes"`
+	IsActive      *bool   `json:"is_active"`
+}
+
+func (c locationChanges) validate() string {
+	if c.Zone != nil && (*c.Zone == "" || len(*c.Zone) > 20) {
+		return "zone deve ter entre 1 e 20 caracteres"
+	}
+	if c.CapacityBoxes != nil && *c.CapacityBoxes < 0 {
+		return "capacity_boxes deve ser >= 0"
+	}
+	return ""
+}
+
+// applyLocationChanges updates the given locations of a company. Locations
+// being deactivated also have their pending tasks cancelled in waves that
+// have not started sending, so the operator is not sent to them.
+func applyLocationChanges(tx *sql.Tx, companyID string, ids []int, c locationChanges) (int64, error) {
+	res, err := tx.Exec(`
+		UPDATE picking_locations
+		SET zone           = COALESCE($3, zone),
+		    capacity_boxes = COALESCE($4, capacity_boxes),
+		    is_active      = COALESCE($5, is_active),
+		    deactivated_at = CASE WHEN $5 IS NULL THEN deactivated_at
+		                          WHEN $5 THEN NULL
+		                          ELSE COALESCE(deactivated_at, NOW()) END,
+		    updated_at     = NOW()
+		WHERE company_id = $1 AND id = ANY($2)
+	`, companyID, pq.Array(ids), c.Zone, c.CapacityBoxes, c.IsActive)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+
+	if c.IsActive != nil && !*c.IsActive {
+		if _, err := tx.Exec(`
+			WITH cancelled AS (
+				UPDATE replenishment_tasks rt SET status = 'cancelado'
+				FROM picking_locations pl, replenishment_waves w
+				WHERE pl.company_id = $1 AND pl.id = ANY($2)
+				  AND rt.company_id = pl.company_id AND rt.filial = pl.filial
+				  AND rt.location_code = pl.location_code
+				  AND w.id = rt.wave_id AND w.status = 'gerada' AND w.send_started_at IS NULL
+				  AND rt.status = 'pendente'
+				RETURNING rt.wave_id
+			)
+			UPDATE replenishment_waves w SET total_tasks = GREATEST(w.total_tasks - c.n, 0)
+			FROM (SELECT wave_id, COUNT(*) AS n FROM cancelled GROUP BY wave_id) c
+			WHERE w.id = c.wave_id
+		`, companyID, pq.Array(ids)); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// UpdatePickingLocationHandler handles PUT /api/picking/locations/:id
+// Body: {"zone":"frio","capacity_boxes":30,"is_active":true} — omitted fields are kept.
+func UpdatePickingLocationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		locationID, err := locationIDFromPath(r)
+		if err != nil {
+			http.Error(w, "Invalid location ID", http.StatusBadRequest)
+			return
+		}
+
+		var req locationChanges
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if msg := req.validate(); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		n, err := applyLocationChanges(tx, companyID, []int{locationID}, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "Location not found", http.StatusNotFound)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		loc, _ := scanLocation(db.QueryRow(`SELECT `+locationColumns+` FROM picking_locations pl WHERE pl.id=$1`, locationID))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(loc)
+	}
+}
+
+// --- Bulk by Aisle ---
+
+// BulkUpdateLocationsHandler handles POST /api/picking/locations/bulk
+// Body: {"filial":"01","aisle":"A","zone":"frio","capacity_boxes":30,"is_active":false}
+// and applies the changes to every location of the aisle.
+func BulkUpdateLocationsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+
+		var req struct {
+			Filial string `json:"filial"`
+			Aisle  string `json:"aisle"`
+			locationChanges
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Filial == "" || req.Aisle == "" {
+			http.Error(w, "filial e aisle sao obrigatorios", http.StatusBadRequest)
+			return
+		}
+		if req.Zone == nil && req.CapacityBoxes == nil && req.IsActive == nil {
+			http.Error(w, "Nada para alterar", http.StatusBadRequest)
+			return
+		}
+		if msg := req.validate(); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`
+			SELECT id FROM picking_locations WHERE company_id=$1 AND filial=$2 AND aisle=$3 FOR UPDATE
+		`, companyID, req.Filial, req.Aisle)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			http.Error(w, "Nenhum endereco no corredor", http.StatusNotFound)
+			return
+		}
+
+		n, err := applyLocationChanges(tx, companyID, ids, req.locationChanges)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"updated": n,
+			"message": strconv.FormatInt(n, 10) + " enderecos atualizados no corredor " + req.Aisle,
+		})
+	}
+}
+
+// --- Stock: Create / Update / Move ---
+
+// CreatePickingStockHandler handles POST /api/picking/stock
+// Body: {"location_id":1,"product_code":"123","product_description":"...","min_qty":5,"max_qty":20,"abc_class":"A"}
+// The product starts with zero quantity; the next sync brings the real one.
+func CreatePickingStockHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+
+		var req struct {
+			LocationID  int     `json:"location_id"`
+			ProductCode string  `json:"product_code"`
+			ProductDesc string  `json:"product_description"`
+			MinQty      float64 `json:"min_qty"`
+			MaxQty      float64 `json:"max_qty"`
+			ABCClass    string  `json:"abc_class"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		req.ProductCode = strings.TrimSpace(req.ProductCode)
+		req.ABCClass = strings.ToUpper(strings.TrimSpace(req.ABCClass))
+		if req.LocationID == 0 || req.ProductCode == "" || len(req.ProductCode) > 50 {
+			http.Error(w, "location_id e product_code sao obrigatorios", http.StatusBadRequest)
+			return
+		}
+		if req.MinQty < 0 || req.MaxQty < req.MinQty {
+			http.Error(w, "Requer 0 <= min_qty <= max_qty", http.StatusBadRequest)
+			return
+		}
+		if req.ABCClass == "" {
+			req.ABCClass = "C"
+		}
+		if req.ABCClass != "A" && req.ABCClass != "B" && req.ABCClass != "C" {
+			http.Error(w, "abc_class deve ser A, B ou C", http.StatusBadRequest)
+			return
+		}
+
+		var filial string
+		var active bool
+		err := db.QueryRow(`
+			SELECT filial, COALESCE(is_active, TRUE) FROM picking_locations WHERE id=$1 AND company_id=$2
+		`, req.LocationID, companyID).Scan(&filial, &active)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Location not found", http.StatusNotFound)
+			return
+		}
+		if !active {
+			http.Error(w, "Endereco inativo", http.StatusConflict)
+			return
+		}
+
+		var id int
+		err = db.QueryRow(`
+			INSERT INTO picking_stock
+			  (company_id, filial, location_id, product_code, product_description, current_qty, min_qty, max_qty, abc_class)
+			VALUES ($1,$2,$3,$4,$5,0,$6,$7,$8)
+			ON CONFLICT (company_id, filial, location_id, product_code) DO NOTHING
+			RETURNING id
+		`, companyID, filial, req.LocationID, req.ProductCode, req.ProductDesc,
+			req.MinQty, req.MaxQty, req.ABCClass).Scan(&id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Produto ja cadastrado neste endereco", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "message": "Produto cadastrado no endereco"})
+	}
+}
+
+// PickingStockHandler handles PUT /api/picking/stock/:id and
+// POST /api/picking/stock/:id/move.
+func PickingStockHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/picking/stock/"), "/"), "/")
+		stockID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid stock ID", http.StatusBadRequest)
+			return
+		}
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+
+		var userID *int
+		if id, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+			userID = &id
+		}
+
+		switch {
+		case action == "" && r.Method == http.MethodPut:
+			updatePickingStock(w, r, db, companyID, stockID, userID)
+		case action == "move" && r.Method == http.MethodPost:
+			movePickingStock(w, r, db, companyID, stockID, userID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// updatePickingStock edits description, ABC class and min/max. Min/max
+// changes go through the parameter audit with source "manual".
+func updatePickingStock(w http.ResponseWriter, r *http.Request, db *sql.DB, companyID string, stockID int, userID *int) {
+	var req struct {
+		ProductDesc *string  `json:"product_description"`
+		ABCClass    *string  `json:"abc_class"`
+		MinQty      *float64 `json:"min_qty"`
+		MaxQty      *float64 `json:"max_qty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.ABCClass != nil {
+		abc := strings.ToUpper(strings.TrimSpace(*req.ABCClass))
+		if abc != "A" && abc != "B" && abc != "C" {
+			http.Error(w, "abc_class deve ser A, B ou C", http.StatusBadRequest)
+			return
+		}
+		req.ABCClass = &abc
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var min, max float64
+	err = tx.QueryRow(`SELECT min_qty, max_qty FROM picking_stock WHERE id=$1 AND company_id=$2 FOR UPDATE`,
+		stockID, companyID).Scan(&min, &max)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Stock not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.MinQty != nil || req.MaxQty != nil {
+		newMin, newMax := min, max
+		if req.MinQty != nil {
+			newMin = *req.MinQty
+		}
+		if req.MaxQty != nil {
+			newMax = *req.MaxQty
+		}
+		if newMin < 0 || newMax < newMin {
+			http.Error(w, "Requer 0 <= min_qty <= max_qty", http.StatusBadRequest)
+			return
+		}
+		if newMin != min || newMax != max {
+			if err := setStockMinMax(tx, companyID, stockID, newMin, newMax, "manual", nil, userID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if _, err := tx.Exec(`
+		UPDATE picking_stock
+		SET product_description = COALESCE($2, product_description),
+		    abc_class           = COALESCE($3, abc_class),
+		    updated_at          = NOW()
+		WHERE id = $1
+	`, stockID, req.ProductDesc, req.ABCClass); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Produto atualizado"})
+}
+
+// movePickingStock moves a product to another location of the same filial.
+// The stock row keeps its id, so movements, recommendations and audit stay
+// attached; the move itself is recorded as a transfer movement. Pending
+// tasks for the product in waves not yet sent follow it to the new location.
+func movePickingStock(w http.ResponseWriter, r *http.Request, db *sql.DB, companyID string, stockID int, userID *int) {
+	var req struct {
+		ToLocationID   int    `json:"to_location_id"`
+		ToLocationCode string `json:"to_location_code"`
+		Notes          string `json:"notes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.ToLocationID == 0 && req.ToLocationCode == "" {
+		http.Error(w, "to_location_id ou to_location_code obrigatorio", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var filial, productCode, fromCode string
+	var fromID int
+	var qty, minQty float64
+	err = tx.QueryRow(`
+		SELECT ps.filial, ps.product_code, ps.location_id, pl.location_code, ps.current_qty, ps.min_qty
+		FROM picking_stock ps JOIN picking_locations pl ON pl.id = ps.location_id
+		WHERE ps.id=$1 AND ps.company_id=$2
+		FOR UPDATE OF ps
+	`, stockID, companyID).Scan(&filial, &productCode, &fromID, &fromCode, &qty, &minQty)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Stock not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var toID int
+	var toCode string
+	var toActive bool
+	err = tx.QueryRow(`
+		SELECT id, location_code, COALESCE(is_active, TRUE) FROM picking_locations
+		WHERE company_id=$1 AND filial=$2 AND (id=$3 OR ($3 = 0 AND location_code=$4))
+	`, companyID, filial, req.ToLocationID, req.ToLocationCode).Scan(&toID, &toCode, &toActive)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Endereco de destino nao encontrado na filial", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !toActive {
+		http.Error(w, "Endereco de destino inativo", http.StatusConflict)
+		return
+	}
+	if toID == fromID {
+		http.Error(w, "Produto ja esta neste endereco", http.StatusBadRequest)
+		return
+	}
+
+	var taken bool
+	tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM picking_stock WHERE location_id=$1 AND product_code=$2)`,
+		toID, productCode).Scan(&taken)
+	if taken {
+		http.Error(w, "Produto ja cadastrado no endereco de destino", http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.Exec(`UPDATE picking_stock SET location_id=$1, updated_at=NOW() WHERE id=$2`, toID, stockID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO picking_stock_movements
+		  (company_id, filial, stock_id, location_id, from_location_id, product_code, movement_type,
+		   qty_before, qty_after, delta, min_qty, reference, created_by, notes)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$8,0,$9,$10,$11,$12)
+	`, companyID, filial, stockID, toID, fromID, productCode, MovementTransfer,
+		qty, minQty, "location:"+fromCode, userID, req.Notes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`
+		UPDATE replenishment_tasks rt SET location_code = $4
+		FROM replenishment_waves w
+		WHERE w.id = rt.wave_id AND w.status = 'gerada' AND w.send_started_at IS NULL
+		  AND rt.company_id = $1 AND rt.filial = $2 AND rt.product_code = $3
+		  AND rt.location_code = $5 AND rt.status = 'pendente'
+		  AND COALESCE(rt.task_type, 'replenishment') = 'replenishment'
+	`, companyID, filial, productCode, toCode, fromCode); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stock_id": stockID, "from_location_code": fromCode, "to_location_code": toCode,
+		"message": "Produto movido de " + fromCode + " para " + toCode,
+	})
+}
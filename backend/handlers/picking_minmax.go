@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Min/Max Recommendations ---
+
+// Locations with less consumption history than this are not recommended,
+// the rate would be too noisy.
+const minMaxMinObservedHours = 24
+
+type MinMaxParams struct {
+	TargetHoursA int
+	TargetHoursB int
+	TargetHoursC int
+	MinPct       int
+	WindowDays   int
+}
+
+func loadMinMaxParams(db *sql.DB, companyID string) MinMaxParams {
+	p := MinMaxParams{TargetHoursA: 8, TargetHoursB: 16, TargetHoursC: 24, MinPct: 30, WindowDays: 7}
+	db.QueryRow(`
+		SELECT COALESCE(minmax_target_hours_a,8), COALESCE(minmax_target_hours_b,16),
+		       COALESCE(minmax_target_hours_c,24), COALESCE(minmax_min_pct,30),
+		       COALESCE(consumption_window_days,7)
+		FROM settings WHERE company_id=$1
+	`, companyID).Scan(&p.TargetHoursA, &p.TargetHoursB, &p.TargetHoursC, &p.MinPct, &p.WindowDays)
+	return p
+}
+
+// TargetHours returns the hours of demand the max should cover for a class.
+func (p MinMaxParams) TargetHours(abc string) int {
+	switch abc {
+	case "A":
+		return p.TargetHoursA
+	case "B":
+		return p.TargetHoursB
+	default:
+		return p.TargetHoursC
+	}
+}
+
+// RecommendMinMax sizes a location for perHour units of demand: max covers
+// the class target hours and min a percentage of max, both rounded up to
+// whole units. With capacity > 0 the max never exceeds it.
+func RecommendMinMax(perHour float64, abc string, capacity float64, p MinMaxParams) (min, max float64, capped bool) {
+	max = math.Ceil(perHour * float64(p.TargetHours(abc)))
+	if capacity > 0 && max > capacity {
+		max = capacity
+		capped = true
+	}
+	min = math.Ceil(max * float64(p.MinPct) / 100)
+	if min >= max && max > 0 {
+		min = max - 1
+	}
+	return min, max, capped
+}
+
+type MinMaxRecommendation struct {
+	ID                 int     `json:"id"`
+	StockID            int     `json:"stock_id"`
+	Filial             string  `json:"filial"`
+	LocationCode       string  `json:"location_code"`
+	ProductCode        string  `json:"product_code"`
+	ProductDesc        string  `json:"product_description"`
+	ABCClass           string  `json:"abc_class"`
+	CurrentMin         float64 `json:"current_min"`
+	CurrentMax         float64 `json:"current_max"`
+	RecommendedMin     float64 `json:"recommended_min"`
+	RecommendedMax     float64 `json:"recommended_max"`
+	ConsumptionPerHour float64 `json:"consumption_per_hour"`
+	TargetHours        int     `json:"target_hours"`
+	Capacity           float64 `json:"capacity"`
+	CappedByCapacity   bool    `json:"capped_by_capacity"`
+	Status             string  `json:"status"`
+	CreatedAt          string  `json:"created_at"`
+	ReviewedBy         *string `json:"reviewed_by"`
+	ReviewedAt         *string `json:"reviewed_at"`
+}
+
+// GenerateMinMaxHandler handles POST /api/picking/minmax/generate
+// Body: {"filial": "01"} (optional; all filiais when empty)
+// Pending recommendations of the filial are replaced by the new ones.
+func GenerateMinMaxHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+
+		var req struct {
+			Filial string `json:"filial"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		params := loadMinMaxParams(db, companyID)
+		rates, err := LoadConsumptionRates(r.Context(), db, companyID, req.Filial, params.WindowDays)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		query := `
+			SELECT ps.id, ps.filial, ps.abc_class, ps.min_qty, ps.max_qty, COALESCE(pl.capacity_boxes, 0)
+			FROM picking_stock ps
+			JOIN picking_locations pl ON pl.id = ps.location_id
+			WHERE ps.company_id = $1 AND COALESCE(pl.is_active, TRUE)
+		`
+		args := []interface{}{companyID}
+		if req.Filial != "" {
+			query += " AND ps.filial = $2"
+			args = append(args, req.Filial)
+		}
+
+		type stockRow struct {
+			ID       int
+			Filial   string
+			ABC      string
+			Min, Max float64
+			Capacity float64
+		}
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var stock []stockRow
+		for rows.Next() {
+			var s stockRow
+			if err := rows.Scan(&s.ID, &s.Filial, &s.ABC, &s.Min, &s.Max, &s.Capacity); err != nil {
+				continue
+			}
+			stock = append(stock, s)
+		}
+		rows.Close()
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		obsoleteQuery := `UPDATE picking_minmax_recommendations SET status='obsoleta' WHERE company_id=$1 AND status='pendente'`
+		if req.Filial != "" {
+			obsoleteQuery += " AND filial=$2"
+		}
+		if _, err := tx.Exec(obsoleteQuery, args...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		created, unchanged, noHistory := 0, 0, 0
+		for _, s := range stock {
+			rate, ok := rates[s.ID]
+			if !ok || rate.PerHour <= 0 || rate.ObservedHours < minMaxMinObservedHours {
+				noHistory++
+				continue
+			}
+			recMin, recMax, capped := RecommendMinMax(rate.PerHour, s.ABC, s.Capacity, params)
+			if math.Abs(recMin-s.Min) < 1 && math.Abs(recMax-s.Max) < 1 {
+				unchanged++
+				continue
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO picking_minmax_recommendations
+				  (company_id, filial, stock_id, current_min, current_max, recommended_min, recommended_max,
+				   consumption_per_hour, target_hours, capacity, capped_by_capacity)
+				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
+			`, companyID, s.Filial, s.ID, s.Min, s.Max, recMin, recMax,
+				math.Round(rate.PerHour*1000)/1000, params.TargetHours(s.ABC), s.Capacity, capped); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			created++
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"created":    created,
+			"unchanged":  unchanged,
+			"no_history": noHistory,
+		})
+	}
+}
+
+// ListMinMaxHandler handles GET /api/picking/minmax?filial=01&status=pendente
+func ListMinMaxHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = "pendente"
+		}
+
+		query := `
+			SELECT rec.id, rec.stock_id, rec.filial, pl.location_code, ps.product_code, ps.product_description,
+			       ps.abc_class, rec.current_min, rec.current_max, rec.recommended_min, rec.recommended_max,
+			       rec.consumption_per_hour, rec.target_hours, rec.capacity, rec.capped_by_capacity,
+			       rec.status, rec.created_at, u.full_name, rec.reviewed_at
+			FROM picking_minmax_recommendations rec
+			JOIN picking_stock ps ON ps.id = rec.stock_id
+			JOIN picking_locations pl ON pl.id = ps.location_id
+			LEFT JOIN users u ON u.id = rec.reviewed_by
+			WHERE rec.company_id = $1 AND rec.status = $2
+		`
+		args := []interface{}{companyID, status}
+		if filial := r.URL.Query().Get("filial"); filial != "" {
+			query += " AND rec.filial = $3"
+			args = append(args, filial)
+		}
+		query += " ORDER BY CASE ps.abc_class WHEN 'A' THEN 1 WHEN 'B' THEN 2 ELSE 3 END, pl.location_code LIMIT 1000"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		recs := []MinMaxRecommendation{}
+		for rows.Next() {
+			var rec MinMaxRecommendation
+			var createdAt time.Time
+			var reviewedBy sql.NullString
+			var reviewedAt sql.NullTime
+			if err := rows.Scan(&rec.ID, &rec.StockID, &rec.Filial, &rec.LocationCode, &rec.ProductCode,
+				&rec.ProductDesc, &rec.ABCClass, &rec.CurrentMin, &rec.CurrentMax,
+				&rec.RecommendedMin, &rec.RecommendedMax, &rec.ConsumptionPerHour, &rec.TargetHours,
+				&rec.Capacity, &rec.CappedByCapacity, &rec.Status, &createdAt, &reviewedBy, &reviewedAt); err != nil {
+				continue
+			}
+			rec.CreatedAt = createdAt.Format(time.RFC3339)
+			if reviewedBy.Valid {
+				rec.ReviewedBy = &reviewedBy.String
+			}
+			if reviewedAt.Valid {
+				s := reviewedAt.Time.Format(time.RFC3339)
+				rec.ReviewedAt = &s
+			}
+			recs = append(recs, rec)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"recommendations": recs, "total": len(recs)})
+	}
+}
+
+// ReviewMinMaxHandler handles POST /api/picking/minmax/:id/accept and
+// POST /api/picking/minmax/:id/reject. On accept the body may override the
+// recommended values: {"min_qty": 10, "max_qty": 40}
+func ReviewMinMaxHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/picking/minmax/"), "/"), "/")
+		if len(parts) != 2 || (parts[1] != "accept" && parts[1] != "reject") {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		recID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid recommendation ID", http.StatusBadRequest)
+			return
+		}
+		accept := parts[1] == "accept"
+
+		var req struct {
+			MinQty *float64 `json:"min_qty"`
+			MaxQty *float64 `json:"max_qty"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		var userID *int
+		if id, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+			userID = &id
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var stockID int
+		var status string
+		var recMin, recMax float64
+		err = tx.QueryRow(`
+			SELECT stock_id, status, recommended_min, recommended_max
+			FROM picking_minmax_recommendations
+			WHERE id=$1 AND company_id=$2 FOR UPDATE
+		`, recID, companyID).Scan(&stockID, &status, &recMin, &recMax)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Recommendation not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if status != "pendente" {
+			http.Error(w, "Recomendacao ja revisada ("+status+")", http.StatusConflict)
+			return
+		}
+
+		newStatus := "rejeitada"
+		if accept {
+			newStatus = "aceita"
+			if req.MinQty != nil {
+				recMin = *req.MinQty
+			}
+			if req.MaxQty != nil {
+				recMax = *req.MaxQty
+			}
+			if recMin < 0 || recMax <= 0 || recMin >= recMax {
+				http.Error(w, "min_qty deve ser menor que max_qty", http.StatusBadRequest)
+				return
+			}
+			if err := setStockMinMax(tx, companyID, stockID, recMin, recMax, "recommendation", &recID, userID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE picking_minmax_recommendations
+			SET status=$1, reviewed_by=$2, reviewed_at=NOW()
+			WHERE id=$3
+		`, newStatus, userID, recID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": recID, "status": newStatus})
+	}
+}
+
+// setStockMinMax updates the min/max of a picking_stock row and records the
+// change in picking_param_changes.
+func setStockMinMax(tx *sql.Tx, companyID string, stockID int, min, max float64, source string, recID, userID *int) error {
+	var oldMin, oldMax float64
+	if err := tx.QueryRow(`
+		SELECT min_qty, max_qty FROM picking_stock WHERE id=$1 AND company_id=$2 FOR UPDATE
+	`, stockID, companyID).Scan(&oldMin, &oldMax); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE picking_stock SET min_qty=$1, max_qty=$2, updated_at=NOW() WHERE id=$3
+	`, min, max, stockID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO picking_param_changes
+		  (company_id, stock_id, old_min, new_min, old_max, new_max, source, recommendation_id, changed_by)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+	`, companyID, stockID, oldMin, min, oldMax, max, source, recID, userID)
+	return err
+}
+
+type ParamChange struct {
+	ID           int     `json:"id"`
+	StockID      int     `json:"stock_id"`
+	LocationCode string  `json:"location_code"`
+	ProductCode  string  `json:"product_code"`
+	OldMin       float64 `json:"old_min"`
+	NewMin       float64 `json:"new_min"`
+	OldMax       float64 `json:"old_max"`
+	NewMax       float64 `json:"new_max"`
+	Source       string  `json:"source"`
+	ChangedBy    string  `json:"changed_by"`
+	ChangedAt    string  `json:"changed_at"`
+}
+
+// GetParamChangesHandler handles GET /api/picking/minmax/changes?stock_id=X&filial=01
+func GetParamChangesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+
+		query := `
+			SELECT c.id, c.stock_id, pl.location_code, ps.product_code,
+			       c.old_min, c.new_min, c.old_max, c.new_max, c.source,
+			       COALESCE(u.full_name, ''), c.changed_at
+			FROM picking_param_changes c
+			JOIN picking_stock ps ON ps.id = c.stock_id
+			JOIN picking_locations pl ON pl.id = ps.location_id
+			LEFT JOIN users u ON u.id = c.changed_by
+			WHERE c.company_id = $1
+		`
+		args := []interface{}{companyID}
+		if stockID := r.URL.Query().Get("stock_id"); stockID != "" {
+			args = append(args, stockID)
+			query += " AND c.stock_id = $" + strconv.Itoa(len(args))
+		}
+		if filial := r.URL.Query().Get("filial"); filial != "" {
+			args = append(args, filial)
+			query += " AND ps.filial = $" + strconv.Itoa(len(args))
+		}
+		query += " ORDER BY c.changed_at DESC LIMIT 500"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		changes := []ParamChange{}
+		for rows.Next() {
+			var c ParamChange
+			var changedAt time.Time
+			if err := rows.Scan(&c.ID, &c.StockID, &c.LocationCode, &c.ProductCode,
+				&c.OldMin, &c.NewMin, &c.OldMax, &c.NewMax, &c.Source, &c.ChangedBy, &changedAt); err != nil {
+				continue
+			}
+			c.ChangedAt = changedAt.Format(time.RFC3339)
+			changes = append(changes, c)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"changes": changes})
+	}
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Stock Movements ---
+
+const (
+	MovementSync          = "sync"
+	MovementReplenishment = "replenishment"
+	MovementAdjustment    = "adjustment"
+	MovementTransfer      = "transfer"
+)
+
+type StockMovement struct {
+	Type      string
+	Reference string
+	UserID    *int
+	Notes     string
+	// SyncedAt, when set, also updates picking_stock.last_sync_at.
+	SyncedAt *time.Time
+}
+
+// setStockQty sets current_qty of a picking_stock row and records the
+// movement when the quantity actually changes. Returns false if the row
+// does not exist.
+func setStockQty(tx *sql.Tx, stockID int, qty float64, m StockMovement) (bool, error) {
+	var companyID, locationID int
+	var filial, productCode string
+	var before, minQty float64
+	err := tx.QueryRow(`
+		SELECT company_id, filial, location_id, product_code, current_qty, min_qty
+		FROM picking_stock WHERE id = $1 FOR UPDATE
+	`, stockID).Scan(&companyID, &filial, &locationID, &productCode, &before, &minQty)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if m.SyncedAt != nil {
+		_, err = tx.Exec(`UPDATE picking_stock SET current_qty=$1, last_sync_at=$2, updated_at=NOW() WHERE id=$3`,
+			qty, *m.SyncedAt, stockID)
+	} else {
+		_, err = tx.Exec(`UPDATE picking_stock SET current_qty=$1, updated_at=NOW() WHERE id=$2`, qty, stockID)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if qty == before {
+		return true, nil
+	}
+	_, err = tx.Exec(`
+		INSERT INTO picking_stock_movements
+		  (company_id, filial, stock_id, location_id, product_code, movement_type,
+		   qty_before, qty_after, delta, min_qty, reference, created_by, notes)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+	`, companyID, filial, stockID, locationID, productCode, m.Type,
+		before, qty, qty-before, minQty, m.Reference, m.UserID, m.Notes)
+	return true, err
+}
+
+// --- Consumption Rates ---
+
+type ConsumptionRate struct {
+	PerHour       float64
+	ObservedHours float64
+}
+
+// LoadConsumptionRates returns, per picking_stock id, the average
+// consumption (units/hour) over the last windowDays. Only sync decreases
+// count as consumption; replenishments and manual adjustments do not.
+func LoadConsumptionRates(ctx context.Context, db *sql.DB, companyID, filial string, windowDays int) (map[int]ConsumptionRate, error) {
+	if windowDays < 1 {
+		windowDays = 7
+	}
+	query := `
+		SELECT stock_id,
+		       COALESCE(SUM(-delta) FILTER (WHERE delta < 0 AND movement_type = 'sync'), 0) AS consumed,
+		       GREATEST(EXTRACT(EPOCH FROM (NOW() - MIN(created_at))) / 3600, 1) AS hours
+		FROM picking_stock_movements
+		WHERE company_id = $1 AND created_at > NOW() - make_interval(days => $2)
+	`
+	args := []interface{}{companyID, windowDays}
+	if filial != "" {
+		query += " AND filial = $3"
+		args = append(args, filial)
+	}
+	query += " GROUP BY stock_id"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := map[int]ConsumptionRate{}
+	for rows.Next() {
+		var stockID int
+		var consumed, hours float64
+		if err := rows.Scan(&stockID, &consumed, &hours); err != nil {
+			continue
+		}
+		rates[stockID] = ConsumptionRate{PerHour: consumed / hours, ObservedHours: hours}
+	}
+	return rates, rows.Err()
+}
+
+// HoursToMin estimates how long until current reaches min at the given
+// rate. Returns 0 when already at or below min and nil without consumption.
+func HoursToMin(current, min, perHour float64) *float64 {
+	if current <= min {
+		zero := 0.0
+		return &zero
+	}
+	if perHour <= 0 {
+		return nil
+	}
+	h := math.Round((current-min)/perHour*10) / 10
+	return &h
+}
+
+// PredictedBelowMin returns the stock ids of a filial that are still above
+// min but will reach it within lookaheadHours at their current consumption.
+func PredictedBelowMin(ctx context.Context, db *sql.DB, companyID, filial string, lookaheadHours, windowDays int) ([]int64, error) {
+	if lookaheadHours <= 0 {
+		return nil, nil
+	}
+	rates, err := LoadConsumptionRates(ctx, db, companyID, filial, windowDays)
+	if err != nil || len(rates) == 0 {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, current_qty, min_qty FROM picking_stock
+		WHERE company_id = $1 AND filial = $2 AND min_qty > 0 AND current_qty > min_qty
+	`, companyID, filial)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int
+		var current, min float64
+		if err := rows.Scan(&id, &current, &min); err != nil {
+			continue
+		}
+		if h := HoursToMin(current, min, rates[id].PerHour); h != nil && *h <= float64(lookaheadHours) {
+			ids = append(ids, int64(id))
+		}
+	}
+	return ids, rows.Err()
+}
+
+// --- Manual Adjustment ---
+
+// AdjustPickingStockHandler handles POST /api/picking/stock/adjust
+// Body: {"stock_id": 1, "current_qty": 12, "notes": "contagem"}
+func AdjustPickingStockHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+
+		var req struct {
+			StockID    int      `json:"stock_id"`
+			CurrentQty *float64 `json:"current_qty"`
+			Notes      string   `json:"notes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.StockID == 0 || req.CurrentQty == nil || *req.CurrentQty < 0 {
+			http.Error(w, "stock_id and current_qty (>= 0) are required", http.StatusBadRequest)
+			return
+		}
+
+		var exists bool
+		db.QueryRow(`SELECT EXISTS(SELECT 1 FROM picking_stock WHERE id=$1 AND company_id=$2)`,
+			req.StockID, companyID).Scan(&exists)
+		if !exists {
+			http.Error(w, "Stock not found", http.StatusNotFound)
+			return
+		}
+
+		var userID *int
+		if id, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+			userID = &id
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := setStockQty(tx, req.StockID, *req.CurrentQty, StockMovement{
+			Type: MovementAdjustment, UserID: userID, Notes: req.Notes,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Estoque ajustado"})
+	}
+}
+
+// --- Movement History ---
+
+type StockMovementEntry struct {
+	ID           int64   `json:"id"`
+	MovementType string  `json:"movement_type"`
+	QtyBefore    float64 `json:"qty_before"`
+	QtyAfter     float64 `json:"qty_after"`
+	Delta        float64 `json:"delta"`
+	Reference    string  `json:"reference"`
+	Notes        string  `json:"notes"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+// GetStockMovementsHandler handles GET /api/picking/stock/movements?stock_id=X&days=7
+func GetStockMovementsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		stockID, err := strconv.Atoi(r.URL.Query().Get("stock_id"))
+		if err != nil {
+			http.Error(w, "stock_id is required", http.StatusBadRequest)
+			return
+		}
+		days := 7
+		if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 {
+			days = d
+		}
+
+		rows, err := db.Query(`
+			SELECT id, movement_type, qty_before, qty_after, delta,
+			       COALESCE(reference,''), COALESCE(notes,''), created_at
+			FROM picking_stock_movements
+			WHERE company_id = $1 AND stock_id = $2 AND created_at > NOW() - make_interval(days => $3)
+			ORDER BY created_at DESC LIMIT 500
+		`, companyID, stockID, days)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		entries := []StockMovementEntry{}
+		for rows.Next() {
+			var e StockMovementEntry
+			var createdAt time.Time
+			if err := rows.Scan(&e.ID, &e.MovementType, &e.QtyBefore, &e.QtyAfter, &e.Delta,
+				&e.Reference, &e.Notes, &createdAt); err != nil {
+				continue
+			}
+			e.CreatedAt = createdAt.Format(time.RFC3339)
+			entries = append(entries, e)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"movements": entries})
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"aprovapedido/services"
+)
+
+// --- Wave Pick List ---
+
+// WavePickListHandler serves GET /api/waves/:id/picklist.pdf. Tasks are
+// listed in walking order (aisle, bay, level, position) rather than by
+// priority, since the sheet is used on the floor.
+func WavePickListHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/waves/"), "/picklist.pdf")
+		waveID, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid wave ID", http.StatusBadRequest)
+			return
+		}
+
+		var h services.PickListHeader
+		var generatedAt time.Time
+		err = db.QueryRow(`
+			SELECT wave_number, filial, COALESCE(zone,''), status, triggered_by, generated_at
+			FROM replenishment_waves WHERE id=$1 AND company_id=$2
+		`, waveID, companyID).Scan(&h.WaveNumber, &h.Filial, &h.Zone, &h.Status, &h.TriggeredBy, &generatedAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Wave not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.GeneratedAt = generatedAt.Format("02/01/2006 15:04")
+
+		rows, err := db.Query(`
+			SELECT rt.product_code, COALESCE(rt.product_description,''), rt.location_code,
+			       COALESCE(rt.from_location_code,''), rt.qty_to_replenish, rt.abc_class
+			FROM replenishment_tasks rt
+			LEFT JOIN picking_locations pl
+			  ON pl.company_id = rt.company_id AND pl.filial = rt.filial AND pl.location_code = rt.location_code
+			WHERE rt.wave_id=$1 AND rt.status <> 'cancelado'
+			ORDER BY pl.aisle, pl.bay, pl.level, pl.position, rt.location_code
+		`, waveID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var lines []services.PickListLine
+		for rows.Next() {
+			var l services.PickListLine
+			rows.Scan(&l.ProductCode, &l.ProductDesc, &l.LocationCode, &l.FromLocationCode, &l.Qty, &l.ABCClass)
+			l.Seq = len(lines) + 1
+			lines = append(lines, l)
+		}
+
+		pdf, err := services.RenderPickListPDF(h, lines)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"onda-%s.pdf\"", h.WaveNumber))
+		w.Write(pdf)
+	}
+}
+
+// --- Location Labels ---
+
+// LocationLabelsHandler serves GET /api/picking/locations/labels with
+// ?filial=&format=pdf|zpl&symbology=code128|qr and optionally &aisle= or
+// &ids=1,2,3. Only active locations are printed.
+func LocationLabelsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		q := r.URL.Query()
+		filial := q.Get("filial")
+		if filial == "" {
+			http.Error(w, "filial obrigatoria", http.StatusBadRequest)
+			return
+		}
+		format := q.Get("format")
+		if format == "" {
+			format = "pdf"
+		}
+		if format != "pdf" && format != "zpl" {
+			http.Error(w, "format deve ser pdf ou zpl", http.StatusBadRequest)
+			return
+		}
+		symbology := q.Get("symbology")
+		if symbology == "" {
+			symbology = services.SymbologyCode128
+		}
+		if symbology != services.SymbologyCode128 && symbology != services.SymbologyQR {
+			http.Error(w, "symbology deve ser code128 ou qr", http.StatusBadRequest)
+			return
+		}
+
+		query := `
+			SELECT pl.location_code, pl.filial,
+			       COALESCE((SELECT ps.product_code || ' ' || ps.product_description
+			                 FROM picking_stock ps WHERE ps.location_id = pl.id LIMIT 1), '')
+			FROM picking_locations pl
+			WHERE pl.company_id=$1 AND pl.filial=$2 AND pl.is_active = TRUE
+		`
+		args := []interface{}{companyID, filial}
+		if aisle := q.Get("aisle"); aisle != "" {
+			args = append(args, aisle)
+			query += " AND pl.aisle=$" + strconv.Itoa(len(args))
+		}
+		if idsParam := q.Get("ids"); idsParam != "" {
+			var ids []string
+			for _, s := range strings.Split(idsParam, ",") {
+				id, err := strconv.Atoi(strings.TrimSpace(s))
+				if err != nil {
+					http.Error(w, "ids invalidos", http.StatusBadRequest)
+					return
+				}
+				args = append(args, id)
+				ids = append(ids, "$"+strconv.Itoa(len(args)))
+			}
+			query += " AND pl.id IN (" + strings.Join(ids, ",") + ")"
+		}
+		query += " ORDER BY pl.aisle, pl.bay, pl.level, pl.position, pl.location_code"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var labels []services.LocationLabel
+		for rows.Next() {
+			var l services.LocationLabel
+			rows.Scan(&l.LocationCode, &l.Filial, &l.Caption)
+			labels = append(labels, l)
+		}
+		if len(labels) == 0 {
+			http.Error(w, "Nenhum endereco encontrado", http.StatusNotFound)
+			return
+		}
+
+		filename := "etiquetas-" + filial
+		if format == "zpl" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+".zpl\"")
+			w.Write([]byte(services.RenderLocationLabelsZPL(labels, symbology)))
+			return
+		}
+		pdf, err := services.RenderLocationLabelsPDF(labels, symbology)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", "inline; filename=\""+filename+".pdf\"")
+		w.Write(pdf)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -170,6 +169,21 @@ type RCARepresentative struct {
 	RouteCustomers int     `json:"route_customers"`
 	TodayVisits    int     `json:"today_visits"`
 	TodayCompleted int     `json:"today_completed"`
+	TodaySuspicious int    `json:"today_suspicious"`
+	// Today's agenda: planned visits, planned ones concluded and
+	// check-ins outside the agenda
+	TodayPlanned   int     `json:"today_planned"`
+	TodayExecuted  int     `json:"today_executed"`
+	TodayUnplanned int     `json:"today_unplanned"`
+	BaseLat        *float64 `json:"base_lat"`
+	BaseLng        *float64 `json:"base_lng"`
+	// Sales orders: discount allowed without approval and stock filial
+	MaxDiscountPct float64 `json:"max_discount_pct"`
+	DefaultFilial  string  `json:"default_filial"`
+	// Last GPS breadcrumb (see rca_tracking.go)
+	LastLat        *float64 `json:"last_lat"`
+	LastLng        *float64 `json:"last_lng"`
+	LastPositionAt *string  `json:"last_position_at"`
 	CreatedAt      string  `json:"created_at"`
 }
 
@@ -185,6 +199,13 @@ type CreateRepresentativeRequest struct {
 	VehiclePlate string `json:"vehicle_plate"`
 	Territory    string `json:"territory"`
 	Phone        string `json:"phone"`
+	// Start point of the day for route optimization (optional)
+	BaseLat *float64 `json:"base_lat"`
+	BaseLng *float64 `json:"base_lng"`
+	// Sales orders (optional): max discount per item without approval, in
+	// percent, and the filial whose stock is offered (default 01)
+	MaxDiscountPct float64 `json:"max_discount_pct"`
+	DefaultFilial  string  `json:"default_filial"`
 }
 
 type RCARoute struct {
@@ -222,7 +243,20 @@ type RCACustomer struct {
 	IsActive         bool     `json:"is_active"`
 	TodayVisitID     *int     `json:"today_visit_id,omitempty"`
 	TodayVisitStatus *string  `json:"today_visit_status,omitempty"`
-	CreatedAt        string   `json:"created_at"`
+	TodayPlanned     *bool    `json:"today_planned,omitempty"`
+	WindowStart      *string  `json:"window_start"`
+	WindowEnd        *string  `json:"window_end"`
+	VisitMinutes     *int     `json:"visit_minutes"`
+	// Visit frequency (see rca_agenda.go)
+	VisitFrequency    string  `json:"visit_frequency"`
+	VisitWeekday      *int    `json:"visit_weekday"`
+	VisitIntervalDays *int    `json:"visit_interval_days"`
+	VisitAnchorDate   *string `json:"visit_anchor_date"`
+	VisitMonthDay     *int    `json:"visit_month_day"`
+	// Geocode precision and source of lat/lng (see rca_geocode.go)
+	GeocodePrecision *string `json:"geocode_precision,omitempty"`
+	GeocodeSource    *string `json:"geocode_source,omitempty"`
+	CreatedAt        string  `json:"created_at"`
 }
 
 type AddCustomerRequest struct {
@@ -237,6 +271,34 @@ type AddCustomerRequest struct {
 	Lng           *float64 `json:"lng"`
 	Priority      int      `json:"priority"`
 	Notes         string   `json:"notes"`
+	// Optional visiting window "HH:MM"; both or neither
+	WindowStart  string `json:"window_start"`
+	WindowEnd    string `json:"window_end"`
+	VisitMinutes int    `json:"visit_minutes"`
+	// Optional visit frequency (weekdays, daily, weekly, interval or
+	// monthly); none means weekdays, Monday to Friday
+	VisitScheduleRequest
+}
+
+// UpdateCustomerRequest changes the fields present in the body. Coordinates
+// sent here are confirmed by the manager; clear_location drops them so the
+// customer is geocoded again from the address.
+type UpdateCustomerRequest struct {
+	CompanyName   *string  `json:"company_name"`
+	ContactName   *string  `json:"contact_name"`
+	Phone         *string  `json:"phone"`
+	City          *string  `json:"city"`
+	Neighborhood  *string  `json:"neighborhood"`
+	Address       *string  `json:"address"`
+	AddressNumber *string  `json:"address_number"`
+	Lat           *float64 `json:"lat"`
+	Lng           *float64 `json:"lng"`
+	ClearLocation bool     `json:"clear_location"`
+	Priority      *int     `json:"priority"`
+	Notes         *string  `json:"notes"`
+	WindowStart   *string  `json:"window_start"`
+	WindowEnd     *string  `json:"window_end"`
+	VisitMinutes  *int     `json:"visit_minutes"`
 }
 
 type RCAVisit struct {
@@ -263,19 +325,41 @@ type RCAVisit struct {
 	DurationMinutes  *int     `json:"duration_minutes"`
 	Notes            string   `json:"notes"`
 	CreatedAt        string   `json:"created_at"`
+	// Geofence validation (see rca_geofence.go)
+	CheckinDistanceM  *float64 `json:"checkin_distance_m"`
+	CheckinGeofence   string   `json:"checkin_geofence"`
+	CheckoutDistanceM *float64 `json:"checkout_distance_m"`
+	CheckoutGeofence  string   `json:"checkout_geofence"`
+	Suspicious        bool     `json:"suspicious"`
+	SuspicionReasons  []string `json:"suspicion_reasons"`
+	// End-of-day closing (see rca_closing.go)
+	AutoClosed   bool   `json:"auto_closed"`
+	MissedReason string `json:"missed_reason"`
+	MissedNotes  string `json:"missed_notes"`
+	// Check-out outcome (see rca_outcome.go)
+	Outcome      string   `json:"outcome"`
+	OrderValue   *float64 `json:"order_value"`
+	NoSaleReason string   `json:"no_sale_reason"`
 }
 
+// Lat/Lng are nil when the device has no GPS fix.
 type CheckinRequest struct {
-	CustomerID int     `json:"customer_id"`
-	Lat        float64 `json:"lat"`
-	Lng        float64 `json:"lng"`
+	CustomerID int      `json:"customer_id"`
+	Lat        *float64 `json:"lat"`
+	Lng        *float64 `json:"lng"`
+	AccuracyM  *float64 `json:"accuracy_m"`
 }
 
 type CheckoutRequest struct {
-	VisitID int     `json:"visit_id"`
-	Lat     float64 `json:"lat"`
-	Lng     float64 `json:"lng"`
-	Notes   string  `json:"notes"`
+	VisitID int      `json:"visit_id"`
+	Lat     *float64 `json:"lat"`
+	Lng     *float64 `json:"lng"`
+	Notes   string   `json:"notes"`
+	// Structured outcome (see rca_outcome.go); optional for older apps
+	Outcome      string         `json:"outcome"`
+	OrderValue   *float64       `json:"order_value"`
+	NoSaleReason string         `json:"no_sale_reason"`
+	Answers      []SurveyAnswer `json:"answers"`
 }
 
 type RCADashboard struct {
@@ -284,6 +368,11 @@ type RCADashboard struct {
 	TotalVisitsToday    int                 `json:"total_visits_today"`
 	TotalPending        int                 `json:"total_pending"`
 	TotalCompleted      int                 `json:"total_completed"`
+	TotalSuspicious     int                 `json:"total_suspicious"`
+	TotalPlanned        int                 `json:"total_planned"`
+	TotalExecuted       int                 `json:"total_executed"`
+	TotalUnplanned      int                 `json:"total_unplanned"`
+	AdherencePct        float64             `json:"adherence_pct"`
 	Representatives     []RCARepresentative `json:"representatives"`
 }
 
@@ -321,19 +410,22 @@ func ListOrCreateRCARepresentativesHandler(db *sql.DB) http.HandlerFunc {
 
 		switch r.Method {
 		case http.MethodGet:
+			today := rcaToday(r.Context(), db, companyID).Format("2006-01-02")
 			rows, err := db.Query(`
 				SELECT r.id, r.company_id, r.user_id, u.full_name, u.email,
 					COALESCE(r.phone,''), COALESCE(r.vehicle_type,''),
 					COALESCE(r.vehicle_plate,''), COALESCE(r.territory,''),
 					r.is_active, r.created_at::text,
 					(SELECT MAX(checkin_at)::text FROM rca_visits WHERE representative_id = r.id) AS last_checkin_at,
-					(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = CURRENT_DATE) AS today_visits,
-					(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = CURRENT_DATE AND status = 'concluida') AS today_completed
+					(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = $2::date AND checkin_at IS NOT NULL) AS today_visits,
+					(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = $2::date AND status = 'concluida') AS today_completed,
+					r.base_lat, r.base_lng,
+					COALESCE(r.max_discount_pct, 0), COALESCE(r.default_filial, '01')
 				FROM rca_representatives r
 				JOIN users u ON u.id = r.user_id
 				WHERE r.company_id = $1
 				ORDER BY u.full_name ASC
-			`, companyID)
+			`, companyID, today)
 			if err != nil {
 				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 				return
@@ -344,17 +436,22 @@ func ListOrCreateRCARepresentativesHandler(db *sql.DB) http.HandlerFunc {
 			for rows.Next() {
 				var rep RCARepresentative
 				var lca sql.NullString
+				var baseLat, baseLng sql.NullFloat64
 				if err := rows.Scan(
 					&rep.ID, &rep.CompanyID, &rep.UserID, &rep.FullName, &rep.Email,
 					&rep.Phone, &rep.VehicleType, &rep.VehiclePlate, &rep.Territory,
 					&rep.IsActive, &rep.CreatedAt, &lca,
-					&rep.TodayVisits, &rep.TodayCompleted,
+					&rep.TodayVisits, &rep.TodayCompleted, &baseLat, &baseLng,
+					&rep.MaxDiscountPct, &rep.DefaultFilial,
 				); err != nil {
 					continue
 				}
 				if lca.Valid {
 					rep.LastCheckinAt = &lca.String
 				}
+				if baseLat.Valid && baseLng.Valid {
+					rep.BaseLat, rep.BaseLng = &baseLat.Float64, &baseLng.Float64
+				}
 				reps = append(reps, rep)
 			}
 			if reps == nil {
@@ -371,6 +468,22 @@ func ListOrCreateRCARepresentativesHandler(db *sql.DB) http.HandlerFunc {
 				return
 			}
 
+			if (req.BaseLat == nil) != (req.BaseLng == nil) || !validCoordinates(req.BaseLat, req.BaseLng) {
+				http.Error(w, "base_lat and base_lng must be valid and given together", http.StatusBadRequest)
+				return
+			}
+			if req.MaxDiscountPct < 0 || req.MaxDiscountPct > 100 {
+				http.Error(w, "max_discount_pct must be between 0 and 100", http.StatusBadRequest)
+				return
+			}
+			if req.DefaultFilial == "" {
+				req.DefaultFilial = "01"
+			}
+			if _, ok := filialStockColumn(req.DefaultFilial); !ok {
+				http.Error(w, "default_filial must be 01, 02 or 03", http.StatusBadRequest)
+				return
+			}
+
 			tx, err := db.Begin()
 			if err != nil {
 				http.Error(w, "Database error", http.StatusInternalServerError)
@@ -421,16 +534,22 @@ func ListOrCreateRCARepresentativesHandler(db *sql.DB) http.HandlerFunc {
 
 			var repID int
 			err = tx.QueryRow(`
-				INSERT INTO rca_representatives (company_id, user_id, vehicle_type, vehicle_plate, territory, phone)
-				VALUES ($1, $2, $3, $4, $5, $6)
+				INSERT INTO rca_representatives (company_id, user_id, vehicle_type, vehicle_plate, territory, phone,
+					base_lat, base_lng, max_discount_pct, default_filial)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 				ON CONFLICT (company_id, user_id) DO UPDATE SET
 					vehicle_type = EXCLUDED.vehicle_type,
 					vehicle_plate = EXCLUDED.vehicle_plate,
 					territory = EXCLUDED.territory,
 					phone = EXCLUDED.phone,
+					base_lat = EXCLUDED.base_lat,
+					base_lng = EXCLUDED.base_lng,
+					max_discount_pct = EXCLUDED.max_discount_pct,
+					default_filial = EXCLUDED.default_filial,
 					updated_at = NOW()
 				RETURNING id
-			`, companyID, userID, req.VehicleType, req.VehiclePlate, req.Territory, req.Phone).Scan(&repID)
+			`, companyID, userID, req.VehicleType, req.VehiclePlate, req.Territory, req.Phone,
+				req.BaseLat, req.BaseLng, req.MaxDiscountPct, req.DefaultFilial).Scan(&repID)
 			if err != nil {
 				http.Error(w, "Erro ao criar representante: "+err.Error(), http.StatusInternalServerError)
 				return
@@ -560,8 +679,11 @@ func ListRCARouteCustomersHandler(db *sql.DB) http.HandlerFunc {
 			SELECT id, company_id, route_id, company_name, COALESCE(contact_name,''),
 				COALESCE(phone,''), COALESCE(city,''), COALESCE(neighborhood,''),
 				COALESCE(address,''), COALESCE(address_number,''),
-				lat, lng, priority, COALESCE(notes,''), is_active, created_at::text
-			FROM rca_customers
+				lat, lng, priority, COALESCE(notes,''), is_active, created_at::text,
+				to_char(window_start, 'HH24:MI'), to_char(window_end, 'HH24:MI'), visit_minutes,
+				geocode_precision, geocode_source,
+				`+customerScheduleColumns+`
+			FROM rca_customers c
 			WHERE route_id = $1 AND company_id = $2 AND is_active = TRUE
 			ORDER BY priority ASC
 		`, routeID, companyID)
@@ -575,12 +697,18 @@ func ListRCARouteCustomersHandler(db *sql.DB) http.HandlerFunc {
 		for rows.Next() {
 			var c RCACustomer
 			var lat, lng sql.NullFloat64
-			if err := rows.Scan(&c.ID, &c.CompanyID, &c.RouteID, &c.CompanyName,
+			var win customerWindow
+			var sched customerSchedule
+			if err := rows.Scan(append([]interface{}{&c.ID, &c.CompanyID, &c.RouteID, &c.CompanyName,
 				&c.ContactName, &c.Phone, &c.City, &c.Neighborhood,
 				&c.Address, &c.AddressNumber, &lat, &lng,
-				&c.Priority, &c.Notes, &c.IsActive, &c.CreatedAt); err != nil {
+				&c.Priority, &c.Notes, &c.IsActive, &c.CreatedAt,
+				&win.Start, &win.End, &win.VisitMinutes,
+				&c.GeocodePrecision, &c.GeocodeSource}, sched.targets()...)...); err != nil {
 				continue
 			}
+			win.apply(&c)
+			sched.apply(&c)
 			if lat.Valid {
 				c.Lat = &lat.Float64
 			}
@@ -628,30 +756,55 @@ func AddRCACustomerHandler(db *sql.DB) http.HandlerFunc {
 		if req.Priority == 0 {
 			req.Priority = 1
 		}
+		windowStart, windowEnd, err := parseVisitWindow(req.WindowStart, req.WindowEnd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var visitMinutes *int
+		if req.VisitMinutes > 0 {
+			visitMinutes = &req.VisitMinutes
+		}
+		schedule, err := req.VisitScheduleRequest.columns()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		var custID int
-		err := db.QueryRow(`
+		err = db.QueryRow(`
 			INSERT INTO rca_customers (company_id, route_id, company_name, contact_name, phone,
-				city, neighborhood, address, address_number, lat, lng, priority, notes)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+				city, neighborhood, address, address_number, lat, lng, priority, notes,
+				window_start, window_end, visit_minutes,
+				visit_frequency, visit_weekday, visit_interval_days, visit_anchor_date, visit_month_day,
+				geocode_source)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16,
+				$17, $18, $19, $20, $21, CASE WHEN $10::numeric IS NOT NULL THEN 'manual' END)
 			RETURNING id
-		`, companyID, routeID, req.CompanyName, req.ContactName, req.Phone,
+		`, append([]interface{}{companyID, routeID, req.CompanyName, req.ContactName, req.Phone,
 			req.City, req.Neighborhood, req.Address, req.AddressNumber,
-			req.Lat, req.Lng, req.Priority, req.Notes).Scan(&custID)
+			req.Lat, req.Lng, req.Priority, req.Notes,
+			windowStart, windowEnd, visitMinutes}, schedule...)...).Scan(&custID)
 		if err != nil {
 			http.Error(w, "Error adding customer: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		if _, err := enqueueCustomerGeocode(db, companyID, custID); err != nil {
+			log.Printf("[Geocode] enqueue customer %d: %v", custID, err)
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{"id": custID, "message": "Cliente adicionado com sucesso"})
 	}
 }
 
-// DeleteRCACustomerHandler handles DELETE /api/rca/customers/:id
-func DeleteRCACustomerHandler(db *sql.DB) http.HandlerFunc {
+// UpdateRCACustomerHandler handles PUT /api/rca/customers/:id
+// A new address re-geocodes the customer unless a person confirmed its
+// coordinates; missing address fields are filled from the coordinates.
+func UpdateRCACustomerHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
+		if r.Method != http.MethodPut {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
@@ -661,127 +814,179 @@ func DeleteRCACustomerHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Company not found", http.StatusBadRequest)
 			return
 		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 
-		custID := strings.TrimPrefix(r.URL.Path, "/api/rca/customers/")
-
-		res, err := db.Exec(`
-			UPDATE rca_customers SET is_active = FALSE
-			WHERE id = $1 AND company_id = $2
-		`, custID, companyID)
+		custID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/rca/customers/"))
 		if err != nil {
-			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Invalid customer id", http.StatusBadRequest)
 			return
 		}
 
-		n, _ := res.RowsAffected()
-		if n == 0 {
-			http.Error(w, "Customer not found", http.StatusNotFound)
+		var req UpdateCustomerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.CompanyName != nil && strings.TrimSpace(*req.CompanyName) == "" {
+			http.Error(w, "company_name cannot be empty", http.StatusBadRequest)
+			return
+		}
+		if req.Priority != nil && *req.Priority < 1 {
+			http.Error(w, "priority must be at least 1", http.StatusBadRequest)
+			return
+		}
+		if (req.Lat == nil) != (req.Lng == nil) || !validCoordinates(req.Lat, req.Lng) {
+			http.Error(w, "lat and lng must be sent together and be valid", http.StatusBadRequest)
+			return
+		}
+		if req.Lat != nil && req.ClearLocation {
+			http.Error(w, "lat/lng and clear_location are exclusive", http.StatusBadRequest)
+			return
+		}
+		// The window is replaced as a whole when either end is sent
+		setWindow := req.WindowStart != nil || req.WindowEnd != nil
+		var windowStart, windowEnd interface{}
+		if setWindow {
+			var start, end string
+			if req.WindowStart != nil {
+				start = *req.WindowStart
+			}
+			if req.WindowEnd != nil {
+				end = *req.WindowEnd
+			}
+			if windowStart, windowEnd, err = parseVisitWindow(start, end); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.VisitMinutes != nil && *req.VisitMinutes < 0 {
+			http.Error(w, "visit_minutes cannot be negative", http.StatusBadRequest)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"message": "Cliente removido com sucesso"})
-	}
-}
-
-// geocodeAddress queries Nominatim to get lat/lng for a Brazilian address.
-// Returns nil, nil if not found or on error.
-// Tries multiple query strategies to handle informal Brazilian addresses.
-func geocodeAddress(address, addressNumber, neighborhood, city string) (*float64, *float64) {
-	client := &http.Client{Timeout: 8 * time.Second}
-
-	doRequest := func(apiURL string) (*float64, *float64) {
-		req, err := http.NewRequest("GET", apiURL, nil)
+		tx, err := db.Begin()
 		if err != nil {
-			return nil, nil
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var address, addressNumber, neighborhood, city, source string
+		err = tx.QueryRow(`
+			SELECT COALESCE(address,''), COALESCE(address_number,''), COALESCE(neighborhood,''),
+				COALESCE(city,''), COALESCE(geocode_source,'')
+			FROM rca_customers WHERE id = $1 AND company_id = $2 AND is_active = TRUE
+			FOR UPDATE
+		`, custID, companyID).Scan(&address, &addressNumber, &neighborhood, &city, &source)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
 		}
-		req.Header.Set("User-Agent", "JCInteligenc/2.0 (fbinteligenc.id)")
-		resp, err := client.Do(req)
 		if err != nil {
-			log.Printf("[Geocode] HTTP error: %v", err)
-			return nil, nil
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-		defer resp.Body.Close()
-		var results []struct {
-			Lat string `json:"lat"`
-			Lon string `json:"lon"`
+		changed := func(field *string, current string) bool {
+			return field != nil && strings.TrimSpace(*field) != current
 		}
-		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil || len(results) == 0 {
-			return nil, nil
+		addressChanged := changed(req.Address, address) || changed(req.AddressNumber, addressNumber) ||
+			changed(req.Neighborhood, neighborhood) || changed(req.City, city)
+		confirmed := source == LocationSourceManual || source == LocationSourcePin || source == LocationSourceCheckinGPS
+		clearLocation := req.ClearLocation || (addressChanged && req.Lat == nil && !confirmed)
+
+		trim := func(field *string) interface{} {
+			if field == nil {
+				return nil
+			}
+			return strings.TrimSpace(*field)
+		}
+		_, err = tx.Exec(`
+			UPDATE rca_customers SET
+				company_name = COALESCE($3, company_name),
+				contact_name = COALESCE($4, contact_name),
+				phone = COALESCE($5, phone),
+				city = COALESCE($6, city),
+				neighborhood = COALESCE($7, neighborhood),
+				address = COALESCE($8, address),
+				address_number = COALESCE($9, address_number),
+				priority = COALESCE($10, priority),
+				notes = COALESCE($11, notes),
+				window_start = CASE WHEN $12 THEN $13::time ELSE window_start END,
+				window_end = CASE WHEN $12 THEN $14::time ELSE window_end END,
+				visit_minutes = CASE WHEN $15::int IS NULL THEN visit_minutes ELSE NULLIF($15, 0) END
+			WHERE id = $1 AND company_id = $2
+		`, custID, companyID, trim(req.CompanyName), trim(req.ContactName), trim(req.Phone),
+			trim(req.City), trim(req.Neighborhood), trim(req.Address), trim(req.AddressNumber),
+			req.Priority, req.Notes, setWindow, windowStart, windowEnd, req.VisitMinutes)
+		if err == nil {
+			switch {
+			case req.Lat != nil:
+				err = setCustomerLocation(tx, companyID, custID, *req.Lat, *req.Lng, LocationSourceManual)
+			case clearLocation:
+				_, err = tx.Exec(`
+					UPDATE rca_customers SET lat = NULL, lng = NULL, geocode_precision = NULL,
+						geocode_source = NULL, geocoded_at = NULL
+					WHERE id = $1
+				`, custID)
+			}
 		}
-		lat, err1 := strconv.ParseFloat(results[0].Lat, 64)
-		lng, err2 := strconv.ParseFloat(results[0].Lon, 64)
-		if err1 != nil || err2 != nil {
-			return nil, nil
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Error updating customer: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-		return &lat, &lng
-	}
-
-	base := "https://nominatim.openstreetmap.org/search?format=json&limit=1&countrycodes=br"
-
-	// Strategy 1: structured query (street + number + city)
-	street := address
-	if addressNumber != "" {
-		street += " " + addressNumber
-	}
-	q1 := base + "&street=" + url.QueryEscape(street) + "&city=" + url.QueryEscape(city)
-	if lat, lng := doRequest(q1); lat != nil {
-		return lat, lng
-	}
 
-	time.Sleep(1100 * time.Millisecond)
+		queued, err := enqueueCustomerGeocode(db, companyID, custID)
+		if err != nil {
+			log.Printf("[Geocode] enqueue customer %d: %v", custID, err)
+		}
 
-	// Strategy 2: free-form with just neighborhood + city
-	q2 := base + "&q=" + url.QueryEscape(neighborhood+", "+city+", Brasil")
-	if lat, lng := doRequest(q2); lat != nil {
-		return lat, lng
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":   "Cliente atualizado com sucesso",
+			"geocoding": queued > 0,
+		})
 	}
-
-	return nil, nil
 }
 
-// geocodeCustomers updates lat/lng for customers without coordinates using Nominatim.
-// Runs in background — respects Nominatim's 1 req/sec rate limit.
-func geocodeCustomers(db *sql.DB, routeID string) {
-	rows, err := db.Query(`
-		SELECT id, address, address_number, neighborhood, city
-		FROM rca_customers
-		WHERE route_id = $1 AND lat IS NULL AND is_active = TRUE
-	`, routeID)
-	if err != nil {
-		log.Printf("[Geocode] query error: %v", err)
-		return
-	}
-	defer rows.Close()
-
-	type customer struct {
-		id            int
-		address       string
-		addressNumber string
-		neighborhood  string
-		city          string
-	}
-	var customers []customer
-	for rows.Next() {
-		var c customer
-		if err := rows.Scan(&c.id, &c.address, &c.addressNumber, &c.neighborhood, &c.city); err == nil {
-			customers = append(customers, c)
+// DeleteRCACustomerHandler handles DELETE /api/rca/customers/:id
+func DeleteRCACustomerHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-	}
 
-	for _, c := range customers {
-		time.Sleep(1100 * time.Millisecond) // Nominatim rate limit: 1 req/sec
-		lat, lng := geocodeAddress(c.address, c.addressNumber, c.neighborhood, c.city)
-		if lat == nil {
-			log.Printf("[Geocode] not found: %s %s, %s", c.address, c.addressNumber, c.city)
-			continue
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
 		}
-		_, err := db.Exec(`UPDATE rca_customers SET lat=$1, lng=$2 WHERE id=$3`, lat, lng, c.id)
+
+		custID := strings.TrimPrefix(r.URL.Path, "/api/rca/customers/")
+
+		res, err := db.Exec(`
+			UPDATE rca_customers SET is_active = FALSE
+			WHERE id = $1 AND company_id = $2
+		`, custID, companyID)
 		if err != nil {
-			log.Printf("[Geocode] update error id=%d: %v", c.id, err)
-		} else {
-			log.Printf("[Geocode] ok id=%d: %.6f, %.6f", c.id, *lat, *lng)
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		n, _ := res.RowsAffected()
+		if n == 0 {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Cliente removido com sucesso"})
 	}
 }
 
@@ -906,8 +1111,9 @@ func ImportRCACustomersHandler(db *sql.DB) http.HandlerFunc {
 			_, err := tx.Exec(`
 				INSERT INTO rca_customers
 					(company_id, route_id, company_name, contact_name, phone,
-					 city, neighborhood, address, address_number, lat, lng, priority, notes)
-				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+					 city, neighborhood, address, address_number, lat, lng, priority, notes, geocode_source)
+				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,
+					CASE WHEN $10::numeric IS NOT NULL THEN 'import' END)
 				ON CONFLICT DO NOTHING
 			`, companyID, routeID,
 				name,
@@ -933,8 +1139,10 @@ func ImportRCACustomersHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Geocode addresses in background (Nominatim, 1 req/sec)
-		go geocodeCustomers(db, routeID)
+		// Queue the addresses without coordinates for the geocoding worker
+		if _, err := enqueueGeocodeJobs(db, companyID, routeID); err != nil {
+			log.Printf("[Geocode] enqueue route %s: %v", routeID, err)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -945,50 +1153,6 @@ func ImportRCACustomersHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// GeocodeRouteCustomersHandler handles POST /api/rca/routes/:id/customers/geocode
-// Triggers background geocoding for all customers in the route without coordinates.
-func GeocodeRouteCustomersHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		companyID := GetCompanyIDFromContext(r)
-		if companyID == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if GetUserRoleFromContext(r) == "rca" {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
-
-		path := strings.TrimPrefix(r.URL.Path, "/api/rca/routes/")
-		parts := strings.Split(path, "/")
-		if len(parts) < 1 {
-			http.Error(w, "Invalid path", http.StatusBadRequest)
-			return
-		}
-		routeID := parts[0]
-
-		var exists bool
-		db.QueryRow(`SELECT EXISTS(SELECT 1 FROM rca_routes WHERE id=$1 AND company_id=$2)`, routeID, companyID).Scan(&exists)
-		if !exists {
-			http.Error(w, "Rota não encontrada", http.StatusNotFound)
-			return
-		}
-
-		// Count customers without coordinates
-		var pending int
-		db.QueryRow(`SELECT COUNT(*) FROM rca_customers WHERE route_id=$1 AND lat IS NULL AND is_active=TRUE`, routeID).Scan(&pending)
-
-		// Launch background geocoding
-		go geocodeCustomers(db, routeID)
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"message": "Geocodificação iniciada em background.",
-			"pending": pending,
-		})
-	}
-}
-
 // GetRCADashboardHandler handles GET /api/rca/dashboard
 func GetRCADashboardHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1008,6 +1172,7 @@ func GetRCADashboardHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		today := rcaToday(r.Context(), db, companyID).Format("2006-01-02")
 		rows, err := db.Query(`
 			SELECT r.id, r.company_id, r.user_id, u.full_name, u.email,
 				COALESCE(r.phone,''), COALESCE(r.vehicle_type,''),
@@ -1017,13 +1182,18 @@ func GetRCADashboardHandler(db *sql.DB) http.HandlerFunc {
 				(SELECT COUNT(*) FROM rca_customers rc
 				 JOIN rca_routes rr ON rr.id = rc.route_id
 				 WHERE rr.representative_id = r.id AND rr.is_active = TRUE AND rc.is_active = TRUE) AS route_customers,
-				(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = CURRENT_DATE) AS today_visits,
-				(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = CURRENT_DATE AND status = 'concluida') AS today_completed
+				(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = $2::date AND checkin_at IS NOT NULL) AS today_visits,
+				(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = $2::date AND status = 'concluida') AS today_completed,
+				(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = $2::date AND suspicious = TRUE) AS today_suspicious,
+				(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = $2::date AND planned = TRUE) AS today_planned,
+				(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = $2::date AND planned = TRUE AND status = 'concluida') AS today_executed,
+				(SELECT COUNT(*) FROM rca_visits WHERE representative_id = r.id AND visit_date = $2::date AND planned = FALSE AND checkin_at IS NOT NULL) AS today_unplanned,
+				r.last_lat, r.last_lng, r.last_position_at::text
 			FROM rca_representatives r
 			JOIN users u ON u.id = r.user_id
 			WHERE r.company_id = $1 AND r.is_active = TRUE
 			ORDER BY u.full_name ASC
-		`, companyID)
+		`, companyID, today)
 		if err != nil {
 			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -1033,27 +1203,41 @@ func GetRCADashboardHandler(db *sql.DB) http.HandlerFunc {
 		dashboard := RCADashboard{Representatives: []RCARepresentative{}}
 		for rows.Next() {
 			var rep RCARepresentative
-			var lca sql.NullString
+			var lca, lastAt sql.NullString
+			var lastLat, lastLng sql.NullFloat64
 			if err := rows.Scan(
 				&rep.ID, &rep.CompanyID, &rep.UserID, &rep.FullName, &rep.Email,
 				&rep.Phone, &rep.VehicleType, &rep.VehiclePlate, &rep.Territory,
 				&rep.IsActive, &rep.CreatedAt, &lca,
-				&rep.RouteCustomers, &rep.TodayVisits, &rep.TodayCompleted,
+				&rep.RouteCustomers, &rep.TodayVisits, &rep.TodayCompleted, &rep.TodaySuspicious,
+				&rep.TodayPlanned, &rep.TodayExecuted, &rep.TodayUnplanned,
+				&lastLat, &lastLng, &lastAt,
 			); err != nil {
 				continue
 			}
 			if lca.Valid {
 				rep.LastCheckinAt = &lca.String
 			}
+			if lastLat.Valid && lastLng.Valid && lastAt.Valid {
+				rep.LastLat, rep.LastLng, rep.LastPositionAt = &lastLat.Float64, &lastLng.Float64, &lastAt.String
+			}
 			if rep.IsActive {
 				dashboard.TotalActive++
 			}
 			dashboard.TotalRouteCustomers += rep.RouteCustomers
 			dashboard.TotalVisitsToday += rep.TodayVisits
 			dashboard.TotalCompleted += rep.TodayCompleted
+			dashboard.TotalSuspicious += rep.TodaySuspicious
+			dashboard.TotalPlanned += rep.TodayPlanned
+			dashboard.TotalExecuted += rep.TodayExecuted
+			dashboard.TotalUnplanned += rep.TodayUnplanned
 			dashboard.Representatives = append(dashboard.Representatives, rep)
 		}
-		dashboard.TotalPending = dashboard.TotalRouteCustomers - dashboard.TotalCompleted
+		// Pending is measured against today's agenda, not the whole routes
+		dashboard.TotalPending = dashboard.TotalPlanned - dashboard.TotalExecuted
+		if dashboard.TotalPlanned > 0 {
+			dashboard.AdherencePct = float64(dashboard.TotalExecuted*1000/dashboard.TotalPlanned) / 10
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(dashboard)
@@ -1086,9 +1270,10 @@ func GetRCAVisitHistoryHandler(db *sql.DB) http.HandlerFunc {
 
 		date := r.URL.Query().Get("date")
 		if date == "" {
-			date = "CURRENT_DATE"
-		} else {
-			date = "'" + date + "'"
+			date = rcaToday(r.Context(), db, companyID).Format("2006-01-02")
+		} else if _, err := time.Parse("2006-01-02", date); err != nil {
+			http.Error(w, "Invalid date", http.StatusBadRequest)
+			return
 		}
 
 		rows, err := db.Query(`
@@ -1098,13 +1283,16 @@ func GetRCAVisitHistoryHandler(db *sql.DB) http.HandlerFunc {
 				v.visit_date::text, v.status,
 				v.checkin_at::text, v.checkin_lat, v.checkin_lng,
 				v.checkout_at::text, v.checkout_lat, v.checkout_lng,
-				v.duration_minutes, COALESCE(v.notes,''), v.created_at::text
+				v.duration_minutes, COALESCE(v.notes,''), v.created_at::text,
+				v.auto_closed, COALESCE(v.missed_reason,''), COALESCE(v.missed_notes,''),
+				`+visitGeofenceColumns+`,
+				`+visitOutcomeColumns+`
 			FROM rca_visits v
 			JOIN rca_customers c ON c.id = v.customer_id
 			WHERE v.representative_id = $1 AND v.company_id = $2
-			  AND v.visit_date = `+date+`
+			  AND v.visit_date = $3::date
 			ORDER BY v.checkin_at ASC NULLS LAST
-		`, repID, companyID)
+		`, repID, companyID, date)
 		if err != nil {
 			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -1117,7 +1305,9 @@ func GetRCAVisitHistoryHandler(db *sql.DB) http.HandlerFunc {
 			var cat, cot sql.NullString
 			var clat, clng, colat, colng, custLat, custLng sql.NullFloat64
 			var dur sql.NullInt64
-			if err := rows.Scan(
+			var geo visitGeofence
+			var out visitOutcome
+			if err := rows.Scan(append([]interface{}{
 				&v.ID, &v.CompanyID, &v.RepresentativeID, &v.CustomerID,
 				&v.CustomerName, &v.CustomerCity, &v.CustomerNeighborhood,
 				&v.CustomerAddress, &v.CustomerAddressNumber, &custLat, &custLng,
@@ -1125,9 +1315,12 @@ func GetRCAVisitHistoryHandler(db *sql.DB) http.HandlerFunc {
 				&cat, &clat, &clng,
 				&cot, &colat, &colng,
 				&dur, &v.Notes, &v.CreatedAt,
-			); err != nil {
+				&v.AutoClosed, &v.MissedReason, &v.MissedNotes,
+			}, append(geo.targets(), out.targets()...)...)...); err != nil {
 				continue
 			}
+			geo.apply(&v)
+			out.apply(&v)
 			if cat.Valid {
 				v.CheckinAt = &cat.String
 			}
@@ -1172,6 +1365,8 @@ func GetRCAVisitHistoryHandler(db *sql.DB) http.HandlerFunc {
 // -----------------------------------------------------------------------
 
 // GetMyRouteHandler handles GET /api/rca/my-route
+// Customers are listed by priority; see GetOptimizedRouteHandler for the
+// driving order.
 func GetMyRouteHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -1201,6 +1396,11 @@ func GetMyRouteHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Only today's agenda is listed unless ?all=true, which lists every
+		// customer of the routes for visits outside the agenda
+		all := r.URL.Query().Get("all") == "true"
+		today := rcaToday(r.Context(), db, companyID).Format("2006-01-02")
+
 		// Find active routes for this rep
 		routeRows, err := db.Query(`
 			SELECT id, name, COALESCE(description,'')
@@ -1234,14 +1434,17 @@ func GetMyRouteHandler(db *sql.DB) http.HandlerFunc {
 					COALESCE(c.phone,''), COALESCE(c.city,''), COALESCE(c.neighborhood,''),
 					COALESCE(c.address,''), COALESCE(c.address_number,''),
 					c.lat, c.lng, c.priority, COALESCE(c.notes,''), c.is_active, c.created_at::text,
-					v.id AS today_visit_id, v.status AS today_visit_status
+					v.id AS today_visit_id, v.status AS today_visit_status, v.planned,
+					to_char(c.window_start, 'HH24:MI'), to_char(c.window_end, 'HH24:MI'), c.visit_minutes,
+					`+customerScheduleColumns+`
 				FROM rca_customers c
 				LEFT JOIN rca_visits v ON v.customer_id = c.id
 					AND v.representative_id = $1
-					AND v.visit_date = CURRENT_DATE
+					AND v.visit_date = $5::date
 				WHERE c.route_id = $2 AND c.company_id = $3 AND c.is_active = TRUE
+				  AND ($4 OR v.id IS NOT NULL)
 				ORDER BY c.priority ASC
-			`, repID, rt.ID, companyID)
+			`, repID, rt.ID, companyID, all, today)
 			if err != nil {
 				continue
 			}
@@ -1251,15 +1454,24 @@ func GetMyRouteHandler(db *sql.DB) http.HandlerFunc {
 				var lat, lng sql.NullFloat64
 				var todayVID sql.NullInt64
 				var todayVStatus sql.NullString
-				if err := custRows.Scan(
+				var todayPlanned sql.NullBool
+				var win customerWindow
+				var sched customerSchedule
+				if err := custRows.Scan(append([]interface{}{
 					&c.ID, &c.CompanyID, &c.RouteID, &c.CompanyName,
 					&c.ContactName, &c.Phone, &c.City, &c.Neighborhood,
 					&c.Address, &c.AddressNumber, &lat, &lng,
 					&c.Priority, &c.Notes, &c.IsActive, &c.CreatedAt,
-					&todayVID, &todayVStatus,
-				); err != nil {
+					&todayVID, &todayVStatus, &todayPlanned,
+					&win.Start, &win.End, &win.VisitMinutes,
+				}, sched.targets()...)...); err != nil {
 					continue
 				}
+				win.apply(&c)
+				sched.apply(&c)
+				if todayPlanned.Valid {
+					c.TodayPlanned = &todayPlanned.Bool
+				}
 				if lat.Valid {
 					c.Lat = &lat.Float64
 				}
@@ -1287,10 +1499,13 @@ func GetMyRouteHandler(db *sql.DB) http.HandlerFunc {
 			routes = []RouteWithCustomers{}
 		}
 
+		// pending_justifications: missed visits the app must ask a reason for
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"representative_id": repID,
-			"routes":            routes,
+			"representative_id":      repID,
+			"all":                    all,
+			"routes":                 routes,
+			"pending_justifications": countPendingJustifications(db, repID, missedJustificationSince(r.Context(), db, companyID)),
 		})
 	}
 }
@@ -1326,29 +1541,70 @@ func RCACheckinHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		var custLat, custLng sql.NullFloat64
+		err = db.QueryRow(`SELECT lat, lng FROM rca_customers WHERE id = $1 AND company_id = $2`,
+			req.CustomerID, companyID).Scan(&custLat, &custLng)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// With the hard block on, a check-in away from the customer (or
+		// without GPS) is refused; otherwise it is recorded and flagged
+		geo := loadGeofenceSettings(db, companyID)
+		geofence, distance := checkGeofence(req.Lat, req.Lng, custLat, custLng, geo.RadiusM)
+		if geo.Block && (geofence == GeofenceOutside || geofence == GeofenceNoGPS) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":      "Check-in fora do raio permitido do cliente",
+				"geofence":   geofence,
+				"distance_m": distance,
+				"radius_m":   geo.RadiusM,
+			})
+			return
+		}
+
 		var visitID int
 		err = db.QueryRow(`
 			INSERT INTO rca_visits (company_id, representative_id, customer_id, visit_date,
-				status, checkin_at, checkin_lat, checkin_lng)
-			VALUES ($1, $2, $3, CURRENT_DATE, 'em_visita', NOW(), $4, $5)
+				status, checkin_at, checkin_lat, checkin_lng, checkin_distance_m, checkin_geofence)
+			VALUES ($1, $2, $3, $8::date, 'em_visita', NOW(), $4, $5, $6, $7)
 			ON CONFLICT (representative_id, customer_id, visit_date)
 			DO UPDATE SET
 				status = 'em_visita',
 				checkin_at = EXCLUDED.checkin_at,
 				checkin_lat = EXCLUDED.checkin_lat,
 				checkin_lng = EXCLUDED.checkin_lng,
+				checkin_distance_m = EXCLUDED.checkin_distance_m,
+				checkin_geofence = EXCLUDED.checkin_geofence,
 				updated_at = NOW()
 			RETURNING id
-		`, companyID, repID, req.CustomerID, req.Lat, req.Lng).Scan(&visitID)
+		`, companyID, repID, req.CustomerID, req.Lat, req.Lng, distance, geofence,
+			rcaToday(r.Context(), db, companyID).Format("2006-01-02")).Scan(&visitID)
 		if err != nil {
 			http.Error(w, "Error registering check-in: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if err := flagRepVisits(db, repID, visitID, geo.MinVisitMinutes); err != nil {
+			log.Printf("[RCA] flag visits of rep %d: %v", repID, err)
+		}
+		if err := proposeCheckinLocation(db, companyID, repID, visitID, req, distance,
+			loadGPSSettings(db, companyID).MaxAccuracyM); err != nil {
+			log.Printf("[RCA] propose location of customer %d: %v", req.CustomerID, err)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"visit_id": visitID,
-			"message":  "Check-in registrado com sucesso",
+			"visit_id":   visitID,
+			"geofence":   geofence,
+			"distance_m": distance,
+			"radius_m":   geo.RadiusM,
+			"message":    "Check-in registrado com sucesso",
 		})
 	}
 }
@@ -1384,8 +1640,38 @@ func RCACheckoutHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var visitID, duration int
+		var custLat, custLng sql.NullFloat64
 		err = db.QueryRow(`
+			SELECT c.lat, c.lng FROM rca_visits v
+			JOIN rca_customers c ON c.id = v.customer_id
+			WHERE v.id = $1 AND v.representative_id = $2 AND v.status = 'em_visita'
+		`, req.VisitID, repID).Scan(&custLat, &custLng)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Visit not found or already concluded", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		outcome, err := validateCheckoutOutcome(db, companyID, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Check-out is never blocked; its position is recorded and flagged
+		geo := loadGeofenceSettings(db, companyID)
+		geofence, distance := checkGeofence(req.Lat, req.Lng, custLat, custLng, geo.RadiusM)
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var visitID, duration int
+		err = tx.QueryRow(`
 			UPDATE rca_visits SET
 				status = 'concluida',
 				checkout_at = NOW(),
@@ -1393,10 +1679,16 @@ func RCACheckoutHandler(db *sql.DB) http.HandlerFunc {
 				checkout_lng = $4,
 				duration_minutes = EXTRACT(EPOCH FROM (NOW() - checkin_at)) / 60,
 				notes = $5,
+				checkout_distance_m = $6,
+				checkout_geofence = $7,
+				outcome = $8,
+				order_value = $9,
+				no_sale_reason = $10,
 				updated_at = NOW()
 			WHERE id = $1 AND representative_id = $2 AND status = 'em_visita'
 			RETURNING id, COALESCE(duration_minutes, 0)
-		`, req.VisitID, repID, req.Lat, req.Lng, req.Notes).Scan(&visitID, &duration)
+		`, req.VisitID, repID, req.Lat, req.Lng, req.Notes, distance, geofence,
+			outcome.Outcome, outcome.OrderValue, outcome.NoSaleReason).Scan(&visitID, &duration)
 		if err == sql.ErrNoRows {
 			http.Error(w, "Visit not found or already concluded", http.StatusBadRequest)
 			return
@@ -1405,11 +1697,24 @@ func RCACheckoutHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Error registering check-out: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if err := saveVisitAnswers(tx, visitID, outcome.Answers); err != nil {
+			http.Error(w, "Error saving answers: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Error registering check-out: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := flagRepVisits(db, repID, visitID, geo.MinVisitMinutes); err != nil {
+			log.Printf("[RCA] flag visits of rep %d: %v", repID, err)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"visit_id":         visitID,
 			"duration_minutes": duration,
+			"geofence":         geofence,
+			"distance_m":       distance,
 			"message":          "Check-out registrado com sucesso",
 		})
 	}
@@ -1443,12 +1748,15 @@ func GetTodayVisitsHandler(db *sql.DB) http.HandlerFunc {
 				v.visit_date::text, v.status,
 				v.checkin_at::text, v.checkin_lat, v.checkin_lng,
 				v.checkout_at::text, v.checkout_lat, v.checkout_lng,
-				v.duration_minutes, COALESCE(v.notes,''), v.created_at::text
+				v.duration_minutes, COALESCE(v.notes,''), v.created_at::text,
+				v.auto_closed, COALESCE(v.missed_reason,''), COALESCE(v.missed_notes,''),
+				`+visitGeofenceColumns+`,
+				`+visitOutcomeColumns+`
 			FROM rca_visits v
 			JOIN rca_customers c ON c.id = v.customer_id
-			WHERE v.representative_id = $1 AND v.visit_date = CURRENT_DATE
+			WHERE v.representative_id = $1 AND v.visit_date = $2::date
 			ORDER BY v.checkin_at ASC NULLS LAST
-		`, repID)
+		`, repID, rcaToday(r.Context(), db, companyID).Format("2006-01-02"))
 		if err != nil {
 			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -1461,7 +1769,9 @@ func GetTodayVisitsHandler(db *sql.DB) http.HandlerFunc {
 			var cat, cot sql.NullString
 			var clat, clng, colat, colng, custLat, custLng sql.NullFloat64
 			var dur sql.NullInt64
-			if err := rows.Scan(
+			var geo visitGeofence
+			var out visitOutcome
+			if err := rows.Scan(append([]interface{}{
 				&v.ID, &v.CompanyID, &v.RepresentativeID, &v.CustomerID,
 				&v.CustomerName, &v.CustomerCity, &v.CustomerNeighborhood,
 				&v.CustomerAddress, &v.CustomerAddressNumber, &custLat, &custLng,
@@ -1469,9 +1779,12 @@ func GetTodayVisitsHandler(db *sql.DB) http.HandlerFunc {
 				&cat, &clat, &clng,
 				&cot, &colat, &colng,
 				&dur, &v.Notes, &v.CreatedAt,
-			); err != nil {
+				&v.AutoClosed, &v.MissedReason, &v.MissedNotes,
+			}, append(geo.targets(), out.targets()...)...)...); err != nil {
 				continue
 			}
+			geo.apply(&v)
+			out.apply(&v)
 			if cat.Valid {
 				v.CheckinAt = &cat.String
 			}
@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"aprovapedido/services"
+
+	"github.com/lib/pq"
+)
+
+// -----------------------------------------------------------------------
+// Visit planning
+// -----------------------------------------------------------------------
+
+// maxAgendaDays bounds the range generated by one request.
+const maxAgendaDays = 62
+
+// customerSchedule holds the visit frequency columns of rca_customers as
+// scanned.
+type customerSchedule struct {
+	Frequency    sql.NullString
+	Weekday      sql.NullInt64
+	IntervalDays sql.NullInt64
+	Anchor       sql.NullString
+	MonthDay     sql.NullInt64
+}
+
+// customerScheduleColumns must be selected in this order for scan targets.
+const customerScheduleColumns = `c.visit_frequency, c.visit_weekday, c.visit_interval_days,
+	to_char(c.visit_anchor_date, 'YYYY-MM-DD'), c.visit_month_day`
+
+func (s *customerSchedule) targets() []interface{} {
+	return []interface{}{&s.Frequency, &s.Weekday, &s.IntervalDays, &s.Anchor, &s.MonthDay}
+}
+
+func (s customerSchedule) rule() services.VisitRule {
+	r := services.VisitRule{
+		Frequency:    s.Frequency.String,
+		Weekday:      int(s.Weekday.Int64),
+		IntervalDays: int(s.IntervalDays.Int64),
+		MonthDay:     int(s.MonthDay.Int64),
+	}
+	if s.Anchor.Valid {
+		r.Anchor, _ = time.Parse("2006-01-02", s.Anchor.String)
+	}
+	return r
+}
+
+func (s customerSchedule) apply(c *RCACustomer) {
+	c.VisitFrequency = services.FrequencyWeekdays
+	if s.Frequency.Valid && s.Frequency.String != "" {
+		c.VisitFrequency = s.Frequency.String
+	}
+	if s.Weekday.Valid {
+		d := int(s.Weekday.Int64)
+		c.VisitWeekday = &d
+	}
+	if s.IntervalDays.Valid {
+		d := int(s.IntervalDays.Int64)
+		c.VisitIntervalDays = &d
+	}
+	if s.Anchor.Valid {
+		c.VisitAnchorDate = &s.Anchor.String
+	}
+	if s.MonthDay.Valid {
+		d := int(s.MonthDay.Int64)
+		c.VisitMonthDay = &d
+	}
+}
+
+// VisitScheduleRequest is the visit frequency of a customer. Only the
+// fields of the chosen frequency are stored.
+type VisitScheduleRequest struct {
+	VisitFrequency    string `json:"visit_frequency"`
+	VisitWeekday      *int   `json:"visit_weekday"`
+	VisitIntervalDays int    `json:"visit_interval_days"`
+	VisitAnchorDate   string `json:"visit_anchor_date"`
+	VisitMonthDay     int    `json:"visit_month_day"`
+}
+
+// columns validates the schedule and returns the values of visit_frequency,
+// visit_weekday, visit_interval_days, visit_anchor_date and visit_month_day.
+func (req VisitScheduleRequest) columns() ([]interface{}, error) {
+	rule := services.VisitRule{
+		Frequency:    req.VisitFrequency,
+		IntervalDays: req.VisitIntervalDays,
+		MonthDay:     req.VisitMonthDay,
+	}
+	if req.VisitWeekday != nil {
+		rule.Weekday = *req.VisitWeekday
+	}
+	if req.VisitFrequency == services.FrequencyWeekly && req.VisitWeekday == nil {
+		return nil, fmt.Errorf("visit_weekday e obrigatorio para a frequencia weekly")
+	}
+	if req.VisitAnchorDate != "" {
+		anchor, err := time.Parse("2006-01-02", req.VisitAnchorDate)
+		if err != nil {
+			return nil, fmt.Errorf("visit_anchor_date invalida, use YYYY-MM-DD")
+		}
+		rule.Anchor = anchor
+	}
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+
+	values := []interface{}{nil, nil, nil, nil, nil}
+	switch rule.Frequency {
+	case services.FrequencyWeekly:
+		values[0], values[1] = rule.Frequency, rule.Weekday
+	case services.FrequencyInterval:
+		values[0], values[2], values[3] = rule.Frequency, rule.IntervalDays, req.VisitAnchorDate
+	case services.FrequencyMonthly:
+		values[0], values[4] = rule.Frequency, rule.MonthDay
+	case services.FrequencyWeekdays, services.FrequencyDaily:
+		values[0] = rule.Frequency
+	}
+	return values, nil
+}
+
+// rcaToday returns the current date in the company's RCA timezone.
+func rcaToday(ctx context.Context, db *sql.DB, companyID string) time.Time {
+	return rcaDate(time.Now(), RCACompanyLocation(ctx, db, companyID))
+}
+
+// rcaDate is the calendar date of now in loc, as midnight UTC.
+func rcaDate(now time.Time, loc *time.Location) time.Time {
+	now = now.In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// rcaAgendaLock is the first key of the advisory lock taken by
+// PlanRCAAgenda; the second is the company id.
+const rcaAgendaLock = 3103
+
+// PlanRCAAgenda materialises the agenda of date as 'agendada' visits for
+// one representative (repID > 0) or all of the company. It is idempotent:
+// visits already recorded are kept, and planned visits no longer due (the
+// customer's frequency or route changed) are removed while untouched.
+// Plans of the same company are serialised, so concurrent callers never
+// undo each other's changes.
+func PlanRCAAgenda(ctx context.Context, db *sql.DB, companyID string, repID int, date time.Time) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, $2::int)`, rcaAgendaLock, companyID); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.id, rt.representative_id, `+customerScheduleColumns+`
+		FROM rca_customers c
+		JOIN rca_routes rt ON rt.id = c.route_id
+		JOIN rca_representatives r ON r.id = rt.representative_id
+		WHERE c.company_id = $1 AND c.is_active = TRUE
+		  AND rt.is_active = TRUE AND r.is_active = TRUE
+		  AND ($2 = 0 OR rt.representative_id = $2)
+	`, companyID, repID)
+	if err != nil {
+		return 0, err
+	}
+	var reps, customers []int64
+	for rows.Next() {
+		var custID, rep int64
+		var s customerSchedule
+		if err := rows.Scan(append([]interface{}{&custID, &rep}, s.targets()...)...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if s.rule().Due(date) {
+			reps = append(reps, rep)
+			customers = append(customers, custID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	day := date.Format("2006-01-02")
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM rca_visits v
+		WHERE v.company_id = $1 AND v.visit_date = $2
+		  AND ($3 = 0 OR v.representative_id = $3)
+		  AND v.planned = TRUE AND v.status = 'agendada' AND v.checkin_at IS NULL
+		  AND NOT EXISTS (
+			SELECT 1 FROM unnest($4::int[], $5::int[]) AS d(rep_id, customer_id)
+			WHERE d.rep_id = v.representative_id AND d.customer_id = v.customer_id
+		  )
+	`, companyID, day, repID, pq.Array(reps), pq.Array(customers)); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO rca_visits (company_id, representative_id, customer_id, visit_date, status, planned)
+		SELECT $1, d.rep_id, d.customer_id, $2, 'agendada', TRUE
+		FROM unnest($3::int[], $4::int[]) AS d(rep_id, customer_id)
+		ON CONFLICT (representative_id, customer_id, visit_date) DO NOTHING
+	`, companyID, day, pq.Array(reps), pq.Array(customers)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(customers), nil
+}
+
+type AgendaVisit struct {
+	VisitID            int     `json:"visit_id"`
+	RepresentativeID   int     `json:"representative_id"`
+	RepresentativeName string  `json:"representative_name"`
+	CustomerID         int     `json:"customer_id"`
+	CustomerName       string  `json:"customer_name"`
+	City               string  `json:"city"`
+	Planned            bool    `json:"planned"`
+	Status             string  `json:"status"`
+	CheckinAt          *string `json:"checkin_at"`
+}
+
+type AgendaSummary struct {
+	Planned   int `json:"planned"`
+	Executed  int `json:"executed"`
+	Pending   int `json:"pending"`
+	Unplanned int `json:"unplanned"`
+	// Executed planned visits over planned visits, 0-100
+	AdherencePct float64 `json:"adherence_pct"`
+}
+
+type GenerateAgendaRequest struct {
+	RepresentativeID int    `json:"rca_id"` // 0 = all representatives
+	DateFrom         string `json:"date_from"`
+	DateTo           string `json:"date_to"`
+}
+
+// RCAAgendaHandler handles /api/rca/agenda
+//
+//	GET  ?rca_id=&date=YYYY-MM-DD  planned and executed visits of a day
+//	POST {rca_id, date_from, date_to}  generates or replans the agenda
+//
+// GET only lists what is stored: the scheduler plans each company's today
+// and POST plans days ahead.
+func RCAAgendaHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		today := rcaToday(r.Context(), db, companyID)
+
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			date := today
+			var err error
+			if d := q.Get("date"); d != "" {
+				if date, err = time.Parse("2006-01-02", d); err != nil {
+					http.Error(w, "Invalid date", http.StatusBadRequest)
+					return
+				}
+			}
+			repID := 0
+			if id := q.Get("rca_id"); id != "" {
+				if repID, err = strconv.Atoi(id); err != nil {
+					http.Error(w, "Invalid rca_id", http.StatusBadRequest)
+					return
+				}
+			}
+			rows, err := db.Query(`
+				SELECT v.id, v.representative_id, COALESCE(u.full_name,''), v.customer_id,
+					COALESCE(c.company_name,''), COALESCE(c.city,''), v.planned, v.status,
+					v.checkin_at::text
+				FROM rca_visits v
+				JOIN rca_customers c ON c.id = v.customer_id
+				JOIN rca_representatives r ON r.id = v.representative_id
+				LEFT JOIN users u ON u.id = r.user_id
+				WHERE v.company_id = $1 AND v.visit_date = $2
+				  AND ($3 = 0 OR v.representative_id = $3)
+				ORDER BY u.full_name ASC, c.priority ASC, c.company_name ASC
+			`, companyID, date.Format("2006-01-02"), repID)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			visits := []AgendaVisit{}
+			var summary AgendaSummary
+			for rows.Next() {
+				var a AgendaVisit
+				var checkin sql.NullString
+				if err := rows.Scan(&a.VisitID, &a.RepresentativeID, &a.RepresentativeName, &a.CustomerID,
+					&a.CustomerName, &a.City, &a.Planned, &a.Status, &checkin); err != nil {
+					continue
+				}
+				if checkin.Valid {
+					a.CheckinAt = &checkin.String
+				}
+				switch {
+				case a.Planned && a.Status == "concluida":
+					summary.Planned++
+					summary.Executed++
+				case a.Planned:
+					summary.Planned++
+					summary.Pending++
+				case a.CheckinAt != nil:
+					summary.Unplanned++
+				}
+				visits = append(visits, a)
+			}
+			if summary.Planned > 0 {
+				summary.AdherencePct = float64(summary.Executed*1000/summary.Planned) / 10
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"date":    date.Format("2006-01-02"),
+				"summary": summary,
+				"visits":  visits,
+			})
+
+		case http.MethodPost:
+			var req GenerateAgendaRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			from, err1 := time.Parse("2006-01-02", req.DateFrom)
+			to, err2 := time.Parse("2006-01-02", req.DateTo)
+			if err1 != nil || err2 != nil {
+				http.Error(w, "date_from and date_to are required (YYYY-MM-DD)", http.StatusBadRequest)
+				return
+			}
+			if from.Before(today) {
+				http.Error(w, "date_from cannot be in the past", http.StatusBadRequest)
+				return
+			}
+			if to.Before(from) || to.Sub(from) >= maxAgendaDays*24*time.Hour {
+				http.Error(w, fmt.Sprintf("date range must have 1 to %d days", maxAgendaDays), http.StatusBadRequest)
+				return
+			}
+
+			total, days := 0, 0
+			for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+				n, err := PlanRCAAgenda(r.Context(), db, companyID, req.RepresentativeID, d)
+				if err != nil {
+					http.Error(w, "Error planning agenda: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				total += n
+				days++
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"days":    days,
+				"planned": total,
+				"message": "Agenda gerada com sucesso",
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// UpdateCustomerScheduleHandler handles PUT /api/rca/customers/:id/schedule
+func UpdateCustomerScheduleHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/rca/customers/")
+		custID, err := strconv.Atoi(strings.Split(path, "/")[0])
+		if err != nil {
+			http.Error(w, "Invalid customer id", http.StatusBadRequest)
+			return
+		}
+
+		var req VisitScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		values, err := req.columns()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var repID int
+		err = db.QueryRow(`
+			UPDATE rca_customers c SET
+				visit_frequency = $3, visit_weekday = $4, visit_interval_days = $5,
+				visit_anchor_date = $6, visit_month_day = $7
+			FROM rca_routes rt
+			WHERE c.id = $1 AND c.company_id = $2 AND rt.id = c.route_id
+			RETURNING rt.representative_id
+		`, append([]interface{}{custID, companyID}, values...)...).Scan(&repID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Today's agenda reflects the change right away; days ahead are
+		// replanned by POST /api/rca/agenda
+		if _, err := PlanRCAAgenda(r.Context(), db, companyID, repID, rcaToday(r.Context(), db, companyID)); err != nil {
+			http.Error(w, "Error planning agenda: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Frequencia de visita atualizada"})
+	}
+}
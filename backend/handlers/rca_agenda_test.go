@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRCADate(t *testing.T) {
+	brt := time.FixedZone("BRT", -3*60*60)
+	tests := []struct {
+		name string
+		now  time.Time
+		loc  *time.Location
+		want string
+	}{
+		// 22:30 in Sao Paulo is already the next day on a UTC clock
+		{"late evening check-in", time.Date(2026, 3, 3, 1, 30, 0, 0, time.UTC), brt, "2026-03-02"},
+		{"last minute of the year", time.Date(2027, 1, 1, 2, 59, 0, 0, time.UTC), brt, "2026-12-31"},
+		{"early morning", time.Date(2026, 3, 3, 3, 0, 0, 0, time.UTC), brt, "2026-03-03"},
+		{"utc company", time.Date(2026, 3, 3, 1, 30, 0, 0, time.UTC), time.UTC, "2026-03-03"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rcaDate(tt.now, tt.loc)
+			if got.Format("2006-01-02") != tt.want {
+				t.Errorf("rcaDate(%s) = %s, want %s", tt.now, got.Format("2006-01-02"), tt.want)
+			}
+			if got.Location() != time.UTC || got.Hour() != 0 {
+				t.Errorf("rcaDate(%s) = %s, want midnight UTC", tt.now, got)
+			}
+		})
+	}
+}
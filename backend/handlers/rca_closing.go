@@ -0,0 +1,348 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------
+// End-of-day closing
+// -----------------------------------------------------------------------
+
+const defaultRCATimezone = "America/Sao_Paulo"
+
+var defaultMissedReasons = []string{
+	"Cliente fechado", "Cliente sem demanda", "Falta de tempo",
+	"Problema no veiculo", "Condicoes climaticas", "Outro",
+}
+
+// missedJustificationDays is how far back the app asks for justifications.
+const missedJustificationDays = 7
+
+// RCACompanyLocation returns the timezone configured for the RCA module,
+// falling back to America/Sao_Paulo (or UTC if tzdata is missing).
+func RCACompanyLocation(ctx context.Context, db *sql.DB, companyID string) *time.Location {
+	var name string
+	db.QueryRowContext(ctx, `SELECT COALESCE(rca_timezone, '') FROM settings WHERE company_id = $1`,
+		companyID).Scan(&name)
+	if name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	if loc, err := time.LoadLocation(defaultRCATimezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+func loadMissedReasons(db *sql.DB, companyID string) []string {
+	var raw string
+	db.QueryRow(`SELECT COALESCE(rca_missed_reasons, '') FROM settings WHERE company_id = $1`,
+		companyID).Scan(&raw)
+	var reasons []string
+	if err := json.Unmarshal([]byte(raw), &reasons); err != nil || len(reasons) == 0 {
+		return defaultMissedReasons
+	}
+	return reasons
+}
+
+// RCADayClosing counts what CloseRCADays changed. Through is the last day
+// closed, the company's yesterday.
+type RCADayClosing struct {
+	Days       int
+	Missed     int
+	AutoClosed int
+	Through    string
+}
+
+// CloseRCADays closes every day of the company before today, in its
+// timezone: planned visits not started become 'nao_visitado' and visits
+// still 'em_visita' are concluded with auto_closed. It is idempotent and
+// runs in one transaction.
+func CloseRCADays(ctx context.Context, db *sql.DB, companyID string) (RCADayClosing, error) {
+	var res RCADayClosing
+	now := time.Now().In(RCACompanyLocation(ctx, db, companyID))
+	today := now.Format("2006-01-02")
+	yesterday := now.AddDate(0, 0, -1).Format("2006-01-02")
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	type dayCounts struct{ missed, autoClosed int }
+	days := map[string]*dayCounts{}
+	count := func(query string, add func(*dayCounts)) error {
+		rows, err := tx.QueryContext(ctx, query, companyID, today)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var day string
+			if err := rows.Scan(&day); err != nil {
+				return err
+			}
+			if days[day] == nil {
+				days[day] = &dayCounts{}
+			}
+			add(days[day])
+		}
+		return rows.Err()
+	}
+
+	if err := count(`
+		UPDATE rca_visits SET status = 'nao_visitado', closed_at = NOW(), updated_at = NOW()
+		WHERE company_id = $1 AND visit_date < $2::date
+		  AND status = 'agendada'
+		RETURNING visit_date::text
+	`, func(d *dayCounts) { d.missed++; res.Missed++ }); err != nil {
+		return res, err
+	}
+	if err := count(`
+		UPDATE rca_visits SET status = 'concluida', auto_closed = TRUE, closed_at = NOW(), updated_at = NOW()
+		WHERE company_id = $1 AND visit_date < $2::date
+		  AND status = 'em_visita'
+		RETURNING visit_date::text
+	`, func(d *dayCounts) { d.autoClosed++; res.AutoClosed++ }); err != nil {
+		return res, err
+	}
+
+	// Yesterday is recorded even when nothing was open
+	if days[yesterday] == nil {
+		days[yesterday] = &dayCounts{}
+	}
+	for day, c := range days {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO rca_day_closings (company_id, visit_date, missed, auto_closed)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (company_id, visit_date) DO UPDATE SET
+				missed = rca_day_closings.missed + EXCLUDED.missed,
+				auto_closed = rca_day_closings.auto_closed + EXCLUDED.auto_closed,
+				closed_at = NOW()
+		`, companyID, day, c.missed, c.autoClosed); err != nil {
+			return res, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+	res.Days = len(days)
+	res.Through = yesterday
+	return res, nil
+}
+
+type MissedVisit struct {
+	VisitID      int    `json:"visit_id"`
+	CustomerID   int    `json:"customer_id"`
+	CustomerName string `json:"customer_name"`
+	City         string `json:"city"`
+	VisitDate    string `json:"visit_date"`
+}
+
+type JustifyVisitRequest struct {
+	VisitID int    `json:"visit_id"`
+	Reason  string `json:"reason"`
+	Notes   string `json:"notes"`
+}
+
+// missedJustificationSince is the first visit date the app still asks a
+// justification for, in the company's calendar.
+func missedJustificationSince(ctx context.Context, db *sql.DB, companyID string) string {
+	return rcaToday(ctx, db, companyID).AddDate(0, 0, -missedJustificationDays).Format("2006-01-02")
+}
+
+func countPendingJustifications(db *sql.DB, repID int, since string) int {
+	var n int
+	db.QueryRow(`
+		SELECT COUNT(*) FROM rca_visits
+		WHERE representative_id = $1 AND status = 'nao_visitado' AND missed_reason IS NULL
+		  AND visit_date >= $2::date
+	`, repID, since).Scan(&n)
+	return n
+}
+
+// RCAMissedVisitsHandler handles /api/rca/visits/missed (RCA role)
+//
+//	GET  missed visits of the last days still without a justification,
+//	     and the reasons to choose from
+//	POST {visit_id, reason, notes} justifies one of them
+func RCAMissedVisitsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		userID := GetUserIDFromContext(r)
+		if companyID == "" || userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		repID, err := getRepresentativeID(db, userID, companyID)
+		if err != nil {
+			http.Error(w, "Representative profile not found", http.StatusNotFound)
+			return
+		}
+		reasons := loadMissedReasons(db, companyID)
+
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := db.Query(`
+				SELECT v.id, v.customer_id, COALESCE(c.company_name,''), COALESCE(c.city,''),
+					v.visit_date::text
+				FROM rca_visits v
+				JOIN rca_customers c ON c.id = v.customer_id
+				WHERE v.representative_id = $1 AND v.status = 'nao_visitado'
+				  AND v.missed_reason IS NULL
+				  AND v.visit_date >= $2::date
+				ORDER BY v.visit_date ASC, c.priority ASC
+			`, repID, missedJustificationSince(r.Context(), db, companyID))
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			visits := []MissedVisit{}
+			for rows.Next() {
+				var m MissedVisit
+				if err := rows.Scan(&m.VisitID, &m.CustomerID, &m.CustomerName, &m.City, &m.VisitDate); err != nil {
+					continue
+				}
+				visits = append(visits, m)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"reasons": reasons,
+				"visits":  visits,
+				"total":   len(visits),
+			})
+
+		case http.MethodPost:
+			var req JustifyVisitRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			req.Reason = strings.TrimSpace(req.Reason)
+			valid := false
+			for _, reason := range reasons {
+				if reason == req.Reason {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				http.Error(w, "reason must be one of the configured reasons", http.StatusBadRequest)
+				return
+			}
+
+			res, err := db.Exec(`
+				UPDATE rca_visits SET missed_reason = $3, missed_notes = $4, justified_at = NOW(), updated_at = NOW()
+				WHERE id = $1 AND representative_id = $2 AND status = 'nao_visitado'
+			`, req.VisitID, repID, req.Reason, strings.TrimSpace(req.Notes))
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "Missed visit not found", http.StatusNotFound)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"visit_id": req.VisitID,
+				"pending":  countPendingJustifications(db, repID, missedJustificationSince(r.Context(), db, companyID)),
+				"message":  "Justificativa registrada",
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+type RCADayClosingRow struct {
+	VisitDate  string `json:"visit_date"`
+	Missed     int    `json:"missed"`
+	AutoClosed int    `json:"auto_closed"`
+	Justified  int    `json:"justified"`
+	ClosedAt   string `json:"closed_at"`
+}
+
+// ListRCADayClosingsHandler handles GET /api/rca/closings?date_from=&date_to=
+// Dates default to the last 30 days.
+func ListRCADayClosingsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		q := r.URL.Query()
+		dateTo := q.Get("date_to")
+		if dateTo == "" {
+			dateTo = time.Now().In(RCACompanyLocation(r.Context(), db, companyID)).Format("2006-01-02")
+		}
+		to, err := time.Parse("2006-01-02", dateTo)
+		if err != nil {
+			http.Error(w, "Invalid date_to", http.StatusBadRequest)
+			return
+		}
+		dateFrom := q.Get("date_from")
+		if dateFrom == "" {
+			dateFrom = to.AddDate(0, 0, -30).Format("2006-01-02")
+		}
+		if _, err := time.Parse("2006-01-02", dateFrom); err != nil {
+			http.Error(w, "Invalid date_from", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT dc.visit_date::text, dc.missed, dc.auto_closed,
+				(SELECT COUNT(*) FROM rca_visits v
+				 WHERE v.company_id = dc.company_id AND v.visit_date = dc.visit_date
+				   AND v.status = 'nao_visitado' AND v.missed_reason IS NOT NULL),
+				dc.closed_at::text
+			FROM rca_day_closings dc
+			WHERE dc.company_id = $1 AND dc.visit_date BETWEEN $2 AND $3
+			ORDER BY dc.visit_date DESC
+		`, companyID, dateFrom, dateTo)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		closings := []RCADayClosingRow{}
+		for rows.Next() {
+			var c RCADayClosingRow
+			if err := rows.Scan(&c.VisitDate, &c.Missed, &c.AutoClosed, &c.Justified, &c.ClosedAt); err != nil {
+				continue
+			}
+			closings = append(closings, c)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"date_from": dateFrom,
+			"date_to":   dateTo,
+			"items":     closings,
+		})
+	}
+}
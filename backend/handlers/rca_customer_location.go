@@ -0,0 +1,440 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"aprovapedido/services"
+)
+
+// -----------------------------------------------------------------------
+// Customer location corrections
+// -----------------------------------------------------------------------
+//
+// A manager sets a customer's coordinates directly (PUT /customers/:id);
+// a representative proposes them, from a map pin or from the GPS of the
+// first check-in, and a manager approves the proposal.
+
+// Location request statuses.
+const (
+	LocationPending    = "pendente"
+	LocationApproved   = "aprovado"
+	LocationRejected   = "rejeitado"
+	LocationSuperseded = "substituido"
+)
+
+// Sources of coordinates set by people rather than the geocoder.
+const (
+	LocationSourceManual     = "manual"
+	LocationSourcePin        = "pin"
+	LocationSourceCheckinGPS = "checkin_gps"
+)
+
+// A first check-in closer than this to the customer's coordinates (or to
+// the reading's accuracy, when larger) confirms them instead of proposing.
+const locationMinCorrectionM = 50.0
+
+type RCALocationRequest struct {
+	ID                 int      `json:"id"`
+	CustomerID         int      `json:"customer_id"`
+	CustomerName       string   `json:"customer_name"`
+	RepresentativeID   *int     `json:"representative_id"`
+	RepresentativeName string   `json:"representative_name"`
+	VisitID            *int     `json:"visit_id"`
+	Source             string   `json:"source"`
+	Lat                float64  `json:"lat"`
+	Lng                float64  `json:"lng"`
+	AccuracyM          *float64 `json:"accuracy_m"`
+	Notes              string   `json:"notes"`
+	Status             string   `json:"status"`
+	RejectionReason    string   `json:"rejection_reason"`
+	ReviewedAt         *string  `json:"reviewed_at"`
+	CreatedAt          string   `json:"created_at"`
+	// The customer's coordinates now, and how far the proposal moves them
+	CurrentLat       *float64 `json:"current_lat"`
+	CurrentLng       *float64 `json:"current_lng"`
+	CurrentPrecision *string  `json:"current_precision"`
+	CurrentSource    *string  `json:"current_source"`
+	DistanceM        *float64 `json:"distance_m"`
+}
+
+const rcaLocationRequestColumns = `l.id, l.customer_id, COALESCE(c.company_name,''), l.representative_id,
+	COALESCE(u.full_name,''), l.visit_id, l.source, l.lat, l.lng, l.accuracy_m, COALESCE(l.notes,''),
+	l.status, COALESCE(l.rejection_reason,''), l.reviewed_at::text, l.created_at::text,
+	c.lat, c.lng, c.geocode_precision, c.geocode_source`
+
+const rcaLocationRequestJoins = `
+	FROM rca_customer_location_requests l
+	JOIN rca_customers c ON c.id = l.customer_id
+	LEFT JOIN rca_representatives r ON r.id = l.representative_id
+	LEFT JOIN users u ON u.id = r.user_id`
+
+func scanRCALocationRequest(row orderScanner) (RCALocationRequest, error) {
+	var l RCALocationRequest
+	var repID, visitID sql.NullInt64
+	var accuracy, curLat, curLng sql.NullFloat64
+	var reviewedAt, curPrecision, curSource sql.NullString
+	err := row.Scan(&l.ID, &l.CustomerID, &l.CustomerName, &repID,
+		&l.RepresentativeName, &visitID, &l.Source, &l.Lat, &l.Lng, &accuracy, &l.Notes,
+		&l.Status, &l.RejectionReason, &reviewedAt, &l.CreatedAt,
+		&curLat, &curLng, &curPrecision, &curSource)
+	if err != nil {
+		return l, err
+	}
+	if repID.Valid {
+		id := int(repID.Int64)
+		l.RepresentativeID = &id
+	}
+	if visitID.Valid {
+		id := int(visitID.Int64)
+		l.VisitID = &id
+	}
+	if accuracy.Valid {
+		l.AccuracyM = &accuracy.Float64
+	}
+	if reviewedAt.Valid {
+		l.ReviewedAt = &reviewedAt.String
+	}
+	if curPrecision.Valid {
+		l.CurrentPrecision = &curPrecision.String
+	}
+	if curSource.Valid {
+		l.CurrentSource = &curSource.String
+	}
+	if curLat.Valid && curLng.Valid {
+		l.CurrentLat, l.CurrentLng = &curLat.Float64, &curLng.Float64
+		d := services.HaversineKm(
+			services.RoutePoint{Lat: l.Lat, Lng: l.Lng},
+			services.RoutePoint{Lat: curLat.Float64, Lng: curLng.Float64},
+		) * 1000
+		d = math.Round(d*10) / 10
+		l.DistanceM = &d
+	}
+	return l, nil
+}
+
+// setCustomerLocation stores coordinates confirmed by a person and
+// supersedes the customer's pending proposal.
+func setCustomerLocation(ex syncExecer, companyID string, customerID int, lat, lng float64, source string) error {
+	res, err := ex.Exec(`
+		UPDATE rca_customers SET lat = $3, lng = $4, geocode_precision = 'address', geocode_source = $5,
+			geocoded_at = NOW()
+		WHERE id = $1 AND company_id = $2
+	`, customerID, companyID, lat, lng, source)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = ex.Exec(`
+		UPDATE rca_customer_location_requests SET status = 'substituido'
+		WHERE customer_id = $1 AND status = 'pendente'
+	`, customerID)
+	return err
+}
+
+// proposeCheckinLocation turns the GPS of a customer's first check-in into
+// a location request, unless a person already confirmed the coordinates,
+// the reading is too inaccurate or it agrees with them. distanceM is the
+// check-in's distance to the customer, nil without coordinates.
+func proposeCheckinLocation(ex syncExecer, companyID string, repID, visitID int, req CheckinRequest, distanceM *float64, maxAccuracyM float64) error {
+	if req.Lat == nil || req.Lng == nil || !validCoordinates(req.Lat, req.Lng) || (*req.Lat == 0 && *req.Lng == 0) {
+		return nil
+	}
+	if req.AccuracyM != nil && *req.AccuracyM > maxAccuracyM {
+		return nil
+	}
+	if distanceM != nil {
+		threshold := locationMinCorrectionM
+		if req.AccuracyM != nil && *req.AccuracyM > threshold {
+			threshold = *req.AccuracyM
+		}
+		if *distanceM <= threshold {
+			return nil
+		}
+	}
+	_, err := ex.Exec(`
+		INSERT INTO rca_customer_location_requests
+			(company_id, customer_id, representative_id, visit_id, source, lat, lng, accuracy_m)
+		SELECT c.company_id, c.id, $3, $4, 'checkin_gps', $5, $6, $7
+		FROM rca_customers c
+		WHERE c.id = $1 AND c.company_id = $2
+		  AND COALESCE(c.geocode_source, '') NOT IN ('manual', 'pin', 'checkin_gps')
+		  AND NOT EXISTS (
+			SELECT 1 FROM rca_visits v
+			WHERE v.customer_id = c.id AND v.id <> $4 AND v.checkin_at IS NOT NULL)
+		  AND NOT EXISTS (SELECT 1 FROM rca_customer_location_requests WHERE visit_id = $4)
+		ON CONFLICT (customer_id) WHERE status = 'pendente' DO NOTHING
+	`, req.CustomerID, companyID, repID, visitID, *req.Lat, *req.Lng, req.AccuracyM)
+	return err
+}
+
+// RCACustomerLocationHandler handles POST /api/rca/customers/:id/location
+// Body: {lat, lng, accuracy_m, notes} — a representative's map pin, sent
+// to a manager for approval. It replaces the customer's pending proposal.
+// Only customers on the rep's active routes can be corrected.
+func RCACustomerLocationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) != "rca" {
+			http.Error(w, "Managers set the location with PUT /api/rca/customers/:id", http.StatusForbidden)
+			return
+		}
+		repID, err := getRepresentativeID(db, GetUserIDFromContext(r), companyID)
+		if err != nil {
+			http.Error(w, "Representative profile not found", http.StatusNotFound)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/rca/customers/")
+		custID, err := strconv.Atoi(strings.Split(path, "/")[0])
+		if err != nil {
+			http.Error(w, "Invalid customer id", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Lat       *float64 `json:"lat"`
+			Lng       *float64 `json:"lng"`
+			AccuracyM *float64 `json:"accuracy_m"`
+			Notes     string   `json:"notes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Lat == nil || req.Lng == nil || !validCoordinates(req.Lat, req.Lng) {
+			http.Error(w, "lat and lng are required", http.StatusBadRequest)
+			return
+		}
+
+		var id int
+		err = db.QueryRow(`
+			INSERT INTO rca_customer_location_requests
+				(company_id, customer_id, representative_id, source, lat, lng, accuracy_m, notes)
+			SELECT c.company_id, c.id, $3, 'pin', $4, $5, $6, NULLIF($7, '')
+			FROM rca_customers c
+			JOIN rca_routes rt ON rt.id = c.route_id
+			WHERE c.id = $1 AND c.company_id = $2 AND c.is_active = TRUE
+			  AND rt.representative_id = $3 AND rt.is_active = TRUE
+			ON CONFLICT (customer_id) WHERE status = 'pendente' DO UPDATE SET
+				representative_id = EXCLUDED.representative_id, visit_id = NULL,
+				source = EXCLUDED.source, lat = EXCLUDED.lat, lng = EXCLUDED.lng,
+				accuracy_m = EXCLUDED.accuracy_m, notes = EXCLUDED.notes, created_at = NOW()
+			RETURNING id
+		`, custID, companyID, repID, *req.Lat, *req.Lng, req.AccuracyM, strings.TrimSpace(req.Notes)).Scan(&id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      id,
+			"status":  LocationPending,
+			"message": "Localizacao enviada para aprovacao",
+		})
+	}
+}
+
+// RCALocationRequestsHandler handles GET /api/rca/location-requests
+// ?status=pendente&rca_id= — reps only see their own proposals.
+func RCALocationRequestsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		repID, err := orderActor(db, r, companyID)
+		if err != nil {
+			http.Error(w, "Representative profile not found", http.StatusNotFound)
+			return
+		}
+
+		where := ` WHERE l.company_id = $1`
+		args := []interface{}{companyID}
+		if status := r.URL.Query().Get("status"); status != "" {
+			args = append(args, status)
+			where += fmt.Sprintf(" AND l.status = $%d", len(args))
+		}
+		if repID > 0 {
+			args = append(args, repID)
+			where += fmt.Sprintf(" AND l.representative_id = $%d", len(args))
+		} else if rca := r.URL.Query().Get("rca_id"); rca != "" {
+			args = append(args, rca)
+			where += fmt.Sprintf(" AND l.representative_id = $%d", len(args))
+		}
+
+		rows, err := db.Query(`SELECT `+rcaLocationRequestColumns+rcaLocationRequestJoins+where+`
+			ORDER BY l.created_at DESC LIMIT 200`, args...)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		items := []RCALocationRequest{}
+		for rows.Next() {
+			l, err := scanRCALocationRequest(rows)
+			if err != nil {
+				continue
+			}
+			items = append(items, l)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "total": len(items)})
+	}
+}
+
+// RCALocationRequestHandler handles /api/rca/location-requests/:id
+//
+//	GET                the request
+//	POST /approve      moves the customer to the proposed coordinates
+//	POST /reject       {reason}
+func RCALocationRequestHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		repID, err := orderActor(db, r, companyID)
+		if err != nil {
+			http.Error(w, "Representative profile not found", http.StatusNotFound)
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rca/location-requests/"), "/")
+		reqID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid request id", http.StatusBadRequest)
+			return
+		}
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+
+		load := func() (RCALocationRequest, error) {
+			return scanRCALocationRequest(db.QueryRow(`SELECT `+rcaLocationRequestColumns+rcaLocationRequestJoins+`
+				WHERE l.id = $1 AND l.company_id = $2`, reqID, companyID))
+		}
+		l, err := load()
+		if err == sql.ErrNoRows || (err == nil && repID > 0 && (l.RepresentativeID == nil || *l.RepresentativeID != repID)) {
+			http.Error(w, "Location request not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respond := func() {
+			l, err := load()
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(l)
+		}
+
+		switch {
+		case r.Method == http.MethodGet && action == "":
+			respond()
+			return
+		case r.Method == http.MethodPost && (action == "approve" || action == "reject"):
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if repID > 0 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var reviewer *int
+		if uid, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+			reviewer = &uid
+		}
+
+		if action == "reject" {
+			var req struct {
+				Reason string `json:"reason"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			if strings.TrimSpace(req.Reason) == "" {
+				http.Error(w, "reason is required", http.StatusBadRequest)
+				return
+			}
+			res, err := db.Exec(`
+				UPDATE rca_customer_location_requests SET status = 'rejeitado', rejection_reason = $3,
+					reviewed_by = $4, reviewed_at = NOW()
+				WHERE id = $1 AND company_id = $2 AND status = 'pendente'
+			`, reqID, companyID, strings.TrimSpace(req.Reason), reviewer)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, fmt.Sprintf("Location request is %s", l.Status), http.StatusConflict)
+				return
+			}
+			respond()
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec(`
+			UPDATE rca_customer_location_requests SET status = 'aprovado', reviewed_by = $3, reviewed_at = NOW()
+			WHERE id = $1 AND company_id = $2 AND status = 'pendente'
+		`, reqID, companyID, reviewer)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, fmt.Sprintf("Location request is %s", l.Status), http.StatusConflict)
+			return
+		}
+		err = setCustomerLocation(tx, companyID, l.CustomerID, l.Lat, l.Lng, l.Source)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Error approving location: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Fill the address fields the customer is missing from the new point
+		if _, err := enqueueCustomerGeocode(db, companyID, l.CustomerID); err != nil {
+			log.Printf("[Geocode] enqueue customer %d: %v", l.CustomerID, err)
+		}
+		respond()
+	}
+}
@@ -0,0 +1,393 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"aprovapedido/services"
+)
+
+// -----------------------------------------------------------------------
+// Geocoding queue
+// -----------------------------------------------------------------------
+//
+// Customers without coordinates get a forward job in rca_geocode_jobs,
+// and customers with coordinates but missing address fields a reverse one;
+// the scheduler drains the queue with RunGeocodeJobs, so work queued before
+// a restart is picked up again. Forward results are cached per provider.
+
+// Geocode job kinds.
+const (
+	GeocodeForward = "forward"
+	GeocodeReverse = "reverse"
+)
+
+const (
+	maxGeocodeAttempts = 5
+	// A job left running this long was interrupted by a restart
+	geocodeStaleAfter = 5 * time.Minute
+	// Cached misses are retried after this; found addresses do not expire
+	geocodeMissTTL = 7 * 24 * time.Hour
+	// Default center of the fake provider: Sao Paulo
+	fakeGeocoderLat = -23.5505
+	fakeGeocoderLng = -46.6333
+)
+
+// dbGeocodeCache stores results in rca_geocode_cache, per source so a
+// fake result never answers for a real provider.
+type dbGeocodeCache struct {
+	db     *sql.DB
+	source string
+}
+
+func (c dbGeocodeCache) Get(ctx context.Context, key string) (services.GeocodeResult, bool, bool) {
+	res := services.GeocodeResult{Source: c.source}
+	var found bool
+	var lat, lng sql.NullFloat64
+	var precision sql.NullString
+	err := c.db.QueryRowContext(ctx, `
+		SELECT found, lat, lng, precision FROM rca_geocode_cache
+		WHERE source = $1 AND query_key = $2
+		  AND (found OR created_at > NOW() - make_interval(secs => $3))
+	`, c.source, key, geocodeMissTTL.Seconds()).Scan(&found, &lat, &lng, &precision)
+	if err != nil {
+		return res, false, false
+	}
+	res.Lat, res.Lng, res.Precision = lat.Float64, lng.Float64, precision.String
+	return res, found, true
+}
+
+func (c dbGeocodeCache) Put(ctx context.Context, key string, res services.GeocodeResult, found bool) {
+	var lat, lng, precision interface{}
+	if found {
+		lat, lng, precision = res.Lat, res.Lng, res.Precision
+	}
+	if _, err := c.db.ExecContext(ctx, `
+		INSERT INTO rca_geocode_cache (source, query_key, found, lat, lng, precision)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (source, query_key) DO UPDATE SET
+			found = EXCLUDED.found, lat = EXCLUDED.lat, lng = EXCLUDED.lng,
+			precision = EXCLUDED.precision, created_at = NOW()
+	`, c.source, key, found, lat, lng, precision); err != nil {
+		log.Printf("[Geocode] cache put: %v", err)
+	}
+}
+
+type geocodeProvider interface {
+	services.Geocoder
+	services.ReverseGeocoder
+}
+
+// companyGeocoder returns the company's configured provider and its source.
+func companyGeocoder(db *sql.DB, companyID string) (geocodeProvider, string) {
+	var provider, baseURL string
+	db.QueryRow(`
+		SELECT COALESCE(rca_geocoder, 'nominatim'), COALESCE(rca_geocoder_url, '')
+		FROM settings WHERE company_id = $1
+	`, companyID).Scan(&provider, &baseURL)
+
+	if provider == "fake" {
+		return services.FakeGeocoder{Center: services.RoutePoint{Lat: fakeGeocoderLat, Lng: fakeGeocoderLng}}, services.SourceFake
+	}
+	g := services.NewNominatimGeocoder(baseURL)
+	return g, g.Source
+}
+
+// NewGeocoder returns the company's configured provider behind the cache.
+func NewGeocoder(db *sql.DB, companyID string) services.Geocoder {
+	inner, source := companyGeocoder(db, companyID)
+	return services.CachedGeocoder{Inner: inner, Cache: dbGeocodeCache{db: db, source: source}}
+}
+
+// NewReverseGeocoder returns the company's configured provider. Reverse
+// lookups are rare enough to go uncached.
+func NewReverseGeocoder(db *sql.DB, companyID string) services.ReverseGeocoder {
+	inner, _ := companyGeocoder(db, companyID)
+	return inner
+}
+
+// enqueueGeocodeJobs queues the active customers of a route: without
+// coordinates to geocode, or with coordinates but missing address fields
+// to reverse geocode. Customers with an open job of the kind are skipped.
+func enqueueGeocodeJobs(db *sql.DB, companyID, routeID string) (int, error) {
+	return enqueueGeocode(db, "route_id = $1 AND company_id = $2", routeID, companyID)
+}
+
+// enqueueCustomerGeocode is enqueueGeocodeJobs for a single customer.
+func enqueueCustomerGeocode(db *sql.DB, companyID string, customerID int) (int, error) {
+	return enqueueGeocode(db, "id = $1 AND company_id = $2", customerID, companyID)
+}
+
+func enqueueGeocode(db *sql.DB, where string, args ...interface{}) (int, error) {
+	res, err := db.Exec(`
+		INSERT INTO rca_geocode_jobs (company_id, customer_id, kind)
+		SELECT company_id, id, CASE WHEN lat IS NULL THEN 'forward' ELSE 'reverse' END
+		FROM rca_customers
+		WHERE `+where+` AND is_active = TRUE
+		  AND (lat IS NULL OR COALESCE(address,'') = '' OR COALESCE(neighborhood,'') = ''
+		       OR COALESCE(city,'') = '')
+		ON CONFLICT (customer_id, kind) WHERE status IN ('pending', 'running') DO NOTHING
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// RunGeocodeJobs processes up to limit queued jobs, one at a time, and
+// returns how many it took. Failed attempts are retried with backoff.
+func RunGeocodeJobs(ctx context.Context, db *sql.DB, limit int) (int, error) {
+	if _, err := db.ExecContext(ctx, `
+		UPDATE rca_geocode_jobs SET status = 'pending', updated_at = NOW()
+		WHERE status = 'running' AND updated_at < NOW() - make_interval(secs => $1)
+	`, geocodeStaleAfter.Seconds()); err != nil {
+		return 0, err
+	}
+
+	geocoders := map[string]services.Geocoder{}
+	reverse := map[string]services.ReverseGeocoder{}
+	for n := 0; n < limit; n++ {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		var jobID, customerID, attempts int
+		var companyID, kind string
+		err := db.QueryRowContext(ctx, `
+			UPDATE rca_geocode_jobs SET status = 'running', attempts = attempts + 1, updated_at = NOW()
+			WHERE id = (
+				SELECT id FROM rca_geocode_jobs
+				WHERE status = 'pending' AND run_after <= NOW()
+				ORDER BY id LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, company_id::text, customer_id, attempts, kind
+		`).Scan(&jobID, &companyID, &customerID, &attempts, &kind)
+		if err == sql.ErrNoRows {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		var q services.GeocodeQuery
+		var lat, lng sql.NullFloat64
+		err = db.QueryRowContext(ctx, `
+			SELECT COALESCE(address,''), COALESCE(address_number,''), COALESCE(neighborhood,''),
+				COALESCE(city,''), lat, lng
+			FROM rca_customers WHERE id = $1
+		`, customerID).Scan(&q.Street, &q.Number, &q.Neighborhood, &q.City, &lat, &lng)
+		if err != nil {
+			finishGeocodeJob(db, jobID, "failed", err.Error())
+			continue
+		}
+		if lat.Valid != (kind == GeocodeReverse) {
+			// Coordinates were set or cleared by hand meanwhile
+			finishGeocodeJob(db, jobID, "done", "")
+			continue
+		}
+
+		jobCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if kind == GeocodeReverse {
+			g := reverse[companyID]
+			if g == nil {
+				g = NewReverseGeocoder(db, companyID)
+				reverse[companyID] = g
+			}
+			var addr services.GeocodeQuery
+			addr, err = g.Reverse(jobCtx, services.RoutePoint{Lat: lat.Float64, Lng: lng.Float64})
+			if err == nil {
+				err = fillCustomerAddress(ctx, db, customerID, addr)
+			}
+		} else {
+			g := geocoders[companyID]
+			if g == nil {
+				g = NewGeocoder(db, companyID)
+				geocoders[companyID] = g
+			}
+			var res services.GeocodeResult
+			if res, err = g.Geocode(jobCtx, q); err == nil {
+				_, err = db.ExecContext(ctx, `
+					UPDATE rca_customers SET lat = $2, lng = $3, geocode_precision = $4, geocode_source = $5,
+						geocoded_at = NOW()
+					WHERE id = $1 AND lat IS NULL
+				`, customerID, res.Lat, res.Lng, res.Precision, res.Source)
+			}
+		}
+		cancel()
+
+		switch {
+		case err == nil:
+			finishGeocodeJob(db, jobID, "done", "")
+		case errors.Is(err, services.ErrGeocodeNotFound):
+			log.Printf("[Geocode] %s not found: customer %d", kind, customerID)
+			finishGeocodeJob(db, jobID, "not_found", "")
+		case ctx.Err() != nil:
+			// Shutting down: give the job back without spending the attempt
+			db.Exec(`UPDATE rca_geocode_jobs SET status = 'pending', attempts = attempts - 1 WHERE id = $1`, jobID)
+			return n, ctx.Err()
+		case attempts >= maxGeocodeAttempts:
+			finishGeocodeJob(db, jobID, "failed", err.Error())
+		default:
+			backoff := time.Duration(attempts*attempts) * time.Minute
+			db.Exec(`
+				UPDATE rca_geocode_jobs SET status = 'pending', last_error = $2,
+					run_after = NOW() + make_interval(secs => $3), updated_at = NOW()
+				WHERE id = $1
+			`, jobID, err.Error(), backoff.Seconds())
+		}
+	}
+	return limit, nil
+}
+
+// fillCustomerAddress sets the address fields of a customer that are still
+// empty. The number is only taken together with the street.
+func fillCustomerAddress(ctx context.Context, db *sql.DB, customerID int, addr services.GeocodeQuery) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE rca_customers SET
+			address_number = CASE WHEN COALESCE(address,'') = '' AND $2 <> '' THEN $3 ELSE address_number END,
+			address = CASE WHEN COALESCE(address,'') = '' AND $2 <> '' THEN $2 ELSE address END,
+			neighborhood = CASE WHEN COALESCE(neighborhood,'') = '' AND $4 <> '' THEN $4 ELSE neighborhood END,
+			city = CASE WHEN COALESCE(city,'') = '' AND $5 <> '' THEN $5 ELSE city END
+		WHERE id = $1
+	`, customerID, addr.Street, addr.Number, addr.Neighborhood, addr.City)
+	return err
+}
+
+func finishGeocodeJob(db *sql.DB, jobID int, status, errMsg string) {
+	if _, err := db.Exec(`
+		UPDATE rca_geocode_jobs SET status = $2, last_error = NULLIF($3, ''), updated_at = NOW()
+		WHERE id = $1
+	`, jobID, status, errMsg); err != nil {
+		log.Printf("[Geocode] job %d: %v", jobID, err)
+	}
+}
+
+type GeocodeProgress struct {
+	Pending  int `json:"pending"`
+	Running  int `json:"running"`
+	Done     int `json:"done"`
+	NotFound int `json:"not_found"`
+	Failed   int `json:"failed"`
+	// Active customers of the route by geocode precision ("" = no
+	// coordinates, "unknown" = coordinates of unknown origin)
+	ByPrecision map[string]int `json:"by_precision"`
+}
+
+// routeGeocodeProgress counts the latest forward job of each customer of
+// the route.
+func routeGeocodeProgress(db *sql.DB, companyID, routeID string) (GeocodeProgress, error) {
+	p := GeocodeProgress{ByPrecision: map[string]int{}}
+	rows, err := db.Query(`
+		SELECT j.status, COUNT(*) FROM (
+			SELECT DISTINCT ON (j.customer_id) j.status
+			FROM rca_geocode_jobs j
+			JOIN rca_customers c ON c.id = j.customer_id
+			WHERE c.route_id = $1 AND c.company_id = $2 AND j.kind = 'forward'
+			ORDER BY j.customer_id, j.id DESC
+		) j GROUP BY j.status
+	`, routeID, companyID)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return p, err
+		}
+		switch status {
+		case "pending":
+			p.Pending = n
+		case "running":
+			p.Running = n
+		case "done":
+			p.Done = n
+		case "not_found":
+			p.NotFound = n
+		case "failed":
+			p.Failed = n
+		}
+	}
+
+	prows, err := db.Query(`
+		SELECT CASE WHEN lat IS NULL THEN '' ELSE COALESCE(geocode_precision, 'unknown') END, COUNT(*)
+		FROM rca_customers
+		WHERE route_id = $1 AND company_id = $2 AND is_active = TRUE
+		GROUP BY 1
+	`, routeID, companyID)
+	if err != nil {
+		return p, err
+	}
+	defer prows.Close()
+	for prows.Next() {
+		var precision string
+		var n int
+		if err := prows.Scan(&precision, &n); err != nil {
+			return p, err
+		}
+		p.ByPrecision[precision] = n
+	}
+	return p, prows.Err()
+}
+
+// GeocodeRouteCustomersHandler handles /api/rca/routes/:id/customers/geocode
+//
+//	POST queues the customers of the route without coordinates
+//	GET  progress of the route's geocoding
+func GeocodeRouteCustomersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		routeID := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rca/routes/"), "/")[0]
+		var exists bool
+		db.QueryRow(`SELECT EXISTS(SELECT 1 FROM rca_routes WHERE id=$1 AND company_id=$2)`, routeID, companyID).Scan(&exists)
+		if !exists {
+			http.Error(w, "Rota não encontrada", http.StatusNotFound)
+			return
+		}
+
+		resp := map[string]interface{}{}
+		switch r.Method {
+		case http.MethodPost:
+			queued, err := enqueueGeocodeJobs(db, companyID, routeID)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp["queued"] = queued
+			resp["message"] = "Geocodificação iniciada em background."
+		case http.MethodGet:
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		progress, err := routeGeocodeProgress(db, companyID, routeID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp["progress"] = progress
+		// Kept for older clients: active customers without coordinates
+		resp["pending"] = progress.ByPrecision[""]
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
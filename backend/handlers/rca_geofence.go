@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"aprovapedido/services"
+)
+
+// -----------------------------------------------------------------------
+// Geofence
+// -----------------------------------------------------------------------
+
+// Geofence outcomes recorded on check-in and check-out.
+const (
+	GeofenceInside             = "inside"
+	GeofenceOutside            = "outside"
+	GeofenceNoGPS              = "no_gps"
+	GeofenceNoCustomerLocation = "no_customer_location"
+)
+
+// Reasons a visit is flagged as suspicious. The outside_radius and no_gps
+// reasons refer to the check-in; the checkout_ ones to the check-out.
+const (
+	SuspicionOutsideRadius         = "outside_radius"
+	SuspicionNoGPS                 = "no_gps"
+	SuspicionCheckoutOutsideRadius = "checkout_outside_radius"
+	SuspicionCheckoutNoGPS         = "checkout_no_gps"
+	SuspicionShortVisit            = "short_visit"
+	SuspicionSamePoint             = "same_point"
+)
+
+// Check-ins of one representative on the same day within samePointMeters
+// of each other, at samePointMinVisits or more different customers, are
+// flagged: a rep rarely visits several customers from one spot.
+const (
+	samePointMeters    = 20.0
+	samePointMinVisits = 3
+)
+
+type geofenceSettings struct {
+	RadiusM         float64
+	Block           bool
+	MinVisitMinutes int
+}
+
+func loadGeofenceSettings(db *sql.DB, companyID string) geofenceSettings {
+	g := geofenceSettings{RadiusM: 200, MinVisitMinutes: 5}
+	var radius int
+	if err := db.QueryRow(`
+		SELECT COALESCE(rca_geofence_radius_m, 200), COALESCE(rca_geofence_block, FALSE),
+		       COALESCE(rca_min_visit_minutes, 5)
+		FROM settings WHERE company_id = $1
+	`, companyID).Scan(&radius, &g.Block, &g.MinVisitMinutes); err == nil {
+		g.RadiusM = float64(radius)
+	}
+	return g
+}
+
+// checkGeofence compares a reported position with the customer's
+// coordinates. distance is nil when either point is missing.
+func checkGeofence(lat, lng *float64, custLat, custLng sql.NullFloat64, radiusM float64) (status string, distance *float64) {
+	if lat == nil || lng == nil || (*lat == 0 && *lng == 0) {
+		return GeofenceNoGPS, nil
+	}
+	if !custLat.Valid || !custLng.Valid {
+		return GeofenceNoCustomerLocation, nil
+	}
+	d := services.HaversineKm(
+		services.RoutePoint{Lat: *lat, Lng: *lng},
+		services.RoutePoint{Lat: custLat.Float64, Lng: custLng.Float64},
+	) * 1000
+	d = math.Round(d*10) / 10
+	if d > radiusM {
+		return GeofenceOutside, &d
+	}
+	return GeofenceInside, &d
+}
+
+// visitGeofence holds the geofence columns of rca_visits as scanned.
+type visitGeofence struct {
+	CheckinDistance  sql.NullFloat64
+	CheckinStatus    string
+	CheckoutDistance sql.NullFloat64
+	CheckoutStatus   string
+	Suspicious       bool
+	Reasons          string
+}
+
+// visitGeofenceColumns must be selected in this order for scan targets.
+const visitGeofenceColumns = `v.checkin_distance_m, COALESCE(v.checkin_geofence,''),
+	v.checkout_distance_m, COALESCE(v.checkout_geofence,''),
+	COALESCE(v.suspicious, FALSE), COALESCE(v.suspicion_reasons,'')`
+
+func (g *visitGeofence) targets() []interface{} {
+	return []interface{}{&g.CheckinDistance, &g.CheckinStatus, &g.CheckoutDistance, &g.CheckoutStatus,
+		&g.Suspicious, &g.Reasons}
+}
+
+func (g visitGeofence) apply(v *RCAVisit) {
+	if g.CheckinDistance.Valid {
+		v.CheckinDistanceM = &g.CheckinDistance.Float64
+	}
+	if g.CheckoutDistance.Valid {
+		v.CheckoutDistanceM = &g.CheckoutDistance.Float64
+	}
+	v.CheckinGeofence = g.CheckinStatus
+	v.CheckoutGeofence = g.CheckoutStatus
+	v.Suspicious = g.Suspicious
+	v.SuspicionReasons = []string{}
+	if g.Reasons != "" {
+		v.SuspicionReasons = strings.Split(g.Reasons, ",")
+	}
+}
+
+// flagRepVisits recomputes the suspicion flags of a representative's
+// visits on the day of visitID. The whole day is recomputed because a new
+// check-in can make earlier ones from the same point suspicious.
+func flagRepVisits(db *sql.DB, repID, visitID int, minVisitMinutes int) error {
+	rows, err := db.Query(`
+		SELECT id, customer_id, checkin_lat, checkin_lng, COALESCE(checkin_geofence,''),
+		       COALESCE(checkout_geofence,''), status, duration_minutes
+		FROM rca_visits
+		WHERE representative_id = $1
+		  AND visit_date = (SELECT visit_date FROM rca_visits WHERE id = $2)
+		  AND checkin_at IS NOT NULL
+	`, repID, visitID)
+	if err != nil {
+		return err
+	}
+	type dayVisit struct {
+		id, customerID int
+		lat, lng       sql.NullFloat64
+		geofence       string
+		checkout       string
+		status         string
+		duration       sql.NullInt64
+	}
+	var visits []dayVisit
+	for rows.Next() {
+		var v dayVisit
+		if err := rows.Scan(&v.id, &v.customerID, &v.lat, &v.lng, &v.geofence, &v.checkout, &v.status, &v.duration); err == nil {
+			visits = append(visits, v)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range visits {
+		var reasons []string
+		switch v.geofence {
+		case GeofenceOutside:
+			reasons = append(reasons, SuspicionOutsideRadius)
+		case GeofenceNoGPS:
+			reasons = append(reasons, SuspicionNoGPS)
+		}
+		switch v.checkout {
+		case GeofenceOutside:
+			reasons = append(reasons, SuspicionCheckoutOutsideRadius)
+		case GeofenceNoGPS:
+			reasons = append(reasons, SuspicionCheckoutNoGPS)
+		}
+		if v.status == "concluida" && v.duration.Valid && int(v.duration.Int64) < minVisitMinutes {
+			reasons = append(reasons, SuspicionShortVisit)
+		}
+		if v.lat.Valid && v.lng.Valid {
+			customers := map[int]bool{v.customerID: true}
+			p := services.RoutePoint{Lat: v.lat.Float64, Lng: v.lng.Float64}
+			for _, o := range visits {
+				if o.id == v.id || !o.lat.Valid || !o.lng.Valid {
+					continue
+				}
+				if services.HaversineKm(p, services.RoutePoint{Lat: o.lat.Float64, Lng: o.lng.Float64})*1000 <= samePointMeters {
+					customers[o.customerID] = true
+				}
+			}
+			if len(customers) >= samePointMinVisits {
+				reasons = append(reasons, SuspicionSamePoint)
+			}
+		}
+		if _, err := db.Exec(`
+			UPDATE rca_visits SET suspicious = $2, suspicion_reasons = $3 WHERE id = $1
+		`, v.id, len(reasons) > 0, strings.Join(reasons, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SuspiciousVisit is a flagged visit as listed for the supervisor.
+type SuspiciousVisit struct {
+	RCAVisit
+	RepresentativeName string `json:"representative_name"`
+}
+
+// ListSuspiciousVisitsHandler handles GET /api/rca/visits/suspicious
+// ?date_from=&date_to=&rca_id=
+//
+// Dates are YYYY-MM-DD and default to today.
+func ListSuspiciousVisitsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		q := r.URL.Query()
+		dateFrom, dateTo := q.Get("date_from"), q.Get("date_to")
+		if dateFrom == "" {
+			dateFrom = rcaToday(r.Context(), db, companyID).Format("2006-01-02")
+		}
+		if dateTo == "" {
+			dateTo = dateFrom
+		}
+		if _, err := time.Parse("2006-01-02", dateFrom); err != nil {
+			http.Error(w, "Invalid date_from", http.StatusBadRequest)
+			return
+		}
+		if _, err := time.Parse("2006-01-02", dateTo); err != nil {
+			http.Error(w, "Invalid date_to", http.StatusBadRequest)
+			return
+		}
+
+		query := `
+			SELECT v.id, v.company_id, v.representative_id, v.customer_id,
+				COALESCE(c.company_name,''), COALESCE(c.city,''), COALESCE(c.neighborhood,''),
+				COALESCE(c.address,''), COALESCE(c.address_number,''), c.lat, c.lng,
+				v.visit_date::text, v.status,
+				v.checkin_at::text, v.checkin_lat, v.checkin_lng,
+				v.checkout_at::text, v.checkout_lat, v.checkout_lng,
+				v.duration_minutes, COALESCE(v.notes,''), v.created_at::text,
+				v.auto_closed, COALESCE(v.missed_reason,''), COALESCE(v.missed_notes,''),
+				` + visitGeofenceColumns + `,
+				` + visitOutcomeColumns + `,
+				COALESCE(u.full_name,'')
+			FROM rca_visits v
+			JOIN rca_customers c ON c.id = v.customer_id
+			JOIN rca_representatives r ON r.id = v.representative_id
+			LEFT JOIN users u ON u.id = r.user_id
+			WHERE v.company_id = $1 AND v.suspicious = TRUE
+			  AND v.visit_date BETWEEN $2 AND $3
+		`
+		args := []interface{}{companyID, dateFrom, dateTo}
+		if rcaID := q.Get("rca_id"); rcaID != "" {
+			id, err := strconv.Atoi(rcaID)
+			if err != nil {
+				http.Error(w, "Invalid rca_id", http.StatusBadRequest)
+				return
+			}
+			args = append(args, id)
+			query += ` AND v.representative_id = $4`
+		}
+		query += ` ORDER BY v.visit_date DESC, v.checkin_at ASC`
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		visits := []SuspiciousVisit{}
+		for rows.Next() {
+			var sv SuspiciousVisit
+			v := &sv.RCAVisit
+			var cat, cot sql.NullString
+			var clat, clng, colat, colng, custLat, custLng sql.NullFloat64
+			var dur sql.NullInt64
+			var geo visitGeofence
+			var out visitOutcome
+			targets := append([]interface{}{
+				&v.ID, &v.CompanyID, &v.RepresentativeID, &v.CustomerID,
+				&v.CustomerName, &v.CustomerCity, &v.CustomerNeighborhood,
+				&v.CustomerAddress, &v.CustomerAddressNumber, &custLat, &custLng,
+				&v.VisitDate, &v.Status,
+				&cat, &clat, &clng,
+				&cot, &colat, &colng,
+				&dur, &v.Notes, &v.CreatedAt,
+				&v.AutoClosed, &v.MissedReason, &v.MissedNotes,
+			}, append(geo.targets(), out.targets()...)...)
+			if err := rows.Scan(append(targets, &sv.RepresentativeName)...); err != nil {
+				continue
+			}
+			geo.apply(v)
+			out.apply(v)
+			if custLat.Valid {
+				v.CustomerLat = &custLat.Float64
+			}
+			if custLng.Valid {
+				v.CustomerLng = &custLng.Float64
+			}
+			if cat.Valid {
+				v.CheckinAt = &cat.String
+			}
+			if clat.Valid {
+				v.CheckinLat = &clat.Float64
+			}
+			if clng.Valid {
+				v.CheckinLng = &clng.Float64
+			}
+			if cot.Valid {
+				v.CheckoutAt = &cot.String
+			}
+			if colat.Valid {
+				v.CheckoutLat = &colat.Float64
+			}
+			if colng.Valid {
+				v.CheckoutLng = &colng.Float64
+			}
+			if dur.Valid {
+				d := int(dur.Int64)
+				v.DurationMinutes = &d
+			}
+			visits = append(visits, sv)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"date_from": dateFrom,
+			"date_to":   dateTo,
+			"total":     len(visits),
+			"visits":    visits,
+		})
+	}
+}
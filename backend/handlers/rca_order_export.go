@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- ERP order export ---
+
+type ERPOrderItem struct {
+	ProductCode string  `json:"product_code"`
+	Quantity    float64 `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	DiscountPct float64 `json:"discount_pct"`
+	Total       float64 `json:"total"`
+}
+
+type ERPOrder struct {
+	OrderNumber    string         `json:"order_number"`
+	Filial         string         `json:"filial"`
+	CustomerName   string         `json:"customer_name"`
+	CustomerCode   string         `json:"customer_code"`
+	Representative string         `json:"representative"`
+	Total          float64        `json:"total"`
+	Notes          string         `json:"notes"`
+	Items          []ERPOrderItem `json:"items"`
+	CreatedAt      string         `json:"created_at"`
+}
+
+type ERPOrderResponse struct {
+	Success bool   `json:"success"`
+	ERPRef  string `json:"erp_ref"`
+	Message string `json:"message"`
+}
+
+// OrderExporter sends an approved sales order to the ERP. Implementations
+// must treat OrderNumber as an idempotency key: an order exported again
+// after a timeout must not be duplicated.
+type OrderExporter interface {
+	ExportOrder(ctx context.Context, companyID string, order ERPOrder) (ERPOrderResponse, error)
+}
+
+// MockOrderExporter accepts every order after a short delay, failing 5% of
+// the calls like the mock Winthor client. The ERP reference derives from
+// the order number, so an order exported again gets the same one.
+type MockOrderExporter struct{}
+
+func (MockOrderExporter) ExportOrder(ctx context.Context, companyID string, order ERPOrder) (ERPOrderResponse, error) {
+	if err := sleepCtx(ctx, time.Duration(100+rand.Intn(300))*time.Millisecond); err != nil {
+		return ERPOrderResponse{}, err
+	}
+	if rand.Float64() < 0.05 {
+		return ERPOrderResponse{}, fmt.Errorf("mock ERP timeout: connection refused")
+	}
+	return ERPOrderResponse{
+		Success: true,
+		ERPRef:  "PED-" + order.OrderNumber,
+		Message: fmt.Sprintf("Pedido %s aceito pelo ERP (mock). %d itens.", order.OrderNumber, len(order.Items)),
+	}, nil
+}
+
+// HTTPOrderExporter posts orders to the Winthor API.
+type HTTPOrderExporter struct {
+	BaseURL        string
+	APIKey         string
+	Client         *http.Client
+	RequestTimeout time.Duration
+}
+
+func (e *HTTPOrderExporter) ExportOrder(ctx context.Context, companyID string, order ERPOrder) (ERPOrderResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.RequestTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(order)
+	if err != nil {
+		return ERPOrderResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.BaseURL+"/sales-orders", strings.NewReader(string(body)))
+	if err != nil {
+		return ERPOrderResponse{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Company-ID", companyID)
+	req.Header.Set("Idempotency-Key", order.OrderNumber)
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return ERPOrderResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ERPOrderResponse{}, readStatusError(resp)
+	}
+
+	var result ERPOrderResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ERPOrderResponse{}, err
+	}
+	if !result.Success {
+		return result, fmt.Errorf("ERP rejected order %s: %s", order.OrderNumber, result.Message)
+	}
+	return result, nil
+}
+
+// NewOrderExporter returns the exporter for the company's Winthor settings.
+func NewOrderExporter(db *sql.DB, companyID string) OrderExporter {
+	var s PickingSettings
+	db.QueryRow(`
+		SELECT COALESCE(use_mock_winthor,TRUE), COALESCE(winthor_api_url,''), COALESCE(winthor_api_key,'')
+		FROM settings WHERE company_id=$1
+	`, companyID).Scan(&s.UseMock, &s.APIURL, &s.APIKey)
+	if s.UseMock || s.APIURL == "" {
+		return MockOrderExporter{}
+	}
+	return &HTTPOrderExporter{
+		BaseURL:        strings.TrimRight(s.APIURL, "/"),
+		APIKey:         s.APIKey,
+		Client:         &http.Client{},
+		RequestTimeout: 15 * time.Second,
+	}
+}
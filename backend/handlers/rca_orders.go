@@ -0,0 +1,816 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------
+// Field sales orders
+// -----------------------------------------------------------------------
+
+// Order statuses. A submitted order with every discount within the rep's
+// limit is approved right away; otherwise it waits for a manager. Approved
+// orders are exported to the ERP, and failed exports can be retried. An
+// order is "exportando" while one caller holds it for the ERP call.
+const (
+	OrderDraft           = "rascunho"
+	OrderPendingApproval = "aguardando_aprovacao"
+	OrderApproved        = "aprovado"
+	OrderExporting       = "exportando"
+	OrderExported        = "exportado"
+	OrderExportError     = "erro_exportacao"
+	OrderRejected        = "rejeitado"
+	OrderCancelled       = "cancelado"
+)
+
+const orderExportTimeout = 30 * time.Second
+
+// orderExportStale is how long an "exportando" claim lasts. A claim left
+// by a crashed export can be taken again after it; the exporter is
+// idempotent on the order number, so the ERP still gets one order.
+const orderExportStale = 2 * orderExportTimeout
+
+var errOrderNotExportable = errors.New("order is not approved or is already being exported")
+
+// filialStockColumn maps a filial to its stock column in products.
+func filialStockColumn(filial string) (string, bool) {
+	switch filial {
+	case "01", "02", "03":
+		return "stock_filial_" + filial, true
+	}
+	return "", false
+}
+
+func orderNumber(id int) string {
+	return fmt.Sprintf("RCA-%06d", id)
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+type RCAProduct struct {
+	ID          int     `json:"id"`
+	Code        string  `json:"code"`
+	Description string  `json:"description"`
+	Unit        string  `json:"unit"`
+	Price       float64 `json:"price"`
+	Stock       float64 `json:"stock"`
+	Filial      string  `json:"filial"`
+}
+
+// RCAProductsHandler handles GET /api/rca/products?q=&filial=
+// Products for order entry, with the list price and the stock of the filial
+// (default: the rep's default filial, or 01).
+func RCAProductsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+
+		q := r.URL.Query()
+		filial := q.Get("filial")
+		if filial == "" {
+			filial = "01"
+			db.QueryRow(`
+				SELECT COALESCE(default_filial, '01') FROM rca_representatives
+				WHERE user_id = $1 AND company_id = $2
+			`, GetUserIDFromContext(r), companyID).Scan(&filial)
+		}
+		stockCol, ok := filialStockColumn(filial)
+		if !ok {
+			http.Error(w, "Invalid filial", http.StatusBadRequest)
+			return
+		}
+		search := "%" + strings.TrimSpace(q.Get("q")) + "%"
+
+		rows, err := db.Query(`
+			SELECT id, code, description, COALESCE(unit,'UN'),
+				COALESCE(NULLIF(sale_price,0), cost_price, 0), COALESCE(`+stockCol+`,0)
+			FROM products
+			WHERE company_id = $1 AND (code ILIKE $2 OR description ILIKE $2)
+			ORDER BY description ASC
+			LIMIT 50
+		`, companyID, search)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		products := []RCAProduct{}
+		for rows.Next() {
+			p := RCAProduct{Filial: filial}
+			if err := rows.Scan(&p.ID, &p.Code, &p.Description, &p.Unit, &p.Price, &p.Stock); err != nil {
+				continue
+			}
+			products = append(products, p)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": products, "filial": filial})
+	}
+}
+
+type RCAOrderItem struct {
+	ID             int     `json:"id"`
+	ProductID      int     `json:"product_id"`
+	ProductCode    string  `json:"product_code"`
+	Description    string  `json:"description"`
+	Unit           string  `json:"unit"`
+	Quantity       float64 `json:"quantity"`
+	ListPrice      float64 `json:"list_price"`
+	DiscountPct    float64 `json:"discount_pct"`
+	UnitPrice      float64 `json:"unit_price"`
+	Total          float64 `json:"total"`
+	StockAvailable float64 `json:"stock_available"`
+	// Quantity above the stock of the filial when the order was priced
+	StockShort bool `json:"stock_short"`
+}
+
+type RCAOrder struct {
+	ID                 int            `json:"id"`
+	Number             string         `json:"number"`
+	RepresentativeID   int            `json:"representative_id"`
+	RepresentativeName string         `json:"representative_name"`
+	VisitID            int            `json:"visit_id"`
+	CustomerID         int            `json:"customer_id"`
+	CustomerName       string         `json:"customer_name"`
+	Filial             string         `json:"filial"`
+	Status             string         `json:"status"`
+	Subtotal           float64        `json:"subtotal"`
+	DiscountTotal      float64        `json:"discount_total"`
+	Total              float64        `json:"total"`
+	Notes              string         `json:"notes"`
+	RejectionReason    string         `json:"rejection_reason"`
+	ERPRef             string         `json:"erp_ref"`
+	ExportError        string         `json:"export_error"`
+	ExportAttempts     int            `json:"export_attempts"`
+	SubmittedAt        *string        `json:"submitted_at"`
+	ApprovedAt         *string        `json:"approved_at"`
+	ExportedAt         *string        `json:"exported_at"`
+	CreatedAt          string         `json:"created_at"`
+	Items              []RCAOrderItem `json:"items,omitempty"`
+}
+
+type OrderItemRequest struct {
+	ProductID   int     `json:"product_id"`
+	Quantity    float64 `json:"quantity"`
+	DiscountPct float64 `json:"discount_pct"`
+}
+
+type CreateOrderRequest struct {
+	VisitID int                `json:"visit_id"`
+	Filial  string             `json:"filial"`
+	Notes   string             `json:"notes"`
+	Items   []OrderItemRequest `json:"items"`
+	// Submit right away instead of keeping a draft
+	Submit bool `json:"submit"`
+}
+
+// orderQueryer is satisfied by *sql.DB and *sql.Tx.
+type orderQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// priceOrderItems validates the requested items and prices them from
+// products at the filial's stock.
+func priceOrderItems(q orderQueryer, companyID, filial string, req []OrderItemRequest) ([]RCAOrderItem, error) {
+	if len(req) == 0 {
+		return nil, fmt.Errorf("at least one item is required")
+	}
+	stockCol, ok := filialStockColumn(filial)
+	if !ok {
+		return nil, fmt.Errorf("invalid filial %q", filial)
+	}
+	items := make([]RCAOrderItem, 0, len(req))
+	for i, it := range req {
+		if it.Quantity <= 0 {
+			return nil, fmt.Errorf("item %d: quantity must be greater than zero", i+1)
+		}
+		if it.DiscountPct < 0 || it.DiscountPct > 100 {
+			return nil, fmt.Errorf("item %d: discount_pct must be between 0 and 100", i+1)
+		}
+		item := RCAOrderItem{ProductID: it.ProductID, Quantity: it.Quantity, DiscountPct: round2(it.DiscountPct)}
+		err := q.QueryRow(`
+			SELECT code, description, COALESCE(unit,'UN'),
+				COALESCE(NULLIF(sale_price,0), cost_price, 0), COALESCE(`+stockCol+`,0)
+			FROM products WHERE id = $1 AND company_id = $2
+		`, it.ProductID, companyID).Scan(&item.ProductCode, &item.Description, &item.Unit,
+			&item.ListPrice, &item.StockAvailable)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("item %d: product %d not found", i+1, it.ProductID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if item.ListPrice <= 0 {
+			return nil, fmt.Errorf("item %d: product %s has no price", i+1, item.ProductCode)
+		}
+		item.UnitPrice = math.Round(item.ListPrice*(1-item.DiscountPct/100)*10000) / 10000
+		item.Total = round2(item.UnitPrice * item.Quantity)
+		item.StockShort = item.Quantity > item.StockAvailable
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// writeOrderItems replaces the items of a draft and updates its totals.
+func writeOrderItems(tx *sql.Tx, orderID int, items []RCAOrderItem) error {
+	if _, err := tx.Exec(`DELETE FROM rca_order_items WHERE order_id = $1`, orderID); err != nil {
+		return err
+	}
+	var subtotal, total float64
+	for _, it := range items {
+		if _, err := tx.Exec(`
+			INSERT INTO rca_order_items (order_id, product_id, product_code, description, unit,
+				quantity, list_price, discount_pct, unit_price, total, stock_available)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		`, orderID, it.ProductID, it.ProductCode, it.Description, it.Unit,
+			it.Quantity, it.ListPrice, it.DiscountPct, it.UnitPrice, it.Total, it.StockAvailable); err != nil {
+			return err
+		}
+		subtotal += it.ListPrice * it.Quantity
+		total += it.Total
+	}
+	_, err := tx.Exec(`
+		UPDATE rca_orders SET subtotal = $2, discount_total = $3, total = $4, updated_at = NOW()
+		WHERE id = $1
+	`, orderID, round2(subtotal), round2(subtotal-total), round2(total))
+	return err
+}
+
+// submitOrder moves a draft to approved, or to awaiting approval when an
+// item exceeds the rep's discount limit. Must run in the caller's tx.
+func submitOrder(tx *sql.Tx, orderID, repID int) (string, error) {
+	var maxAllowed, maxGiven float64
+	if err := tx.QueryRow(`
+		SELECT COALESCE(r.max_discount_pct, 0),
+			COALESCE((SELECT MAX(discount_pct) FROM rca_order_items WHERE order_id = $1), 0)
+		FROM rca_representatives r WHERE r.id = $2
+	`, orderID, repID).Scan(&maxAllowed, &maxGiven); err != nil {
+		return "", err
+	}
+	status := OrderApproved
+	if maxGiven > maxAllowed {
+		status = OrderPendingApproval
+	}
+	_, err := tx.Exec(`
+		UPDATE rca_orders SET status = $2, submitted_at = NOW(),
+			approved_at = CASE WHEN $2 = 'aprovado' THEN NOW() END, updated_at = NOW()
+		WHERE id = $1
+	`, orderID, status)
+	return status, err
+}
+
+// exportRCAOrder sends an approved (or failed) order to the ERP and records
+// the outcome. It returns the resulting status. The order is claimed as
+// "exportando" first, so concurrent exports and a cancel cannot interleave
+// with the ERP call; errOrderNotExportable means another caller holds it
+// or it is not exportable.
+func exportRCAOrder(db *sql.DB, companyID string, orderID int) (string, error) {
+	var order ERPOrder
+	var id int
+	var createdAt time.Time
+	err := db.QueryRow(`
+		UPDATE rca_orders o SET status = 'exportando', export_attempts = export_attempts + 1, updated_at = NOW()
+		FROM rca_customers c, rca_representatives r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE o.id = $1 AND o.company_id = $2
+		  AND (o.status IN ('aprovado', 'erro_exportacao')
+		       OR (o.status = 'exportando' AND o.updated_at < NOW() - make_interval(secs => $3)))
+		  AND c.id = o.customer_id AND r.id = o.representative_id
+		RETURNING o.id, o.filial, c.company_name, c.id::text, COALESCE(u.full_name,''),
+			o.total, COALESCE(o.notes,''), o.created_at
+	`, orderID, companyID, orderExportStale.Seconds()).Scan(&id, &order.Filial, &order.CustomerName, &order.CustomerCode,
+		&order.Representative, &order.Total, &order.Notes, &createdAt)
+	if err == sql.ErrNoRows {
+		return "", errOrderNotExportable
+	}
+	if err != nil {
+		return "", err
+	}
+	order.OrderNumber = orderNumber(id)
+	order.CreatedAt = createdAt.Format(time.RFC3339)
+
+	rows, err := db.Query(`
+		SELECT product_code, quantity, unit_price, discount_pct, total
+		FROM rca_order_items WHERE order_id = $1 ORDER BY id ASC
+	`, orderID)
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var it ERPOrderItem
+		if err := rows.Scan(&it.ProductCode, &it.Quantity, &it.UnitPrice, &it.DiscountPct, &it.Total); err != nil {
+			rows.Close()
+			return "", err
+		}
+		order.Items = append(order.Items, it)
+	}
+	rows.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), orderExportTimeout)
+	defer cancel()
+	resp, exportErr := NewOrderExporter(db, companyID).ExportOrder(ctx, companyID, order)
+	if exportErr != nil {
+		log.Printf("[RCA] export order %s: %v", order.OrderNumber, exportErr)
+		_, err = db.Exec(`
+			UPDATE rca_orders SET status = 'erro_exportacao', export_error = $2, updated_at = NOW()
+			WHERE id = $1 AND status = 'exportando'
+		`, orderID, exportErr.Error())
+		return OrderExportError, err
+	}
+	_, err = db.Exec(`
+		UPDATE rca_orders SET status = 'exportado', erp_ref = $2, export_error = NULL,
+			exported_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND status = 'exportando'
+	`, orderID, resp.ERPRef)
+	return OrderExported, err
+}
+
+const rcaOrderColumns = `o.id, o.representative_id, COALESCE(u.full_name,''), o.visit_id, o.customer_id,
+	COALESCE(c.company_name,''), o.filial, o.status, o.subtotal, o.discount_total, o.total,
+	COALESCE(o.notes,''), COALESCE(o.rejection_reason,''), COALESCE(o.erp_ref,''),
+	COALESCE(o.export_error,''), o.export_attempts, o.submitted_at::text, o.approved_at::text,
+	o.exported_at::text, o.created_at::text`
+
+const rcaOrderJoins = `
+	FROM rca_orders o
+	JOIN rca_customers c ON c.id = o.customer_id
+	JOIN rca_representatives r ON r.id = o.representative_id
+	LEFT JOIN users u ON u.id = r.user_id`
+
+type orderScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRCAOrder(s orderScanner) (RCAOrder, error) {
+	var o RCAOrder
+	var submitted, approved, exported sql.NullString
+	err := s.Scan(&o.ID, &o.RepresentativeID, &o.RepresentativeName, &o.VisitID, &o.CustomerID,
+		&o.CustomerName, &o.Filial, &o.Status, &o.Subtotal, &o.DiscountTotal, &o.Total,
+		&o.Notes, &o.RejectionReason, &o.ERPRef,
+		&o.ExportError, &o.ExportAttempts, &submitted, &approved,
+		&exported, &o.CreatedAt)
+	if err != nil {
+		return o, err
+	}
+	o.Number = orderNumber(o.ID)
+	if submitted.Valid {
+		o.SubmittedAt = &submitted.String
+	}
+	if approved.Valid {
+		o.ApprovedAt = &approved.String
+	}
+	if exported.Valid {
+		o.ExportedAt = &exported.String
+	}
+	return o, nil
+}
+
+func loadRCAOrder(db *sql.DB, companyID string, orderID int) (RCAOrder, error) {
+	o, err := scanRCAOrder(db.QueryRow(`SELECT `+rcaOrderColumns+rcaOrderJoins+`
+		WHERE o.id = $1 AND o.company_id = $2`, orderID, companyID))
+	if err != nil {
+		return o, err
+	}
+	rows, err := db.Query(`
+		SELECT id, product_id, product_code, description, COALESCE(unit,'UN'), quantity,
+			list_price, discount_pct, unit_price, total, stock_available
+		FROM rca_order_items WHERE order_id = $1 ORDER BY id ASC
+	`, orderID)
+	if err != nil {
+		return o, err
+	}
+	defer rows.Close()
+	o.Items = []RCAOrderItem{}
+	for rows.Next() {
+		var it RCAOrderItem
+		if err := rows.Scan(&it.ID, &it.ProductID, &it.ProductCode, &it.Description, &it.Unit, &it.Quantity,
+			&it.ListPrice, &it.DiscountPct, &it.UnitPrice, &it.Total, &it.StockAvailable); err != nil {
+			return o, err
+		}
+		it.StockShort = it.Quantity > it.StockAvailable
+		o.Items = append(o.Items, it)
+	}
+	return o, rows.Err()
+}
+
+// orderActor returns the representative id of an RCA user, or 0 for a
+// manager.
+func orderActor(db *sql.DB, r *http.Request, companyID string) (int, error) {
+	if GetUserRoleFromContext(r) != "rca" {
+		return 0, nil
+	}
+	return getRepresentativeID(db, GetUserIDFromContext(r), companyID)
+}
+
+// RCAOrdersHandler handles /api/rca/orders
+//
+//	GET  ?status=&rca_id=&date_from=&date_to= — reps only see their own orders
+//	POST {visit_id, filial, notes, items: [{product_id, quantity, discount_pct}], submit}
+func RCAOrdersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		repID, err := orderActor(db, r, companyID)
+		if err != nil {
+			http.Error(w, "Representative profile not found", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			where := ` WHERE o.company_id = $1`
+			args := []interface{}{companyID}
+			add := func(cond string, v interface{}) {
+				args = append(args, v)
+				where += fmt.Sprintf(cond, len(args))
+			}
+			if repID > 0 {
+				add(` AND o.representative_id = $%d`, repID)
+			} else if id := q.Get("rca_id"); id != "" {
+				n, err := strconv.Atoi(id)
+				if err != nil {
+					http.Error(w, "Invalid rca_id", http.StatusBadRequest)
+					return
+				}
+				add(` AND o.representative_id = $%d`, n)
+			}
+			if status := q.Get("status"); status != "" {
+				add(` AND o.status = $%d`, status)
+			}
+			for _, p := range []struct{ param, cond string }{
+				{"date_from", ` AND o.created_at::date >= $%d`},
+				{"date_to", ` AND o.created_at::date <= $%d`},
+			} {
+				if d := q.Get(p.param); d != "" {
+					if _, err := time.Parse("2006-01-02", d); err != nil {
+						http.Error(w, "Invalid "+p.param, http.StatusBadRequest)
+						return
+					}
+					add(p.cond, d)
+				}
+			}
+
+			rows, err := db.Query(`SELECT `+rcaOrderColumns+rcaOrderJoins+where+`
+				ORDER BY o.created_at DESC LIMIT 200`, args...)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			orders := []RCAOrder{}
+			for rows.Next() {
+				o, err := scanRCAOrder(rows)
+				if err != nil {
+					continue
+				}
+				orders = append(orders, o)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": orders, "total": len(orders)})
+
+		case http.MethodPost:
+			if repID == 0 {
+				http.Error(w, "Only representatives take orders", http.StatusForbidden)
+				return
+			}
+			var req CreateOrderRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+
+			var customerID int
+			var defaultFilial string
+			err := db.QueryRow(`
+				SELECT v.customer_id, COALESCE(r.default_filial, '01')
+				FROM rca_visits v JOIN rca_representatives r ON r.id = v.representative_id
+				WHERE v.id = $1 AND v.representative_id = $2 AND v.company_id = $3
+				  AND v.status IN ('em_visita', 'concluida')
+			`, req.VisitID, repID, companyID).Scan(&customerID, &defaultFilial)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Visit not found or not started", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			if req.Filial == "" {
+				req.Filial = defaultFilial
+			}
+
+			items, err := priceOrderItems(db, companyID, req.Filial, req.Items)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+
+			var orderID int
+			if err := tx.QueryRow(`
+				INSERT INTO rca_orders (company_id, representative_id, visit_id, customer_id, filial, notes)
+				VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+			`, companyID, repID, req.VisitID, customerID, req.Filial, strings.TrimSpace(req.Notes)).Scan(&orderID); err != nil {
+				http.Error(w, "Error creating order: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := writeOrderItems(tx, orderID, items); err != nil {
+				http.Error(w, "Error creating order: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			status := OrderDraft
+			if req.Submit {
+				if status, err = submitOrder(tx, orderID, repID); err != nil {
+					http.Error(w, "Error submitting order: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			if status == OrderApproved {
+				if status, err = exportRCAOrder(db, companyID, orderID); err != nil {
+					log.Printf("[RCA] order %d: %v", orderID, err)
+				}
+			}
+
+			order, err := loadRCAOrder(db, companyID, orderID)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(order)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// RCAOrderHandler handles /api/rca/orders/:id[/action]
+//
+//	GET            order with items
+//	PUT            {notes, items} replaces the items of a draft (rep)
+//	POST submit    rep sends the draft
+//	POST approve   manager approves an order over the discount limit
+//	POST reject    manager rejects it {reason}
+//	POST cancel    cancels an order never sent to the ERP; a failed export
+//	               may have reached it, so it can only be retried
+//	POST export    manager retries a failed export
+func RCAOrderHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		repID, err := orderActor(db, r, companyID)
+		if err != nil {
+			http.Error(w, "Representative profile not found", http.StatusNotFound)
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rca/orders/"), "/")
+		orderID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid order id", http.StatusBadRequest)
+			return
+		}
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+
+		order, err := loadRCAOrder(db, companyID, orderID)
+		if err == sql.ErrNoRows || (err == nil && repID > 0 && order.RepresentativeID != repID) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond := func() {
+			order, err := loadRCAOrder(db, companyID, orderID)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(order)
+		}
+		conflict := func() {
+			http.Error(w, fmt.Sprintf("Order is %s", order.Status), http.StatusConflict)
+		}
+		managerOnly := func() bool {
+			if repID > 0 {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return false
+			}
+			return true
+		}
+
+		switch {
+		case r.Method == http.MethodGet && action == "":
+			respond()
+
+		case r.Method == http.MethodPut && action == "":
+			if repID == 0 {
+				http.Error(w, "Only the representative edits the order", http.StatusForbidden)
+				return
+			}
+			if order.Status != OrderDraft {
+				conflict()
+				return
+			}
+			var req struct {
+				Notes string             `json:"notes"`
+				Items []OrderItemRequest `json:"items"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			items, err := priceOrderItems(db, companyID, order.Filial, req.Items)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			tx, err := db.Begin()
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+			res, err := tx.Exec(`UPDATE rca_orders SET notes = $2 WHERE id = $1 AND status = 'rascunho'`,
+				orderID, strings.TrimSpace(req.Notes))
+			if err != nil {
+				http.Error(w, "Error updating order: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				conflict()
+				return
+			}
+			err = writeOrderItems(tx, orderID, items)
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				http.Error(w, "Error updating order: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			respond()
+
+		case r.Method == http.MethodPost && action == "submit":
+			if repID == 0 {
+				http.Error(w, "Only the representative submits the order", http.StatusForbidden)
+				return
+			}
+			tx, err := db.Begin()
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+			var status string
+			if err := tx.QueryRow(`SELECT status FROM rca_orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&status); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			if status != OrderDraft {
+				conflict()
+				return
+			}
+			if status, err = submitOrder(tx, orderID, repID); err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				http.Error(w, "Error submitting order: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if status == OrderApproved {
+				if _, err := exportRCAOrder(db, companyID, orderID); err != nil {
+					log.Printf("[RCA] order %d: %v", orderID, err)
+				}
+			}
+			respond()
+
+		case r.Method == http.MethodPost && (action == "approve" || action == "reject"):
+			if !managerOnly() {
+				return
+			}
+			var req struct {
+				Reason string `json:"reason"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			var res sql.Result
+			if action == "approve" {
+				var approver *int
+				if uid, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+					approver = &uid
+				}
+				res, err = db.Exec(`
+					UPDATE rca_orders SET status = 'aprovado', approved_by = $3, approved_at = NOW(), updated_at = NOW()
+					WHERE id = $1 AND company_id = $2 AND status = 'aguardando_aprovacao'
+				`, orderID, companyID, approver)
+			} else {
+				if strings.TrimSpace(req.Reason) == "" {
+					http.Error(w, "reason is required", http.StatusBadRequest)
+					return
+				}
+				res, err = db.Exec(`
+					UPDATE rca_orders SET status = 'rejeitado', rejection_reason = $3, updated_at = NOW()
+					WHERE id = $1 AND company_id = $2 AND status = 'aguardando_aprovacao'
+				`, orderID, companyID, strings.TrimSpace(req.Reason))
+			}
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				conflict()
+				return
+			}
+			if action == "approve" {
+				if _, err := exportRCAOrder(db, companyID, orderID); err != nil {
+					log.Printf("[RCA] order %d: %v", orderID, err)
+				}
+			}
+			respond()
+
+		case r.Method == http.MethodPost && action == "cancel":
+			res, err := db.Exec(`
+				UPDATE rca_orders SET status = 'cancelado', updated_at = NOW()
+				WHERE id = $1 AND company_id = $2
+				  AND status IN ('rascunho', 'aguardando_aprovacao')
+			`, orderID, companyID)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				conflict()
+				return
+			}
+			respond()
+
+		case r.Method == http.MethodPost && action == "export":
+			if !managerOnly() {
+				return
+			}
+			if order.Status != OrderApproved && order.Status != OrderExportError && order.Status != OrderExporting {
+				conflict()
+				return
+			}
+			if _, err := exportRCAOrder(db, companyID, orderID); err == errOrderNotExportable {
+				conflict()
+				return
+			} else if err != nil {
+				http.Error(w, "Error exporting order: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			respond()
+
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}
+}
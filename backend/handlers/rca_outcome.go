@@ -0,0 +1,813 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------
+// Visit outcomes and surveys
+// -----------------------------------------------------------------------
+
+// Outcomes of a concluded visit.
+const (
+	OutcomeSale          = "sale"
+	OutcomeNoSale        = "no_sale"
+	OutcomeCollection    = "collection"
+	OutcomeMerchandising = "merchandising"
+)
+
+var visitOutcomes = []string{OutcomeSale, OutcomeNoSale, OutcomeCollection, OutcomeMerchandising}
+
+// Answer types of a survey question.
+const (
+	AnswerText   = "text"
+	AnswerNumber = "number"
+	AnswerYesNo  = "yes_no"
+	AnswerChoice = "choice"
+)
+
+type NoSaleReason struct {
+	Code     string `json:"code"`
+	Label    string `json:"label"`
+	IsActive bool   `json:"is_active"`
+}
+
+// defaultNoSaleReasons apply while the company has configured none.
+var defaultNoSaleReasons = []NoSaleReason{
+	{"estoque_alto", "Cliente com estoque alto", true},
+	{"preco", "Preco acima da concorrencia", true},
+	{"sem_credito", "Cliente sem limite de credito", true},
+	{"comprador_ausente", "Comprador ausente", true},
+	{"concorrencia", "Comprou da concorrencia", true},
+	{"outro", "Outro", true},
+}
+
+// loadNoSaleReasons returns the company's reasons, or the defaults when it
+// has none. custom is false for the defaults.
+func loadNoSaleReasons(db *sql.DB, companyID string, activeOnly bool) (reasons []NoSaleReason, custom bool, err error) {
+	rows, err := db.Query(`
+		SELECT code, label, is_active FROM rca_no_sale_reasons
+		WHERE company_id = $1
+		ORDER BY label ASC
+	`, companyID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r NoSaleReason
+		if err := rows.Scan(&r.Code, &r.Label, &r.IsActive); err != nil {
+			return nil, false, err
+		}
+		custom = true
+		if r.IsActive || !activeOnly {
+			reasons = append(reasons, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if !custom {
+		return defaultNoSaleReasons, false, nil
+	}
+	if reasons == nil {
+		reasons = []NoSaleReason{}
+	}
+	return reasons, true, nil
+}
+
+type RCASurveyQuestion struct {
+	ID         int      `json:"id"`
+	SurveyID   int      `json:"survey_id"`
+	Position   int      `json:"position"`
+	Question   string   `json:"question"`
+	AnswerType string   `json:"answer_type"`
+	Options    []string `json:"options"`
+	Required   bool     `json:"required"`
+}
+
+type RCASurvey struct {
+	ID        int                 `json:"id"`
+	Name      string              `json:"name"`
+	IsActive  bool                `json:"is_active"`
+	CreatedAt string              `json:"created_at"`
+	Questions []RCASurveyQuestion `json:"questions"`
+}
+
+func loadSurveys(db *sql.DB, companyID string, activeOnly bool) ([]RCASurvey, error) {
+	rows, err := db.Query(`
+		SELECT s.id, s.name, s.is_active, s.created_at::text,
+			q.id, q.position, q.question, q.answer_type, COALESCE(q.options,''), q.required
+		FROM rca_surveys s
+		LEFT JOIN rca_survey_questions q ON q.survey_id = s.id
+		WHERE s.company_id = $1 AND (s.is_active = TRUE OR NOT $2)
+		ORDER BY s.id ASC, q.position ASC, q.id ASC
+	`, companyID, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	surveys := []RCASurvey{}
+	for rows.Next() {
+		var s RCASurvey
+		var qID, qPos sql.NullInt64
+		var question, answerType, options sql.NullString
+		var required sql.NullBool
+		if err := rows.Scan(&s.ID, &s.Name, &s.IsActive, &s.CreatedAt,
+			&qID, &qPos, &question, &answerType, &options, &required); err != nil {
+			return nil, err
+		}
+		if n := len(surveys); n == 0 || surveys[n-1].ID != s.ID {
+			s.Questions = []RCASurveyQuestion{}
+			surveys = append(surveys, s)
+		}
+		if !qID.Valid {
+			continue
+		}
+		q := RCASurveyQuestion{
+			ID: int(qID.Int64), SurveyID: s.ID, Position: int(qPos.Int64),
+			Question: question.String, AnswerType: answerType.String, Required: required.Bool,
+			Options: []string{},
+		}
+		if options.String != "" {
+			json.Unmarshal([]byte(options.String), &q.Options)
+		}
+		cur := &surveys[len(surveys)-1]
+		cur.Questions = append(cur.Questions, q)
+	}
+	return surveys, rows.Err()
+}
+
+type SurveyAnswer struct {
+	QuestionID int    `json:"question_id"`
+	Answer     string `json:"answer"`
+}
+
+// normalizeAnswer validates an answer against its question. yes_no answers
+// are stored as "yes" or "no".
+func normalizeAnswer(q RCASurveyQuestion, answer string) (string, error) {
+	switch q.AnswerType {
+	case AnswerNumber:
+		if _, err := strconv.ParseFloat(strings.Replace(answer, ",", ".", 1), 64); err != nil {
+			return "", fmt.Errorf("question %d expects a number", q.ID)
+		}
+		return strings.Replace(answer, ",", ".", 1), nil
+	case AnswerYesNo:
+		switch strings.ToLower(answer) {
+		case "yes", "sim", "true", "s":
+			return "yes", nil
+		case "no", "nao", "não", "false", "n":
+			return "no", nil
+		}
+		return "", fmt.Errorf("question %d expects yes or no", q.ID)
+	case AnswerChoice:
+		for _, o := range q.Options {
+			if o == answer {
+				return answer, nil
+			}
+		}
+		return "", fmt.Errorf("question %d: %q is not one of the options", q.ID, answer)
+	}
+	return answer, nil
+}
+
+// checkoutOutcome is what a check-out records besides position and notes.
+type checkoutOutcome struct {
+	Outcome      interface{}
+	OrderValue   interface{}
+	NoSaleReason interface{}
+	Answers      []SurveyAnswer
+}
+
+// validateCheckoutOutcome checks the outcome and survey answers of a
+// check-out. Check-outs without an outcome (older app versions) are
+// accepted as they were; with one, required questions of the active
+// surveys must be answered.
+func validateCheckoutOutcome(db *sql.DB, companyID string, req CheckoutRequest) (checkoutOutcome, error) {
+	var out checkoutOutcome
+	if req.Outcome == "" && len(req.Answers) == 0 {
+		return out, nil
+	}
+
+	if req.Outcome != "" {
+		valid := false
+		for _, o := range visitOutcomes {
+			valid = valid || o == req.Outcome
+		}
+		if !valid {
+			return out, fmt.Errorf("outcome must be one of: %s", strings.Join(visitOutcomes, ", "))
+		}
+		out.Outcome = req.Outcome
+	}
+	switch req.Outcome {
+	case OutcomeSale:
+		if req.OrderValue == nil || *req.OrderValue <= 0 {
+			return out, fmt.Errorf("order_value is required for a sale")
+		}
+		out.OrderValue = *req.OrderValue
+	case OutcomeNoSale:
+		reasons, _, err := loadNoSaleReasons(db, companyID, true)
+		if err != nil {
+			return out, err
+		}
+		for _, r := range reasons {
+			if r.Code == req.NoSaleReason {
+				out.NoSaleReason = r.Code
+			}
+		}
+		if out.NoSaleReason == nil {
+			return out, fmt.Errorf("no_sale_reason must be one of the configured reason codes")
+		}
+	}
+
+	surveys, err := loadSurveys(db, companyID, true)
+	if err != nil {
+		return out, err
+	}
+	questions := map[int]RCASurveyQuestion{}
+	for _, s := range surveys {
+		for _, q := range s.Questions {
+			questions[q.ID] = q
+		}
+	}
+	answered := map[int]bool{}
+	for _, a := range req.Answers {
+		q, ok := questions[a.QuestionID]
+		if !ok {
+			return out, fmt.Errorf("question %d is not part of an active survey", a.QuestionID)
+		}
+		answer := strings.TrimSpace(a.Answer)
+		if answer == "" {
+			continue
+		}
+		answer, err := normalizeAnswer(q, answer)
+		if err != nil {
+			return out, err
+		}
+		answered[q.ID] = true
+		out.Answers = append(out.Answers, SurveyAnswer{QuestionID: q.ID, Answer: answer})
+	}
+	if req.Outcome != "" {
+		for id, q := range questions {
+			if q.Required && !answered[id] {
+				return out, fmt.Errorf("question %d (%s) is required", id, q.Question)
+			}
+		}
+	}
+	return out, nil
+}
+
+func saveVisitAnswers(tx *sql.Tx, visitID int, answers []SurveyAnswer) error {
+	for _, a := range answers {
+		if _, err := tx.Exec(`
+			INSERT INTO rca_visit_answers (visit_id, question_id, answer)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (visit_id, question_id) DO UPDATE SET answer = EXCLUDED.answer
+		`, visitID, a.QuestionID, a.Answer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visitOutcome holds the outcome columns of rca_visits as scanned.
+type visitOutcome struct {
+	Outcome      string
+	OrderValue   sql.NullFloat64
+	NoSaleReason string
+}
+
+// visitOutcomeColumns must be selected in this order for scan targets.
+const visitOutcomeColumns = `COALESCE(v.outcome,''), v.order_value, COALESCE(v.no_sale_reason,'')`
+
+func (o *visitOutcome) targets() []interface{} {
+	return []interface{}{&o.Outcome, &o.OrderValue, &o.NoSaleReason}
+}
+
+func (o visitOutcome) apply(v *RCAVisit) {
+	v.Outcome = o.Outcome
+	if o.OrderValue.Valid {
+		v.OrderValue = &o.OrderValue.Float64
+	}
+	v.NoSaleReason = o.NoSaleReason
+}
+
+// RCACheckoutFormHandler handles GET /api/rca/checkout-form: the outcomes,
+// no-sale reasons and active surveys the app shows at check-out.
+func RCACheckoutFormHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+
+		reasons, _, err := loadNoSaleReasons(db, companyID, true)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		surveys, err := loadSurveys(db, companyID, true)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"outcomes":        visitOutcomes,
+			"no_sale_reasons": reasons,
+			"surveys":         surveys,
+		})
+	}
+}
+
+// RCANoSaleReasonsHandler handles /api/rca/no-sale-reasons
+//
+//	GET  reasons of the company (the defaults while none is configured)
+//	POST {code, label, is_active} creates or updates a reason
+func RCANoSaleReasonsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			reasons, custom, err := loadNoSaleReasons(db, companyID, false)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": reasons, "custom": custom})
+
+		case http.MethodPost:
+			var req NoSaleReason
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			req.Code = strings.ToLower(strings.TrimSpace(req.Code))
+			req.Label = strings.TrimSpace(req.Label)
+			if req.Code == "" || req.Label == "" || len(req.Code) > 40 {
+				http.Error(w, "code (up to 40 characters) and label are required", http.StatusBadRequest)
+				return
+			}
+
+			// The first custom reason replaces the defaults: copy them so the
+			// list the reps see does not shrink to a single entry
+			tx, err := db.Begin()
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+			var n int
+			tx.QueryRow(`SELECT COUNT(*) FROM rca_no_sale_reasons WHERE company_id = $1`, companyID).Scan(&n)
+			if n == 0 {
+				for _, d := range defaultNoSaleReasons {
+					if _, err := tx.Exec(`
+						INSERT INTO rca_no_sale_reasons (company_id, code, label, is_active)
+						VALUES ($1, $2, $3, TRUE) ON CONFLICT (company_id, code) DO NOTHING
+					`, companyID, d.Code, d.Label); err != nil {
+						http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO rca_no_sale_reasons (company_id, code, label, is_active)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT (company_id, code) DO UPDATE SET label = EXCLUDED.label, is_active = EXCLUDED.is_active
+			`, companyID, req.Code, req.Label, req.IsActive); err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"code": req.Code, "message": "Motivo salvo com sucesso"})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+type CreateSurveyRequest struct {
+	Name      string `json:"name"`
+	Questions []struct {
+		Question   string   `json:"question"`
+		AnswerType string   `json:"answer_type"`
+		Options    []string `json:"options"`
+		Required   bool     `json:"required"`
+	} `json:"questions"`
+}
+
+// RCASurveysHandler handles /api/rca/surveys
+//
+//	GET  all surveys of the company with their questions
+//	POST {name, questions: [{question, answer_type, options, required}]}
+func RCASurveysHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			surveys, err := loadSurveys(db, companyID, false)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": surveys, "total": len(surveys)})
+
+		case http.MethodPost:
+			var req CreateSurveyRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			req.Name = strings.TrimSpace(req.Name)
+			if req.Name == "" || len(req.Questions) == 0 {
+				http.Error(w, "name and at least one question are required", http.StatusBadRequest)
+				return
+			}
+			for i, q := range req.Questions {
+				if strings.TrimSpace(q.Question) == "" {
+					http.Error(w, fmt.Sprintf("question %d is empty", i+1), http.StatusBadRequest)
+					return
+				}
+				switch q.AnswerType {
+				case "":
+					req.Questions[i].AnswerType = AnswerText
+				case AnswerText, AnswerNumber, AnswerYesNo:
+				case AnswerChoice:
+					if len(q.Options) < 2 {
+						http.Error(w, fmt.Sprintf("question %d: choice needs at least two options", i+1), http.StatusBadRequest)
+						return
+					}
+				default:
+					http.Error(w, fmt.Sprintf("question %d: invalid answer_type %q", i+1, q.AnswerType), http.StatusBadRequest)
+					return
+				}
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+
+			var surveyID int
+			if err := tx.QueryRow(`
+				INSERT INTO rca_surveys (company_id, name) VALUES ($1, $2) RETURNING id
+			`, companyID, req.Name).Scan(&surveyID); err != nil {
+				http.Error(w, "Error creating survey: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for i, q := range req.Questions {
+				var options interface{}
+				if q.AnswerType == AnswerChoice {
+					b, _ := json.Marshal(q.Options)
+					options = string(b)
+				}
+				if _, err := tx.Exec(`
+					INSERT INTO rca_survey_questions (survey_id, position, question, answer_type, options, required)
+					VALUES ($1, $2, $3, $4, $5, $6)
+				`, surveyID, i+1, strings.TrimSpace(q.Question), q.AnswerType, options, q.Required); err != nil {
+					http.Error(w, "Error creating survey: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": surveyID, "message": "Questionario criado com sucesso"})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// UpdateRCASurveyHandler handles PUT /api/rca/surveys/:id {name, is_active}.
+// Fields left out are kept. Questions are fixed once created.
+func UpdateRCASurveyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		surveyID, err := strconv.Atoi(strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rca/surveys/"), "/")[0])
+		if err != nil {
+			http.Error(w, "Invalid survey id", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Name     string `json:"name"`
+			IsActive *bool  `json:"is_active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		res, err := db.Exec(`
+			UPDATE rca_surveys SET name = COALESCE(NULLIF($3, ''), name), is_active = COALESCE($4, is_active)
+			WHERE id = $1 AND company_id = $2
+		`, surveyID, companyID, strings.TrimSpace(req.Name), req.IsActive)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Survey not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Questionario atualizado"})
+	}
+}
+
+type SurveyAnswerRow struct {
+	VisitID            int    `json:"visit_id"`
+	VisitDate          string `json:"visit_date"`
+	RepresentativeName string `json:"representative_name"`
+	CustomerID         int    `json:"customer_id"`
+	CustomerName       string `json:"customer_name"`
+	QuestionID         int    `json:"question_id"`
+	Question           string `json:"question"`
+	Answer             string `json:"answer"`
+}
+
+// ListSurveyAnswersHandler handles GET /api/rca/surveys/:id/answers
+// ?date_from=&date_to= (default: last 30 days)
+func ListSurveyAnswersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		surveyID, err := strconv.Atoi(strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rca/surveys/"), "/")[0])
+		if err != nil {
+			http.Error(w, "Invalid survey id", http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		dateTo := q.Get("date_to")
+		if dateTo == "" {
+			dateTo = rcaToday(r.Context(), db, companyID).Format("2006-01-02")
+		}
+		to, err := time.Parse("2006-01-02", dateTo)
+		if err != nil {
+			http.Error(w, "Invalid date_to", http.StatusBadRequest)
+			return
+		}
+		dateFrom := q.Get("date_from")
+		if dateFrom == "" {
+			dateFrom = to.AddDate(0, 0, -30).Format("2006-01-02")
+		}
+		if _, err := time.Parse("2006-01-02", dateFrom); err != nil {
+			http.Error(w, "Invalid date_from", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT v.id, v.visit_date::text, COALESCE(u.full_name,''), v.customer_id,
+				COALESCE(c.company_name,''), q.id, q.question, a.answer
+			FROM rca_visit_answers a
+			JOIN rca_survey_questions q ON q.id = a.question_id
+			JOIN rca_surveys s ON s.id = q.survey_id
+			JOIN rca_visits v ON v.id = a.visit_id
+			JOIN rca_customers c ON c.id = v.customer_id
+			JOIN rca_representatives r ON r.id = v.representative_id
+			LEFT JOIN users u ON u.id = r.user_id
+			WHERE s.id = $1 AND s.company_id = $2
+			  AND v.visit_date BETWEEN $3 AND $4
+			ORDER BY v.visit_date DESC, v.id ASC, q.position ASC
+		`, surveyID, companyID, dateFrom, dateTo)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		answers := []SurveyAnswerRow{}
+		for rows.Next() {
+			var a SurveyAnswerRow
+			if err := rows.Scan(&a.VisitID, &a.VisitDate, &a.RepresentativeName, &a.CustomerID,
+				&a.CustomerName, &a.QuestionID, &a.Question, &a.Answer); err != nil {
+				continue
+			}
+			answers = append(answers, a)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"survey_id": surveyID,
+			"date_from": dateFrom,
+			"date_to":   dateTo,
+			"items":     answers,
+		})
+	}
+}
+
+type PositivacaoRow struct {
+	ID               int     `json:"id"`
+	Name             string  `json:"name"`
+	VisitedCustomers int     `json:"visited_customers"`
+	SaleCustomers    int     `json:"sale_customers"`
+	PositivacaoPct   float64 `json:"positivacao_pct"`
+	OrderTotal       float64 `json:"order_total"`
+}
+
+// RCAPositivacaoHandler handles GET /api/rca/positivacao
+// ?date_from=&date_to=&rca_id=
+//
+// Positivação is the share of customers visited in the period (concluded
+// visits) that had at least one visit with a sale, per representative and
+// per route. Dates default to the current month.
+func RCAPositivacaoHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		q := r.URL.Query()
+		today := rcaToday(r.Context(), db, companyID)
+		dateFrom, dateTo := q.Get("date_from"), q.Get("date_to")
+		if dateFrom == "" {
+			dateFrom = today.AddDate(0, 0, 1-today.Day()).Format("2006-01-02")
+		}
+		if dateTo == "" {
+			dateTo = today.Format("2006-01-02")
+		}
+		if _, err := time.Parse("2006-01-02", dateFrom); err != nil {
+			http.Error(w, "Invalid date_from", http.StatusBadRequest)
+			return
+		}
+		if _, err := time.Parse("2006-01-02", dateTo); err != nil {
+			http.Error(w, "Invalid date_to", http.StatusBadRequest)
+			return
+		}
+		repID := 0
+		if id := q.Get("rca_id"); id != "" {
+			var err error
+			if repID, err = strconv.Atoi(id); err != nil {
+				http.Error(w, "Invalid rca_id", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// groupID, groupName and join are fixed SQL from the calls below
+		load := func(groupID, groupName, join string) ([]PositivacaoRow, error) {
+			rows, err := db.Query(`
+				SELECT `+groupID+`, `+groupName+`,
+					COUNT(DISTINCT v.customer_id),
+					COUNT(DISTINCT v.customer_id) FILTER (WHERE v.outcome = 'sale'),
+					COALESCE(SUM(v.order_value) FILTER (WHERE v.outcome = 'sale'), 0)
+				FROM rca_visits v
+				JOIN rca_customers c ON c.id = v.customer_id
+				`+join+`
+				WHERE v.company_id = $1 AND v.status = 'concluida'
+				  AND v.visit_date BETWEEN $2 AND $3
+				  AND ($4 = 0 OR v.representative_id = $4)
+				GROUP BY 1, 2
+				ORDER BY 2 ASC
+			`, companyID, dateFrom, dateTo, repID)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+			items := []PositivacaoRow{}
+			for rows.Next() {
+				var p PositivacaoRow
+				if err := rows.Scan(&p.ID, &p.Name, &p.VisitedCustomers, &p.SaleCustomers, &p.OrderTotal); err != nil {
+					return nil, err
+				}
+				p.PositivacaoPct = positivacaoPct(p.SaleCustomers, p.VisitedCustomers)
+				items = append(items, p)
+			}
+			return items, rows.Err()
+		}
+
+		byRep, err := load("v.representative_id", "COALESCE(u.full_name,'')", `
+				JOIN rca_representatives r ON r.id = v.representative_id
+				LEFT JOIN users u ON u.id = r.user_id`)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		byRoute, err := load("c.route_id", "COALESCE(rt.name,'')", `
+				JOIN rca_routes rt ON rt.id = c.route_id`)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Totals count each customer once across representatives
+		var total PositivacaoRow
+		if err := db.QueryRow(`
+			SELECT COUNT(DISTINCT customer_id),
+				COUNT(DISTINCT customer_id) FILTER (WHERE outcome = 'sale'),
+				COALESCE(SUM(order_value) FILTER (WHERE outcome = 'sale'), 0)
+			FROM rca_visits
+			WHERE company_id = $1 AND status = 'concluida'
+			  AND visit_date BETWEEN $2 AND $3
+			  AND ($4 = 0 OR representative_id = $4)
+		`, companyID, dateFrom, dateTo, repID).Scan(&total.VisitedCustomers, &total.SaleCustomers, &total.OrderTotal); err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		total.PositivacaoPct = positivacaoPct(total.SaleCustomers, total.VisitedCustomers)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"date_from":         dateFrom,
+			"date_to":           dateTo,
+			"visited_customers": total.VisitedCustomers,
+			"sale_customers":    total.SaleCustomers,
+			"positivacao_pct":   total.PositivacaoPct,
+			"order_total":       total.OrderTotal,
+			"by_representative": byRep,
+			"by_route":          byRoute,
+		})
+	}
+}
+
+func positivacaoPct(sales, visited int) float64 {
+	if visited == 0 {
+		return 0
+	}
+	return float64(sales*1000/visited) / 10
+}
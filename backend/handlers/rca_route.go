@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"aprovapedido/services"
+)
+
+// -----------------------------------------------------------------------
+// Route optimization
+// -----------------------------------------------------------------------
+
+// customerWindow holds the optional visiting constraints of a customer as
+// scanned from rca_customers.
+type customerWindow struct {
+	Start        sql.NullString
+	End          sql.NullString
+	VisitMinutes sql.NullInt64
+}
+
+func (win customerWindow) apply(c *RCACustomer) {
+	if win.Start.Valid && win.End.Valid {
+		c.WindowStart, c.WindowEnd = &win.Start.String, &win.End.String
+	}
+	if win.VisitMinutes.Valid {
+		m := int(win.VisitMinutes.Int64)
+		c.VisitMinutes = &m
+	}
+}
+
+// parseVisitWindow validates an optional "HH:MM" window. Both bounds are
+// required together; empty values give NULLs.
+func parseVisitWindow(start, end string) (interface{}, interface{}, error) {
+	if start == "" && end == "" {
+		return nil, nil, nil
+	}
+	if start == "" || end == "" {
+		return nil, nil, fmt.Errorf("window_start and window_end must be given together")
+	}
+	s, err := services.ParseClockMinutes(start)
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := services.ParseClockMinutes(end)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e <= s {
+		return nil, nil, fmt.Errorf("window_end must be after window_start")
+	}
+	return start, end, nil
+}
+
+// validCoordinates accepts a missing point or one within WGS84 bounds.
+func validCoordinates(lat, lng *float64) bool {
+	if lat == nil || lng == nil {
+		return true
+	}
+	return *lat >= -90 && *lat <= 90 && *lng >= -180 && *lng <= 180
+}
+
+type OptimizedRouteStop struct {
+	RCACustomer
+	services.PlannedStop
+}
+
+// GetOptimizedRouteHandler handles GET /api/rca/my-route/optimized
+// ?lat=&lng=&route_id=&start=HH:MM
+//
+// It orders today's pending agenda of the representative's active routes
+// (or only route_id) for driving, starting from lat/lng (the current GPS
+// position), the configured base, or the most important customer when
+// neither is known. Customers without coordinates are listed apart.
+func GetOptimizedRouteHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		userID := GetUserIDFromContext(r)
+		if companyID == "" || userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+
+		var repID int
+		var baseLat, baseLng sql.NullFloat64
+		err := db.QueryRow(`
+			SELECT id, base_lat, base_lng FROM rca_representatives
+			WHERE user_id = $1 AND company_id = $2 AND is_active = TRUE
+		`, userID, companyID).Scan(&repID, &baseLat, &baseLng)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Representative profile not found. Contact your administrator.", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var start *services.RoutePoint
+		startSource := "none"
+		if q.Get("lat") != "" || q.Get("lng") != "" {
+			lat, err1 := strconv.ParseFloat(q.Get("lat"), 64)
+			lng, err2 := strconv.ParseFloat(q.Get("lng"), 64)
+			if err1 != nil || err2 != nil || !validCoordinates(&lat, &lng) {
+				http.Error(w, "Invalid lat/lng", http.StatusBadRequest)
+				return
+			}
+			start, startSource = &services.RoutePoint{Lat: lat, Lng: lng}, "gps"
+		} else if baseLat.Valid && baseLng.Valid {
+			start, startSource = &services.RoutePoint{Lat: baseLat.Float64, Lng: baseLng.Float64}, "base"
+		}
+
+		// Today's agenda and the default start follow the company clock,
+		// not the server's or the database's
+		now := time.Now().In(RCACompanyLocation(r.Context(), db, companyID))
+		today := now.Format("2006-01-02")
+
+		cfg := services.DefaultRouteConfig()
+		var visitMinutes int
+		if err := db.QueryRow(`
+			SELECT COALESCE(rca_avg_speed_kmh, 30), COALESCE(rca_visit_minutes, 20)
+			FROM settings WHERE company_id = $1
+		`, companyID).Scan(&cfg.SpeedKmh, &visitMinutes); err == nil {
+			cfg.ServiceMinutes = float64(visitMinutes)
+		}
+		if s := q.Get("start"); s != "" {
+			m, err := services.ParseClockMinutes(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cfg.StartMinute = m
+		} else {
+			cfg.StartMinute = now.Hour()*60 + now.Minute()
+		}
+
+		query := `
+			SELECT c.id, c.company_id, c.route_id, c.company_name, COALESCE(c.contact_name,''),
+				COALESCE(c.phone,''), COALESCE(c.city,''), COALESCE(c.neighborhood,''),
+				COALESCE(c.address,''), COALESCE(c.address_number,''),
+				c.lat, c.lng, c.priority, COALESCE(c.notes,''), c.is_active, c.created_at::text,
+				v.id, v.status,
+				to_char(c.window_start, 'HH24:MI'), to_char(c.window_end, 'HH24:MI'), c.visit_minutes
+			FROM rca_customers c
+			JOIN rca_routes rt ON rt.id = c.route_id
+			JOIN rca_visits v ON v.customer_id = c.id
+				AND v.representative_id = $1
+				AND v.visit_date = $3
+			WHERE rt.representative_id = $1 AND rt.company_id = $2 AND rt.is_active = TRUE
+			  AND c.is_active = TRUE
+			  AND v.status IN ('agendada', 'em_visita')
+		`
+		args := []interface{}{repID, companyID, today}
+		if routeID := q.Get("route_id"); routeID != "" {
+			id, err := strconv.Atoi(routeID)
+			if err != nil {
+				http.Error(w, "Invalid route_id", http.StatusBadRequest)
+				return
+			}
+			args = append(args, id)
+			query += ` AND rt.id = $4`
+		}
+		query += ` ORDER BY c.priority ASC, c.id ASC`
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var located []RCACustomer
+		var stops []services.RouteStop
+		unlocated := []RCACustomer{}
+		for rows.Next() {
+			var c RCACustomer
+			var lat, lng sql.NullFloat64
+			var todayVID sql.NullInt64
+			var todayVStatus sql.NullString
+			var win customerWindow
+			if err := rows.Scan(
+				&c.ID, &c.CompanyID, &c.RouteID, &c.CompanyName,
+				&c.ContactName, &c.Phone, &c.City, &c.Neighborhood,
+				&c.Address, &c.AddressNumber, &lat, &lng,
+				&c.Priority, &c.Notes, &c.IsActive, &c.CreatedAt,
+				&todayVID, &todayVStatus,
+				&win.Start, &win.End, &win.VisitMinutes,
+			); err != nil {
+				continue
+			}
+			win.apply(&c)
+			if todayVID.Valid {
+				id := int(todayVID.Int64)
+				c.TodayVisitID = &id
+			}
+			if todayVStatus.Valid {
+				c.TodayVisitStatus = &todayVStatus.String
+			}
+			if !lat.Valid || !lng.Valid {
+				unlocated = append(unlocated, c)
+				continue
+			}
+			c.Lat, c.Lng = &lat.Float64, &lng.Float64
+
+			stop := services.RouteStop{
+				Point:    services.RoutePoint{Lat: lat.Float64, Lng: lng.Float64},
+				Priority: c.Priority,
+			}
+			if c.WindowStart != nil {
+				stop.WindowStart, _ = services.ParseClockMinutes(*c.WindowStart)
+				stop.WindowEnd, _ = services.ParseClockMinutes(*c.WindowEnd)
+			}
+			if c.VisitMinutes != nil {
+				stop.ServiceMinutes = float64(*c.VisitMinutes)
+			}
+			located = append(located, c)
+			stops = append(stops, stop)
+		}
+
+		plan := services.OptimizeRoute(start, stops, cfg)
+		sequence := make([]OptimizedRouteStop, 0, len(plan.Stops))
+		for _, ps := range plan.Stops {
+			sequence = append(sequence, OptimizedRouteStop{RCACustomer: located[ps.Index], PlannedStop: ps})
+		}
+
+		var startJSON interface{}
+		if start != nil {
+			startJSON = start
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"representative_id": repID,
+			"start":             startJSON,
+			"start_source":      startSource,
+			"start_time":        fmt.Sprintf("%02d:%02d", cfg.StartMinute/60, cfg.StartMinute%60),
+			"end_time":          plan.EndTime,
+			"total_km":          plan.TotalKm,
+			"drive_minutes":     plan.DriveMinutes,
+			"total_minutes":     plan.TotalMinutes,
+			"late_stops":        plan.LateStops,
+			"stops":             sequence,
+			"unlocated":         unlocated,
+		})
+	}
+}
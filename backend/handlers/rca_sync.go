@@ -0,0 +1,824 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------
+// Offline sync
+// -----------------------------------------------------------------------
+//
+// The app queues what the rep does while offline and uploads the queue to
+// POST /api/rca/sync. Each event carries a UUID generated on the device and
+// the device time it happened; events are applied in the order sent, each
+// in its own transaction, and their result is stored under the UUID so an
+// upload repeated after a dropped connection returns the same results
+// instead of applying anything twice.
+
+// Event types accepted by the sync endpoint.
+const (
+	SyncEventCheckin  = "checkin"
+	SyncEventCheckout = "checkout"
+	SyncEventNote     = "note"
+	SyncEventOrder    = "order"
+)
+
+// Result of an event. Applied, conflict and rejected are final and stored;
+// failed (a server error) is not, so the app keeps the event and retries.
+const (
+	SyncApplied  = "applied"
+	SyncConflict = "conflict"
+	SyncRejected = "rejected"
+	SyncFailed   = "failed"
+)
+
+const (
+	maxSyncEvents = 200
+	// Device clocks ahead of the server by more than this are refused
+	syncMaxClockSkew = 10 * time.Minute
+	// Events older than this are refused: the day was closed long ago
+	syncMaxEventAge = 30 * 24 * time.Hour
+)
+
+type SyncEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	ClientTime time.Time `json:"client_time"`
+	// Visit of a checkout, note or order: its server id when known, or the
+	// id of the check-in event that opened it
+	VisitID        int    `json:"visit_id"`
+	CheckinEventID string `json:"checkin_event_id"`
+	// checkin: CheckinRequest, checkout: CheckoutRequest,
+	// note: {notes}, order: CreateOrderRequest
+	Payload json.RawMessage `json:"payload"`
+}
+
+type SyncRequest struct {
+	DeviceID string      `json:"device_id"`
+	Events   []SyncEvent `json:"events"`
+}
+
+type SyncResult struct {
+	EventID string `json:"event_id"`
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	VisitID *int   `json:"visit_id,omitempty"`
+	OrderID *int   `json:"order_id,omitempty"`
+	// Already processed in an earlier upload
+	Duplicate bool `json:"duplicate"`
+}
+
+// syncError is an expected outcome of an event that is not applied.
+type syncError struct {
+	status, code, message string
+	visitID               int
+}
+
+func (e *syncError) Error() string { return e.code + ": " + e.message }
+
+func syncConflict(code, format string, args ...interface{}) *syncError {
+	return &syncError{status: SyncConflict, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func syncRejected(code, format string, args ...interface{}) *syncError {
+	return &syncError{status: SyncRejected, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// syncSession holds what every event of one upload needs.
+type syncSession struct {
+	db        *sql.DB
+	companyID string
+	repID     int
+	deviceID  string
+	loc       *time.Location
+	geo       geofenceSettings
+	gps       gpsSettings
+}
+
+// syncApplied is what an applied event changed, and the work left for
+// after its commit.
+type syncApplied struct {
+	visitID, orderID int
+	flagVisits       bool
+	exportOrder      bool
+}
+
+func optionalID(id int) *int {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+func (s *syncSession) storedResult(ev SyncEvent) (SyncResult, bool) {
+	res := SyncResult{EventID: ev.ID, Type: ev.Type, Duplicate: true}
+	var visitID, orderID sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT event_type, status, COALESCE(code,''), COALESCE(message,''), visit_id, order_id
+		FROM rca_sync_events WHERE representative_id = $1 AND event_id = $2
+	`, s.repID, ev.ID).Scan(&res.Type, &res.Status, &res.Code, &res.Message, &visitID, &orderID)
+	if err != nil {
+		return res, false
+	}
+	res.VisitID = optionalID(int(visitID.Int64))
+	res.OrderID = optionalID(int(orderID.Int64))
+	return res, true
+}
+
+type syncExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *syncSession) record(ex syncExecer, ev SyncEvent, res SyncResult) error {
+	_, err := ex.Exec(`
+		INSERT INTO rca_sync_events (company_id, representative_id, event_id, event_type, device_id,
+			client_time, status, code, message, visit_id, order_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8,''), NULLIF($9,''), $10, $11)
+	`, s.companyID, s.repID, ev.ID, ev.Type, s.deviceID, ev.ClientTime,
+		res.Status, res.Code, res.Message, res.VisitID, res.OrderID)
+	return err
+}
+
+// apply processes one event.
+func (s *syncSession) apply(ev SyncEvent) SyncResult {
+	res := SyncResult{EventID: ev.ID, Type: ev.Type}
+	if ev.ID == "" || len(ev.ID) > 64 {
+		res.Status, res.Code, res.Message = SyncRejected, "invalid_event", "id is required (at most 64 characters)"
+		return res
+	}
+	if stored, ok := s.storedResult(ev); ok {
+		return stored
+	}
+
+	now := time.Now()
+	var serr *syncError
+	switch {
+	case ev.ClientTime.IsZero():
+		serr = syncRejected("invalid_client_time", "client_time is required")
+	case ev.ClientTime.After(now.Add(syncMaxClockSkew)):
+		serr = syncRejected("invalid_client_time", "client_time is in the future; check the device clock")
+	case ev.ClientTime.Before(now.Add(-syncMaxEventAge)):
+		serr = syncRejected("event_too_old", "events older than %d days are not accepted", int(syncMaxEventAge.Hours()/24))
+	}
+
+	var applied syncApplied
+	var tx *sql.Tx
+	if serr == nil {
+		var err error
+		if tx, err = s.db.Begin(); err != nil {
+			res.Status, res.Message = SyncFailed, err.Error()
+			return res
+		}
+		defer tx.Rollback()
+
+		switch ev.Type {
+		case SyncEventCheckin:
+			applied, err = s.applyCheckin(tx, ev)
+		case SyncEventCheckout:
+			applied, err = s.applyCheckout(tx, ev)
+		case SyncEventNote:
+			applied, err = s.applyNote(tx, ev)
+		case SyncEventOrder:
+			applied, err = s.applyOrder(tx, ev)
+		default:
+			err = syncRejected("invalid_event", "unknown event type %q", ev.Type)
+		}
+		if e, ok := err.(*syncError); ok {
+			serr = e
+		} else if err != nil {
+			log.Printf("[RCA] sync event %s of rep %d: %v", ev.ID, s.repID, err)
+			res.Status, res.Message = SyncFailed, err.Error()
+			return res
+		}
+	}
+
+	if serr != nil {
+		if tx != nil {
+			tx.Rollback()
+		}
+		res.Status, res.Code, res.Message = serr.status, serr.code, serr.message
+		res.VisitID = optionalID(serr.visitID)
+		if err := s.record(s.db, ev, res); err != nil {
+			// Recorded concurrently by another upload of the same queue
+			if stored, ok := s.storedResult(ev); ok {
+				return stored
+			}
+		}
+		return res
+	}
+
+	res.Status = SyncApplied
+	res.VisitID = optionalID(applied.visitID)
+	res.OrderID = optionalID(applied.orderID)
+	err := s.record(tx, ev, res)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		if stored, ok := s.storedResult(ev); ok {
+			return stored
+		}
+		res.Status, res.Message = SyncFailed, err.Error()
+		res.VisitID, res.OrderID = nil, nil
+		return res
+	}
+
+	if applied.flagVisits {
+		if err := flagRepVisits(s.db, s.repID, applied.visitID, s.geo.MinVisitMinutes); err != nil {
+			log.Printf("[RCA] flag visits of rep %d: %v", s.repID, err)
+		}
+	}
+	if applied.exportOrder {
+		if _, err := exportRCAOrder(s.db, s.companyID, applied.orderID); err != nil {
+			log.Printf("[RCA] order %d: %v", applied.orderID, err)
+		}
+	}
+	return res
+}
+
+func decodePayload(ev SyncEvent, v interface{}) error {
+	if len(ev.Payload) == 0 {
+		return syncRejected("invalid_payload", "payload is required")
+	}
+	if err := json.Unmarshal(ev.Payload, v); err != nil {
+		return syncRejected("invalid_payload", "invalid payload: %v", err)
+	}
+	return nil
+}
+
+// resolveVisit finds the visit an event refers to, either by id or through
+// the check-in event that opened it.
+func (s *syncSession) resolveVisit(tx *sql.Tx, ev SyncEvent) (int, error) {
+	if ev.VisitID > 0 {
+		return ev.VisitID, nil
+	}
+	if ev.CheckinEventID == "" {
+		return 0, syncRejected("invalid_event", "visit_id or checkin_event_id is required")
+	}
+	var visitID sql.NullInt64
+	var status string
+	err := tx.QueryRow(`
+		SELECT status, visit_id FROM rca_sync_events
+		WHERE representative_id = $1 AND event_id = $2 AND event_type = 'checkin'
+	`, s.repID, ev.CheckinEventID).Scan(&status, &visitID)
+	if err == sql.ErrNoRows {
+		return 0, syncConflict("unknown_visit", "check-in event %s was not received", ev.CheckinEventID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status != SyncApplied || !visitID.Valid {
+		return 0, syncConflict("unknown_visit", "check-in event %s was not applied", ev.CheckinEventID)
+	}
+	return int(visitID.Int64), nil
+}
+
+// applyCheckin opens the visit on the device's date, at the device's time.
+// A visit closed as missed by the end-of-day job is reopened, since it did
+// happen; a concluded one is a conflict.
+func (s *syncSession) applyCheckin(tx *sql.Tx, ev SyncEvent) (syncApplied, error) {
+	var req CheckinRequest
+	if err := decodePayload(ev, &req); err != nil {
+		return syncApplied{}, err
+	}
+	if req.CustomerID == 0 {
+		return syncApplied{}, syncRejected("invalid_payload", "customer_id is required")
+	}
+
+	var custLat, custLng sql.NullFloat64
+	err := tx.QueryRow(`SELECT lat, lng FROM rca_customers WHERE id = $1 AND company_id = $2`,
+		req.CustomerID, s.companyID).Scan(&custLat, &custLng)
+	if err == sql.ErrNoRows {
+		return syncApplied{}, syncConflict("unknown_customer", "customer %d not found", req.CustomerID)
+	}
+	if err != nil {
+		return syncApplied{}, err
+	}
+	geofence, distance := checkGeofence(req.Lat, req.Lng, custLat, custLng, s.geo.RadiusM)
+	if s.geo.Block && (geofence == GeofenceOutside || geofence == GeofenceNoGPS) {
+		return syncApplied{}, syncConflict("geofence_blocked", "Check-in fora do raio permitido do cliente")
+	}
+
+	visitDate := ev.ClientTime.In(s.loc).Format("2006-01-02")
+	var visitID int
+	err = tx.QueryRow(`
+		INSERT INTO rca_visits (company_id, representative_id, customer_id, visit_date,
+			status, checkin_at, checkin_lat, checkin_lng, checkin_distance_m, checkin_geofence)
+		VALUES ($1, $2, $3, $4, 'em_visita', $5, $6, $7, $8, $9)
+		ON CONFLICT (representative_id, customer_id, visit_date)
+		DO UPDATE SET
+			status = 'em_visita',
+			checkin_at = EXCLUDED.checkin_at,
+			checkin_lat = EXCLUDED.checkin_lat,
+			checkin_lng = EXCLUDED.checkin_lng,
+			checkin_distance_m = EXCLUDED.checkin_distance_m,
+			checkin_geofence = EXCLUDED.checkin_geofence,
+			closed_at = NULL,
+			missed_reason = NULL,
+			missed_notes = NULL,
+			justified_at = NULL,
+			updated_at = NOW()
+		WHERE rca_visits.status <> 'concluida'
+		RETURNING id
+	`, s.companyID, s.repID, req.CustomerID, visitDate, ev.ClientTime,
+		req.Lat, req.Lng, distance, geofence).Scan(&visitID)
+	if err == sql.ErrNoRows {
+		e := syncConflict("already_concluded", "visit to customer %d on %s is already concluded", req.CustomerID, visitDate)
+		tx.QueryRow(`
+			SELECT id FROM rca_visits WHERE representative_id = $1 AND customer_id = $2 AND visit_date = $3
+		`, s.repID, req.CustomerID, visitDate).Scan(&e.visitID)
+		return syncApplied{}, e
+	}
+	if err != nil {
+		return syncApplied{}, err
+	}
+	if err := proposeCheckinLocation(tx, s.companyID, s.repID, visitID, req, distance, s.gps.MaxAccuracyM); err != nil {
+		return syncApplied{}, err
+	}
+	return syncApplied{visitID: visitID, flagVisits: true}, nil
+}
+
+// applyCheckout concludes the visit at the device's time. A visit the
+// end-of-day job auto-closed takes the real check-out.
+func (s *syncSession) applyCheckout(tx *sql.Tx, ev SyncEvent) (syncApplied, error) {
+	var req CheckoutRequest
+	if err := decodePayload(ev, &req); err != nil {
+		return syncApplied{}, err
+	}
+	visitID, err := s.resolveVisit(tx, ev)
+	if err != nil {
+		return syncApplied{}, err
+	}
+	req.VisitID = visitID
+	outcome, err := validateCheckoutOutcome(s.db, s.companyID, req)
+	if err != nil {
+		return syncApplied{}, syncRejected("invalid_outcome", "%v", err)
+	}
+
+	var status string
+	var autoClosed bool
+	var checkinAt sql.NullTime
+	var custLat, custLng sql.NullFloat64
+	err = tx.QueryRow(`
+		SELECT v.status, COALESCE(v.auto_closed, FALSE), v.checkin_at, c.lat, c.lng
+		FROM rca_visits v JOIN rca_customers c ON c.id = v.customer_id
+		WHERE v.id = $1 AND v.representative_id = $2
+		FOR UPDATE OF v
+	`, visitID, s.repID).Scan(&status, &autoClosed, &checkinAt, &custLat, &custLng)
+	if err == sql.ErrNoRows {
+		return syncApplied{}, syncConflict("unknown_visit", "visit %d not found", visitID)
+	}
+	if err != nil {
+		return syncApplied{}, err
+	}
+	conflict := func(code, format string, args ...interface{}) (syncApplied, error) {
+		e := syncConflict(code, format, args...)
+		e.visitID = visitID
+		return syncApplied{}, e
+	}
+	if status == "concluida" && !autoClosed {
+		return conflict("already_concluded", "visit %d is already concluded", visitID)
+	}
+	if status != "em_visita" && status != "concluida" {
+		return conflict("not_checked_in", "visit %d has no check-in", visitID)
+	}
+	if checkinAt.Valid && ev.ClientTime.Before(checkinAt.Time) {
+		return conflict("checkout_before_checkin", "check-out time is before the check-in of visit %d", visitID)
+	}
+	geofence, distance := checkGeofence(req.Lat, req.Lng, custLat, custLng, s.geo.RadiusM)
+
+	if _, err := tx.Exec(`
+		UPDATE rca_visits SET
+			status = 'concluida',
+			auto_closed = FALSE,
+			closed_at = NULL,
+			checkout_at = $2,
+			checkout_lat = $3,
+			checkout_lng = $4,
+			duration_minutes = EXTRACT(EPOCH FROM ($2 - checkin_at)) / 60,
+			notes = COALESCE(NULLIF($5, ''), notes),
+			checkout_distance_m = $6,
+			checkout_geofence = $7,
+			outcome = $8,
+			order_value = $9,
+			no_sale_reason = $10,
+			updated_at = NOW()
+		WHERE id = $1
+	`, visitID, ev.ClientTime, req.Lat, req.Lng, req.Notes, distance, geofence,
+		outcome.Outcome, outcome.OrderValue, outcome.NoSaleReason); err != nil {
+		return syncApplied{}, err
+	}
+	if err := saveVisitAnswers(tx, visitID, outcome.Answers); err != nil {
+		return syncApplied{}, err
+	}
+	return syncApplied{visitID: visitID, flagVisits: true}, nil
+}
+
+// applyNote appends a note to the visit.
+func (s *syncSession) applyNote(tx *sql.Tx, ev SyncEvent) (syncApplied, error) {
+	var req struct {
+		Notes string `json:"notes"`
+	}
+	if err := decodePayload(ev, &req); err != nil {
+		return syncApplied{}, err
+	}
+	req.Notes = strings.TrimSpace(req.Notes)
+	if req.Notes == "" {
+		return syncApplied{}, syncRejected("invalid_payload", "notes is required")
+	}
+	visitID, err := s.resolveVisit(tx, ev)
+	if err != nil {
+		return syncApplied{}, err
+	}
+	res, err := tx.Exec(`
+		UPDATE rca_visits SET
+			notes = CASE WHEN COALESCE(notes, '') = '' THEN $3 ELSE notes || E'\n' || $3 END,
+			updated_at = NOW()
+		WHERE id = $1 AND representative_id = $2
+	`, visitID, s.repID, req.Notes)
+	if err != nil {
+		return syncApplied{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return syncApplied{}, syncConflict("unknown_visit", "visit %d not found", visitID)
+	}
+	return syncApplied{visitID: visitID}, nil
+}
+
+// applyOrder creates the order taken during the visit, submitting it when
+// asked; an approved order is exported after the commit.
+func (s *syncSession) applyOrder(tx *sql.Tx, ev SyncEvent) (syncApplied, error) {
+	var req CreateOrderRequest
+	if err := decodePayload(ev, &req); err != nil {
+		return syncApplied{}, err
+	}
+	visitID, err := s.resolveVisit(tx, ev)
+	if err != nil {
+		return syncApplied{}, err
+	}
+
+	var customerID int
+	var defaultFilial string
+	err = tx.QueryRow(`
+		SELECT v.customer_id, COALESCE(r.default_filial, '01')
+		FROM rca_visits v JOIN rca_representatives r ON r.id = v.representative_id
+		WHERE v.id = $1 AND v.representative_id = $2
+		  AND v.status IN ('em_visita', 'concluida')
+	`, visitID, s.repID).Scan(&customerID, &defaultFilial)
+	if err == sql.ErrNoRows {
+		e := syncConflict("visit_not_started", "visit %d not found or not started", visitID)
+		e.visitID = visitID
+		return syncApplied{}, e
+	}
+	if err != nil {
+		return syncApplied{}, err
+	}
+	if req.Filial == "" {
+		req.Filial = defaultFilial
+	}
+	items, err := priceOrderItems(tx, s.companyID, req.Filial, req.Items)
+	if err != nil {
+		return syncApplied{}, syncRejected("invalid_order", "%v", err)
+	}
+
+	var orderID int
+	if err := tx.QueryRow(`
+		INSERT INTO rca_orders (company_id, representative_id, visit_id, customer_id, filial, notes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7::timestamptz) RETURNING id
+	`, s.companyID, s.repID, visitID, customerID, req.Filial, strings.TrimSpace(req.Notes),
+		ev.ClientTime).Scan(&orderID); err != nil {
+		return syncApplied{}, err
+	}
+	if err := writeOrderItems(tx, orderID, items); err != nil {
+		return syncApplied{}, err
+	}
+	status := OrderDraft
+	if req.Submit {
+		if status, err = submitOrder(tx, orderID, s.repID); err != nil {
+			return syncApplied{}, err
+		}
+	}
+	return syncApplied{visitID: visitID, orderID: orderID, exportOrder: status == OrderApproved}, nil
+}
+
+// RCASyncHandler handles POST /api/rca/sync (RCA role)
+// Body: {device_id, events: [{id, type, client_time, visit_id | checkin_event_id, payload}]}
+func RCASyncHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		userID := GetUserIDFromContext(r)
+		if companyID == "" || userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		repID, err := getRepresentativeID(db, userID, companyID)
+		if err != nil {
+			http.Error(w, "Representative profile not found", http.StatusNotFound)
+			return
+		}
+
+		var req SyncRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if len(req.Events) > maxSyncEvents {
+			http.Error(w, fmt.Sprintf("at most %d events per sync", maxSyncEvents), http.StatusBadRequest)
+			return
+		}
+
+		s := &syncSession{
+			db:        db,
+			companyID: companyID,
+			repID:     repID,
+			deviceID:  req.DeviceID,
+			loc:       RCACompanyLocation(r.Context(), db, companyID),
+			geo:       loadGeofenceSettings(db, companyID),
+			gps:       loadGPSSettings(db, companyID),
+		}
+		results := make([]SyncResult, 0, len(req.Events))
+		counts := map[string]int{}
+		for _, ev := range req.Events {
+			res := s.apply(ev)
+			counts[res.Status]++
+			results = append(results, res)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results":     results,
+			"applied":     counts[SyncApplied],
+			"conflicts":   counts[SyncConflict],
+			"rejected":    counts[SyncRejected],
+			"failed":      counts[SyncFailed],
+			"server_time": time.Now().Format(time.RFC3339),
+		})
+	}
+}
+
+// SyncCustomer is a customer in the delta download.
+type SyncCustomer struct {
+	RCACustomer
+	SyncVersion int64 `json:"sync_version"`
+}
+
+type SyncRoute struct {
+	RCARoute
+	SyncVersion int64 `json:"sync_version"`
+}
+
+// SyncRemoval is a route or customer the rep no longer has.
+type SyncRemoval struct {
+	Entity      string `json:"entity"` // route | customer
+	ID          int    `json:"id"`
+	SyncVersion int64  `json:"sync_version"`
+}
+
+// RCASyncChangesHandler handles GET /api/rca/sync/changes?cursor=&limit= (RCA role)
+// Routes and customers of the rep changed after the cursor, deactivated
+// ones included, and the ones moved to another rep or deleted under
+// "removed", so the app can drop them. Without a cursor it is a full
+// download of the active ones. Keep calling with the returned cursor while
+// has_more is true.
+//
+// Versions are handed out per company in commit order (migration 039) and
+// the lists are read from one snapshot, so a change committed after the
+// response always gets a version above the returned cursor.
+func RCASyncChangesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		userID := GetUserIDFromContext(r)
+		if companyID == "" || userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		repID, err := getRepresentativeID(db, userID, companyID)
+		if err != nil {
+			http.Error(w, "Representative profile not found", http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+		var cursor int64
+		if c := q.Get("cursor"); c != "" {
+			if cursor, err = strconv.ParseInt(c, 10, 64); err != nil || cursor < 0 {
+				http.Error(w, "Invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+		limit := 500
+		if l := q.Get("limit"); l != "" {
+			if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > 2000 {
+				http.Error(w, "limit must be between 1 and 2000", http.StatusBadRequest)
+				return
+			}
+		}
+		full := cursor == 0
+
+		tx, err := db.BeginTx(r.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`
+			SELECT c.id, c.company_id, c.route_id, c.company_name, COALESCE(c.contact_name,''),
+				COALESCE(c.phone,''), COALESCE(c.city,''), COALESCE(c.neighborhood,''),
+				COALESCE(c.address,''), COALESCE(c.address_number,''),
+				c.lat, c.lng, c.priority, COALESCE(c.notes,''), COALESCE(c.is_active, FALSE), c.created_at::text,
+				to_char(c.window_start, 'HH24:MI'), to_char(c.window_end, 'HH24:MI'), c.visit_minutes,
+				`+customerScheduleColumns+`, c.sync_version
+			FROM rca_customers c
+			JOIN rca_routes rt ON rt.id = c.route_id
+			WHERE rt.representative_id = $1 AND c.company_id = $2 AND c.sync_version > $3
+			  AND ($4 = FALSE OR (c.is_active = TRUE AND rt.is_active = TRUE))
+			ORDER BY c.sync_version ASC
+			LIMIT $5
+		`, repID, companyID, cursor, full, limit+1)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		customers := []SyncCustomer{}
+		for rows.Next() {
+			var c SyncCustomer
+			var lat, lng sql.NullFloat64
+			var win customerWindow
+			var sched customerSchedule
+			if err := rows.Scan(append(append([]interface{}{&c.ID, &c.CompanyID, &c.RouteID, &c.CompanyName,
+				&c.ContactName, &c.Phone, &c.City, &c.Neighborhood,
+				&c.Address, &c.AddressNumber, &lat, &lng,
+				&c.Priority, &c.Notes, &c.IsActive, &c.CreatedAt,
+				&win.Start, &win.End, &win.VisitMinutes}, sched.targets()...), &c.SyncVersion)...); err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			win.apply(&c.RCACustomer)
+			sched.apply(&c.RCACustomer)
+			if lat.Valid && lng.Valid {
+				c.Lat, c.Lng = &lat.Float64, &lng.Float64
+			}
+			customers = append(customers, c)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rows.Close()
+
+		// A full download has nothing to remove
+		removed := []SyncRemoval{}
+		if !full {
+			removalRows, err := tx.Query(`
+				SELECT entity, entity_id, sync_version FROM rca_sync_removals
+				WHERE representative_id = $1 AND sync_version > $2
+				ORDER BY sync_version ASC
+				LIMIT $3
+			`, repID, cursor, limit+1)
+			if err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for removalRows.Next() {
+				var rm SyncRemoval
+				if err := removalRows.Scan(&rm.Entity, &rm.ID, &rm.SyncVersion); err != nil {
+					removalRows.Close()
+					http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				removed = append(removed, rm)
+			}
+			removalRows.Close()
+			if err := removalRows.Err(); err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// When either list has more to come, every list is cut at the
+		// lowest version reached so the cursor covers all of them
+		hasMore := len(customers) > limit || len(removed) > limit
+		upTo := int64(-1)
+		if len(customers) > limit {
+			upTo = customers[limit-1].SyncVersion
+		}
+		if len(removed) > limit && (upTo < 0 || removed[limit-1].SyncVersion < upTo) {
+			upTo = removed[limit-1].SyncVersion
+		}
+		if hasMore {
+			n := 0
+			for n < len(customers) && customers[n].SyncVersion <= upTo {
+				n++
+			}
+			customers = customers[:n]
+			n = 0
+			for n < len(removed) && removed[n].SyncVersion <= upTo {
+				n++
+			}
+			removed = removed[:n]
+		}
+
+		routeRows, err := tx.Query(`
+			SELECT rt.id, rt.company_id, rt.representative_id, rt.name, COALESCE(rt.description,''),
+				COALESCE(rt.is_active, FALSE), rt.created_at::text,
+				(SELECT COUNT(*) FROM rca_customers WHERE route_id = rt.id AND is_active = TRUE),
+				rt.sync_version
+			FROM rca_routes rt
+			WHERE rt.representative_id = $1 AND rt.company_id = $2 AND rt.sync_version > $3
+			  AND ($4 < 0 OR rt.sync_version <= $4)
+			  AND ($5 = FALSE OR rt.is_active = TRUE)
+			ORDER BY rt.sync_version ASC
+		`, repID, companyID, cursor, upTo, full)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer routeRows.Close()
+
+		routes := []SyncRoute{}
+		for routeRows.Next() {
+			var rt SyncRoute
+			if err := routeRows.Scan(&rt.ID, &rt.CompanyID, &rt.RepresentativeID, &rt.Name, &rt.Description,
+				&rt.IsActive, &rt.CreatedAt, &rt.CustomerCount, &rt.SyncVersion); err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			routes = append(routes, rt)
+		}
+		if err := routeRows.Err(); err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		next := cursor
+		if hasMore {
+			next = upTo
+		} else {
+			for _, c := range customers {
+				if c.SyncVersion > next {
+					next = c.SyncVersion
+				}
+			}
+			for _, rt := range routes {
+				if rt.SyncVersion > next {
+					next = rt.SyncVersion
+				}
+			}
+			for _, rm := range removed {
+				if rm.SyncVersion > next {
+					next = rm.SyncVersion
+				}
+			}
+		}
+
+		// A removal followed by a move back is superseded by the row itself,
+		// whose version is always the later one
+		present := map[string]bool{}
+		for _, c := range customers {
+			present["customer:"+strconv.Itoa(c.ID)] = true
+		}
+		for _, rt := range routes {
+			present["route:"+strconv.Itoa(rt.ID)] = true
+		}
+		kept := removed[:0]
+		for _, rm := range removed {
+			if !present[rm.Entity+":"+strconv.Itoa(rm.ID)] {
+				kept = append(kept, rm)
+			}
+		}
+		removed = kept
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"cursor":    strconv.FormatInt(next, 10),
+			"has_more":  hasMore,
+			"full":      full,
+			"routes":    routes,
+			"customers": customers,
+			"removed":   removed,
+		})
+	}
+}
@@ -0,0 +1,536 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"aprovapedido/services"
+)
+
+// -----------------------------------------------------------------------
+// GPS breadcrumbs and mileage
+// -----------------------------------------------------------------------
+
+const (
+	maxGPSPointsPerBatch = 1000
+	// Default Douglas-Peucker tolerance of the path shown on the map
+	defaultPathToleranceM = 15.0
+	maxMileageRangeDays   = 62
+	// Readings faster than this are glitches; speed_kmh is NUMERIC(6,1)
+	maxGPSSpeedKmh = 500.0
+	// accuracy_m is NUMERIC(8,1)
+	maxGPSAccuracyM = 1000000.0
+)
+
+type gpsSettings struct {
+	RetentionDays int
+	MaxAccuracyM  float64
+}
+
+func loadGPSSettings(db *sql.DB, companyID string) gpsSettings {
+	g := gpsSettings{RetentionDays: 90, MaxAccuracyM: 100}
+	var accuracy int
+	if err := db.QueryRow(`
+		SELECT COALESCE(rca_gps_retention_days, 90), COALESCE(rca_gps_max_accuracy_m, 100)
+		FROM settings WHERE company_id = $1
+	`, companyID).Scan(&g.RetentionDays, &accuracy); err == nil {
+		g.MaxAccuracyM = float64(accuracy)
+	}
+	return g
+}
+
+// PurgeRCATracking deletes the breadcrumbs older than the company's
+// retention, and last positions as old. Run once a day by the scheduler.
+func PurgeRCATracking(ctx context.Context, db *sql.DB, companyID string) (int64, error) {
+	g := loadGPSSettings(db, companyID)
+	cutoff := time.Now().In(RCACompanyLocation(ctx, db, companyID)).
+		AddDate(0, 0, -g.RetentionDays).Format("2006-01-02")
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM rca_gps_points WHERE company_id = $1 AND point_date < $2
+	`, companyID, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.ExecContext(ctx, `
+		UPDATE rca_representatives SET last_lat = NULL, last_lng = NULL, last_position_at = NULL
+		WHERE company_id = $1 AND last_position_at < $2::date
+	`, companyID, cutoff); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type GPSPointRequest struct {
+	Lat        float64   `json:"lat"`
+	Lng        float64   `json:"lng"`
+	AccuracyM  *float64  `json:"accuracy_m"`
+	SpeedKmh   *float64  `json:"speed_kmh"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// normalizeGPSReading checks the accuracy and speed of a point. A negative
+// speed means unknown (iOS reports -1) and is dropped; a negative or
+// oversized accuracy or an impossible speed rejects the point.
+func normalizeGPSReading(p *GPSPointRequest) bool {
+	if p.AccuracyM != nil && (*p.AccuracyM < 0 || *p.AccuracyM >= maxGPSAccuracyM) {
+		return false
+	}
+	if p.SpeedKmh != nil {
+		if *p.SpeedKmh < 0 {
+			p.SpeedKmh = nil
+		} else if *p.SpeedKmh > maxGPSSpeedKmh {
+			return false
+		}
+	}
+	return true
+}
+
+// RCATrackingPointsHandler handles POST /api/rca/tracking/points (RCA role)
+// Body: {points: [{lat, lng, accuracy_m, speed_kmh, recorded_at}]}
+// Points without a fix, less precise than the configured accuracy, from the
+// future or older than the retention are discarded; points with an invalid
+// accuracy or speed are rejected; points already received are ignored, so a
+// batch can be sent again.
+func RCATrackingPointsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		userID := GetUserIDFromContext(r)
+		if companyID == "" || userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		repID, err := getRepresentativeID(db, userID, companyID)
+		if err != nil {
+			http.Error(w, "Representative profile not found", http.StatusNotFound)
+			return
+		}
+
+		var req struct {
+			Points []GPSPointRequest `json:"points"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if len(req.Points) > maxGPSPointsPerBatch {
+			http.Error(w, fmt.Sprintf("at most %d points per batch", maxGPSPointsPerBatch), http.StatusBadRequest)
+			return
+		}
+
+		g := loadGPSSettings(db, companyID)
+		loc := RCACompanyLocation(r.Context(), db, companyID)
+		now := time.Now()
+		oldest := now.AddDate(0, 0, -g.RetentionDays)
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		stmt, err := tx.Prepare(`
+			INSERT INTO rca_gps_points (company_id, representative_id, point_date, recorded_at,
+				lat, lng, accuracy_m, speed_kmh)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (representative_id, recorded_at) DO NOTHING
+		`)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer stmt.Close()
+
+		var accepted, duplicates, discarded, rejected int
+		var last *GPSPointRequest
+		for i := range req.Points {
+			p := req.Points[i]
+			if !normalizeGPSReading(&p) {
+				rejected++
+				continue
+			}
+			if (p.Lat == 0 && p.Lng == 0) || !validCoordinates(&p.Lat, &p.Lng) ||
+				(p.AccuracyM != nil && *p.AccuracyM > g.MaxAccuracyM) ||
+				p.RecordedAt.IsZero() || p.RecordedAt.After(now.Add(syncMaxClockSkew)) || p.RecordedAt.Before(oldest) {
+				discarded++
+				continue
+			}
+			res, err := stmt.Exec(companyID, repID, p.RecordedAt.In(loc).Format("2006-01-02"), p.RecordedAt,
+				p.Lat, p.Lng, p.AccuracyM, p.SpeedKmh)
+			if err != nil {
+				http.Error(w, "Error saving points: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				duplicates++
+				continue
+			}
+			accepted++
+			if last == nil || p.RecordedAt.After(last.RecordedAt) {
+				last = &req.Points[i]
+			}
+		}
+		if last != nil {
+			if _, err := tx.Exec(`
+				UPDATE rca_representatives SET last_lat = $2, last_lng = $3, last_position_at = $4
+				WHERE id = $1 AND (last_position_at IS NULL OR last_position_at < $4)
+			`, repID, last.Lat, last.Lng, last.RecordedAt); err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"accepted":   accepted,
+			"duplicates": duplicates,
+			"discarded":  discarded,
+			"rejected":   rejected,
+		})
+	}
+}
+
+// loadTrack returns the breadcrumbs of a rep on a day, in order.
+func loadTrack(db *sql.DB, repID int, date string) ([]services.TrackPoint, error) {
+	rows, err := db.Query(`
+		SELECT lat, lng, COALESCE(accuracy_m, 0), recorded_at
+		FROM rca_gps_points
+		WHERE representative_id = $1 AND point_date = $2
+		ORDER BY recorded_at ASC
+	`, repID, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	points := []services.TrackPoint{}
+	for rows.Next() {
+		var p services.TrackPoint
+		if err := rows.Scan(&p.Lat, &p.Lng, &p.AccuracyM, &p.Time); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func roundKm(km float64) float64 {
+	return math.Round(km*100) / 100
+}
+
+// TrackVisit is a visit of the day on the tracking map.
+type TrackVisit struct {
+	VisitID      int        `json:"visit_id"`
+	CustomerID   int        `json:"customer_id"`
+	CustomerName string     `json:"customer_name"`
+	Lat          *float64   `json:"lat"`
+	Lng          *float64   `json:"lng"`
+	CheckinAt    time.Time  `json:"checkin_at"`
+	CheckoutAt   *time.Time `json:"checkout_at"`
+}
+
+// TrackLeg is the trip between two consecutive visits: from the check-out
+// of one (its check-in when it has none) to the check-in of the next.
+type TrackLeg struct {
+	FromVisitID int     `json:"from_visit_id"`
+	ToVisitID   int     `json:"to_visit_id"`
+	Minutes     float64 `json:"minutes"`
+	DistanceKm  float64 `json:"distance_km"`
+}
+
+// RCATrackingDayHandler handles GET /api/rca/tracking/day?rca_id=&date=&tolerance_m=
+// The path of a rep on a day simplified for the map, the mileage and the
+// time and distance between visits. A rep only sees their own day.
+func RCATrackingDayHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+
+		q := r.URL.Query()
+		var repID int
+		var err error
+		if GetUserRoleFromContext(r) == "rca" {
+			repID, err = getRepresentativeID(db, GetUserIDFromContext(r), companyID)
+			if err != nil {
+				http.Error(w, "Representative profile not found", http.StatusNotFound)
+				return
+			}
+		} else {
+			if repID, err = strconv.Atoi(q.Get("rca_id")); err != nil {
+				http.Error(w, "rca_id is required", http.StatusBadRequest)
+				return
+			}
+			var exists bool
+			db.QueryRow(`SELECT EXISTS(SELECT 1 FROM rca_representatives WHERE id = $1 AND company_id = $2)`,
+				repID, companyID).Scan(&exists)
+			if !exists {
+				http.Error(w, "Representative not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		date := q.Get("date")
+		if date == "" {
+			date = time.Now().In(RCACompanyLocation(r.Context(), db, companyID)).Format("2006-01-02")
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			http.Error(w, "Invalid date", http.StatusBadRequest)
+			return
+		}
+		tolerance := defaultPathToleranceM
+		if t := q.Get("tolerance_m"); t != "" {
+			if tolerance, err = strconv.ParseFloat(t, 64); err != nil || tolerance < 0 || tolerance > 1000 {
+				http.Error(w, "tolerance_m must be between 0 and 1000", http.StatusBadRequest)
+				return
+			}
+		}
+
+		track, err := loadTrack(db, repID, date)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT v.id, v.customer_id, COALESCE(c.company_name,''), c.lat, c.lng, v.checkin_at, v.checkout_at
+			FROM rca_visits v
+			JOIN rca_customers c ON c.id = v.customer_id
+			WHERE v.representative_id = $1 AND v.visit_date = $2 AND v.checkin_at IS NOT NULL
+			ORDER BY v.checkin_at ASC
+		`, repID, date)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		visits := []TrackVisit{}
+		for rows.Next() {
+			var v TrackVisit
+			var lat, lng sql.NullFloat64
+			var checkout sql.NullTime
+			if err := rows.Scan(&v.VisitID, &v.CustomerID, &v.CustomerName, &lat, &lng, &v.CheckinAt, &checkout); err != nil {
+				continue
+			}
+			if lat.Valid && lng.Valid {
+				v.Lat, v.Lng = &lat.Float64, &lng.Float64
+			}
+			if checkout.Valid {
+				v.CheckoutAt = &checkout.Time
+			}
+			visits = append(visits, v)
+		}
+
+		// Legs use the breadcrumbs already loaded, cut by time
+		legs := []TrackLeg{}
+		for i := 1; i < len(visits); i++ {
+			from := visits[i-1].CheckinAt
+			if visits[i-1].CheckoutAt != nil {
+				from = *visits[i-1].CheckoutAt
+			}
+			to := visits[i].CheckinAt
+			var segment []services.TrackPoint
+			for _, p := range track {
+				if !p.Time.Before(from) && !p.Time.After(to) {
+					segment = append(segment, p)
+				}
+			}
+			minutes := to.Sub(from).Minutes()
+			if minutes < 0 {
+				minutes = 0
+			}
+			legs = append(legs, TrackLeg{
+				FromVisitID: visits[i-1].VisitID,
+				ToVisitID:   visits[i].VisitID,
+				Minutes:     math.Round(minutes*10) / 10,
+				DistanceKm:  roundKm(services.TrackDistanceKm(segment)),
+			})
+		}
+
+		resp := map[string]interface{}{
+			"representative_id": repID,
+			"date":              date,
+			"distance_km":       roundKm(services.TrackDistanceKm(track)),
+			"raw_points":        len(track),
+			"path":              services.SimplifyPath(track, tolerance),
+			"visits":            visits,
+			"legs":              legs,
+			"first_at":          nil,
+			"last_at":           nil,
+		}
+		if len(track) > 0 {
+			resp["first_at"] = track[0].Time
+			resp["last_at"] = track[len(track)-1].Time
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+type MileageRow struct {
+	RepresentativeID   int        `json:"representative_id"`
+	RepresentativeName string     `json:"representative_name"`
+	Date               string     `json:"date"`
+	DistanceKm         float64    `json:"distance_km"`
+	Points             int        `json:"points"`
+	FirstAt            *time.Time `json:"first_at"`
+	LastAt             *time.Time `json:"last_at"`
+}
+
+// RCAMileageHandler handles GET /api/rca/tracking/mileage?date_from=&date_to=&rca_id=
+// Kilometers driven per rep and day, for fuel reimbursement. Dates default
+// to the current month.
+func RCAMileageHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := GetCompanyIDFromContext(r)
+		if companyID == "" {
+			http.Error(w, "Company not found", http.StatusBadRequest)
+			return
+		}
+		if GetUserRoleFromContext(r) == "rca" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		q := r.URL.Query()
+		now := time.Now().In(RCACompanyLocation(r.Context(), db, companyID))
+		dateFrom, dateTo := q.Get("date_from"), q.Get("date_to")
+		if dateFrom == "" {
+			dateFrom = now.AddDate(0, 0, 1-now.Day()).Format("2006-01-02")
+		}
+		if dateTo == "" {
+			dateTo = now.Format("2006-01-02")
+		}
+		from, err := time.Parse("2006-01-02", dateFrom)
+		if err != nil {
+			http.Error(w, "Invalid date_from", http.StatusBadRequest)
+			return
+		}
+		to, err := time.Parse("2006-01-02", dateTo)
+		if err != nil {
+			http.Error(w, "Invalid date_to", http.StatusBadRequest)
+			return
+		}
+		if to.Before(from) || to.Sub(from) > maxMileageRangeDays*24*time.Hour {
+			http.Error(w, fmt.Sprintf("date range must be at most %d days", maxMileageRangeDays), http.StatusBadRequest)
+			return
+		}
+
+		query := `
+			SELECT p.representative_id, COALESCE(u.full_name,''), p.point_date::text,
+				p.lat, p.lng, COALESCE(p.accuracy_m, 0), p.recorded_at
+			FROM rca_gps_points p
+			JOIN rca_representatives r ON r.id = p.representative_id
+			LEFT JOIN users u ON u.id = r.user_id
+			WHERE p.company_id = $1 AND p.point_date BETWEEN $2 AND $3
+		`
+		args := []interface{}{companyID, dateFrom, dateTo}
+		if rcaID := q.Get("rca_id"); rcaID != "" {
+			id, err := strconv.Atoi(rcaID)
+			if err != nil {
+				http.Error(w, "Invalid rca_id", http.StatusBadRequest)
+				return
+			}
+			args = append(args, id)
+			query += ` AND p.representative_id = $4`
+		}
+		query += ` ORDER BY p.representative_id, p.point_date, p.recorded_at`
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// Points come grouped by rep and day; each group is measured when
+		// the next one starts
+		days := []MileageRow{}
+		totals := map[int]float64{}
+		var cur *MileageRow
+		var track []services.TrackPoint
+		flush := func() {
+			if cur == nil {
+				return
+			}
+			cur.DistanceKm = roundKm(services.TrackDistanceKm(track))
+			cur.Points = len(track)
+			first, last := track[0].Time, track[len(track)-1].Time
+			cur.FirstAt, cur.LastAt = &first, &last
+			totals[cur.RepresentativeID] += cur.DistanceKm
+			days = append(days, *cur)
+		}
+		for rows.Next() {
+			var repID int
+			var name, date string
+			var p services.TrackPoint
+			if err := rows.Scan(&repID, &name, &date, &p.Lat, &p.Lng, &p.AccuracyM, &p.Time); err != nil {
+				http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if cur == nil || cur.RepresentativeID != repID || cur.Date != date {
+				flush()
+				cur = &MileageRow{RepresentativeID: repID, RepresentativeName: name, Date: date}
+				track = track[:0]
+			}
+			track = append(track, p)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		flush()
+
+		byRep := []map[string]interface{}{}
+		seen := map[int]bool{}
+		var total float64
+		for _, d := range days {
+			if seen[d.RepresentativeID] {
+				continue
+			}
+			seen[d.RepresentativeID] = true
+			km := roundKm(totals[d.RepresentativeID])
+			total += km
+			byRep = append(byRep, map[string]interface{}{
+				"representative_id":   d.RepresentativeID,
+				"representative_name": d.RepresentativeName,
+				"distance_km":         km,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"date_from":         dateFrom,
+			"date_to":           dateTo,
+			"days":              days,
+			"by_representative": byRep,
+			"total_km":          roundKm(total),
+		})
+	}
+}
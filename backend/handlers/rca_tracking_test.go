@@ -0,0 +1,37 @@
+package handlers
+
+import "testing"
+
+func TestNormalizeGPSReading(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name      string
+		accuracy  *float64
+		speed     *float64
+		want      bool
+		wantSpeed *float64
+	}{
+		{"no accuracy or speed", nil, nil, true, nil},
+		{"normal reading", f(12), f(45.5), true, f(45.5)},
+		{"parked", f(5), f(0), true, f(0)},
+		{"unknown speed", f(8), f(-1), true, nil},
+		{"negative accuracy", f(-3), f(30), false, nil},
+		{"accuracy beyond the column", f(2e6), nil, false, nil},
+		{"impossible speed", f(10), f(1e6), false, nil},
+		{"top speed", f(10), f(maxGPSSpeedKmh), true, f(maxGPSSpeedKmh)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := GPSPointRequest{Lat: -23.55, Lng: -46.63, AccuracyM: tt.accuracy, SpeedKmh: tt.speed}
+			if got := normalizeGPSReading(&p); got != tt.want {
+				t.Fatalf("normalizeGPSReading = %v, want %v", got, tt.want)
+			}
+			if !tt.want {
+				return
+			}
+			if (p.SpeedKmh == nil) != (tt.wantSpeed == nil) || (p.SpeedKmh != nil && *p.SpeedKmh != *tt.wantSpeed) {
+				t.Errorf("speed = %v, want %v", p.SpeedKmh, tt.wantSpeed)
+			}
+		})
+	}
+}
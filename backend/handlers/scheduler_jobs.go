@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Scheduler Job Runs ---
+
+type SchedulerJobRun struct {
+	ID              int64              `json:"id"`
+	Filial          string             `json:"filial"`
+	Trigger         string             `json:"trigger"`
+	Status          string             `json:"status"`
+	Message         string             `json:"message"`
+	CancelRequested bool               `json:"cancel_requested"`
+	RequestedBy     *int               `json:"requested_by"`
+	StartedAt       string             `json:"started_at"`
+	FinishedAt      *string            `json:"finished_at"`
+	DurationMs      *int               `json:"duration_ms"`
+	Steps           []SchedulerJobStep `json:"steps,omitempty"`
+}
+
+type SchedulerJobStep struct {
+	Filial     string `json:"filial"`
+	Step       string `json:"step"`
+	Status     string `json:"status"`
+	Message    string `json:"message"`
+	StartedAt  string `json:"started_at"`
+	DurationMs int    `json:"duration_ms"`
+}
+
+const jobRunColumns = `id, COALESCE(filial,''), trigger, status, COALESCE(message,''), cancel_requested,
+	requested_by, started_at, finished_at, duration_ms`
+
+func scanJobRun(row interface{ Scan(...interface{}) error }) (SchedulerJobRun, error) {
+	var j SchedulerJobRun
+	var requestedBy, durationMs sql.NullInt64
+	var startedAt time.Time
+	var finishedAt sql.NullTime
+	if err := row.Scan(&j.ID, &j.Filial, &j.Trigger, &j.Status, &j.Message, &j.CancelRequested,
+		&requestedBy, &startedAt, &finishedAt, &durationMs); err != nil {
+		return j, err
+	}
+	j.StartedAt = startedAt.Format(time.RFC3339)
+	if requestedBy.Valid {
+		id := int(requestedBy.Int64)
+		j.RequestedBy = &id
+	}
+	if finishedAt.Valid {
+		s := finishedAt.Time.Format(time.RFC3339)
+		j.FinishedAt = &s
+	}
+	if durationMs.Valid {
+		d := int(durationMs.Int64)
+		j.DurationMs = &d
+	}
+	return j, nil
+}
+
+// ListSchedulerRunsHandler serves GET /api/scheduler/runs with optional
+// ?filial=&status=&page=, newest first.
+func ListSchedulerRunsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		q := r.URL.Query()
+
+		page, _ := strconv.Atoi(q.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		limit := 50
+		offset := (page - 1) * limit
+
+		where := ` WHERE company_id = $1`
+		args := []interface{}{companyID}
+		if filial := q.Get("filial"); filial != "" {
+			// Runs covering every filial have an empty filial; match them
+			// through their steps
+			args = append(args, filial)
+			n := strconv.Itoa(len(args))
+			where += ` AND (filial = $` + n + ` OR EXISTS (
+				SELECT 1 FROM scheduler_job_steps s WHERE s.run_id = scheduler_job_runs.id AND s.filial = $` + n + `))`
+		}
+		if status := q.Get("status"); status != "" {
+			args = append(args, status)
+			where += ` AND status = $` + strconv.Itoa(len(args))
+		}
+
+		var total int
+		db.QueryRow(`SELECT COUNT(*) FROM scheduler_job_runs`+where, args...).Scan(&total)
+
+		args = append(args, limit, offset)
+		rows, err := db.Query(`SELECT `+jobRunColumns+` FROM scheduler_job_runs`+where+
+			` ORDER BY started_at DESC, id DESC LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)), args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		runs := []SchedulerJobRun{}
+		for rows.Next() {
+			j, err := scanJobRun(rows)
+			if err != nil {
+				continue
+			}
+			runs = append(runs, j)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"runs":  runs,
+			"total": total,
+			"page":  page,
+			"limit": limit,
+		})
+	}
+}
+
+// SchedulerRunHandler serves GET /api/scheduler/runs/:id (with its steps)
+// and POST /api/scheduler/runs/:id/cancel. cancel stops a run executing in
+// this process; a run it does not know (e.g. left by a previous process)
+// is closed as cancelled directly.
+func SchedulerRunHandler(db *sql.DB, cancel func(id int64) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/scheduler/runs/"), "/"), "/")
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			http.Error(w, "ID invalido", http.StatusBadRequest)
+			return
+		}
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			getSchedulerRun(db, w, companyID, id)
+		case action == "cancel" && r.Method == http.MethodPost:
+			cancelSchedulerRun(db, w, companyID, id, cancel)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func getSchedulerRun(db *sql.DB, w http.ResponseWriter, companyID string, id int64) {
+	j, err := scanJobRun(db.QueryRow(`SELECT `+jobRunColumns+` FROM scheduler_job_runs
+		WHERE id = $1 AND company_id = $2`, id, companyID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Execucao nao encontrada", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT filial, step, status, COALESCE(message,''), started_at, duration_ms
+		FROM scheduler_job_steps WHERE run_id = $1
+		ORDER BY started_at, id
+	`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	j.Steps = []SchedulerJobStep{}
+	for rows.Next() {
+		var s SchedulerJobStep
+		var startedAt time.Time
+		if rows.Scan(&s.Filial, &s.Step, &s.Status, &s.Message, &startedAt, &s.DurationMs) != nil {
+			continue
+		}
+		s.StartedAt = startedAt.Format(time.RFC3339)
+		j.Steps = append(j.Steps, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
+
+func cancelSchedulerRun(db *sql.DB, w http.ResponseWriter, companyID string, id int64, cancel func(int64) bool) {
+	res, err := db.Exec(`
+		UPDATE scheduler_job_runs SET cancel_requested = TRUE
+		WHERE id = $1 AND company_id = $2 AND status = 'running'
+	`, id, companyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Execucao nao encontrada ou ja finalizada", http.StatusConflict)
+		return
+	}
+
+	if cancel == nil || !cancel(id) {
+		db.Exec(`
+			UPDATE scheduler_job_runs
+			SET status = 'cancelled', message = 'cancelada: execucao nao estava ativa',
+			    finished_at = NOW(), duration_ms = (EXTRACT(EPOCH FROM NOW() - started_at) * 1000)::INT
+			WHERE id = $1 AND status = 'running'
+		`, id)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "cancel_requested": true})
+}
+
+// --- Scheduler Pauses ---
+
+type SchedulerPause struct {
+	Filial   string `json:"filial"`
+	Reason   string `json:"reason"`
+	PausedBy *int   `json:"paused_by"`
+	PausedAt string `json:"paused_at"`
+}
+
+// ListSchedulerPausesHandler serves GET /api/scheduler/pauses. An empty
+// filial means the whole company is paused.
+func ListSchedulerPausesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		rows, err := db.Query(`
+			SELECT filial, COALESCE(reason,''), paused_by, paused_at
+			FROM scheduler_pauses WHERE company_id = $1
+			ORDER BY filial
+		`, companyID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		pauses := []SchedulerPause{}
+		for rows.Next() {
+			var p SchedulerPause
+			var pausedBy sql.NullInt64
+			var pausedAt time.Time
+			if rows.Scan(&p.Filial, &p.Reason, &pausedBy, &pausedAt) != nil {
+				continue
+			}
+			if pausedBy.Valid {
+				id := int(pausedBy.Int64)
+				p.PausedBy = &id
+			}
+			p.PausedAt = pausedAt.Format(time.RFC3339)
+			pauses = append(pauses, p)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"pauses": pauses})
+	}
+}
+
+// PauseSchedulerHandler serves POST /api/scheduler/pause with
+// {"filial": "", "reason": ""}. Without filial the whole company is paused.
+// Pauses only stop automatic cycles; a manual sync still runs.
+func PauseSchedulerHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+		var req struct {
+			Filial string `json:"filial"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "JSON invalido", http.StatusBadRequest)
+			return
+		}
+		var userID *int
+		if uid, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+			userID = &uid
+		}
+
+		if _, err := db.Exec(`
+			INSERT INTO scheduler_pauses (company_id, filial, reason, paused_by)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (company_id, filial) DO UPDATE
+			SET reason = EXCLUDED.reason, paused_by = EXCLUDED.paused_by, paused_at = NOW()
+		`, companyID, strings.TrimSpace(req.Filial), req.Reason, userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"paused": true, "filial": req.Filial})
+	}
+}
+
+// ResumeSchedulerHandler serves POST /api/scheduler/resume with
+// {"filial": ""}, removing the matching pause.
+func ResumeSchedulerHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+		var req struct {
+			Filial string `json:"filial"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "JSON invalido", http.StatusBadRequest)
+			return
+		}
+
+		res, err := db.Exec(`DELETE FROM scheduler_pauses WHERE company_id = $1 AND filial = $2`,
+			companyID, strings.TrimSpace(req.Filial))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, _ := res.RowsAffected()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"resumed": n > 0, "filial": req.Filial})
+	}
+}
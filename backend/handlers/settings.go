@@ -4,18 +4,47 @@ import (
 	"database/sql"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type Settings struct {
-	LowTurnoverDays     int    `json:"low_turnover_days"`
-	WarningTurnoverDays int    `json:"warning_turnover_days"`
-	PickingEnabled      bool   `json:"picking_enabled"`
-	WinthorAPIURL       string `json:"winthor_api_url"`
-	WinthorAPIKey       string `json:"winthor_api_key"`
-	SyncIntervalMinutes int    `json:"sync_interval_minutes"`
-	SyncSchedule        string `json:"sync_schedule"`
-	ActiveFiliais       string `json:"active_filiais"`
-	UseMockWinthor      bool   `json:"use_mock_winthor"`
+	LowTurnoverDays       int     `json:"low_turnover_days"`
+	WarningTurnoverDays   int     `json:"warning_turnover_days"`
+	PickingEnabled        bool    `json:"picking_enabled"`
+	WinthorAPIURL         string  `json:"winthor_api_url"`
+	WinthorAPIKey         string  `json:"winthor_api_key"`
+	SyncIntervalMinutes   int     `json:"sync_interval_minutes"`
+	SyncSchedule          string  `json:"sync_schedule"`
+	ActiveFiliais         string  `json:"active_filiais"`
+	UseMockWinthor        bool    `json:"use_mock_winthor"`
+	ConsumptionWindowDays int     `json:"consumption_window_days"`
+	WaveLookaheadHours    int     `json:"wave_lookahead_hours"`
+	MinMaxTargetHoursA    int     `json:"minmax_target_hours_a"`
+	MinMaxTargetHoursB    int     `json:"minmax_target_hours_b"`
+	MinMaxTargetHoursC    int     `json:"minmax_target_hours_c"`
+	MinMaxMinPct          int     `json:"minmax_min_pct"`
+	FragWeightA           float64 `json:"frag_weight_a"`
+	FragWeightB           float64 `json:"frag_weight_b"`
+	FragWeightC           float64 `json:"frag_weight_c"`
+	FragAlertThreshold    float64 `json:"frag_alert_threshold"`
+	FragTrendWindowDays   int     `json:"frag_trend_window_days"`
+	WaveSplitByZone       bool    `json:"wave_split_by_zone"`
+	WaveMaxTasks          int     `json:"wave_max_tasks"`
+	WaveMaxVolume         float64 `json:"wave_max_volume"`
+	WaveMergePending      bool    `json:"wave_merge_pending"`
+	WaveMinIntervalMin    int     `json:"wave_min_interval_minutes"`
+	RCAAvgSpeedKmh        float64 `json:"rca_avg_speed_kmh"`
+	RCAVisitMinutes       int     `json:"rca_visit_minutes"`
+	RCAGeofenceRadiusM    int     `json:"rca_geofence_radius_m"`
+	RCAGeofenceBlock      bool    `json:"rca_geofence_block"`
+	RCAMinVisitMinutes    int     `json:"rca_min_visit_minutes"`
+	RCATimezone           string  `json:"rca_timezone"`
+	RCAMissedReasons      string  `json:"rca_missed_reasons"`
+	RCAGPSRetentionDays   int     `json:"rca_gps_retention_days"`
+	RCAGPSMaxAccuracyM    int     `json:"rca_gps_max_accuracy_m"`
+	RCAGeocoder           string  `json:"rca_geocoder"`
+	RCAGeocoderURL        string  `json:"rca_geocoder_url"`
 }
 
 func GetSettingsHandler(db *sql.DB) http.HandlerFunc {
@@ -33,12 +62,34 @@ func GetSettingsHandler(db *sql.DB) http.HandlerFunc {
 			       COALESCE(winthor_api_key,''), COALESCE(sync_interval_minutes,30),
 			       COALESCE(sync_schedule,'["06:00","12:00","18:00"]'),
 			       COALESCE(active_filiais,'["01","02","03"]'),
-			       COALESCE(use_mock_winthor,true)
+			       COALESCE(use_mock_winthor,true),
+			       COALESCE(consumption_window_days,7), COALESCE(wave_lookahead_hours,0),
+			       COALESCE(minmax_target_hours_a,8), COALESCE(minmax_target_hours_b,16),
+			       COALESCE(minmax_target_hours_c,24), COALESCE(minmax_min_pct,30),
+			       COALESCE(frag_weight_a,3), COALESCE(frag_weight_b,2), COALESCE(frag_weight_c,1),
+			       COALESCE(frag_alert_threshold,60), COALESCE(frag_trend_window_days,7),
+			       COALESCE(wave_split_by_zone,false), COALESCE(wave_max_tasks,0), COALESCE(wave_max_volume,0),
+			       COALESCE(wave_merge_pending,false), COALESCE(wave_min_interval_minutes,0),
+			       COALESCE(rca_avg_speed_kmh,30), COALESCE(rca_visit_minutes,20),
+			       COALESCE(rca_geofence_radius_m,200), COALESCE(rca_geofence_block,false),
+			       COALESCE(rca_min_visit_minutes,5),
+			       COALESCE(rca_timezone,'America/Sao_Paulo'), COALESCE(rca_missed_reasons,'[]'),
+			       COALESCE(rca_gps_retention_days,90), COALESCE(rca_gps_max_accuracy_m,100),
+			       COALESCE(rca_geocoder,'nominatim'), COALESCE(rca_geocoder_url,'')
 			FROM settings WHERE company_id = $1
 		`, companyID).Scan(
 			&s.LowTurnoverDays, &s.WarningTurnoverDays,
 			&s.PickingEnabled, &s.WinthorAPIURL, &s.WinthorAPIKey,
 			&s.SyncIntervalMinutes, &s.SyncSchedule, &s.ActiveFiliais, &s.UseMockWinthor,
+			&s.ConsumptionWindowDays, &s.WaveLookaheadHours,
+			&s.MinMaxTargetHoursA, &s.MinMaxTargetHoursB, &s.MinMaxTargetHoursC, &s.MinMaxMinPct,
+			&s.FragWeightA, &s.FragWeightB, &s.FragWeightC, &s.FragAlertThreshold, &s.FragTrendWindowDays,
+			&s.WaveSplitByZone, &s.WaveMaxTasks, &s.WaveMaxVolume, &s.WaveMergePending, &s.WaveMinIntervalMin,
+			&s.RCAAvgSpeedKmh, &s.RCAVisitMinutes,
+			&s.RCAGeofenceRadiusM, &s.RCAGeofenceBlock, &s.RCAMinVisitMinutes,
+			&s.RCATimezone, &s.RCAMissedReasons,
+			&s.RCAGPSRetentionDays, &s.RCAGPSMaxAccuracyM,
+			&s.RCAGeocoder, &s.RCAGeocoderURL,
 		)
 		if err != nil {
 			s.LowTurnoverDays = 90
@@ -47,6 +98,24 @@ func GetSettingsHandler(db *sql.DB) http.HandlerFunc {
 			s.SyncSchedule = `["06:00","12:00","18:00"]`
 			s.ActiveFiliais = `["01","02","03"]`
 			s.UseMockWinthor = true
+			s.ConsumptionWindowDays = 7
+			s.MinMaxTargetHoursA, s.MinMaxTargetHoursB, s.MinMaxTargetHoursC = 8, 16, 24
+			s.MinMaxMinPct = 30
+			s.FragWeightA, s.FragWeightB, s.FragWeightC = 3, 2, 1
+			s.FragAlertThreshold = 60
+			s.FragTrendWindowDays = 7
+			s.RCAAvgSpeedKmh = 30
+			s.RCAVisitMinutes = 20
+			s.RCAGeofenceRadiusM = 200
+			s.RCAMinVisitMinutes = 5
+			s.RCATimezone = defaultRCATimezone
+			s.RCAGPSRetentionDays = 90
+			s.RCAGPSMaxAccuracyM = 100
+			s.RCAGeocoder = "nominatim"
+		}
+		if reasons := []string{}; json.Unmarshal([]byte(s.RCAMissedReasons), &reasons) != nil || len(reasons) == 0 {
+			b, _ := json.Marshal(defaultMissedReasons)
+			s.RCAMissedReasons = string(b)
 		}
 
 		// Mask API key for security
@@ -90,6 +159,71 @@ func UpdateSettingsHandler(db *sql.DB) http.HandlerFunc {
 		if s.SyncIntervalMinutes < 5 {
 			s.SyncIntervalMinutes = 30
 		}
+		if s.ConsumptionWindowDays < 1 {
+			s.ConsumptionWindowDays = 7
+		}
+		if s.WaveLookaheadHours < 0 {
+			s.WaveLookaheadHours = 0
+		}
+		if s.MinMaxTargetHoursA < 1 {
+			s.MinMaxTargetHoursA = 8
+		}
+		if s.MinMaxTargetHoursB < 1 {
+			s.MinMaxTargetHoursB = 16
+		}
+		if s.MinMaxTargetHoursC < 1 {
+			s.MinMaxTargetHoursC = 24
+		}
+		if s.MinMaxMinPct < 1 || s.MinMaxMinPct > 90 {
+			s.MinMaxMinPct = 30
+		}
+		if s.FragWeightA <= 0 && s.FragWeightB <= 0 && s.FragWeightC <= 0 {
+			s.FragWeightA, s.FragWeightB, s.FragWeightC = 3, 2, 1
+		}
+		if s.FragAlertThreshold <= 0 || s.FragAlertThreshold > 100 {
+			s.FragAlertThreshold = 60
+		}
+		if s.FragTrendWindowDays < 2 {
+			s.FragTrendWindowDays = 7
+		}
+		if s.WaveMaxTasks < 0 {
+			s.WaveMaxTasks = 0
+		}
+		if s.WaveMaxVolume < 0 {
+			s.WaveMaxVolume = 0
+		}
+		if s.WaveMinIntervalMin < 0 {
+			s.WaveMinIntervalMin = 0
+		}
+		if s.RCAAvgSpeedKmh <= 0 || s.RCAAvgSpeedKmh > 120 {
+			s.RCAAvgSpeedKmh = 30
+		}
+		if s.RCAVisitMinutes < 1 {
+			s.RCAVisitMinutes = 20
+		}
+		if s.RCAGeofenceRadiusM < 10 {
+			s.RCAGeofenceRadiusM = 200
+		}
+		if s.RCAMinVisitMinutes < 0 {
+			s.RCAMinVisitMinutes = 5
+		}
+		if _, err := time.LoadLocation(s.RCATimezone); s.RCATimezone == "" || err != nil {
+			s.RCATimezone = defaultRCATimezone
+		}
+		if reasons := []string{}; json.Unmarshal([]byte(s.RCAMissedReasons), &reasons) != nil || len(reasons) == 0 {
+			b, _ := json.Marshal(defaultMissedReasons)
+			s.RCAMissedReasons = string(b)
+		}
+		if s.RCAGPSRetentionDays < 1 || s.RCAGPSRetentionDays > 730 {
+			s.RCAGPSRetentionDays = 90
+		}
+		if s.RCAGPSMaxAccuracyM < 10 {
+			s.RCAGPSMaxAccuracyM = 100
+		}
+		if s.RCAGeocoder != "fake" {
+			s.RCAGeocoder = "nominatim"
+		}
+		s.RCAGeocoderURL = strings.TrimSpace(s.RCAGeocoderURL)
 		if s.SyncSchedule == "" {
 			s.SyncSchedule = `["06:00","12:00","18:00"]`
 		}
@@ -107,8 +241,18 @@ func UpdateSettingsHandler(db *sql.DB) http.HandlerFunc {
 		_, err := db.Exec(`
 			INSERT INTO settings (company_id, low_turnover_days, warning_turnover_days,
 			  picking_enabled, winthor_api_url, winthor_api_key, sync_interval_minutes,
-			  sync_schedule, active_filiais, use_mock_winthor, updated_at)
-			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,NOW())
+			  sync_schedule, active_filiais, use_mock_winthor,
+			  consumption_window_days, wave_lookahead_hours,
+			  minmax_target_hours_a, minmax_target_hours_b, minmax_target_hours_c, minmax_min_pct,
+			  frag_weight_a, frag_weight_b, frag_weight_c, frag_alert_threshold, frag_trend_window_days,
+			  wave_split_by_zone, wave_max_tasks, wave_max_volume, wave_merge_pending, wave_min_interval_minutes,
+			  rca_avg_speed_kmh, rca_visit_minutes,
+			  rca_geofence_radius_m, rca_geofence_block, rca_min_visit_minutes,
+			  rca_timezone, rca_missed_reasons,
+			  rca_gps_retention_days, rca_gps_max_accuracy_m,
+			  rca_geocoder, rca_geocoder_url, updated_at)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,
+			        $22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,$36,$37,NOW())
 			ON CONFLICT (company_id) DO UPDATE SET
 				low_turnover_days=EXCLUDED.low_turnover_days,
 				warning_turnover_days=EXCLUDED.warning_turnover_days,
@@ -119,10 +263,46 @@ func UpdateSettingsHandler(db *sql.DB) http.HandlerFunc {
 				sync_schedule=EXCLUDED.sync_schedule,
 				active_filiais=EXCLUDED.active_filiais,
 				use_mock_winthor=EXCLUDED.use_mock_winthor,
+				consumption_window_days=EXCLUDED.consumption_window_days,
+				wave_lookahead_hours=EXCLUDED.wave_lookahead_hours,
+				minmax_target_hours_a=EXCLUDED.minmax_target_hours_a,
+				minmax_target_hours_b=EXCLUDED.minmax_target_hours_b,
+				minmax_target_hours_c=EXCLUDED.minmax_target_hours_c,
+				minmax_min_pct=EXCLUDED.minmax_min_pct,
+				frag_weight_a=EXCLUDED.frag_weight_a,
+				frag_weight_b=EXCLUDED.frag_weight_b,
+				frag_weight_c=EXCLUDED.frag_weight_c,
+				frag_alert_threshold=EXCLUDED.frag_alert_threshold,
+				frag_trend_window_days=EXCLUDED.frag_trend_window_days,
+				wave_split_by_zone=EXCLUDED.wave_split_by_zone,
+				wave_max_tasks=EXCLUDED.wave_max_tasks,
+				wave_max_volume=EXCLUDED.wave_max_volume,
+				wave_merge_pending=EXCLUDED.wave_merge_pending,
+				wave_min_interval_minutes=EXCLUDED.wave_min_interval_minutes,
+				rca_avg_speed_kmh=EXCLUDED.rca_avg_speed_kmh,
+				rca_visit_minutes=EXCLUDED.rca_visit_minutes,
+				rca_geofence_radius_m=EXCLUDED.rca_geofence_radius_m,
+				rca_geofence_block=EXCLUDED.rca_geofence_block,
+				rca_min_visit_minutes=EXCLUDED.rca_min_visit_minutes,
+				rca_timezone=EXCLUDED.rca_timezone,
+				rca_missed_reasons=EXCLUDED.rca_missed_reasons,
+				rca_gps_retention_days=EXCLUDED.rca_gps_retention_days,
+				rca_gps_max_accuracy_m=EXCLUDED.rca_gps_max_accuracy_m,
+				rca_geocoder=EXCLUDED.rca_geocoder,
+				rca_geocoder_url=EXCLUDED.rca_geocoder_url,
 				updated_at=NOW()
 		`, companyID, s.LowTurnoverDays, s.WarningTurnoverDays,
 			s.PickingEnabled, s.WinthorAPIURL, s.WinthorAPIKey, s.SyncIntervalMinutes,
-			s.SyncSchedule, s.ActiveFiliais, s.UseMockWinthor)
+			s.SyncSchedule, s.ActiveFiliais, s.UseMockWinthor,
+			s.ConsumptionWindowDays, s.WaveLookaheadHours,
+			s.MinMaxTargetHoursA, s.MinMaxTargetHoursB, s.MinMaxTargetHoursC, s.MinMaxMinPct,
+			s.FragWeightA, s.FragWeightB, s.FragWeightC, s.FragAlertThreshold, s.FragTrendWindowDays,
+			s.WaveSplitByZone, s.WaveMaxTasks, s.WaveMaxVolume, s.WaveMergePending, s.WaveMinIntervalMin,
+			s.RCAAvgSpeedKmh, s.RCAVisitMinutes,
+			s.RCAGeofenceRadiusM, s.RCAGeofenceBlock, s.RCAMinVisitMinutes,
+			s.RCATimezone, s.RCAMissedReasons,
+			s.RCAGPSRetentionDays, s.RCAGPSMaxAccuracyM,
+			s.RCAGeocoder, s.RCAGeocoderURL)
 
 		if err != nil {
 			http.Error(w, "Error saving settings: "+err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,423 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"aprovapedido/services"
+)
+
+// --- Slotting ---
+
+type SlottingAnalysis struct {
+	ID             int                 `json:"id"`
+	Filial         string              `json:"filial"`
+	Status         string              `json:"status"`
+	CurrentScore   float64             `json:"current_score"`
+	ProposedScore  float64             `json:"proposed_score"`
+	ImprovementPct float64             `json:"improvement_pct"`
+	TotalMoves     int                 `json:"total_moves"`
+	WaveID         *int                `json:"wave_id"`
+	CreatedBy      string              `json:"created_by"`
+	CreatedAt      string              `json:"created_at"`
+	Moves          []services.SlotMove `json:"moves,omitempty"`
+}
+
+// RunSlottingHandler handles POST /api/picking/slotting/analyze
+// Body: {"filial": "01", "max_moves": 30, "golden_level": 2, ...}
+// Any services.SlottingConfig field may be given; the rest use defaults.
+func RunSlottingHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		companyID := GetCompanyIDFromContext(r)
+
+		req := struct {
+			Filial string `json:"filial"`
+			services.SlottingConfig
+		}{SlottingConfig: services.DefaultSlottingConfig()}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Filial == "" {
+			http.Error(w, "filial is required", http.StatusBadRequest)
+			return
+		}
+		if req.MaxMoves < 1 || req.MaxMoves > 500 {
+			req.MaxMoves = services.DefaultSlottingConfig().MaxMoves
+		}
+
+		locations, products, err := loadSlottingInput(r, db, companyID, req.Filial)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(locations) == 0 {
+			http.Error(w, "Nenhum endereco ativo na filial "+req.Filial, http.StatusBadRequest)
+			return
+		}
+
+		result := services.OptimizeSlotting(locations, products, req.SlottingConfig)
+
+		var userID *int
+		if id, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+			userID = &id
+		}
+		params, _ := json.Marshal(req.SlottingConfig)
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var analysisID int
+		if err := tx.QueryRow(`
+			INSERT INTO slotting_analyses
+			  (company_id, filial, current_score, proposed_score, improvement_pct, total_moves, params, created_by)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id
+		`, companyID, req.Filial, result.CurrentScore, result.ProposedScore, result.ImprovementPct,
+			len(result.Moves), string(params), userID).Scan(&analysisID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, m := range result.Moves {
+			if _, err := tx.Exec(`
+				INSERT INTO slotting_moves
+				  (analysis_id, stock_id, product_code, product_description,
+				   from_location_id, from_location_code, to_location_id, to_location_code,
+				   swap_group, demand, gain)
+				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
+			`, analysisID, m.StockID, m.ProductCode, m.ProductDesc,
+				m.FromLocationID, m.FromLocationCode, m.ToLocationID, m.ToLocationCode,
+				m.SwapGroup, m.Demand, m.Gain); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SlottingAnalysis{
+			ID:             analysisID,
+			Filial:         req.Filial,
+			Status:         "proposta",
+			CurrentScore:   result.CurrentScore,
+			ProposedScore:  result.ProposedScore,
+			ImprovementPct: result.ImprovementPct,
+			TotalMoves:     len(result.Moves),
+			CreatedAt:      time.Now().Format(time.RFC3339),
+			Moves:          result.Moves,
+		})
+	}
+}
+
+// loadSlottingInput reads the active locations of a filial and the products
+// stored in them, with their consumption rate as demand.
+func loadSlottingInput(r *http.Request, db *sql.DB, companyID, filial string) ([]services.SlotLocation, []services.SlotProduct, error) {
+	rows, err := db.Query(`
+		SELECT id, location_code, COALESCE(aisle,''), COALESCE(bay,0), COALESCE(level,1), COALESCE(capacity_boxes,0)
+		FROM picking_locations
+		WHERE company_id=$1 AND filial=$2 AND COALESCE(is_active, TRUE)
+	`, companyID, filial)
+	if err != nil {
+		return nil, nil, err
+	}
+	var locations []services.SlotLocation
+	for rows.Next() {
+		var l services.SlotLocation
+		if err := rows.Scan(&l.ID, &l.Code, &l.Aisle, &l.Bay, &l.Level, &l.Capacity); err == nil {
+			locations = append(locations, l)
+		}
+	}
+	rows.Close()
+
+	var windowDays int
+	db.QueryRow(`SELECT COALESCE(consumption_window_days, 7) FROM settings WHERE company_id=$1`,
+		companyID).Scan(&windowDays)
+	rates, err := LoadConsumptionRates(r.Context(), db, companyID, filial, windowDays)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT id, product_code, COALESCE(product_description,''), abc_class, max_qty, location_id
+		FROM picking_stock
+		WHERE company_id=$1 AND filial=$2
+	`, companyID, filial)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var products []services.SlotProduct
+	for rows.Next() {
+		var p services.SlotProduct
+		if err := rows.Scan(&p.StockID, &p.ProductCode, &p.ProductDesc, &p.ABCClass, &p.MaxQty, &p.LocationID); err != nil {
+			continue
+		}
+		p.Demand = rates[p.StockID].PerHour
+		products = append(products, p)
+	}
+	return locations, products, rows.Err()
+}
+
+// ListSlottingHandler handles GET /api/picking/slotting?filial=01
+func ListSlottingHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+
+		query := `
+			SELECT a.id, a.filial, a.status, a.current_score, a.proposed_score, a.improvement_pct,
+			       a.total_moves, a.wave_id, COALESCE(u.full_name,''), a.created_at
+			FROM slotting_analyses a
+			LEFT JOIN users u ON u.id = a.created_by
+			WHERE a.company_id=$1
+		`
+		args := []interface{}{companyID}
+		if filial := r.URL.Query().Get("filial"); filial != "" {
+			query += " AND a.filial=$2"
+			args = append(args, filial)
+		}
+		query += " ORDER BY a.created_at DESC LIMIT 50"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		analyses := []SlottingAnalysis{}
+		for rows.Next() {
+			a, err := scanSlottingAnalysis(rows)
+			if err != nil {
+				continue
+			}
+			analyses = append(analyses, a)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"analyses": analyses})
+	}
+}
+
+func scanSlottingAnalysis(row interface{ Scan(...interface{}) error }) (SlottingAnalysis, error) {
+	var a SlottingAnalysis
+	var waveID sql.NullInt64
+	var createdAt time.Time
+	err := row.Scan(&a.ID, &a.Filial, &a.Status, &a.CurrentScore, &a.ProposedScore, &a.ImprovementPct,
+		&a.TotalMoves, &waveID, &a.CreatedBy, &createdAt)
+	if err != nil {
+		return a, err
+	}
+	if waveID.Valid {
+		id := int(waveID.Int64)
+		a.WaveID = &id
+	}
+	a.CreatedAt = createdAt.Format(time.RFC3339)
+	return a, nil
+}
+
+// SlottingDetailHandler handles
+//
+//	GET  /api/picking/slotting/:id       analysis with its moves
+//	POST /api/picking/slotting/:id/wave  convert the moves into a wave
+//	POST /api/picking/slotting/:id/discard
+//
+// sendWave starts sending the created wave in the background and returns
+// right away. When it fails the wave stays "gerada" for the next cycle.
+func SlottingDetailHandler(db *sql.DB, sendWave func(companyID string, waveID int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		companyID := GetCompanyIDFromContext(r)
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/picking/slotting/"), "/"), "/")
+		analysisID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid analysis ID", http.StatusBadRequest)
+			return
+		}
+
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			getSlottingAnalysis(w, db, companyID, analysisID)
+		case action == "wave" && r.Method == http.MethodPost:
+			convertSlottingToWave(w, r, db, companyID, analysisID, sendWave)
+		case action == "discard" && r.Method == http.MethodPost:
+			res, err := db.Exec(`
+				UPDATE slotting_analyses SET status='descartada'
+				WHERE id=$1 AND company_id=$2 AND status='proposta'
+			`, analysisID, companyID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "Analise nao encontrada ou ja convertida", http.StatusConflict)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "descartada"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func getSlottingAnalysis(w http.ResponseWriter, db *sql.DB, companyID string, analysisID int) {
+	a, err := scanSlottingAnalysis(db.QueryRow(`
+		SELECT a.id, a.filial, a.status, a.current_score, a.proposed_score, a.improvement_pct,
+		       a.total_moves, a.wave_id, COALESCE(u.full_name,''), a.created_at
+		FROM slotting_analyses a
+		LEFT JOIN users u ON u.id = a.created_by
+		WHERE a.id=$1 AND a.company_id=$2
+	`, analysisID, companyID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Analysis not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	moves, err := loadSlottingMoves(db, analysisID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.Moves = moves
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+func loadSlottingMoves(db *sql.DB, analysisID int) ([]services.SlotMove, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(stock_id,0), product_code, COALESCE(product_description,''),
+		       COALESCE(from_location_id,0), from_location_code, COALESCE(to_location_id,0), to_location_code,
+		       swap_group, demand, gain
+		FROM slotting_moves WHERE analysis_id=$1
+		ORDER BY swap_group, id
+	`, analysisID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	moves := []services.SlotMove{}
+	for rows.Next() {
+		var m services.SlotMove
+		if err := rows.Scan(&m.StockID, &m.ProductCode, &m.ProductDesc, &m.FromLocationID, &m.FromLocationCode,
+			&m.ToLocationID, &m.ToLocationCode, &m.SwapGroup, &m.Demand, &m.Gain); err != nil {
+			continue
+		}
+		moves = append(moves, m)
+	}
+	return moves, rows.Err()
+}
+
+// convertSlottingToWave creates a wave with triggered_by "slotting" holding
+// one relocation task per move: the product is taken from
+// from_location_code and stored in location_code.
+func convertSlottingToWave(w http.ResponseWriter, r *http.Request, db *sql.DB, companyID string, analysisID int, sendWave func(companyID string, waveID int) error) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var filial, status string
+	err = tx.QueryRow(`
+		SELECT filial, status FROM slotting_analyses WHERE id=$1 AND company_id=$2 FOR UPDATE
+	`, analysisID, companyID).Scan(&filial, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Analysis not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if status != "proposta" {
+		http.Error(w, "Analise ja "+status, http.StatusConflict)
+		return
+	}
+
+	var totalMoves int
+	tx.QueryRow(`SELECT COUNT(*) FROM slotting_moves WHERE analysis_id=$1`, analysisID).Scan(&totalMoves)
+	if totalMoves == 0 {
+		http.Error(w, "Analise sem movimentacoes", http.StatusBadRequest)
+		return
+	}
+
+	waveNumber, err := NextWaveNumber(r.Context(), tx, companyID, filial)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var waveID int
+	if err := tx.QueryRow(`
+		INSERT INTO replenishment_waves (company_id, filial, wave_number, total_tasks, triggered_by)
+		VALUES ($1, $2, $3, $4, 'slotting') RETURNING id
+	`, companyID, filial, waveNumber, totalMoves).Scan(&waveID); err != nil {
+		http.Error(w, fmt.Sprintf("insert wave: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Quantity to move is whatever the product holds in its current location
+	if _, err := tx.Exec(`
+		INSERT INTO replenishment_tasks
+		  (wave_id, company_id, filial, product_code, product_description, location_code,
+		   current_qty, min_qty, qty_to_replenish, abc_class, priority, task_type, from_location_code)
+		SELECT $1, $2, $3, m.product_code, m.product_description, m.to_location_code,
+		       COALESCE(ps.current_qty,0), COALESCE(ps.min_qty,0), COALESCE(ps.current_qty,0),
+		       COALESCE(ps.abc_class,'C'), m.swap_group, 'slotting', m.from_location_code
+		FROM slotting_moves m
+		LEFT JOIN picking_stock ps ON ps.id = m.stock_id
+		WHERE m.analysis_id = $4
+		ORDER BY m.swap_group, m.id
+	`, waveID, companyID, filial, analysisID); err != nil {
+		http.Error(w, fmt.Sprintf("insert tasks: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE slotting_analyses SET status='convertida', wave_id=$1 WHERE id=$2
+	`, waveID, analysisID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendWave(companyID, waveID); err != nil {
+		log.Printf("[Slotting] wave %d left for the scheduler: %v", waveID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"wave_id":     waveID,
+		"wave_number": waveNumber,
+		"total_tasks": totalMoves,
+	})
+}
@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -23,20 +25,23 @@ type Wave struct {
 	SentAt          *string `json:"sent_to_winthor_at"`
 	WinthorResponse string  `json:"winthor_response"`
 	ErrorMessage    string  `json:"error_message"`
+	Zone            string  `json:"zone"`
 }
 
 type ReplenishmentTask struct {
-	ID             int     `json:"id"`
-	ProductCode    string  `json:"product_code"`
-	ProductDesc    string  `json:"product_desc"`
-	LocationCode   string  `json:"location_code"`
-	CurrentQty     float64 `json:"current_qty"`
-	MinQty         float64 `json:"min_qty"`
-	QtyToReplenish float64 `json:"qty_to_replenish"`
-	ABCClass       string  `json:"abc_class"`
-	Priority       int     `json:"priority"`
-	Status         string  `json:"status"`
-	WinthorTaskID  string  `json:"winthor_task_id"`
+	ID               int     `json:"id"`
+	ProductCode      string  `json:"product_code"`
+	ProductDesc      string  `json:"product_desc"`
+	LocationCode     string  `json:"location_code"`
+	CurrentQty       float64 `json:"current_qty"`
+	MinQty           float64 `json:"min_qty"`
+	QtyToReplenish   float64 `json:"qty_to_replenish"`
+	ABCClass         string  `json:"abc_class"`
+	Priority         int     `json:"priority"`
+	Status           string  `json:"status"`
+	WinthorTaskID    string  `json:"winthor_task_id"`
+	TaskType         string  `json:"task_type"`
+	FromLocationCode string  `json:"from_location_code"`
 }
 
 type WaveStats struct {
@@ -64,7 +69,7 @@ func ListWavesHandler(db *sql.DB) http.HandlerFunc {
 
 		query := `SELECT id, filial, wave_number, status, total_tasks, completed_tasks,
 		                 triggered_by, generated_at, sent_to_winthor_at,
-		                 COALESCE(winthor_response,''), COALESCE(error_message,'')
+		                 COALESCE(winthor_response,''), COALESCE(error_message,''), COALESCE(zone,'')
 		          FROM replenishment_waves WHERE company_id=$1`
 		args := []interface{}{companyID}
 		argIdx := 2
@@ -101,7 +106,7 @@ func ListWavesHandler(db *sql.DB) http.HandlerFunc {
 			var sentAt sql.NullTime
 			rows.Scan(&wave.ID, &wave.Filial, &wave.WaveNumber, &wave.Status,
 				&wave.TotalTasks, &wave.CompletedTasks, &wave.TriggeredBy,
-				&generatedAt, &sentAt, &wave.WinthorResponse, &wave.ErrorMessage)
+				&generatedAt, &sentAt, &wave.WinthorResponse, &wave.ErrorMessage, &wave.Zone)
 			wave.GeneratedAt = generatedAt.Format(time.RFC3339)
 			if sentAt.Valid {
 				s := sentAt.Time.Format(time.RFC3339)
@@ -121,6 +126,11 @@ func ListWavesHandler(db *sql.DB) http.HandlerFunc {
 
 func GetWaveDetailHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/picklist.pdf") {
+			WavePickListHandler(db)(w, r)
+			return
+		}
+
 		companyID := GetCompanyIDFromContext(r)
 		idStr := strings.TrimPrefix(r.URL.Path, "/api/waves/")
 		waveID, err := strconv.Atoi(idStr)
@@ -135,12 +145,12 @@ func GetWaveDetailHandler(db *sql.DB) http.HandlerFunc {
 		err = db.QueryRow(`
 			SELECT id, filial, wave_number, status, total_tasks, completed_tasks,
 			       triggered_by, generated_at, sent_to_winthor_at,
-			       COALESCE(winthor_response,''), COALESCE(error_message,'')
+			       COALESCE(winthor_response,''), COALESCE(error_message,''), COALESCE(zone,'')
 			FROM replenishment_waves WHERE id=$1 AND company_id=$2
 		`, waveID, companyID).Scan(
 			&wave.ID, &wave.Filial, &wave.WaveNumber, &wave.Status,
 			&wave.TotalTasks, &wave.CompletedTasks, &wave.TriggeredBy,
-			&generatedAt, &sentAt, &wave.WinthorResponse, &wave.ErrorMessage)
+			&generatedAt, &sentAt, &wave.WinthorResponse, &wave.ErrorMessage, &wave.Zone)
 		if err == sql.ErrNoRows {
 			http.Error(w, "Wave not found", http.StatusNotFound)
 			return
@@ -155,7 +165,8 @@ func GetWaveDetailHandler(db *sql.DB) http.HandlerFunc {
 		taskRows, _ := db.Query(`
 			SELECT id, product_code, COALESCE(product_description,''), location_code,
 			       current_qty, min_qty, qty_to_replenish, abc_class, priority, status,
-			       COALESCE(winthor_task_id,'')
+			       COALESCE(winthor_task_id,''), COALESCE(task_type,'replenishment'),
+			       COALESCE(from_location_code,'')
 			FROM replenishment_tasks WHERE wave_id=$1 ORDER BY priority ASC, abc_class ASC
 		`, waveID)
 		defer taskRows.Close()
@@ -165,18 +176,52 @@ func GetWaveDetailHandler(db *sql.DB) http.HandlerFunc {
 			var t ReplenishmentTask
 			taskRows.Scan(&t.ID, &t.ProductCode, &t.ProductDesc, &t.LocationCode,
 				&t.CurrentQty, &t.MinQty, &t.QtyToReplenish, &t.ABCClass, &t.Priority,
-				&t.Status, &t.WinthorTaskID)
+				&t.Status, &t.WinthorTaskID, &t.TaskType, &t.FromLocationCode)
 			tasks = append(tasks, t)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"wave": wave, "tasks": tasks})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"wave": wave, "tasks": tasks,
+			"picklist_url": fmt.Sprintf("/api/waves/%d/picklist.pdf", wave.ID),
+		})
+	}
+}
+
+// --- Wave Number ---
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// NextWaveNumber reserves the next wave number of the filial for today,
+// formatted YYYYMMDD-FILIAL-SEQ. The sequence row is incremented atomically,
+// so concurrent callers never get the same number; the first number of a
+// day starts after any wave already generated that day.
+func NextWaveNumber(ctx context.Context, q rowQuerier, companyID, filial string) (string, error) {
+	var seq int
+	var day string
+	if err := q.QueryRowContext(ctx, `
+		INSERT INTO wave_sequences (company_id, filial, seq_date, last_seq)
+		SELECT $1::int, $2::varchar, CURRENT_DATE, COUNT(*) + 1
+		FROM replenishment_waves
+		WHERE company_id = $1 AND filial = $2 AND generated_at::date = CURRENT_DATE
+		ON CONFLICT (company_id, filial, seq_date)
+		DO UPDATE SET last_seq = wave_sequences.last_seq + 1
+		RETURNING last_seq, to_char(seq_date, 'YYYYMMDD')
+	`, companyID, filial).Scan(&seq, &day); err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("%s-%s-%03d", day, filial, seq), nil
 }
 
 // --- Generate Wave Manually ---
 
-func GenerateWaveHandler(db *sql.DB, generateFn func(companyID, filial string) error) http.HandlerFunc {
+// GenerateWaveHandler starts a sync and wave generation of one filial in
+// the background. generateFn returns the job run id to poll and whether it
+// started (false when the company already has a run in progress).
+func GenerateWaveHandler(db *sql.DB, generateFn func(companyID, filial string, userID *int) (int64, bool, error)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		companyID := GetCompanyIDFromContext(r)
 		var req struct {
@@ -187,17 +232,27 @@ func GenerateWaveHandler(db *sql.DB, generateFn func(companyID, filial string) e
 			http.Error(w, "filial is required", http.StatusBadRequest)
 			return
 		}
+		var userID *int
+		if uid, err := strconv.Atoi(GetUserIDFromContext(r)); err == nil {
+			userID = &uid
+		}
 
-		go func() {
-			if err := generateFn(companyID, req.Filial); err != nil {
-				// Log error but don't block response
-				_ = err
-			}
-		}()
+		jobID, started, err := generateFn(companyID, req.Filial, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		message := "Geracao de onda iniciada para filial " + req.Filial + "."
+		if !started {
+			message = "Sincronizacao ja em andamento."
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "Geracao de onda iniciada para filial " + req.Filial + ".",
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"job_id":     jobID,
+			"started":    started,
+			"message":    message,
+			"status_url": fmt.Sprintf("/api/scheduler/runs/%d", jobID),
 		})
 	}
 }
@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"strings"
@@ -37,6 +40,10 @@ type WinthorTaskItem struct {
 	QtyToReplenish  float64 `json:"qty_to_replenish"`
 	ABCClass        string  `json:"abc_class"`
 	Priority        int     `json:"priority"`
+	// Relocation tasks (slotting) move the product from FromLocationCode
+	// to LocationCode; empty TaskType means replenishment.
+	TaskType         string `json:"task_type,omitempty"`
+	FromLocationCode string `json:"from_location_code,omitempty"`
 }
 
 type WinthorWaveResponse struct {
@@ -48,8 +55,8 @@ type WinthorWaveResponse struct {
 // --- Interface ---
 
 type WinthorClient interface {
-	GetPickingStock(companyID, filial string) ([]WinthorStockItem, error)
-	SendReplenishmentWave(companyID string, wave WinthorWavePayload) (WinthorWaveResponse, error)
+	GetPickingStock(ctx context.Context, companyID, filial string) ([]WinthorStockItem, error)
+	SendReplenishmentWave(ctx context.Context, companyID string, wave WinthorWavePayload) (WinthorWaveResponse, error)
 }
 
 // --- Mock Client ---
@@ -58,14 +65,14 @@ type MockWinthorClient struct {
 	DB *sql.DB
 }
 
-func (m *MockWinthorClient) GetPickingStock(companyID, filial string) ([]WinthorStockItem, error) {
+func (m *MockWinthorClient) GetPickingStock(ctx context.Context, companyID, filial string) ([]WinthorStockItem, error) {
 	// Read current picking_stock from DB and apply simulated depletion
-	rows, err := m.DB.Query(`
+	rows, err := m.DB.QueryContext(ctx, `
 		SELECT ps.product_code, ps.product_description, ps.current_qty,
 		       ps.min_qty, ps.max_qty, ps.abc_class, pl.location_code
 		FROM picking_stock ps
 		JOIN picking_locations pl ON pl.id = ps.location_id
-		WHERE ps.company_id = $1 AND ps.filial = $2
+		WHERE ps.company_id = $1 AND ps.filial = $2 AND COALESCE(pl.is_active, TRUE)
 	`, companyID, filial)
 	if err != nil {
 		return nil, err
@@ -104,14 +111,18 @@ func (m *MockWinthorClient) GetPickingStock(companyID, filial string) ([]Winthor
 	}
 
 	// Small artificial delay to simulate API call
-	time.Sleep(time.Duration(50+rand.Intn(150)) * time.Millisecond)
+	if err := sleepCtx(ctx, time.Duration(50+rand.Intn(150))*time.Millisecond); err != nil {
+		return nil, err
+	}
 
 	return items, nil
 }
 
-func (m *MockWinthorClient) SendReplenishmentWave(companyID string, wave WinthorWavePayload) (WinthorWaveResponse, error) {
+func (m *MockWinthorClient) SendReplenishmentWave(ctx context.Context, companyID string, wave WinthorWavePayload) (WinthorWaveResponse, error) {
 	// Simulate API latency
-	time.Sleep(time.Duration(100+rand.Intn(300)) * time.Millisecond)
+	if err := sleepCtx(ctx, time.Duration(100+rand.Intn(300))*time.Millisecond); err != nil {
+		return WinthorWaveResponse{}, err
+	}
 
 	// 5% random error rate to test resilience
 	if rand.Float64() < 0.05 {
@@ -128,23 +139,58 @@ func (m *MockWinthorClient) SendReplenishmentWave(companyID string, wave Winthor
 
 // --- Real HTTP Client ---
 
+// RealWinthorClient talks to the Winthor HTTP API. Each call is bounded by
+// the caller's context plus a per-request timeout; retries are handled by
+// ResilientWinthorClient, not here.
 type RealWinthorClient struct {
-	BaseURL string
-	APIKey  string
-	Client  *http.Client
+	BaseURL        string
+	APIKey         string
+	Client         *http.Client
+	RequestTimeout time.Duration
 }
 
 func NewRealWinthorClient(baseURL, apiKey string) *RealWinthorClient {
 	return &RealWinthorClient{
-		BaseURL: strings.TrimRight(baseURL, "/"),
-		APIKey:  apiKey,
-		Client:  &http.Client{Timeout: 15 * time.Second},
+		BaseURL:        strings.TrimRight(baseURL, "/"),
+		APIKey:         apiKey,
+		Client:         &http.Client{},
+		RequestTimeout: 15 * time.Second,
 	}
 }
 
-func (c *RealWinthorClient) GetPickingStock(companyID, filial string) ([]WinthorStockItem, error) {
+// WinthorStatusError is returned when the API answers with a non-2xx status.
+// 5xx and 429 are considered transient and are retried.
+type WinthorStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *WinthorStatusError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("winthor API returned status %d: %s", e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("winthor API returned status %d", e.StatusCode)
+}
+
+func (e *WinthorStatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// ErrWinthorRejected means Winthor answered but refused the wave; resending
+// the same payload will not help.
+var ErrWinthorRejected = errors.New("winthor rejected wave")
+
+func readStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &WinthorStatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
+
+func (c *RealWinthorClient) GetPickingStock(ctx context.Context, companyID, filial string) ([]WinthorStockItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.RequestTimeout)
+	defer cancel()
+
 	url := fmt.Sprintf("%s/picking-stock?filial=%s", c.BaseURL, filial)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -158,7 +204,7 @@ func (c *RealWinthorClient) GetPickingStock(companyID, filial string) ([]Winthor
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("winthor API returned status %d", resp.StatusCode)
+		return nil, readStatusError(resp)
 	}
 
 	var items []WinthorStockItem
@@ -168,20 +214,26 @@ func (c *RealWinthorClient) GetPickingStock(companyID, filial string) ([]Winthor
 	return items, nil
 }
 
-func (c *RealWinthorClient) SendReplenishmentWave(companyID string, wave WinthorWavePayload) (WinthorWaveResponse, error) {
+func (c *RealWinthorClient) SendReplenishmentWave(ctx context.Context, companyID string, wave WinthorWavePayload) (WinthorWaveResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.RequestTimeout)
+	defer cancel()
+
 	url := fmt.Sprintf("%s/replenishment", c.BaseURL)
 	body, err := json.Marshal(wave)
 	if err != nil {
 		return WinthorWaveResponse{}, err
 	}
 
-	req, err := http.NewRequest("POST", url, strings.NewReader(string(body)))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(body)))
 	if err != nil {
 		return WinthorWaveResponse{}, err
 	}
 	req.Header.Set("Authorization", "Bearer "+c.APIKey)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Company-ID", companyID)
+	// The wave number identifies the wave across retries so Winthor can
+	// discard duplicates instead of creating the tasks twice.
+	req.Header.Set("Idempotency-Key", wave.WaveNumber)
 
 	resp, err := c.Client.Do(req)
 	if err != nil {
@@ -189,10 +241,17 @@ func (c *RealWinthorClient) SendReplenishmentWave(companyID string, wave Winthor
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return WinthorWaveResponse{}, readStatusError(resp)
+	}
+
 	var result WinthorWaveResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return WinthorWaveResponse{}, err
 	}
+	if !result.Success {
+		return result, fmt.Errorf("%w: wave %s: %s", ErrWinthorRejected, wave.WaveNumber, result.Message)
+	}
 	return result, nil
 }
 
@@ -204,9 +263,22 @@ type PickingSettings struct {
 	APIKey     string
 }
 
+// NewWinthorClient returns the raw client for the company settings, without
+// retries. The scheduler wraps it with NewResilientWinthorClient.
 func NewWinthorClient(db *sql.DB, settings PickingSettings) WinthorClient {
 	if settings.UseMock || settings.APIURL == "" {
 		return &MockWinthorClient{DB: db}
 	}
 	return NewRealWinthorClient(settings.APIURL, settings.APIKey)
 }
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
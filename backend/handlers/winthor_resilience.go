@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// --- Retry Policy ---
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultWinthorRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   1 * time.Second,
+	MaxDelay:    20 * time.Second,
+}
+
+// Backoff returns the delay before the given retry (1-based), doubling from
+// BaseDelay up to MaxDelay with up to 20% random jitter.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/5 + 1))
+	return d + jitter
+}
+
+// --- Circuit Breaker ---
+
+var ErrWinthorCircuitOpen = errors.New("winthor circuit breaker open: syncs paused after repeated failures")
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// CircuitBreaker opens after Threshold consecutive failed calls and stays
+// open for Cooldown. After that a single probe call is let through
+// (half-open): success closes the circuit, failure opens it again.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown, state: CircuitClosed}
+}
+
+// Allow reports whether a call may proceed, moving an expired open circuit
+// to half-open.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.Cooldown {
+			return ErrWinthorCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		return nil
+	default:
+		return nil
+	}
+}
+
+// IsOpen reports whether calls are currently being rejected, without
+// changing the breaker state.
+func (b *CircuitBreaker) IsOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == CircuitOpen && time.Since(b.openedAt) < b.Cooldown
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = CircuitClosed
+	b.failures = 0
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.Threshold {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+var winthorBreakers = struct {
+	sync.Mutex
+	m map[string]*CircuitBreaker
+}{m: map[string]*CircuitBreaker{}}
+
+// WinthorBreaker returns the circuit breaker shared by every Winthor call of
+// a company.
+func WinthorBreaker(companyID string) *CircuitBreaker {
+	winthorBreakers.Lock()
+	defer winthorBreakers.Unlock()
+	b, ok := winthorBreakers.m[companyID]
+	if !ok {
+		b = NewCircuitBreaker(3, 10*time.Minute)
+		winthorBreakers.m[companyID] = b
+	}
+	return b
+}
+
+// --- Resilient Client ---
+
+// WinthorAttempt describes a single call made by ResilientWinthorClient.
+type WinthorAttempt struct {
+	CompanyID      string
+	Filial         string
+	Operation      string // "stock_fetch" | "wave_send"
+	Attempt        int
+	IdempotencyKey string
+	Records        int
+	Duration       time.Duration
+	Err            error
+}
+
+// ResilientWinthorClient wraps a WinthorClient with exponential backoff
+// retries and the company circuit breaker. OnAttempt, when set, is called
+// after every attempt so it can be persisted in winthor_sync_log.
+type ResilientWinthorClient struct {
+	Inner     WinthorClient
+	Policy    RetryPolicy
+	Breaker   *CircuitBreaker
+	OnAttempt func(context.Context, WinthorAttempt)
+}
+
+func NewResilientWinthorClient(inner WinthorClient, companyID string, onAttempt func(context.Context, WinthorAttempt)) *ResilientWinthorClient {
+	return &ResilientWinthorClient{
+		Inner:     inner,
+		Policy:    DefaultWinthorRetryPolicy,
+		Breaker:   WinthorBreaker(companyID),
+		OnAttempt: onAttempt,
+	}
+}
+
+func (c *ResilientWinthorClient) GetPickingStock(ctx context.Context, companyID, filial string) ([]WinthorStockItem, error) {
+	var items []WinthorStockItem
+	err := c.do(ctx, WinthorAttempt{CompanyID: companyID, Filial: filial, Operation: "stock_fetch"},
+		func(ctx context.Context) (int, error) {
+			var err error
+			items, err = c.Inner.GetPickingStock(ctx, companyID, filial)
+			return len(items), err
+		})
+	return items, err
+}
+
+func (c *ResilientWinthorClient) SendReplenishmentWave(ctx context.Context, companyID string, wave WinthorWavePayload) (WinthorWaveResponse, error) {
+	var resp WinthorWaveResponse
+	err := c.do(ctx, WinthorAttempt{CompanyID: companyID, Filial: wave.Filial, Operation: "wave_send", IdempotencyKey: wave.WaveNumber},
+		func(ctx context.Context) (int, error) {
+			var err error
+			resp, err = c.Inner.SendReplenishmentWave(ctx, companyID, wave)
+			return len(wave.Tasks), err
+		})
+	return resp, err
+}
+
+func (c *ResilientWinthorClient) do(ctx context.Context, info WinthorAttempt, call func(context.Context) (int, error)) error {
+	if c.Breaker != nil {
+		if err := c.Breaker.Allow(); err != nil {
+			return err
+		}
+	}
+
+	maxAttempts := c.Policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		start := time.Now()
+		records, err := call(ctx)
+
+		a := info
+		a.Attempt = attempt
+		a.Records = records
+		a.Duration = time.Since(start)
+		a.Err = err
+		if c.OnAttempt != nil {
+			c.OnAttempt(ctx, a)
+		}
+
+		if err == nil {
+			if c.Breaker != nil {
+				c.Breaker.Success()
+			}
+			return nil
+		}
+		lastErr = err
+
+		if !isRetryableWinthorError(ctx, err) || attempt == maxAttempts {
+			break
+		}
+		if err := sleepCtx(ctx, c.Policy.Backoff(attempt)); err != nil {
+			lastErr = err
+			break
+		}
+	}
+
+	// Cancellation is not the ERP's fault and must not trip the breaker, and a
+	// rejected wave proves the ERP is reachable.
+	if c.Breaker != nil && ctx.Err() == nil {
+		if errors.Is(lastErr, ErrWinthorRejected) {
+			c.Breaker.Success()
+		} else {
+			c.Breaker.Failure()
+		}
+	}
+	return fmt.Errorf("%s failed: %w", info.Operation, lastErr)
+}
+
+func isRetryableWinthorError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, ErrWinthorCircuitOpen) || errors.Is(err, ErrWinthorRejected) {
+		return false
+	}
+	var statusErr *WinthorStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	return true
+}
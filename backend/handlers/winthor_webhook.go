@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Winthor Webhook Types ---
+
+const (
+	WebhookStockChanged  = "stock_changed"
+	WebhookTaskCompleted = "task_completed"
+	WebhookWaveRejected  = "wave_rejected"
+)
+
+// Maximum clock difference accepted in X-Winthor-Timestamp, to limit replays.
+const webhookMaxSkew = 5 * time.Minute
+
+// Column sizes of winthor_webhook_events (019) and of the stock movement
+// reference (021), which stores the event id behind webhookRefPrefix.
+const (
+	webhookRefPrefix    = "webhook:"
+	webhookMaxEventID   = 100 - len(webhookRefPrefix)
+	webhookMaxEventType = 30
+	webhookMaxFilial    = 5
+)
+
+type WinthorWebhookEvent struct {
+	EventID    string          `json:"event_id"`
+	EventType  string          `json:"event_type"`
+	Filial     string          `json:"filial"`
+	OccurredAt string          `json:"occurred_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+type WebhookStockItem struct {
+	LocationCode string  `json:"location_code"`
+	ProductCode  string  `json:"product_code"`
+	CurrentQty   float64 `json:"current_qty"`
+}
+
+type WebhookStockData struct {
+	Items []WebhookStockItem `json:"items"`
+}
+
+type WebhookTaskData struct {
+	WaveNumber     string   `json:"wave_number"`
+	LocationCode   string   `json:"location_code"`
+	ProductCode    string   `json:"product_code"`
+	WinthorTaskID  string   `json:"winthor_task_id"`
+	QtyReplenished float64  `json:"qty_replenished"`
+	CurrentQty     *float64 `json:"current_qty"`
+}
+
+type WebhookWaveData struct {
+	WaveNumber string `json:"wave_number"`
+	Reason     string `json:"reason"`
+}
+
+// SignWinthorWebhook computes the X-Winthor-Signature value for a body:
+// "sha256=" + hex(HMAC-SHA256(api_key, timestamp + "." + body)).
+func SignWinthorWebhook(apiKey, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// --- Handler ---
+
+// WinthorWebhookHandler handles POST /api/winthor/webhook
+// Headers: X-Company-ID, X-Winthor-Timestamp (unix seconds) and
+// X-Winthor-Signature, signed with the company's winthor_api_key.
+// Events are applied once per event_id; repeated deliveries return
+// status "duplicate".
+func WinthorWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		companyID := r.Header.Get("X-Company-ID")
+		if _, err := strconv.Atoi(companyID); err != nil {
+			http.Error(w, "X-Company-ID is required", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 5<<20))
+		if err != nil {
+			http.Error(w, "Error reading body", http.StatusBadRequest)
+			return
+		}
+
+		var apiKey string
+		db.QueryRow(`SELECT COALESCE(winthor_api_key,'') FROM settings WHERE company_id=$1`, companyID).Scan(&apiKey)
+		if apiKey == "" {
+			http.Error(w, "Webhook not configured", http.StatusUnauthorized)
+			return
+		}
+
+		timestamp := r.Header.Get("X-Winthor-Timestamp")
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid X-Winthor-Timestamp", http.StatusUnauthorized)
+			return
+		}
+		if skew := time.Since(time.Unix(ts, 0)); skew > webhookMaxSkew || skew < -webhookMaxSkew {
+			http.Error(w, "Timestamp outside allowed window", http.StatusUnauthorized)
+			return
+		}
+		expected := SignWinthorWebhook(apiKey, timestamp, body)
+		if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Winthor-Signature"))) {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var ev WinthorWebhookEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if ev.EventID == "" || ev.EventType == "" {
+			http.Error(w, "event_id and event_type are required", http.StatusBadRequest)
+			return
+		}
+		// Oversized values would fail the INSERT with a 500, which Winthor
+		// retries forever; refuse them for good instead
+		if len(ev.EventID) > webhookMaxEventID || len(ev.EventType) > webhookMaxEventType || len(ev.Filial) > webhookMaxFilial {
+			http.Error(w, fmt.Sprintf("event_id, event_type and filial are limited to %d, %d and %d characters",
+				webhookMaxEventID, webhookMaxEventType, webhookMaxFilial), http.StatusBadRequest)
+			return
+		}
+		occurredAt := time.Now()
+		if ev.OccurredAt != "" {
+			if t, err := time.Parse(time.RFC3339, ev.OccurredAt); err == nil {
+				occurredAt = t
+			}
+		}
+
+		start := time.Now()
+		status, message, err := applyWinthorWebhook(db, companyID, ev, body, occurredAt)
+		durMs := int(time.Since(start).Milliseconds())
+		syncType := "webhook_" + ev.EventType
+		if len(syncType) > 30 {
+			syncType = syncType[:30]
+		}
+
+		if err != nil {
+			log.Printf("[Webhook] company=%s event=%s: %v", companyID, ev.EventID, err)
+			logWinthorSync(db, companyID, ev.Filial, syncType, "error", 0, err.Error(), durMs)
+			// Not stored, so Winthor can deliver the same event again
+			http.Error(w, "Error applying event: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if status != "duplicate" {
+			logWinthorSync(db, companyID, ev.Filial, syncType, status, 1, message, durMs)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"event_id": ev.EventID,
+			"status":   status,
+			"message":  message,
+		})
+	}
+}
+
+// applyWinthorWebhook records the event and applies it in one transaction.
+// Returns status "applied", "ignored" (valid but nothing to change) or
+// "duplicate" (event_id already processed).
+func applyWinthorWebhook(db *sql.DB, companyID string, ev WinthorWebhookEvent, body []byte, occurredAt time.Time) (string, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var eventRowID int
+	err = tx.QueryRow(`
+		INSERT INTO winthor_webhook_events (company_id, event_id, event_type, filial, payload, status, occurred_at)
+		VALUES ($1,$2,$3,$4,$5,'processing',$6)
+		ON CONFLICT (company_id, event_id) DO NOTHING
+		RETURNING id
+	`, companyID, ev.EventID, ev.EventType, ev.Filial, string(body), occurredAt).Scan(&eventRowID)
+	if err == sql.ErrNoRows {
+		return "duplicate", "Evento ja processado", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var applied int
+	var message string
+	switch ev.EventType {
+	case WebhookStockChanged:
+		applied, message, err = applyWebhookStock(tx, companyID, ev, occurredAt)
+	case WebhookTaskCompleted:
+		applied, message, err = applyWebhookTask(tx, companyID, ev, occurredAt)
+	case WebhookWaveRejected:
+		applied, message, err = applyWebhookWaveRejected(tx, companyID, ev)
+	default:
+		message = "Tipo de evento desconhecido: " + ev.EventType
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	status := "applied"
+	if applied == 0 {
+		status = "ignored"
+	}
+	if _, err := tx.Exec(`UPDATE winthor_webhook_events SET status=$1, message=$2 WHERE id=$3`,
+		status, message, eventRowID); err != nil {
+		return "", "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+	return status, message, nil
+}
+
+func applyWebhookStock(tx *sql.Tx, companyID string, ev WinthorWebhookEvent, occurredAt time.Time) (int, string, error) {
+	var data WebhookStockData
+	if err := json.Unmarshal(ev.Data, &data); err != nil {
+		return 0, "", fmt.Errorf("invalid stock data: %w", err)
+	}
+
+	updated := 0
+	for _, it := range data.Items {
+		// Older events than the last sync of the location are skipped, so a
+		// late delivery cannot overwrite newer stock.
+		stockID, err := webhookStockID(tx, companyID, ev.Filial, it.LocationCode, it.ProductCode, &occurredAt)
+		if err != nil {
+			return 0, "", err
+		}
+		if stockID == 0 {
+			continue
+		}
+		ok, err := setStockQty(tx, stockID, it.CurrentQty, StockMovement{
+			Type: MovementSync, Reference: webhookRefPrefix + ev.EventID, SyncedAt: &occurredAt,
+		})
+		if err != nil {
+			return 0, "", err
+		}
+		if ok {
+			updated++
+		}
+	}
+	return updated, fmt.Sprintf("%d de %d posicoes atualizadas", updated, len(data.Items)), nil
+}
+
+func applyWebhookTask(tx *sql.Tx, companyID string, ev WinthorWebhookEvent, occurredAt time.Time) (int, string, error) {
+	var data WebhookTaskData
+	if err := json.Unmarshal(ev.Data, &data); err != nil {
+		return 0, "", fmt.Errorf("invalid task data: %w", err)
+	}
+
+	var waveID int
+	err := tx.QueryRow(`
+		SELECT id FROM replenishment_waves WHERE company_id=$1 AND wave_number=$2
+	`, companyID, data.WaveNumber).Scan(&waveID)
+	if err == sql.ErrNoRows {
+		return 0, "Onda nao encontrada: " + data.WaveNumber, nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	res, err := tx.Exec(`
+		UPDATE replenishment_tasks
+		SET status = 'concluido', completed_at = $1,
+		    winthor_task_id = CASE WHEN $2 <> '' THEN $2 ELSE winthor_task_id END
+		WHERE wave_id = $3 AND location_code = $4 AND product_code = $5 AND status <> 'concluido'
+	`, occurredAt, data.WinthorTaskID, waveID, data.LocationCode, data.ProductCode)
+	if err != nil {
+		return 0, "", err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return 0, "Tarefa nao encontrada ou ja concluida", nil
+	}
+
+	if data.CurrentQty != nil {
+		stockID, err := webhookStockID(tx, companyID, ev.Filial, data.LocationCode, data.ProductCode, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		if stockID != 0 {
+			if _, err := setStockQty(tx, stockID, *data.CurrentQty, StockMovement{
+				Type: MovementReplenishment, Reference: "wave:" + data.WaveNumber, SyncedAt: &occurredAt,
+			}); err != nil {
+				return 0, "", err
+			}
+		}
+	}
+
+	// Wave is complete once all of its tasks are
+	if _, err := tx.Exec(`
+		UPDATE replenishment_waves w
+		SET completed_tasks = t.done,
+		    status = CASE WHEN t.done >= t.total THEN 'concluida' ELSE w.status END,
+		    completed_at = CASE WHEN t.done >= t.total THEN $2 ELSE w.completed_at END
+		FROM (
+			SELECT COUNT(*) AS total,
+			       COUNT(*) FILTER (WHERE status = 'concluido') AS done
+			FROM replenishment_tasks WHERE wave_id = $1
+		) t
+		WHERE w.id = $1
+	`, waveID, occurredAt); err != nil {
+		return 0, "", err
+	}
+	return int(n), "Tarefa concluida na onda " + data.WaveNumber, nil
+}
+
+// webhookStockID resolves a picking_stock row by location and product. With
+// notAfter set, rows synced after that instant are ignored so a late
+// delivery cannot overwrite newer stock. Returns 0 when nothing matches or
+// the location is deactivated.
+func webhookStockID(tx *sql.Tx, companyID, filial, locationCode, productCode string, notAfter *time.Time) (int, error) {
+	var id int
+	err := tx.QueryRow(`
+		SELECT ps.id
+		FROM picking_stock ps
+		JOIN picking_locations pl ON pl.id = ps.location_id
+		WHERE ps.company_id = $1 AND ps.filial = $2
+		  AND pl.location_code = $3 AND ps.product_code = $4 AND COALESCE(pl.is_active, TRUE)
+		  AND ($5::timestamptz IS NULL OR ps.last_sync_at IS NULL OR ps.last_sync_at <= $5)
+	`, companyID, filial, locationCode, productCode, notAfter).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+func applyWebhookWaveRejected(tx *sql.Tx, companyID string, ev WinthorWebhookEvent) (int, string, error) {
+	var data WebhookWaveData
+	if err := json.Unmarshal(ev.Data, &data); err != nil {
+		return 0, "", fmt.Errorf("invalid wave data: %w", err)
+	}
+
+	// "rejeitada" is terminal: unlike "erro" it is not re-sent by the scheduler
+	var waveID int
+	err := tx.QueryRow(`
+		UPDATE replenishment_waves
+		SET status = 'rejeitada', error_message = $1
+		WHERE company_id = $2 AND wave_number = $3 AND status NOT IN ('concluida','rejeitada')
+		RETURNING id
+	`, strings.TrimSpace("Rejeitada pelo Winthor: "+data.Reason), companyID, data.WaveNumber).Scan(&waveID)
+	if err == sql.ErrNoRows {
+		return 0, "Onda nao encontrada ou ja finalizada: " + data.WaveNumber, nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE replenishment_tasks SET status = 'cancelado' WHERE wave_id = $1 AND status = 'pendente'
+	`, waveID); err != nil {
+		return 0, "", err
+	}
+	return 1, "Onda " + data.WaveNumber + " rejeitada", nil
+}
+
+// logWinthorSync writes an entry to winthor_sync_log from outside the
+// scheduler.
+func logWinthorSync(db *sql.DB, companyID, filial, syncType, status string, records int, errMsg string, durMs int) {
+	db.Exec(`
+		INSERT INTO winthor_sync_log (company_id, filial, sync_type, status, records_processed, error_message, duration_ms)
+		VALUES ($1,$2,$3,$4,$5,$6,$7)
+	`, companyID, filial, syncType, status, records, errMsg, durMs)
+}
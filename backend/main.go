@@ -309,35 +309,115 @@ func main() {
 	// Picking Module — specific routes BEFORE the wildcard /api/picking/
 	http.HandleFunc("/api/picking/dashboard", corsMiddleware(withAuth(handlers.GetPickingDashboardHandler, "")))
 	http.HandleFunc("/api/picking/fragmentation", corsMiddleware(withAuth(handlers.GetFragmentationHandler, "")))
+	// GET /api/picking/kpis?filial=&from=&to=&format=csv
+	http.HandleFunc("/api/picking/kpis", corsMiddleware(withAuth(handlers.GetPickingKPIsHandler, "")))
 	http.HandleFunc("/api/picking/import", corsMiddleware(withAuth(handlers.ImportPickingCSVHandler, "")))
+	http.HandleFunc("/api/picking/import/preview", corsMiddleware(withAuth(handlers.PreviewPickingImportHandler, "")))
+	// GET /api/picking/import/:id, POST /api/picking/import/:id/commit | /discard
+	http.HandleFunc("/api/picking/import/", corsMiddleware(withAuth(handlers.PickingImportBatchHandler, "")))
 	http.HandleFunc("/api/picking/sync", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		database := getDB()
 		if database == nil {
 			http.Error(w, "Database initializing...", http.StatusServiceUnavailable)
 			return
 		}
-		h := handlers.SyncNowHandler(database, func(companyID string) {
-			if pickingScheduler != nil {
-				pickingScheduler.RunNow(companyID)
+		h := handlers.SyncNowHandler(database, func(companyID string, userID *int) (int64, bool, error) {
+			if pickingScheduler == nil {
+				return 0, false, fmt.Errorf("scheduler indisponivel")
 			}
+			return pickingScheduler.RunNow(companyID, userID)
 		})
 		handlers.AuthMiddleware(h, "")(w, r)
 	}))
+
+	// Scheduler job history and control
+	http.HandleFunc("/api/scheduler/runs", corsMiddleware(withAuth(handlers.ListSchedulerRunsHandler, "")))
+	// GET /api/scheduler/runs/:id, POST /api/scheduler/runs/:id/cancel
+	http.HandleFunc("/api/scheduler/runs/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		database := getDB()
+		if database == nil {
+			http.Error(w, "Database initializing...", http.StatusServiceUnavailable)
+			return
+		}
+		h := handlers.SchedulerRunHandler(database, func(id int64) bool {
+			return pickingScheduler != nil && pickingScheduler.CancelRun(id)
+		})
+		handlers.AuthMiddleware(h, "")(w, r)
+	}))
+	http.HandleFunc("/api/scheduler/pauses", corsMiddleware(withAuth(handlers.ListSchedulerPausesHandler, "")))
+	http.HandleFunc("/api/scheduler/pause", corsMiddleware(withAuth(handlers.PauseSchedulerHandler, "")))
+	http.HandleFunc("/api/scheduler/resume", corsMiddleware(withAuth(handlers.ResumeSchedulerHandler, "")))
 	http.HandleFunc("/api/picking/sync-log", corsMiddleware(withAuth(handlers.GetSyncLogHandler, "")))
-	http.HandleFunc("/api/picking/locations", corsMiddleware(withAuth(handlers.ListPickingLocationsHandler, "")))
+	http.HandleFunc("/api/picking/locations", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		database := getDB()
+		if database == nil {
+			http.Error(w, "Database initializing...", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			handlers.AuthMiddleware(handlers.ListPickingLocationsHandler(database), "")(w, r)
+		case http.MethodPost:
+			handlers.AuthMiddleware(handlers.CreatePickingLocationHandler(database), "")(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	http.HandleFunc("/api/picking/locations/catalog", corsMiddleware(withAuth(handlers.ListLocationCatalogHandler, "")))
+	http.HandleFunc("/api/picking/locations/bulk", corsMiddleware(withAuth(handlers.BulkUpdateLocationsHandler, "")))
+	// GET /api/picking/locations/labels?filial=&format=pdf|zpl&symbology=code128|qr
+	http.HandleFunc("/api/picking/locations/labels", corsMiddleware(withAuth(handlers.LocationLabelsHandler, "")))
+	http.HandleFunc("/api/picking/stock", corsMiddleware(withAuth(handlers.CreatePickingStockHandler, "")))
+	http.HandleFunc("/api/picking/stock/adjust", corsMiddleware(withAuth(handlers.AdjustPickingStockHandler, "")))
+	http.HandleFunc("/api/picking/stock/movements", corsMiddleware(withAuth(handlers.GetStockMovementsHandler, "")))
+	// PUT /api/picking/stock/:id, POST /api/picking/stock/:id/move
+	http.HandleFunc("/api/picking/stock/", corsMiddleware(withAuth(handlers.PickingStockHandler, "")))
+	http.HandleFunc("/api/picking/minmax", corsMiddleware(withAuth(handlers.ListMinMaxHandler, "")))
+	http.HandleFunc("/api/picking/minmax/generate", corsMiddleware(withAuth(handlers.GenerateMinMaxHandler, "")))
+	http.HandleFunc("/api/picking/minmax/changes", corsMiddleware(withAuth(handlers.GetParamChangesHandler, "")))
+	// POST /api/picking/minmax/:id/accept | /reject
+	http.HandleFunc("/api/picking/minmax/", corsMiddleware(withAuth(handlers.ReviewMinMaxHandler, "")))
+	http.HandleFunc("/api/picking/slotting", corsMiddleware(withAuth(handlers.ListSlottingHandler, "")))
+	http.HandleFunc("/api/picking/slotting/analyze", corsMiddleware(withAuth(handlers.RunSlottingHandler, "")))
+	// GET /api/picking/slotting/:id, POST /api/picking/slotting/:id/wave | /discard
+	http.HandleFunc("/api/picking/slotting/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		database := getDB()
+		if database == nil {
+			http.Error(w, "Database initializing...", http.StatusServiceUnavailable)
+			return
+		}
+		h := handlers.SlottingDetailHandler(database, func(companyID string, waveID int) error {
+			if pickingScheduler == nil {
+				return fmt.Errorf("scheduler indisponivel")
+			}
+			return pickingScheduler.SendWaveNow(companyID, waveID)
+		})
+		handlers.AuthMiddleware(h, "")(w, r)
+	}))
+	http.HandleFunc("/api/picking/alerts", corsMiddleware(withAuth(handlers.ListPickingAlertsHandler, "")))
+	// POST /api/picking/alerts/:id/ack
+	http.HandleFunc("/api/picking/alerts/", corsMiddleware(withAuth(handlers.AckPickingAlertHandler, "")))
 	http.HandleFunc("/api/picking/locations/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		database := getDB()
 		if database == nil {
 			http.Error(w, "Database initializing...", http.StatusServiceUnavailable)
 			return
 		}
-		if r.Method == http.MethodDelete {
+		switch r.Method {
+		case http.MethodGet:
+			handlers.AuthMiddleware(handlers.GetPickingLocationHandler(database), "")(w, r)
+		case http.MethodPut:
+			handlers.AuthMiddleware(handlers.UpdatePickingLocationHandler(database), "")(w, r)
+		case http.MethodDelete:
 			handlers.AuthMiddleware(handlers.DeletePickingLocationHandler(database), "")(w, r)
-		} else {
+		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}))
 
+	// Winthor inbound webhook — authenticated by HMAC signature, not JWT
+	http.HandleFunc("/api/winthor/webhook", corsMiddleware(withDB(handlers.WinthorWebhookHandler)))
+
 	// Waves — specific routes BEFORE /api/waves/
 	http.HandleFunc("/api/waves/stats", corsMiddleware(withAuth(handlers.GetWaveStatsHandler, "")))
 	http.HandleFunc("/api/waves/generate", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
@@ -346,12 +426,16 @@ func main() {
 			http.Error(w, "Database initializing...", http.StatusServiceUnavailable)
 			return
 		}
-		h := handlers.GenerateWaveHandler(database, func(companyID, filial string) error {
-			return scheduler.GenerateWaveManual(database, companyID, filial)
+		h := handlers.GenerateWaveHandler(database, func(companyID, filial string, userID *int) (int64, bool, error) {
+			if pickingScheduler == nil {
+				return 0, false, fmt.Errorf("scheduler indisponivel")
+			}
+			return pickingScheduler.GenerateWaveNow(companyID, filial, userID)
 		})
 		handlers.AuthMiddleware(h, "")(w, r)
 	}))
 	http.HandleFunc("/api/waves", corsMiddleware(withAuth(handlers.ListWavesHandler, "")))
+	// GET /api/waves/:id and /api/waves/:id/picklist.pdf
 	http.HandleFunc("/api/waves/", corsMiddleware(withAuth(handlers.GetWaveDetailHandler, "")))
 
 	// Company users — GET list / POST create in same company
@@ -363,10 +447,41 @@ func main() {
 	http.HandleFunc("/api/rca/representatives", corsMiddleware(withAuth(handlers.ListOrCreateRCARepresentativesHandler, "")))
 	http.HandleFunc("/api/rca/routes", corsMiddleware(withAuth(handlers.ListOrCreateRCARoutesHandler, "")))
 	http.HandleFunc("/api/rca/dashboard", corsMiddleware(withAuth(handlers.GetRCADashboardHandler, "")))
+	// GET ?rca_id=&date= agenda of a day / POST {rca_id, date_from, date_to} generate ahead
+	http.HandleFunc("/api/rca/agenda", corsMiddleware(withAuth(handlers.RCAAgendaHandler, "")))
 	http.HandleFunc("/api/rca/my-route", corsMiddleware(withAuth(handlers.GetMyRouteHandler, "rca")))
+	// GET /api/rca/my-route/optimized?lat=&lng=&route_id=&start=HH:MM
+	http.HandleFunc("/api/rca/my-route/optimized", corsMiddleware(withAuth(handlers.GetOptimizedRouteHandler, "rca")))
 	http.HandleFunc("/api/rca/visits/checkin", corsMiddleware(withAuth(handlers.RCACheckinHandler, "rca")))
 	http.HandleFunc("/api/rca/visits/checkout", corsMiddleware(withAuth(handlers.RCACheckoutHandler, "rca")))
 	http.HandleFunc("/api/rca/visits/today", corsMiddleware(withAuth(handlers.GetTodayVisitsHandler, "rca")))
+	// GET /api/rca/visits/suspicious?date_from=&date_to=&rca_id=
+	http.HandleFunc("/api/rca/visits/suspicious", corsMiddleware(withAuth(handlers.ListSuspiciousVisitsHandler, "")))
+	// GET missed visits to justify / POST {visit_id, reason, notes}
+	http.HandleFunc("/api/rca/visits/missed", corsMiddleware(withAuth(handlers.RCAMissedVisitsHandler, "rca")))
+	// GET /api/rca/closings?date_from=&date_to=
+	http.HandleFunc("/api/rca/closings", corsMiddleware(withAuth(handlers.ListRCADayClosingsHandler, "")))
+	// Check-out outcomes: form for the app, no-sale reasons, surveys, positivação
+	http.HandleFunc("/api/rca/checkout-form", corsMiddleware(withAuth(handlers.RCACheckoutFormHandler, "")))
+	http.HandleFunc("/api/rca/no-sale-reasons", corsMiddleware(withAuth(handlers.RCANoSaleReasonsHandler, "")))
+	http.HandleFunc("/api/rca/surveys", corsMiddleware(withAuth(handlers.RCASurveysHandler, "")))
+	// GET /api/rca/positivacao?date_from=&date_to=&rca_id=
+	http.HandleFunc("/api/rca/positivacao", corsMiddleware(withAuth(handlers.RCAPositivacaoHandler, "")))
+	// Sales orders: GET ?q=&filial= products with price and stock, GET/POST orders
+	http.HandleFunc("/api/rca/products", corsMiddleware(withAuth(handlers.RCAProductsHandler, "")))
+	http.HandleFunc("/api/rca/orders", corsMiddleware(withAuth(handlers.RCAOrdersHandler, "")))
+	// Wildcard: /api/rca/orders/:id and POST /api/rca/orders/:id/{submit,approve,reject,cancel,export}
+	http.HandleFunc("/api/rca/orders/", corsMiddleware(withAuth(handlers.RCAOrderHandler, "")))
+	// Customer location proposals: GET ?status=, GET /:id, POST /:id/approve|reject
+	http.HandleFunc("/api/rca/location-requests", corsMiddleware(withAuth(handlers.RCALocationRequestsHandler, "")))
+	http.HandleFunc("/api/rca/location-requests/", corsMiddleware(withAuth(handlers.RCALocationRequestHandler, "")))
+	// Offline sync: POST queued events / GET ?cursor=&limit= routes and customers changed since the cursor
+	http.HandleFunc("/api/rca/sync", corsMiddleware(withAuth(handlers.RCASyncHandler, "rca")))
+	http.HandleFunc("/api/rca/sync/changes", corsMiddleware(withAuth(handlers.RCASyncChangesHandler, "rca")))
+	// GPS breadcrumbs: POST batches of points / GET ?rca_id=&date= path and legs / GET mileage report
+	http.HandleFunc("/api/rca/tracking/points", corsMiddleware(withAuth(handlers.RCATrackingPointsHandler, "rca")))
+	http.HandleFunc("/api/rca/tracking/day", corsMiddleware(withAuth(handlers.RCATrackingDayHandler, "")))
+	http.HandleFunc("/api/rca/tracking/mileage", corsMiddleware(withAuth(handlers.RCAMileageHandler, "")))
 
 	// Wildcard: /api/rca/routes/:id/customers
 	http.HandleFunc("/api/rca/routes/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
@@ -383,7 +498,7 @@ func main() {
 			return
 		}
 		// /routes/:id/customers/geocode
-		if len(parts) == 3 && parts[1] == "customers" && parts[2] == "geocode" && r.Method == http.MethodPost {
+		if len(parts) == 3 && parts[1] == "customers" && parts[2] == "geocode" {
 			handlers.AuthMiddleware(handlers.GeocodeRouteCustomersHandler(database), "")(w, r)
 			return
 		}
@@ -402,13 +517,45 @@ func main() {
 		http.Error(w, "Not found", http.StatusNotFound)
 	}))
 
-	// Wildcard: DELETE /api/rca/customers/:id
+	// Wildcard: PUT /api/rca/surveys/:id, GET /api/rca/surveys/:id/answers
+	http.HandleFunc("/api/rca/surveys/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		database := getDB()
+		if database == nil {
+			http.Error(w, "Database initializing...", http.StatusServiceUnavailable)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rca/surveys/"), "/")
+		if len(parts) == 2 && parts[1] == "answers" && r.Method == http.MethodGet {
+			handlers.AuthMiddleware(handlers.ListSurveyAnswersHandler(database), "")(w, r)
+			return
+		}
+		if len(parts) == 1 && r.Method == http.MethodPut {
+			handlers.AuthMiddleware(handlers.UpdateRCASurveyHandler(database), "")(w, r)
+			return
+		}
+		http.Error(w, "Not found", http.StatusNotFound)
+	}))
+
+	// Wildcard: PUT/DELETE /api/rca/customers/:id, PUT /api/rca/customers/:id/schedule,
+	// POST /api/rca/customers/:id/location
 	http.HandleFunc("/api/rca/customers/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		database := getDB()
 		if database == nil {
 			http.Error(w, "Database initializing...", http.StatusServiceUnavailable)
 			return
 		}
+		if strings.HasSuffix(r.URL.Path, "/schedule") && r.Method == http.MethodPut {
+			handlers.AuthMiddleware(handlers.UpdateCustomerScheduleHandler(database), "")(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/location") && r.Method == http.MethodPost {
+			handlers.AuthMiddleware(handlers.RCACustomerLocationHandler(database), "")(w, r)
+			return
+		}
+		if r.Method == http.MethodPut {
+			handlers.AuthMiddleware(handlers.UpdateRCACustomerHandler(database), "")(w, r)
+			return
+		}
 		if r.Method == http.MethodDelete {
 			handlers.AuthMiddleware(handlers.DeleteRCACustomerHandler(database), "")(w, r)
 			return
@@ -456,6 +603,16 @@ func main() {
 			log.Printf("HTTP server shutdown error: %v", err)
 		}
 
+		// Let the scheduler finish the cycle and sends in flight before
+		// closing the database; past the timeout they are cancelled
+		if pickingScheduler != nil {
+			schedCtx, schedCancel := context.WithTimeout(context.Background(), 15*time.Second)
+			if err := pickingScheduler.Shutdown(schedCtx); err != nil {
+				log.Printf("Scheduler shutdown: %v", err)
+			}
+			schedCancel()
+		}
+
 		database := getDB()
 		if database != nil {
 			database.Close()
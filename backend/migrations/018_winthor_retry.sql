@@ -0,0 +1,8 @@
+-- Retry bookkeeping for Winthor calls
+ALTER TABLE winthor_sync_log ADD COLUMN IF NOT EXISTS attempt INTEGER DEFAULT 1;
+ALTER TABLE winthor_sync_log ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(50) DEFAULT '';
+
+ALTER TABLE replenishment_waves ADD COLUMN IF NOT EXISTS send_attempts INTEGER DEFAULT 0;
+ALTER TABLE replenishment_waves ADD COLUMN IF NOT EXISTS next_retry_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_waves_retry ON replenishment_waves(status, next_retry_at);
@@ -0,0 +1,16 @@
+-- Inbound Winthor webhook events (idempotency by event_id)
+CREATE TABLE IF NOT EXISTS winthor_webhook_events (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    event_id VARCHAR(100) NOT NULL,
+    event_type VARCHAR(30) NOT NULL,
+    filial VARCHAR(5) DEFAULT '',
+    payload JSONB,
+    status VARCHAR(20) NOT NULL,
+    message TEXT DEFAULT '',
+    occurred_at TIMESTAMPTZ,
+    received_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE(company_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_events_company ON winthor_webhook_events(company_id, received_at DESC);
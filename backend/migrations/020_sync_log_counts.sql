@@ -0,0 +1,4 @@
+-- Per-sync breakdown of the stock merge
+ALTER TABLE winthor_sync_log ADD COLUMN IF NOT EXISTS records_inserted INTEGER DEFAULT 0;
+ALTER TABLE winthor_sync_log ADD COLUMN IF NOT EXISTS records_updated INTEGER DEFAULT 0;
+ALTER TABLE winthor_sync_log ADD COLUMN IF NOT EXISTS records_missing INTEGER DEFAULT 0;
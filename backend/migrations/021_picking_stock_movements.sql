@@ -0,0 +1,26 @@
+-- Every change of picking_stock.current_qty
+CREATE TABLE IF NOT EXISTS picking_stock_movements (
+    id BIGSERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    filial VARCHAR(5) NOT NULL,
+    stock_id INTEGER REFERENCES picking_stock(id) ON DELETE CASCADE,
+    location_id INTEGER,
+    product_code VARCHAR(50) NOT NULL,
+    movement_type VARCHAR(20) NOT NULL,
+    qty_before NUMERIC(15,3) DEFAULT 0,
+    qty_after NUMERIC(15,3) DEFAULT 0,
+    delta NUMERIC(15,3) DEFAULT 0,
+    min_qty NUMERIC(15,3) DEFAULT 0,
+    reference VARCHAR(100) DEFAULT '',
+    created_by INTEGER REFERENCES users(id),
+    notes TEXT DEFAULT '',
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- movement_type values: sync | replenishment | adjustment
+CREATE INDEX IF NOT EXISTS idx_stock_mov_stock ON picking_stock_movements(stock_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_stock_mov_company ON picking_stock_movements(company_id, filial, created_at DESC);
+
+-- Consumption window and how far ahead waves anticipate a location reaching min
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS consumption_window_days INTEGER DEFAULT 7;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS wave_lookahead_hours INTEGER DEFAULT 0;
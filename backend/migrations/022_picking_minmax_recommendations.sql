@@ -0,0 +1,47 @@
+-- Hours of demand the max of a location should cover, per ABC class.
+-- The min covers minmax_min_pct percent of that.
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS minmax_target_hours_a INTEGER DEFAULT 8;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS minmax_target_hours_b INTEGER DEFAULT 16;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS minmax_target_hours_c INTEGER DEFAULT 24;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS minmax_min_pct INTEGER DEFAULT 30;
+
+-- Recommended min/max per picking_stock row
+CREATE TABLE IF NOT EXISTS picking_minmax_recommendations (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    filial VARCHAR(5) NOT NULL,
+    stock_id INTEGER REFERENCES picking_stock(id) ON DELETE CASCADE,
+    current_min NUMERIC(15,3) DEFAULT 0,
+    current_max NUMERIC(15,3) DEFAULT 0,
+    recommended_min NUMERIC(15,3) DEFAULT 0,
+    recommended_max NUMERIC(15,3) DEFAULT 0,
+    consumption_per_hour NUMERIC(15,3) DEFAULT 0,
+    target_hours INTEGER DEFAULT 0,
+    capacity NUMERIC(15,3) DEFAULT 0,
+    capped_by_capacity BOOLEAN DEFAULT FALSE,
+    status VARCHAR(20) DEFAULT 'pendente',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    reviewed_by INTEGER REFERENCES users(id),
+    reviewed_at TIMESTAMPTZ
+);
+
+-- status values: pendente | aceita | rejeitada | obsoleta
+CREATE INDEX IF NOT EXISTS idx_minmax_rec_company ON picking_minmax_recommendations(company_id, filial, status);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_minmax_rec_pending ON picking_minmax_recommendations(stock_id) WHERE status = 'pendente';
+
+-- Audit of min/max changes
+CREATE TABLE IF NOT EXISTS picking_param_changes (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    stock_id INTEGER REFERENCES picking_stock(id) ON DELETE CASCADE,
+    old_min NUMERIC(15,3) DEFAULT 0,
+    new_min NUMERIC(15,3) DEFAULT 0,
+    old_max NUMERIC(15,3) DEFAULT 0,
+    new_max NUMERIC(15,3) DEFAULT 0,
+    source VARCHAR(20) NOT NULL,
+    recommendation_id INTEGER REFERENCES picking_minmax_recommendations(id),
+    changed_by INTEGER REFERENCES users(id),
+    changed_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_param_changes_stock ON picking_param_changes(stock_id, changed_at DESC);
@@ -0,0 +1,39 @@
+-- Slotting analyses (run per filial on demand)
+CREATE TABLE IF NOT EXISTS slotting_analyses (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    filial VARCHAR(5) NOT NULL,
+    status VARCHAR(20) DEFAULT 'proposta',
+    current_score NUMERIC(15,2) DEFAULT 0,
+    proposed_score NUMERIC(15,2) DEFAULT 0,
+    improvement_pct NUMERIC(6,2) DEFAULT 0,
+    total_moves INTEGER DEFAULT 0,
+    params TEXT DEFAULT '{}',
+    wave_id INTEGER REFERENCES replenishment_waves(id) ON DELETE SET NULL,
+    created_by INTEGER REFERENCES users(id),
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- status values: proposta | convertida | descartada
+CREATE INDEX IF NOT EXISTS idx_slotting_company ON slotting_analyses(company_id, filial, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS slotting_moves (
+    id SERIAL PRIMARY KEY,
+    analysis_id INTEGER REFERENCES slotting_analyses(id) ON DELETE CASCADE,
+    stock_id INTEGER REFERENCES picking_stock(id) ON DELETE CASCADE,
+    product_code VARCHAR(50) NOT NULL,
+    product_description VARCHAR(500) DEFAULT '',
+    from_location_id INTEGER,
+    from_location_code VARCHAR(20) NOT NULL,
+    to_location_id INTEGER,
+    to_location_code VARCHAR(20) NOT NULL,
+    swap_group INTEGER DEFAULT 0,
+    demand NUMERIC(15,3) DEFAULT 0,
+    gain NUMERIC(15,2) DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_slotting_moves ON slotting_moves(analysis_id);
+
+-- Waves can now carry relocation tasks besides replenishment
+ALTER TABLE replenishment_tasks ADD COLUMN IF NOT EXISTS task_type VARCHAR(20) DEFAULT 'replenishment';
+ALTER TABLE replenishment_tasks ADD COLUMN IF NOT EXISTS from_location_code VARCHAR(20) DEFAULT '';
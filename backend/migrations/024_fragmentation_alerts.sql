@@ -0,0 +1,24 @@
+-- Fragmentation score model per company
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS frag_weight_a NUMERIC(6,2) DEFAULT 3;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS frag_weight_b NUMERIC(6,2) DEFAULT 2;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS frag_weight_c NUMERIC(6,2) DEFAULT 1;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS frag_alert_threshold NUMERIC(5,1) DEFAULT 60;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS frag_trend_window_days INTEGER DEFAULT 7;
+
+-- Picking alerts (fired when a filial crosses the fragmentation threshold)
+CREATE TABLE IF NOT EXISTS picking_alerts (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    filial VARCHAR(5) NOT NULL,
+    alert_type VARCHAR(40) NOT NULL,
+    score NUMERIC(5,1) DEFAULT 0,
+    previous_score NUMERIC(5,1),
+    threshold NUMERIC(5,1) DEFAULT 0,
+    message TEXT DEFAULT '',
+    acknowledged_by INTEGER REFERENCES users(id),
+    acknowledged_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- alert_type values: fragmentation_high | fragmentation_normal
+CREATE INDEX IF NOT EXISTS idx_picking_alerts_company ON picking_alerts(company_id, created_at DESC);
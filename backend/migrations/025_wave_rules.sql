@@ -0,0 +1,21 @@
+-- Wave-building rules per company (defaults keep one wave per filial, sent at once)
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS wave_split_by_zone BOOLEAN DEFAULT FALSE;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS wave_max_tasks INTEGER DEFAULT 0;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS wave_max_volume NUMERIC(15,3) DEFAULT 0;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS wave_merge_pending BOOLEAN DEFAULT FALSE;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS wave_min_interval_minutes INTEGER DEFAULT 0;
+
+ALTER TABLE replenishment_waves ADD COLUMN IF NOT EXISTS zone VARCHAR(20) DEFAULT '';
+-- Set when a "gerada" wave is claimed for sending; it no longer accepts merged tasks
+ALTER TABLE replenishment_waves ADD COLUMN IF NOT EXISTS send_started_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_waves_pending ON replenishment_waves(company_id, filial, status) WHERE status = 'gerada';
+
+-- Daily wave sequence per filial (replaces COUNT(*)+1)
+CREATE TABLE IF NOT EXISTS wave_sequences (
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    filial VARCHAR(5) NOT NULL,
+    seq_date DATE NOT NULL,
+    last_seq INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (company_id, filial, seq_date)
+);
@@ -0,0 +1,9 @@
+-- Locations are deactivated instead of deleted, so stock history survives
+ALTER TABLE picking_locations ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ DEFAULT NOW();
+ALTER TABLE picking_locations ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_picking_loc_aisle ON picking_locations(company_id, filial, aisle);
+
+-- movement_type values: sync | replenishment | adjustment | transfer
+-- A transfer keeps the quantity and records where the product came from
+ALTER TABLE picking_stock_movements ADD COLUMN IF NOT EXISTS from_location_id INTEGER;
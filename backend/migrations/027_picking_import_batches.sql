@@ -0,0 +1,22 @@
+-- Two-phase picking CSV import: a preview stores the parsed file and its
+-- diff; a later commit applies it in one transaction
+CREATE TABLE IF NOT EXISTS picking_import_batches (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    filename VARCHAR(255) DEFAULT '',
+    status VARCHAR(20) DEFAULT 'preview',
+    remove_missing BOOLEAN DEFAULT FALSE,
+    total_lines INTEGER DEFAULT 0,
+    valid_lines INTEGER DEFAULT 0,
+    error_lines INTEGER DEFAULT 0,
+    rows TEXT DEFAULT '[]',
+    errors TEXT DEFAULT '[]',
+    diff TEXT DEFAULT '{}',
+    created_by INTEGER REFERENCES users(id),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    applied_by INTEGER REFERENCES users(id),
+    applied_at TIMESTAMPTZ
+);
+
+-- status values: preview | aplicado | descartado
+CREATE INDEX IF NOT EXISTS idx_import_batches_company ON picking_import_batches(company_id, created_at DESC);
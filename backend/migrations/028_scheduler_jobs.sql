@@ -0,0 +1,44 @@
+-- One row per scheduler cycle of a company (or manual sync / wave generation)
+CREATE TABLE IF NOT EXISTS scheduler_job_runs (
+    id BIGSERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    filial VARCHAR(5) DEFAULT '',
+    trigger VARCHAR(20) NOT NULL,
+    status VARCHAR(20) DEFAULT 'running',
+    message TEXT DEFAULT '',
+    cancel_requested BOOLEAN DEFAULT FALSE,
+    requested_by INTEGER REFERENCES users(id),
+    started_at TIMESTAMPTZ DEFAULT NOW(),
+    finished_at TIMESTAMPTZ,
+    duration_ms INTEGER DEFAULT 0
+);
+
+-- trigger values: scheduler | manual | manual_wave
+-- status values: running | success | error | cancelled
+CREATE INDEX IF NOT EXISTS idx_job_runs_company ON scheduler_job_runs(company_id, started_at DESC);
+CREATE INDEX IF NOT EXISTS idx_job_runs_running ON scheduler_job_runs(status) WHERE status = 'running';
+
+CREATE TABLE IF NOT EXISTS scheduler_job_steps (
+    id BIGSERIAL PRIMARY KEY,
+    run_id BIGINT REFERENCES scheduler_job_runs(id) ON DELETE CASCADE,
+    filial VARCHAR(5) DEFAULT '',
+    step VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    message TEXT DEFAULT '',
+    started_at TIMESTAMPTZ DEFAULT NOW(),
+    duration_ms INTEGER DEFAULT 0
+);
+
+-- step values: fetch | upsert | score | wave | dispatch
+-- status values: success | error | skipped
+CREATE INDEX IF NOT EXISTS idx_job_steps_run ON scheduler_job_steps(run_id, id);
+
+-- Automatic scheduling paused for a whole company (filial = '') or one filial
+CREATE TABLE IF NOT EXISTS scheduler_pauses (
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    filial VARCHAR(5) NOT NULL DEFAULT '',
+    reason TEXT DEFAULT '',
+    paused_by INTEGER REFERENCES users(id),
+    paused_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (company_id, filial)
+);
@@ -0,0 +1,13 @@
+-- Route optimization: start point of a representative's day and customer
+-- visiting constraints
+ALTER TABLE rca_representatives ADD COLUMN IF NOT EXISTS base_lat NUMERIC(10,7);
+ALTER TABLE rca_representatives ADD COLUMN IF NOT EXISTS base_lng NUMERIC(10,7);
+
+-- Optional time window; both NULL means the customer can be visited any time
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS window_start TIME;
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS window_end TIME;
+-- Expected visit duration; NULL uses settings.rca_visit_minutes
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS visit_minutes INTEGER;
+
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_avg_speed_kmh NUMERIC(5,1) DEFAULT 30;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_visit_minutes INTEGER DEFAULT 20;
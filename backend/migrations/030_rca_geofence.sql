@@ -0,0 +1,17 @@
+-- Geofenced check-in/check-out: distance to the customer and the outcome of
+-- the radius check are recorded on each visit
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_geofence_radius_m INTEGER DEFAULT 200;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_geofence_block BOOLEAN DEFAULT FALSE;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_min_visit_minutes INTEGER DEFAULT 5;
+
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS checkin_distance_m NUMERIC(10,1);
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS checkin_geofence VARCHAR(20);
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS checkout_distance_m NUMERIC(10,1);
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS checkout_geofence VARCHAR(20);
+-- geofence values: inside | outside | no_gps | no_customer_location
+
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS suspicious BOOLEAN DEFAULT FALSE;
+-- comma-separated: outside_radius | no_gps | short_visit | same_point
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS suspicion_reasons TEXT DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_rca_visits_suspicious ON rca_visits(company_id, visit_date DESC) WHERE suspicious = TRUE;
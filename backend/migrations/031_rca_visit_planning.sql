@@ -0,0 +1,19 @@
+-- Visit planning: how often each customer is visited. The agenda is
+-- materialised as rca_visits rows with status 'agendada' and planned = TRUE.
+
+-- visit_frequency values: weekdays | daily | weekly | interval | monthly
+-- NULL or empty is treated as weekdays (Monday to Friday); daily also
+-- includes weekends.
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS visit_frequency TEXT;
+-- weekly: day of the week, 0 = Sunday ... 6 = Saturday
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS visit_weekday SMALLINT;
+-- interval: every N days counted from visit_anchor_date
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS visit_interval_days INTEGER;
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS visit_anchor_date DATE;
+-- monthly: day of the month; days past the end of a month fall on its last day
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS visit_month_day SMALLINT;
+
+-- FALSE for visits registered by a check-in outside the agenda
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS planned BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_rca_visits_rep_date ON rca_visits(representative_id, visit_date);
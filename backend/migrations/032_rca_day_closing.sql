@@ -0,0 +1,28 @@
+-- End-of-day closing of RCA visits. After a day ends in the company's
+-- timezone, planned visits never started become 'nao_visitado' and visits
+-- never checked out are concluded with auto_closed = TRUE.
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_timezone TEXT DEFAULT 'America/Sao_Paulo';
+-- JSON array of the reasons a rep can give for a missed visit
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_missed_reasons TEXT
+    DEFAULT '["Cliente fechado","Cliente sem demanda","Falta de tempo","Problema no veiculo","Condicoes climaticas","Outro"]';
+
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS auto_closed BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS closed_at TIMESTAMP;
+-- Justification of a 'nao_visitado' visit, given by the rep afterwards
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS missed_reason TEXT;
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS missed_notes TEXT;
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS justified_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_rca_visits_open
+    ON rca_visits(company_id, visit_date) WHERE status IN ('agendada', 'em_visita');
+
+-- One row per company and closed day
+CREATE TABLE IF NOT EXISTS rca_day_closings (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    visit_date DATE NOT NULL,
+    missed INTEGER NOT NULL DEFAULT 0,
+    auto_closed INTEGER NOT NULL DEFAULT 0,
+    closed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE(company_id, visit_date)
+);
@@ -0,0 +1,47 @@
+-- Structured outcome of a visit, recorded at check-out
+-- outcome values: sale | no_sale | collection | merchandising
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS outcome TEXT;
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS order_value NUMERIC(14,2);
+ALTER TABLE rca_visits ADD COLUMN IF NOT EXISTS no_sale_reason TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_rca_visits_company_date ON rca_visits(company_id, visit_date);
+
+-- Reason codes for a visit without a sale; a company without rows uses the
+-- built-in list
+CREATE TABLE IF NOT EXISTS rca_no_sale_reasons (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    code VARCHAR(40) NOT NULL,
+    label TEXT NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    UNIQUE(company_id, code)
+);
+
+-- Checklists / surveys answered at check-out. Questions are not edited once
+-- created, so answers keep their meaning; a changed survey is a new one.
+CREATE TABLE IF NOT EXISTS rca_surveys (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    name TEXT NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- answer_type values: text | number | yes_no | choice
+CREATE TABLE IF NOT EXISTS rca_survey_questions (
+    id SERIAL PRIMARY KEY,
+    survey_id INTEGER REFERENCES rca_surveys(id) ON DELETE CASCADE NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    question TEXT NOT NULL,
+    answer_type VARCHAR(10) NOT NULL DEFAULT 'text',
+    options TEXT, -- JSON array, for choice
+    required BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS rca_visit_answers (
+    id SERIAL PRIMARY KEY,
+    visit_id INTEGER REFERENCES rca_visits(id) ON DELETE CASCADE NOT NULL,
+    question_id INTEGER REFERENCES rca_survey_questions(id) NOT NULL,
+    answer TEXT NOT NULL,
+    UNIQUE(visit_id, question_id)
+);
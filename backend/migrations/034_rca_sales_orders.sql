@@ -0,0 +1,56 @@
+-- Field sales orders taken by representatives during a visit
+
+-- List price used by the orders; 0 falls back to cost_price
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sale_price NUMERIC(15,4) DEFAULT 0;
+
+-- Largest discount per item a rep can give without approval, in percent
+ALTER TABLE rca_representatives ADD COLUMN IF NOT EXISTS max_discount_pct NUMERIC(5,2) DEFAULT 0;
+-- Filial whose stock is offered by default ('01', '02' or '03')
+ALTER TABLE rca_representatives ADD COLUMN IF NOT EXISTS default_filial VARCHAR(5) DEFAULT '01';
+
+-- status values: rascunho | aguardando_aprovacao | aprovado | exportando |
+--                exportado | erro_exportacao | rejeitado | cancelado
+CREATE TABLE IF NOT EXISTS rca_orders (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    representative_id INTEGER REFERENCES rca_representatives(id) NOT NULL,
+    visit_id INTEGER REFERENCES rca_visits(id) NOT NULL,
+    customer_id INTEGER REFERENCES rca_customers(id) NOT NULL,
+    filial VARCHAR(5) NOT NULL DEFAULT '01',
+    status VARCHAR(25) NOT NULL DEFAULT 'rascunho',
+    subtotal NUMERIC(14,2) NOT NULL DEFAULT 0,
+    discount_total NUMERIC(14,2) NOT NULL DEFAULT 0,
+    total NUMERIC(14,2) NOT NULL DEFAULT 0,
+    notes TEXT,
+    rejection_reason TEXT,
+    erp_ref VARCHAR(100),
+    export_error TEXT,
+    export_attempts INTEGER NOT NULL DEFAULT 0,
+    submitted_at TIMESTAMPTZ,
+    approved_by INTEGER REFERENCES users(id),
+    approved_at TIMESTAMPTZ,
+    exported_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_rca_orders_company_status ON rca_orders(company_id, status);
+CREATE INDEX IF NOT EXISTS idx_rca_orders_visit ON rca_orders(visit_id);
+
+-- Items keep a copy of the product data and prices at the time of the order
+CREATE TABLE IF NOT EXISTS rca_order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER REFERENCES rca_orders(id) ON DELETE CASCADE NOT NULL,
+    product_id INTEGER REFERENCES products(id) NOT NULL,
+    product_code VARCHAR(50) NOT NULL,
+    description VARCHAR(500) NOT NULL,
+    unit VARCHAR(10) DEFAULT 'UN',
+    quantity NUMERIC(15,3) NOT NULL,
+    list_price NUMERIC(15,4) NOT NULL,
+    discount_pct NUMERIC(5,2) NOT NULL DEFAULT 0,
+    unit_price NUMERIC(15,4) NOT NULL,
+    total NUMERIC(14,2) NOT NULL,
+    stock_available NUMERIC(15,3) NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_rca_order_items_order ON rca_order_items(order_id);
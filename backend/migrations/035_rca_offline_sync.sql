@@ -0,0 +1,47 @@
+-- Offline sync for the RCA app
+
+-- Events uploaded by the app, keyed by the UUID the device generated, so a
+-- queue sent again after a dropped connection is not applied twice.
+-- status values: applied | conflict | rejected
+CREATE TABLE IF NOT EXISTS rca_sync_events (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    representative_id INTEGER REFERENCES rca_representatives(id) NOT NULL,
+    event_id VARCHAR(64) NOT NULL,
+    event_type VARCHAR(20) NOT NULL,
+    device_id VARCHAR(100),
+    client_time TIMESTAMPTZ NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    code VARCHAR(40),
+    message TEXT,
+    visit_id INTEGER REFERENCES rca_visits(id),
+    order_id INTEGER REFERENCES rca_orders(id),
+    received_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE(representative_id, event_id)
+);
+
+-- Change cursor for the delta download: every insert or update of a route
+-- or customer takes the next value of one shared sequence
+CREATE SEQUENCE IF NOT EXISTS rca_sync_version_seq;
+
+ALTER TABLE rca_routes ADD COLUMN IF NOT EXISTS sync_version BIGINT NOT NULL DEFAULT nextval('rca_sync_version_seq');
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS sync_version BIGINT NOT NULL DEFAULT nextval('rca_sync_version_seq');
+
+CREATE INDEX IF NOT EXISTS idx_rca_routes_sync ON rca_routes(representative_id, sync_version);
+CREATE INDEX IF NOT EXISTS idx_rca_customers_sync ON rca_customers(route_id, sync_version);
+
+CREATE OR REPLACE FUNCTION rca_bump_sync_version() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.sync_version := nextval('rca_sync_version_seq');
+    NEW.updated_at := NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_rca_routes_sync ON rca_routes;
+CREATE TRIGGER trg_rca_routes_sync BEFORE UPDATE ON rca_routes
+    FOR EACH ROW EXECUTE FUNCTION rca_bump_sync_version();
+
+DROP TRIGGER IF EXISTS trg_rca_customers_sync ON rca_customers;
+CREATE TRIGGER trg_rca_customers_sync BEFORE UPDATE ON rca_customers
+    FOR EACH ROW EXECUTE FUNCTION rca_bump_sync_version();
@@ -0,0 +1,29 @@
+-- GPS breadcrumbs of the representatives, posted in batches by the app
+
+CREATE TABLE IF NOT EXISTS rca_gps_points (
+    id BIGSERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    representative_id INTEGER REFERENCES rca_representatives(id) NOT NULL,
+    -- Day in the company's timezone (settings.rca_timezone)
+    point_date DATE NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL,
+    lat NUMERIC(10,7) NOT NULL,
+    lng NUMERIC(10,7) NOT NULL,
+    accuracy_m NUMERIC(8,1),
+    speed_kmh NUMERIC(6,1),
+    received_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE(representative_id, recorded_at)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rca_gps_points_rep_date ON rca_gps_points(representative_id, point_date, recorded_at);
+CREATE INDEX IF NOT EXISTS idx_rca_gps_points_company_date ON rca_gps_points(company_id, point_date);
+
+-- Last known position, shown on the dashboard
+ALTER TABLE rca_representatives ADD COLUMN IF NOT EXISTS last_lat NUMERIC(10,7);
+ALTER TABLE rca_representatives ADD COLUMN IF NOT EXISTS last_lng NUMERIC(10,7);
+ALTER TABLE rca_representatives ADD COLUMN IF NOT EXISTS last_position_at TIMESTAMPTZ;
+
+-- Points older than the retention are deleted by the daily RCA closing;
+-- points less precise than the max accuracy are discarded on upload
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_gps_retention_days INTEGER DEFAULT 90;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_gps_max_accuracy_m INTEGER DEFAULT 100;
@@ -0,0 +1,43 @@
+-- Geocoding through a provider interface, with a cache and a job queue
+
+-- precision values: address | street | neighborhood | city
+-- source values: nominatim | nominatim_local | fake | manual | import
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS geocode_precision VARCHAR(20);
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS geocode_source VARCHAR(20);
+ALTER TABLE rca_customers ADD COLUMN IF NOT EXISTS geocoded_at TIMESTAMPTZ;
+
+-- Provider: 'nominatim' (the public server, or a local one at
+-- rca_geocoder_url) or 'fake' (offline stand-in for tests and demos)
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_geocoder VARCHAR(20) DEFAULT 'nominatim';
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS rca_geocoder_url TEXT DEFAULT '';
+
+-- Results by normalized address, per source; found = FALSE caches a miss
+CREATE TABLE IF NOT EXISTS rca_geocode_cache (
+    source VARCHAR(20) NOT NULL,
+    query_key TEXT NOT NULL,
+    found BOOLEAN NOT NULL,
+    lat NUMERIC(10,7),
+    lng NUMERIC(10,7),
+    precision VARCHAR(20),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (source, query_key)
+);
+
+-- One job per customer to geocode; survives restarts.
+-- status values: pending | running | done | not_found | failed
+CREATE TABLE IF NOT EXISTS rca_geocode_jobs (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    customer_id INTEGER REFERENCES rca_customers(id) ON DELETE CASCADE NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    run_after TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- At most one open job per customer
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rca_geocode_jobs_open
+    ON rca_geocode_jobs(customer_id) WHERE status IN ('pending', 'running');
+CREATE INDEX IF NOT EXISTS idx_rca_geocode_jobs_queue ON rca_geocode_jobs(status, run_after);
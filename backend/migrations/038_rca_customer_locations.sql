@@ -0,0 +1,40 @@
+-- Customer location corrections and reverse geocoding
+
+-- geocode_source gains: pin (map pin) | checkin_gps (rep's GPS at check-in)
+
+-- Jobs are either forward (address -> coordinates) or reverse
+-- (coordinates -> missing address fields).
+-- kind values: forward | reverse
+ALTER TABLE rca_geocode_jobs ADD COLUMN IF NOT EXISTS kind VARCHAR(10) NOT NULL DEFAULT 'forward';
+
+-- At most one open job per customer and kind
+DROP INDEX IF EXISTS idx_rca_geocode_jobs_open;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rca_geocode_jobs_open_kind
+    ON rca_geocode_jobs(customer_id, kind) WHERE status IN ('pending', 'running');
+
+-- Coordinates proposed by a representative, waiting for a manager.
+-- source values: pin | checkin_gps
+-- status values: pendente | aprovado | rejeitado | substituido
+CREATE TABLE IF NOT EXISTS rca_customer_location_requests (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    customer_id INTEGER REFERENCES rca_customers(id) ON DELETE CASCADE NOT NULL,
+    representative_id INTEGER REFERENCES rca_representatives(id),
+    visit_id INTEGER REFERENCES rca_visits(id) ON DELETE SET NULL,
+    source VARCHAR(20) NOT NULL,
+    lat NUMERIC(10,7) NOT NULL,
+    lng NUMERIC(10,7) NOT NULL,
+    accuracy_m NUMERIC(8,1),
+    notes TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'pendente',
+    reviewed_by INTEGER REFERENCES users(id),
+    reviewed_at TIMESTAMPTZ,
+    rejection_reason TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- A newer proposal replaces the pending one of the customer
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rca_location_requests_pending
+    ON rca_customer_location_requests(customer_id) WHERE status = 'pendente';
+CREATE INDEX IF NOT EXISTS idx_rca_location_requests_company
+    ON rca_customer_location_requests(company_id, status);
@@ -0,0 +1,116 @@
+-- Commit-ordered sync versions and removals for the RCA delta download
+
+-- Versions come from one counter row per company instead of the shared
+-- sequence. The row stays locked until the writing transaction ends, so a
+-- company's versions become visible in order and a cursor never passes a
+-- change still being committed.
+CREATE TABLE IF NOT EXISTS rca_sync_counters (
+    company_id INTEGER PRIMARY KEY REFERENCES companies(id),
+    last_version BIGINT NOT NULL
+);
+
+-- Existing versions came from the sequence; continue after its last value
+INSERT INTO rca_sync_counters (company_id, last_version)
+SELECT id, (SELECT last_value FROM rca_sync_version_seq) FROM companies
+ON CONFLICT (company_id) DO NOTHING;
+
+CREATE OR REPLACE FUNCTION rca_next_sync_version(p_company_id INTEGER) RETURNS BIGINT AS $$
+DECLARE
+    v BIGINT;
+BEGIN
+    INSERT INTO rca_sync_counters AS s (company_id, last_version)
+    VALUES (p_company_id, (SELECT last_value FROM rca_sync_version_seq) + 1)
+    ON CONFLICT (company_id) DO UPDATE SET last_version = s.last_version + 1
+    RETURNING last_version INTO v;
+    RETURN v;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE rca_routes ALTER COLUMN sync_version DROP DEFAULT;
+ALTER TABLE rca_customers ALTER COLUMN sync_version DROP DEFAULT;
+
+CREATE OR REPLACE FUNCTION rca_bump_sync_version() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.sync_version := rca_next_sync_version(NEW.company_id);
+    IF TG_OP = 'UPDATE' THEN
+        NEW.updated_at := NOW();
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_rca_routes_sync ON rca_routes;
+CREATE TRIGGER trg_rca_routes_sync BEFORE INSERT OR UPDATE ON rca_routes
+    FOR EACH ROW EXECUTE FUNCTION rca_bump_sync_version();
+
+DROP TRIGGER IF EXISTS trg_rca_customers_sync ON rca_customers;
+CREATE TRIGGER trg_rca_customers_sync BEFORE INSERT OR UPDATE ON rca_customers
+    FOR EACH ROW EXECUTE FUNCTION rca_bump_sync_version();
+
+-- Routes and customers a representative no longer has: the route moved to
+-- another rep, the customer to another rep's route, or either was deleted.
+-- The delta download sends them so the app drops them.
+-- entity values: route | customer
+CREATE TABLE IF NOT EXISTS rca_sync_removals (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) NOT NULL,
+    representative_id INTEGER REFERENCES rca_representatives(id) ON DELETE CASCADE NOT NULL,
+    entity VARCHAR(10) NOT NULL,
+    entity_id INTEGER NOT NULL,
+    sync_version BIGINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_rca_sync_removals_rep ON rca_sync_removals(representative_id, sync_version);
+
+-- A route leaving its rep takes its customers along. On a move the
+-- customers are touched so the new rep downloads them too.
+CREATE OR REPLACE FUNCTION rca_route_removed() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF OLD.representative_id = NEW.representative_id THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+    INSERT INTO rca_sync_removals (company_id, representative_id, entity, entity_id, sync_version)
+    VALUES (OLD.company_id, OLD.representative_id, 'route', OLD.id, rca_next_sync_version(OLD.company_id));
+    INSERT INTO rca_sync_removals (company_id, representative_id, entity, entity_id, sync_version)
+    SELECT c.company_id, OLD.representative_id, 'customer', c.id, rca_next_sync_version(c.company_id)
+    FROM rca_customers c WHERE c.route_id = OLD.id;
+    IF TG_OP = 'UPDATE' THEN
+        UPDATE rca_customers SET updated_at = NOW() WHERE route_id = NEW.id;
+        RETURN NULL;
+    END IF;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+-- BEFORE DELETE: the customers deleted in cascade are still there
+DROP TRIGGER IF EXISTS trg_rca_routes_removed ON rca_routes;
+CREATE TRIGGER trg_rca_routes_removed BEFORE DELETE ON rca_routes
+    FOR EACH ROW EXECUTE FUNCTION rca_route_removed();
+
+DROP TRIGGER IF EXISTS trg_rca_routes_moved ON rca_routes;
+CREATE TRIGGER trg_rca_routes_moved AFTER UPDATE OF representative_id ON rca_routes
+    FOR EACH ROW EXECUTE FUNCTION rca_route_removed();
+
+CREATE OR REPLACE FUNCTION rca_customer_removed() RETURNS TRIGGER AS $$
+DECLARE
+    old_rep INTEGER;
+    new_rep INTEGER;
+BEGIN
+    SELECT representative_id INTO old_rep FROM rca_routes WHERE id = OLD.route_id;
+    IF TG_OP = 'UPDATE' THEN
+        SELECT representative_id INTO new_rep FROM rca_routes WHERE id = NEW.route_id;
+    END IF;
+    IF old_rep IS NOT NULL AND old_rep IS DISTINCT FROM new_rep THEN
+        INSERT INTO rca_sync_removals (company_id, representative_id, entity, entity_id, sync_version)
+        VALUES (OLD.company_id, old_rep, 'customer', OLD.id, rca_next_sync_version(OLD.company_id));
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_rca_customers_removed ON rca_customers;
+CREATE TRIGGER trg_rca_customers_removed AFTER DELETE OR UPDATE OF route_id ON rca_customers
+    FOR EACH ROW EXECUTE FUNCTION rca_customer_removed();
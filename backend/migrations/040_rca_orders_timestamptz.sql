@@ -0,0 +1,10 @@
+-- rca_orders timestamps are instants. Databases that ran 034 before it
+-- declared them TIMESTAMPTZ still have TIMESTAMP columns; their values were
+-- written by NOW() in the session timezone, which is also how the
+-- conversion reads them.
+ALTER TABLE rca_orders
+    ALTER COLUMN submitted_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN approved_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN exported_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN updated_at TYPE TIMESTAMPTZ;
@@ -0,0 +1,212 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// jobRun persists one scheduler cycle and its steps in scheduler_job_runs /
+// scheduler_job_steps. A nil *jobRun is valid and records nothing, which
+// keeps syncFilial usable on its own.
+type jobRun struct {
+	s         *PickingScheduler
+	id        int64
+	companyID string
+	start     time.Time
+	firstErr  string
+}
+
+var (
+	errJobCancelled = errors.New("execucao cancelada")
+	errRunActive    = errors.New("execucao ja em andamento")
+)
+
+// startRun records a running job and returns a context that CancelRun
+// cancels. Only one run per company executes at a time in this process;
+// otherwise errRunActive is returned. The caller must call finish.
+func (s *PickingScheduler) startRun(ctx context.Context, companyID, filial, trigger string, userID *int) (*jobRun, context.Context, error) {
+	s.mu.Lock()
+	if _, busy := s.active[companyID]; busy {
+		s.mu.Unlock()
+		return nil, ctx, errRunActive
+	}
+	if s.active == nil {
+		s.active = map[string]int64{}
+		s.runs = map[int64]context.CancelFunc{}
+	}
+	s.active[companyID] = 0
+	s.mu.Unlock()
+
+	var id int64
+	if err := s.db.QueryRowContext(ctx, `
+		INSERT INTO scheduler_job_runs (company_id, filial, trigger, requested_by)
+		VALUES ($1, $2, $3, $4) RETURNING id
+	`, companyID, filial, trigger, userID).Scan(&id); err != nil {
+		s.mu.Lock()
+		delete(s.active, companyID)
+		s.mu.Unlock()
+		return nil, ctx, err
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.active[companyID] = id
+	s.runs[id] = cancel
+	s.mu.Unlock()
+
+	return &jobRun{s: s, id: id, companyID: companyID, start: time.Now()}, runCtx, nil
+}
+
+// CancelRun cancels a run executing in this process. Returns false when
+// the run is not active here (already finished, or left over from a
+// previous process).
+func (s *PickingScheduler) CancelRun(id int64) bool {
+	s.mu.Lock()
+	cancel, ok := s.runs[id]
+	s.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// activeRun returns the id of the company's run executing in this
+// process, or 0.
+func (s *PickingScheduler) activeRun(companyID string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active[companyID]
+}
+
+// step runs fn and records it. fn returns a short message for operators
+// (e.g. why no wave was generated). Steps of a cancelled run are recorded
+// as skipped without running.
+func (j *jobRun) step(ctx context.Context, filial, name string, fn func() (string, error)) error {
+	if ctx.Err() != nil {
+		j.record(ctx, filial, name, "skipped", errJobCancelled.Error(), time.Now())
+		return errJobCancelled
+	}
+	start := time.Now()
+	msg, err := fn()
+	status := "success"
+	if err != nil {
+		status = "error"
+		if msg == "" {
+			msg = err.Error()
+		}
+		if j != nil && j.firstErr == "" {
+			j.firstErr = filial + " " + name + ": " + msg
+		}
+	}
+	j.record(ctx, filial, name, status, msg, start)
+	return err
+}
+
+// skip records a step that did not run, with the reason.
+func (j *jobRun) skip(ctx context.Context, filial, name, reason string) {
+	j.record(ctx, filial, name, "skipped", reason, time.Now())
+}
+
+// record writes a step, even when ctx was cancelled.
+func (j *jobRun) record(ctx context.Context, filial, name, status, msg string, start time.Time) {
+	if j == nil {
+		return
+	}
+	if _, err := j.s.db.ExecContext(context.WithoutCancel(ctx), `
+		INSERT INTO scheduler_job_steps (run_id, filial, step, status, message, started_at, duration_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, j.id, filial, name, status, msg, start, int(time.Since(start).Milliseconds())); err != nil {
+		log.Printf("[Scheduler] job %d: record step %s: %v", j.id, name, err)
+	}
+}
+
+// finish closes the run as success, error (first failed step) or cancelled.
+// Steps and the outcome are written detached from ctx's cancellation so a
+// cancelled run is still recorded.
+func (j *jobRun) finish(ctx context.Context, message string) {
+	if j == nil {
+		return
+	}
+	status := "success"
+	switch {
+	case ctx.Err() != nil:
+		status, message = "cancelled", errJobCancelled.Error()
+	case j.firstErr != "":
+		status, message = "error", j.firstErr
+	}
+	j.s.db.ExecContext(context.WithoutCancel(ctx), `
+		UPDATE scheduler_job_runs
+		SET status = $2, message = $3, finished_at = NOW(), duration_ms = $4
+		WHERE id = $1 AND status = 'running'
+	`, j.id, status, message, int(time.Since(j.start).Milliseconds()))
+
+	j.s.mu.Lock()
+	if cancel, ok := j.s.runs[j.id]; ok {
+		cancel()
+		delete(j.s.runs, j.id)
+	}
+	delete(j.s.active, j.companyID)
+	j.s.mu.Unlock()
+}
+
+// schedulingPaused reports whether automatic scheduling is paused for the
+// whole company, and which filiais are paused on their own.
+func schedulingPaused(ctx context.Context, db *sql.DB, companyID string) (bool, map[string]bool) {
+	filiais := map[string]bool{}
+	rows, err := db.QueryContext(ctx, `SELECT filial FROM scheduler_pauses WHERE company_id = $1`, companyID)
+	if err != nil {
+		return false, filiais
+	}
+	defer rows.Close()
+	company := false
+	for rows.Next() {
+		var f string
+		if rows.Scan(&f) != nil {
+			continue
+		}
+		if f == "" {
+			company = true
+		} else {
+			filiais[f] = true
+		}
+	}
+	return company, filiais
+}
+
+const jobRunRetention = 30 * 24 * time.Hour
+
+// pruneJobRuns drops finished runs past the retention period.
+func (s *PickingScheduler) pruneJobRuns(ctx context.Context) {
+	s.db.ExecContext(ctx, `DELETE FROM scheduler_job_runs WHERE status <> 'running' AND started_at < $1`,
+		time.Now().Add(-jobRunRetention))
+}
+
+// recoverInterrupted cleans up after a process that stopped mid-cycle:
+// runs still marked running are closed as cancelled, and waves claimed for
+// sending but never sent are released so dispatchWaves sends them again.
+// The wave number is the idempotency key, so a wave the ERP did receive is
+// not duplicated.
+func (s *PickingScheduler) recoverInterrupted(ctx context.Context) {
+	if res, err := s.db.ExecContext(ctx, `
+		UPDATE scheduler_job_runs
+		SET status = 'cancelled', message = 'interrompida: servidor reiniciado',
+		    finished_at = NOW(), duration_ms = (EXTRACT(EPOCH FROM NOW() - started_at) * 1000)::INT
+		WHERE status = 'running'
+	`); err != nil {
+		log.Printf("[Scheduler] recoverInterrupted: job runs: %v", err)
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[Scheduler] %d interrupted job runs closed", n)
+	}
+
+	if res, err := s.db.ExecContext(ctx, `
+		UPDATE replenishment_waves SET send_started_at = NULL
+		WHERE status = 'gerada' AND send_started_at IS NOT NULL
+	`); err != nil {
+		log.Printf("[Scheduler] recoverInterrupted: waves: %v", err)
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[Scheduler] %d waves left mid-send released for dispatch", n)
+	}
+}
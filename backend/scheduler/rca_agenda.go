@@ -0,0 +1,56 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"aprovapedido/handlers"
+)
+
+// rcaPlanInterval is how often today's agenda is replanned, picking up
+// customers and routes changed during the day.
+const rcaPlanInterval = 15 * time.Minute
+
+// planRCAAgendas plans today's agenda of each company, in its timezone, at
+// the start of the local day and every rcaPlanInterval after. Planning is
+// idempotent, so a restart just repeats it.
+func (s *PickingScheduler) planRCAAgendas(ctx context.Context) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT company_id::text FROM rca_representatives WHERE is_active = TRUE
+	`)
+	if err != nil {
+		log.Printf("[Scheduler] planRCAAgendas: %v", err)
+		return
+	}
+	var companies []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			companies = append(companies, id)
+		}
+	}
+	rows.Close()
+
+	for _, companyID := range companies {
+		if ctx.Err() != nil {
+			return
+		}
+		now := time.Now().In(handlers.RCACompanyLocation(ctx, s.db, companyID))
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		s.mu.Lock()
+		last := s.rcaPlanned[companyID]
+		s.mu.Unlock()
+		if last.Format("2006-01-02") == now.Format("2006-01-02") && now.Sub(last) < rcaPlanInterval {
+			continue
+		}
+
+		if _, err := handlers.PlanRCAAgenda(ctx, s.db, companyID, 0, today); err != nil {
+			log.Printf("[Scheduler] planRCAAgendas: company %s: %v", companyID, err)
+			continue
+		}
+		s.mu.Lock()
+		s.rcaPlanned[companyID] = now
+		s.mu.Unlock()
+	}
+}
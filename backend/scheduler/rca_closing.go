@@ -0,0 +1,68 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"aprovapedido/handlers"
+)
+
+// closeRCADays closes the RCA visits of the days that have ended in each
+// company's timezone and deletes GPS points past their retention. A company
+// is marked closed for the local day only once the closing reached its
+// yesterday; the closing itself is idempotent, so a restart just repeats
+// it.
+func (s *PickingScheduler) closeRCADays(ctx context.Context) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT company_id::text FROM rca_representatives WHERE is_active = TRUE
+	`)
+	if err != nil {
+		log.Printf("[Scheduler] closeRCADays: %v", err)
+		return
+	}
+	var companies []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			companies = append(companies, id)
+		}
+	}
+	rows.Close()
+
+	for _, companyID := range companies {
+		if ctx.Err() != nil {
+			return
+		}
+		now := time.Now().In(handlers.RCACompanyLocation(ctx, s.db, companyID))
+		today := now.Format("2006-01-02")
+		s.mu.Lock()
+		done := s.rcaClosed[companyID] == today
+		s.mu.Unlock()
+		if done {
+			continue
+		}
+
+		res, err := handlers.CloseRCADays(ctx, s.db, companyID)
+		if err != nil {
+			log.Printf("[Scheduler] closeRCADays: company %s: %v", companyID, err)
+			continue
+		}
+		if res.Through == now.AddDate(0, 0, -1).Format("2006-01-02") {
+			s.mu.Lock()
+			s.rcaClosed[companyID] = today
+			s.mu.Unlock()
+		}
+		if res.Missed > 0 || res.AutoClosed > 0 {
+			log.Printf("[Scheduler] Company %s: RCA days closed — %d nao visitadas, %d encerradas sem check-out",
+				companyID, res.Missed, res.AutoClosed)
+		}
+
+		// GPS retention is applied with the daily closing
+		if n, err := handlers.PurgeRCATracking(ctx, s.db, companyID); err != nil {
+			log.Printf("[Scheduler] purge RCA tracking: company %s: %v", companyID, err)
+		} else if n > 0 {
+			log.Printf("[Scheduler] Company %s: %d pontos GPS removidos pela retencao", companyID, n)
+		}
+	}
+}
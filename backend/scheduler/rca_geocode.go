@@ -0,0 +1,48 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"aprovapedido/handlers"
+)
+
+const (
+	geocodePollInterval = 5 * time.Second
+	geocodeBatchSize    = 20
+)
+
+// geocodeWorker drains the RCA geocoding queue until the scheduler stops.
+// The public Nominatim rate limit is enforced by the geocoder itself, so a
+// batch of queued addresses takes about a second each.
+func (s *PickingScheduler) geocodeWorker(ctx context.Context) {
+	ticker := time.NewTicker(geocodePollInterval)
+	defer ticker.Stop()
+	for {
+		n, err := handlers.RunGeocodeJobs(ctx, s.db, geocodeBatchSize)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("[Scheduler] geocode jobs: %v", err)
+		} else if n > 0 {
+			log.Printf("[Scheduler] geocode jobs: %d processed", n)
+		}
+		// A full batch means there is probably more waiting
+		if n == geocodeBatchSize && err == nil {
+			select {
+			case <-s.stopCh:
+				return
+			case <-ctx.Done():
+				return
+			default:
+				continue
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stopCh:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
-	"math/rand"
 	"sync"
 	"time"
 
@@ -19,16 +19,50 @@ type PickingScheduler struct {
 	stopCh chan struct{}
 	mu     sync.Mutex
 	ticker *time.Ticker
+
+	// runs in progress in this process: cancel funcs by run id, and the
+	// run id per company (0 while the run row is being created)
+	runs   map[int64]context.CancelFunc
+	active map[string]int64
+
+	// local date each company last had its RCA days closed, and local
+	// time its agenda was last planned
+	rcaClosed  map[string]string
+	rcaPlanned map[string]time.Time
+
+	// baseCtx is the parent of every job and is cancelled when Shutdown
+	// gives up waiting; jobs counts the loop and the jobs in flight
+	baseCtx context.Context
+	cancel  context.CancelFunc
+	jobs    sync.WaitGroup
+	closing bool
 }
 
+var errShuttingDown = errors.New("servidor em desligamento")
+
 func New(db *sql.DB) *PickingScheduler {
+	baseCtx, cancel := context.WithCancel(context.Background())
 	return &PickingScheduler{
-		db:     db,
-		stopCh: make(chan struct{}),
+		db:         db,
+		stopCh:     make(chan struct{}),
+		rcaClosed:  make(map[string]string),
+		rcaPlanned: make(map[string]time.Time),
+		baseCtx:    baseCtx,
+		cancel:     cancel,
 	}
 }
 
 func (s *PickingScheduler) Start(ctx context.Context) {
+	if !s.track() {
+		return
+	}
+	defer s.jobs.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.baseCtx, cancel)
+	defer stop()
+
 	log.Println("[Scheduler] PickingScheduler started")
 
 	// Check every minute to see if any company needs a sync cycle
@@ -36,15 +70,30 @@ func (s *PickingScheduler) Start(ctx context.Context) {
 	defer s.ticker.Stop()
 
 	// Run immediately on start (after a short delay for DB to be ready)
-	time.Sleep(5 * time.Second)
-	s.completeOldWaves()
-	s.runAllCompanies()
+	select {
+	case <-time.After(5 * time.Second):
+	case <-s.stopCh:
+		return
+	case <-ctx.Done():
+		return
+	}
+	s.recoverInterrupted(ctx)
+	s.completeOldWaves(ctx)
+	s.resendFailedWaves(ctx)
+	s.runAllCompanies(ctx)
+	s.closeRCADays(ctx)
+	s.planRCAAgendas(ctx)
+	s.goJob(s.geocodeWorker)
 
 	for {
 		select {
 		case <-s.ticker.C:
-			s.completeOldWaves()
-			s.runAllCompanies()
+			s.completeOldWaves(ctx)
+			s.resendFailedWaves(ctx)
+			s.runAllCompanies(ctx)
+			s.pruneJobRuns(ctx)
+			s.closeRCADays(ctx)
+			s.planRCAAgendas(ctx)
 		case <-s.stopCh:
 			log.Println("[Scheduler] PickingScheduler stopped")
 			return
@@ -55,19 +104,129 @@ func (s *PickingScheduler) Start(ctx context.Context) {
 	}
 }
 
+// Stop stops the loop after the current cycle and refuses new jobs,
+// without waiting. See Shutdown.
 func (s *PickingScheduler) Stop() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	close(s.stopCh)
+	if !s.closing {
+		s.closing = true
+		close(s.stopCh)
+	}
 }
 
-// RunNow triggers an immediate sync for a specific company (called from API)
-func (s *PickingScheduler) RunNow(companyID string) {
-	go s.runCompany(companyID)
+// Shutdown stops the loop, refuses new jobs and waits for the ones in
+// flight. If ctx expires first they are cancelled: a cycle stops between
+// steps and a wave being sent ends in "erro", to be re-sent with the same
+// idempotency key after the restart.
+func (s *PickingScheduler) Shutdown(ctx context.Context) error {
+	s.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	log.Println("[Scheduler] Shutdown timeout, cancelling jobs in flight")
+	s.cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		log.Println("[Scheduler] Jobs still running after cancel")
+	}
+	return ctx.Err()
+}
+
+// track counts a job for Shutdown. Returns false once shutdown has begun;
+// a true result must be paired with s.jobs.Done().
+func (s *PickingScheduler) track() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.jobs.Add(1)
+	return true
+}
+
+// goJob runs fn in a tracked goroutine under the scheduler's context.
+func (s *PickingScheduler) goJob(fn func(ctx context.Context)) error {
+	if !s.track() {
+		return errShuttingDown
+	}
+	go func() {
+		defer s.jobs.Done()
+		fn(s.baseCtx)
+	}()
+	return nil
+}
+
+// RunNow starts an immediate sync of a company (called from API), ignoring
+// the sync interval and any pause, and returns the id of the job run to
+// poll. If the company already has a run in progress, its id is returned
+// with started=false.
+func (s *PickingScheduler) RunNow(companyID string, userID *int) (id int64, started bool, err error) {
+	cfg, err := loadCompanyConfig(s.baseCtx, s.db, companyID)
+	if err != nil {
+		return 0, false, err
+	}
+	return s.startManualRun(companyID, "", "manual", userID, func(ctx context.Context, run *jobRun) {
+		s.runCycle(ctx, run, companyID, cfg, nil)
+	})
 }
 
-func (s *PickingScheduler) runAllCompanies() {
-	rows, err := s.db.Query(`
+// GenerateWaveNow syncs one filial right away, generating and sending its
+// waves, as a manual_wave job run. Same return values as RunNow.
+func (s *PickingScheduler) GenerateWaveNow(companyID, filial string, userID *int) (id int64, started bool, err error) {
+	client := s.newClient(companyID, loadPickingSettings(s.baseCtx, s.db, companyID))
+	return s.startManualRun(companyID, filial, "manual_wave", userID, func(ctx context.Context, run *jobRun) {
+		s.syncFilial(ctx, run, companyID, filial, client)
+		run.finish(ctx, "filial "+filial+" sincronizada")
+	})
+}
+
+// startManualRun records a run and executes fn in a tracked goroutine.
+func (s *PickingScheduler) startManualRun(companyID, filial, trigger string, userID *int, fn func(ctx context.Context, run *jobRun)) (int64, bool, error) {
+	if !s.track() {
+		return 0, false, errShuttingDown
+	}
+	run, ctx, err := s.startRun(s.baseCtx, companyID, filial, trigger, userID)
+	if err != nil {
+		s.jobs.Done()
+		if err == errRunActive {
+			return s.activeRun(companyID), false, nil
+		}
+		return 0, false, err
+	}
+	go func() {
+		defer s.jobs.Done()
+		fn(ctx, run)
+	}()
+	return run.id, true, nil
+}
+
+// SendWaveNow sends a wave created outside the scheduler (e.g. a slotting
+// wave) in the background, regardless of the minimum wave interval. A
+// failure leaves it in "erro" for resendFailedWaves.
+func (s *PickingScheduler) SendWaveNow(companyID string, waveID int) error {
+	return s.goJob(func(ctx context.Context) {
+		client := s.newClient(companyID, loadPickingSettings(ctx, s.db, companyID))
+		if _, err := s.claimAndSendWave(ctx, companyID, waveID, client); err != nil {
+			log.Printf("[Scheduler] SendWaveNow: wave %d: %v", waveID, err)
+		}
+	})
+}
+
+func (s *PickingScheduler) runAllCompanies(ctx context.Context) {
+	rows, err := s.db.QueryContext(ctx, `
 		SELECT c.id::text FROM companies c
 		INNER JOIN settings st ON st.company_id = c.id
 		WHERE st.picking_enabled = TRUE
@@ -79,29 +238,48 @@ func (s *PickingScheduler) runAllCompanies() {
 	defer rows.Close()
 
 	for rows.Next() {
+		if ctx.Err() != nil {
+			return
+		}
 		var companyID string
 		if err := rows.Scan(&companyID); err != nil {
 			continue
 		}
-		s.runCompany(companyID)
+		s.runCompany(ctx, companyID)
 	}
 }
 
-func (s *PickingScheduler) runCompany(companyID string) {
-	// Load settings
-	var intervalMinutes int
-	var activeFiliaisJSON string
-	var useMock bool
-	var apiURL, apiKey string
+type companyConfig struct {
+	IntervalMinutes int
+	Filiais         []string
+	Winthor         handlers.PickingSettings
+}
 
-	err := s.db.QueryRow(`
+func loadCompanyConfig(ctx context.Context, db *sql.DB, companyID string) (companyConfig, error) {
+	var cfg companyConfig
+	var activeFiliaisJSON string
+	err := db.QueryRowContext(ctx, `
 		SELECT COALESCE(sync_interval_minutes, 30),
 		       COALESCE(active_filiais, '["01","02","03"]'),
 		       COALESCE(use_mock_winthor, TRUE),
 		       COALESCE(winthor_api_url, ''),
 		       COALESCE(winthor_api_key, '')
 		FROM settings WHERE company_id = $1
-	`, companyID).Scan(&intervalMinutes, &activeFiliaisJSON, &useMock, &apiURL, &apiKey)
+	`, companyID).Scan(&cfg.IntervalMinutes, &activeFiliaisJSON, &cfg.Winthor.UseMock,
+		&cfg.Winthor.APIURL, &cfg.Winthor.APIKey)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal([]byte(activeFiliaisJSON), &cfg.Filiais); err != nil {
+		cfg.Filiais = []string{"01", "02", "03"}
+	}
+	return cfg, nil
+}
+
+// runCompany starts a scheduled cycle for a company when it is due and not
+// paused. Skips are only logged; a run is recorded once the cycle starts.
+func (s *PickingScheduler) runCompany(ctx context.Context, companyID string) {
+	cfg, err := loadCompanyConfig(ctx, s.db, companyID)
 	if err != nil {
 		log.Printf("[Scheduler] Company %s: cannot load settings: %v", companyID, err)
 		return
@@ -109,204 +287,366 @@ func (s *PickingScheduler) runCompany(companyID string) {
 
 	// Check if enough time has passed since last sync
 	var lastSyncAt sql.NullTime
-	s.db.QueryRow(`
+	s.db.QueryRowContext(ctx, `
 		SELECT MAX(synced_at) FROM winthor_sync_log
 		WHERE company_id = $1 AND sync_type = 'stock_fetch' AND status = 'success'
 	`, companyID).Scan(&lastSyncAt)
 
 	if lastSyncAt.Valid {
 		elapsed := time.Since(lastSyncAt.Time)
-		if elapsed < time.Duration(intervalMinutes)*time.Minute {
+		if elapsed < time.Duration(cfg.IntervalMinutes)*time.Minute {
 			return // Not time yet
 		}
 	}
 
-	var filiais []string
-	if err := json.Unmarshal([]byte(activeFiliaisJSON), &filiais); err != nil {
-		filiais = []string{"01", "02", "03"}
+	// Circuit open: Winthor failed repeatedly, pause until the cooldown ends
+	if handlers.WinthorBreaker(companyID).IsOpen() {
+		log.Printf("[Scheduler] Company %s: Winthor circuit open, sync paused", companyID)
+		return
+	}
+
+	companyPaused, pausedFiliais := schedulingPaused(ctx, s.db, companyID)
+	if companyPaused {
+		return
 	}
 
-	winthorSettings := handlers.PickingSettings{
-		UseMock: useMock,
-		APIURL:  apiURL,
-		APIKey:  apiKey,
+	run, runCtx, err := s.startRun(ctx, companyID, "", "scheduler", nil)
+	if err == errRunActive {
+		return
 	}
-	client := handlers.NewWinthorClient(s.db, winthorSettings)
+	if err != nil {
+		log.Printf("[Scheduler] Company %s: cannot record job run: %v", companyID, err)
+		return
+	}
+	s.runCycle(runCtx, run, companyID, cfg, pausedFiliais)
+}
 
-	for _, filial := range filiais {
-		s.syncFilial(companyID, filial, client)
+// runCycle syncs every active filial of the company under one job run.
+func (s *PickingScheduler) runCycle(ctx context.Context, run *jobRun, companyID string, cfg companyConfig, pausedFiliais map[string]bool) {
+	client := s.newClient(companyID, cfg.Winthor)
+	synced := 0
+	for _, filial := range cfg.Filiais {
+		if ctx.Err() != nil {
+			break
+		}
+		if pausedFiliais[filial] {
+			run.skip(ctx, filial, "fetch", "filial pausada")
+			continue
+		}
+		s.syncFilial(ctx, run, companyID, filial, client)
+		synced++
 	}
+	run.finish(ctx, fmt.Sprintf("%d filiais sincronizadas", synced))
+}
+
+// newClient builds the Winthor client for a company with retries, the
+// company circuit breaker and per-attempt logging in winthor_sync_log.
+func (s *PickingScheduler) newClient(companyID string, settings handlers.PickingSettings) handlers.WinthorClient {
+	return handlers.NewResilientWinthorClient(handlers.NewWinthorClient(s.db, settings), companyID, s.logAttempt)
 }
 
-func (s *PickingScheduler) syncFilial(companyID, filial string, client handlers.WinthorClient) {
+// syncFilial runs the steps of one filial, recording each in run (which
+// may be nil). A failed fetch or upsert stops the filial.
+func (s *PickingScheduler) syncFilial(ctx context.Context, run *jobRun, companyID, filial string, client handlers.WinthorClient) {
 	start := time.Now()
 	log.Printf("[Scheduler] Syncing company=%s filial=%s", companyID, filial)
 
 	// 1. Fetch stock from Winthor (or mock)
-	items, err := client.GetPickingStock(companyID, filial)
-	durMs := int(time.Since(start).Milliseconds())
-
+	var items []handlers.WinthorStockItem
+	err := run.step(ctx, filial, "fetch", func() (string, error) {
+		var err error
+		items, err = client.GetPickingStock(ctx, companyID, filial)
+		if err != nil {
+			log.Printf("[Scheduler] GetPickingStock error: %v", err)
+			s.logSync(ctx, companyID, filial, "stock_fetch", "error", 0, err.Error(), int(time.Since(start).Milliseconds()))
+			return "", err
+		}
+		return fmt.Sprintf("%d itens recebidos", len(items)), nil
+	})
 	if err != nil {
-		log.Printf("[Scheduler] GetPickingStock error: %v", err)
-		s.logSync(companyID, filial, "stock_fetch", "error", 0, err.Error(), durMs)
 		return
 	}
 
-	// 2. Upsert picking_stock records
-	for _, item := range items {
-		s.db.Exec(`
-			UPDATE picking_stock
-			SET current_qty = $1, last_sync_at = NOW(), updated_at = NOW()
-			WHERE company_id = $2 AND filial = $3 AND product_code = $4
-		`, item.CurrentQty, companyID, filial, item.ProductCode)
+	// 2. Merge the snapshot into picking_stock (one transaction)
+	err = run.step(ctx, filial, "upsert", func() (string, error) {
+		counts, err := applyStockSnapshot(ctx, s.db, companyID, filial, items)
+		durMs := int(time.Since(start).Milliseconds())
+		if err != nil {
+			log.Printf("[Scheduler] applyStockSnapshot error: %v", err)
+			s.logSync(ctx, companyID, filial, "stock_fetch", "error", len(items), "merge: "+err.Error(), durMs)
+			return "", err
+		}
+		s.logSyncCounts(ctx, companyID, filial, "stock_fetch", "success", len(items), counts, durMs)
+		log.Printf("[Scheduler] company=%s filial=%s: %d inserted, %d updated, %d missing (%d new locations)",
+			companyID, filial, counts.Inserted, counts.Updated, counts.Missing, counts.LocationsCreated)
+		return fmt.Sprintf("%d inseridos, %d atualizados, %d ausentes, %d enderecos novos",
+			counts.Inserted, counts.Updated, counts.Missing, counts.LocationsCreated), nil
+	})
+	if err != nil {
+		return
 	}
 
-	s.logSync(companyID, filial, "stock_fetch", "success", len(items), "", durMs)
-
-	// 3. Count locations below minimum
+	// 3-5. Locations below minimum, those expected to reach it within the
+	// wave lookahead, and the fragmentation score
 	var belowMin int
-	s.db.QueryRow(`
-		SELECT COUNT(*) FROM picking_stock
-		WHERE company_id = $1 AND filial = $2 AND current_qty <= min_qty AND min_qty > 0
-	`, companyID, filial).Scan(&belowMin)
-
-	// 4. Calculate and record fragmentation score
-	s.recordFragmentationScore(companyID, filial)
-
-	// 5. Generate wave if there are locations below minimum
-	if belowMin > 0 {
-		log.Printf("[Scheduler] company=%s filial=%s: %d locations below min, generating wave", companyID, filial, belowMin)
-		if err := s.generateWave(companyID, filial, client, "scheduler"); err != nil {
+	var predicted []int64
+	if run.step(ctx, filial, "score", func() (string, error) {
+		s.db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM picking_stock ps
+			JOIN picking_locations pl ON pl.id = ps.location_id
+			WHERE ps.company_id = $1 AND ps.filial = $2 AND ps.current_qty <= ps.min_qty AND ps.min_qty > 0
+			  AND COALESCE(pl.is_active, TRUE)
+		`, companyID, filial).Scan(&belowMin)
+		predicted = s.predictedBelowMin(ctx, companyID, filial)
+		s.recordFragmentationScore(ctx, companyID, filial)
+		return fmt.Sprintf("%d abaixo do minimo, %d previstos", belowMin, len(predicted)), nil
+	}) != nil {
+		return
+	}
+
+	// 6. Generate wave if there are locations below (or about to reach) minimum
+	if run.step(ctx, filial, "wave", func() (string, error) {
+		if belowMin == 0 && len(predicted) == 0 {
+			log.Printf("[Scheduler] company=%s filial=%s: all locations OK", companyID, filial)
+			return "nenhuma onda: nenhum endereco abaixo do minimo ou previsto", nil
+		}
+		log.Printf("[Scheduler] company=%s filial=%s: %d locations below min, %d predicted, generating wave",
+			companyID, filial, belowMin, len(predicted))
+		res, err := s.generateWave(ctx, companyID, filial, "scheduler", predicted)
+		if err != nil {
 			log.Printf("[Scheduler] generateWave error: %v", err)
+			return "", err
+		}
+		if res.Tasks == 0 {
+			return "nenhuma onda: enderecos abaixo do minimo ja estao em ondas pendentes", nil
 		}
-	} else {
-		log.Printf("[Scheduler] company=%s filial=%s: all locations OK", companyID, filial)
+		return fmt.Sprintf("%d tarefas: %d ondas novas, %d incluidas em onda pendente",
+			res.Tasks, res.Created, res.Merged), nil
+	}) != nil {
+		return
 	}
+
+	// 7. Send pending waves the wave rules allow
+	run.step(ctx, filial, "dispatch", func() (string, error) {
+		res := s.dispatchWaves(ctx, companyID, filial, client)
+		msg := fmt.Sprintf("%d ondas enviadas", res.Sent)
+		if res.Held > 0 {
+			msg += fmt.Sprintf(", %d retidas pelo intervalo minimo", res.Held)
+		}
+		if res.Failed > 0 {
+			return msg, fmt.Errorf("%d ondas com falha no envio", res.Failed)
+		}
+		return msg, nil
+	})
 }
 
-func (s *PickingScheduler) generateWave(companyID, filial string, client handlers.WinthorClient, triggeredBy string) error {
-	// Fetch locations below minimum, ordered by ABC priority
-	rows, err := s.db.Query(`
-		SELECT ps.product_code, ps.product_description, pl.location_code,
-		       ps.current_qty, ps.min_qty, ps.max_qty, ps.abc_class,
-		       CASE ps.abc_class WHEN 'A' THEN 1 WHEN 'B' THEN 2 ELSE 3 END as priority
-		FROM picking_stock ps
-		JOIN picking_locations pl ON pl.id = ps.location_id
-		WHERE ps.company_id = $1 AND ps.filial = $2
-		  AND ps.current_qty <= ps.min_qty AND ps.min_qty > 0
-		ORDER BY priority ASC, (ps.min_qty - ps.current_qty) DESC
-	`, companyID, filial)
+// predictedBelowMin returns the stock ids expected to reach min within the
+// company's wave_lookahead_hours (none when the lookahead is 0).
+func (s *PickingScheduler) predictedBelowMin(ctx context.Context, companyID, filial string) []int64 {
+	var lookaheadHours, windowDays int
+	s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(wave_lookahead_hours, 0), COALESCE(consumption_window_days, 7)
+		FROM settings WHERE company_id = $1
+	`, companyID).Scan(&lookaheadHours, &windowDays)
+
+	ids, err := handlers.PredictedBelowMin(ctx, s.db, companyID, filial, lookaheadHours, windowDays)
 	if err != nil {
-		return err
+		log.Printf("[Scheduler] predictedBelowMin company=%s filial=%s: %v", companyID, filial, err)
+		return nil
 	}
-	defer rows.Close()
+	return ids
+}
+
+// sendWave sends a wave to Winthor and records the outcome. A failed send
+// leaves the wave in "erro" with next_retry_at set so resendFailedWaves
+// picks it up later; a wave Winthor rejected is final ("rejeitada") and an
+// open circuit breaker only postpones the send without counting an attempt.
+// The outcome is only recorded while the wave is still being sent, so a
+// webhook that finished it first is not overwritten.
+func (s *PickingScheduler) sendWave(ctx context.Context, companyID string, waveID int, payload handlers.WinthorWavePayload, client handlers.WinthorClient) error {
+	start := time.Now()
+	resp, err := client.SendReplenishmentWave(ctx, companyID, payload)
+	durMs := int(time.Since(start).Milliseconds())
 
-	type taskRow struct {
-		ProductCode  string
-		ProductDesc  string
-		LocationCode string
-		CurrentQty   float64
-		MinQty       float64
-		MaxQty       float64
-		ABCClass     string
-		Priority     int
+	// The outcome is recorded even when ctx was cancelled mid-send
+	rec := context.WithoutCancel(ctx)
+	if err != nil {
+		switch {
+		case errors.Is(err, handlers.ErrWinthorRejected):
+			s.rejectWave(rec, waveID, err)
+		case errors.Is(err, handlers.ErrWinthorCircuitOpen):
+			s.db.ExecContext(rec, `
+				UPDATE replenishment_waves SET status='erro', error_message=$1, next_retry_at=$2
+				WHERE id=$3 AND status IN ('gerada','erro')
+			`, err.Error(), time.Now().Add(handlers.WinthorBreaker(companyID).Cooldown), waveID)
+		default:
+			var attempts int
+			s.db.QueryRowContext(rec, `
+				UPDATE replenishment_waves
+				SET status='erro', error_message=$1, send_attempts=COALESCE(send_attempts,0)+1
+				WHERE id=$2 AND status IN ('gerada','erro') RETURNING send_attempts
+			`, err.Error(), waveID).Scan(&attempts)
+			s.db.ExecContext(rec, `UPDATE replenishment_waves SET next_retry_at=$1 WHERE id=$2 AND status='erro'`,
+				time.Now().Add(waveRetryDelay(attempts)), waveID)
+		}
+		s.logSync(ctx, companyID, payload.Filial, "wave_send", "error", len(payload.Tasks), err.Error(), durMs)
+		return fmt.Errorf("send wave: %w", err)
 	}
 
-	var tasks []taskRow
-	for rows.Next() {
-		var t taskRow
-		rows.Scan(&t.ProductCode, &t.ProductDesc, &t.LocationCode,
-			&t.CurrentQty, &t.MinQty, &t.MaxQty, &t.ABCClass, &t.Priority)
-		tasks = append(tasks, t)
+	// Update wave as sent
+	s.db.ExecContext(rec, `
+		UPDATE replenishment_waves
+		SET status='enviada', sent_to_winthor_at=NOW(), winthor_response=$1,
+		    error_message='', send_attempts=COALESCE(send_attempts,0)+1, next_retry_at=NULL
+		WHERE id=$2 AND status IN ('gerada','erro')
+	`, resp.WinthorRef, waveID)
+
+	s.logSync(ctx, companyID, payload.Filial, "wave_send", "success", len(payload.Tasks), "", durMs)
+	log.Printf("[Scheduler] Wave %s sent: %s", payload.WaveNumber, resp.WinthorRef)
+	return nil
+}
+
+// rejectWave marks a wave Winthor refused as "rejeitada" and cancels its
+// pending tasks, like a wave_rejected webhook. Re-sending it would only be
+// refused again.
+func (s *PickingScheduler) rejectWave(ctx context.Context, waveID int, sendErr error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("[Scheduler] reject wave %d: %v", waveID, err)
+		return
 	}
+	defer tx.Rollback()
 
-	if len(tasks) == 0 {
-		return nil
+	res, err := tx.ExecContext(ctx, `
+		UPDATE replenishment_waves
+		SET status='rejeitada', error_message=$1, send_attempts=COALESCE(send_attempts,0)+1, next_retry_at=NULL
+		WHERE id=$2 AND status IN ('gerada','erro')
+	`, "Rejeitada pelo Winthor: "+sendErr.Error(), waveID)
+	if err != nil {
+		log.Printf("[Scheduler] reject wave %d: %v", waveID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE replenishment_tasks SET status = 'cancelado' WHERE wave_id = $1 AND status = 'pendente'
+	`, waveID); err != nil {
+		log.Printf("[Scheduler] reject wave %d: %v", waveID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[Scheduler] reject wave %d: %v", waveID, err)
 	}
+}
 
-	// Generate wave number: YYYYMMDD-FILIAL-SEQ
-	var seqCount int
-	s.db.QueryRow(`
-		SELECT COUNT(*) FROM replenishment_waves
-		WHERE company_id = $1 AND filial = $2
-		  AND generated_at::date = CURRENT_DATE
-	`, companyID, filial).Scan(&seqCount)
-
-	waveNumber := fmt.Sprintf("%s-%s-%03d",
-		time.Now().Format("20060102"), filial, seqCount+1)
-
-	// Create wave record
-	var waveID int
-	err = s.db.QueryRow(`
-		INSERT INTO replenishment_waves (company_id, filial, wave_number, total_tasks, triggered_by)
-		VALUES ($1, $2, $3, $4, $5) RETURNING id
-	`, companyID, filial, waveNumber, len(tasks), triggeredBy).Scan(&waveID)
+const maxWaveSendAttempts = 6
+
+// waveRetryDelay spaces background re-sends of a failed wave: 2, 4, 8...
+// minutes, capped at one hour.
+func waveRetryDelay(attempts int) time.Duration {
+	d := 2 * time.Minute
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// resendFailedWaves re-sends waves left in "erro" whose retry time has come,
+// rebuilding the payload from their tasks. The wave number is reused so the
+// idempotency key stays the same.
+func (s *PickingScheduler) resendFailedWaves(ctx context.Context) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, company_id::text, filial, wave_number, generated_at
+		FROM replenishment_waves
+		WHERE status = 'erro'
+		  AND COALESCE(send_attempts,0) < $1
+		  AND (next_retry_at IS NULL OR next_retry_at <= NOW())
+		ORDER BY generated_at ASC
+	`, maxWaveSendAttempts)
 	if err != nil {
-		return fmt.Errorf("insert wave: %w", err)
+		log.Printf("[Scheduler] resendFailedWaves: %v", err)
+		return
 	}
+	defer rows.Close()
 
-	// Build Winthor payload
-	var winthorTasks []handlers.WinthorTaskItem
-	for _, t := range tasks {
-		qtyToReplenish := t.MaxQty - t.CurrentQty
-		if qtyToReplenish <= 0 {
-			qtyToReplenish = t.MinQty
+	type failedWave struct {
+		ID          int
+		CompanyID   string
+		Filial      string
+		WaveNumber  string
+		GeneratedAt time.Time
+	}
+	var failed []failedWave
+	for rows.Next() {
+		var w failedWave
+		if err := rows.Scan(&w.ID, &w.CompanyID, &w.Filial, &w.WaveNumber, &w.GeneratedAt); err == nil {
+			failed = append(failed, w)
 		}
+	}
+	rows.Close()
 
-		// Insert task record
-		s.db.Exec(`
-			INSERT INTO replenishment_tasks
-			  (wave_id, company_id, filial, product_code, product_description,
-			   location_code, current_qty, min_qty, qty_to_replenish, abc_class, priority)
-			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
-		`, waveID, companyID, filial, t.ProductCode, t.ProductDesc,
-			t.LocationCode, t.CurrentQty, t.MinQty, qtyToReplenish, t.ABCClass, t.Priority)
+	for _, w := range failed {
+		if ctx.Err() != nil {
+			return
+		}
+		if handlers.WinthorBreaker(w.CompanyID).IsOpen() {
+			continue
+		}
+
+		payload, err := s.loadWavePayload(ctx, w.ID, w.WaveNumber, w.Filial, w.GeneratedAt)
+		if err != nil || len(payload.Tasks) == 0 {
+			continue
+		}
 
-		winthorTasks = append(winthorTasks, handlers.WinthorTaskItem{
-			LocationCode:   t.LocationCode,
-			ProductCode:    t.ProductCode,
-			ProductDesc:    t.ProductDesc,
-			QtyToReplenish: qtyToReplenish,
-			ABCClass:       t.ABCClass,
-			Priority:       t.Priority,
-		})
+		log.Printf("[Scheduler] Re-sending wave %s (company=%s)", w.WaveNumber, w.CompanyID)
+		client := s.newClient(w.CompanyID, loadPickingSettings(ctx, s.db, w.CompanyID))
+		if err := s.sendWave(ctx, w.CompanyID, w.ID, payload, client); err != nil {
+			log.Printf("[Scheduler] Re-send of wave %s failed: %v", w.WaveNumber, err)
+		}
 	}
+}
 
-	// Send to Winthor
+// loadWavePayload rebuilds the Winthor payload of a stored wave from its tasks.
+func (s *PickingScheduler) loadWavePayload(ctx context.Context, waveID int, waveNumber, filial string, generatedAt time.Time) (handlers.WinthorWavePayload, error) {
 	payload := handlers.WinthorWavePayload{
 		WaveNumber:  waveNumber,
 		Filial:      filial,
-		Tasks:       winthorTasks,
-		GeneratedAt: time.Now().Format(time.RFC3339),
+		GeneratedAt: generatedAt.Format(time.RFC3339),
 	}
-
-	start := time.Now()
-	resp, err := client.SendReplenishmentWave(companyID, payload)
-	durMs := int(time.Since(start).Milliseconds())
-
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT location_code, product_code, COALESCE(product_description,''),
+		       qty_to_replenish, abc_class, priority,
+		       COALESCE(task_type,'replenishment'), COALESCE(from_location_code,'')
+		FROM replenishment_tasks WHERE wave_id = $1 AND status <> 'cancelado'
+		ORDER BY priority ASC, id ASC
+	`, waveID)
 	if err != nil {
-		s.db.Exec(`UPDATE replenishment_waves SET status='erro', error_message=$1 WHERE id=$2`,
-			err.Error(), waveID)
-		s.logSync(companyID, filial, "wave_send", "error", len(tasks), err.Error(), durMs)
-		return fmt.Errorf("send wave: %w", err)
+		return payload, err
 	}
+	defer rows.Close()
 
-	// Update wave as sent
-	s.db.Exec(`
-		UPDATE replenishment_waves
-		SET status='enviada', sent_to_winthor_at=NOW(), winthor_response=$1
-		WHERE id=$2
-	`, resp.WinthorRef, waveID)
-
-	s.logSync(companyID, filial, "wave_send", "success", len(tasks), "", durMs)
-	log.Printf("[Scheduler] Wave %s sent: %s", waveNumber, resp.WinthorRef)
-	return nil
+	for rows.Next() {
+		var t handlers.WinthorTaskItem
+		if err := rows.Scan(&t.LocationCode, &t.ProductCode, &t.ProductDesc,
+			&t.QtyToReplenish, &t.ABCClass, &t.Priority, &t.TaskType, &t.FromLocationCode); err != nil {
+			continue
+		}
+		if t.TaskType == "replenishment" {
+			t.TaskType = ""
+		}
+		payload.Tasks = append(payload.Tasks, t)
+	}
+	return payload, rows.Err()
 }
 
 // completeOldWaves marks waves sent more than 5 minutes ago as "concluida",
 // updates their tasks, and refills the picking stock to simulate replenishment.
-func (s *PickingScheduler) completeOldWaves() {
-	rows, err := s.db.Query(`
+func (s *PickingScheduler) completeOldWaves(ctx context.Context) {
+	rows, err := s.db.QueryContext(ctx, `
 		SELECT id, company_id::text, filial
 		FROM replenishment_waves
 		WHERE status = 'enviada'
@@ -328,57 +668,185 @@ func (s *PickingScheduler) completeOldWaves() {
 		rows.Scan(&w.ID, &w.CompanyID, &w.Filial)
 		pending = append(pending, w)
 	}
+	rows.Close()
 
 	for _, w := range pending {
-		// 1. Mark wave as concluida
-		_, err := s.db.Exec(`
-			UPDATE replenishment_waves
-			SET status = 'concluida',
-			    completed_at = NOW(),
-			    completed_tasks = total_tasks
-			WHERE id = $1
-		`, w.ID)
-		if err != nil {
-			log.Printf("[Scheduler] completeOldWaves: update wave %d: %v", w.ID, err)
+		if ctx.Err() != nil {
+			return
+		}
+		if err := s.completeWave(ctx, w.ID, w.CompanyID, w.Filial); err != nil {
+			log.Printf("[Scheduler] completeOldWaves: wave %d: %v", w.ID, err)
 			continue
 		}
+		log.Printf("[Scheduler] Wave %d (filial %s) concluida — stock refilled", w.ID, w.Filial)
+		s.logSync(ctx, w.CompanyID, w.Filial, "wave_complete", "success", 0, "", 0)
+	}
+}
 
-		// 2. Mark all tasks as concluido
-		s.db.Exec(`
-			UPDATE replenishment_tasks
-			SET status = 'concluido', completed_at = NOW()
-			WHERE wave_id = $1
-		`, w.ID)
-
-		// 3. Refill picking_stock for replenished locations (current_qty → max_qty)
-		// This simulates the warehouse operator completing the physical replenishment.
-		s.db.Exec(`
-			UPDATE picking_stock ps
-			SET current_qty = ps.max_qty,
-			    last_sync_at = NOW(),
-			    updated_at   = NOW()
-			WHERE ps.company_id = $1
-			  AND ps.filial     = $2
-			  AND ps.location_id IN (
-			      SELECT pl.id
-			      FROM picking_locations pl
-			      INNER JOIN replenishment_tasks rt
-			          ON  rt.location_code = pl.location_code
-			          AND rt.company_id    = pl.company_id
-			          AND rt.filial        = pl.filial
-			      WHERE rt.wave_id = $3
-			  )
-		`, w.CompanyID, w.Filial, w.ID)
+// completeWave applies one completed wave in a single transaction, so an
+// interrupted shutdown never leaves a wave concluida with its stock not
+// refilled.
+func (s *PickingScheduler) completeWave(ctx context.Context, waveID int, companyID, filial string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		log.Printf("[Scheduler] Wave %d (filial %s) concluida — stock refilled", w.ID, w.Filial)
-		s.logSync(w.CompanyID, w.Filial, "wave_complete", "success", 0, "", 0)
+	// 1. Mark wave as concluida
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE replenishment_waves
+		SET status = 'concluida',
+		    completed_at = NOW(),
+		    completed_tasks = total_tasks
+		WHERE id = $1
+	`, waveID); err != nil {
+		return fmt.Errorf("update wave: %w", err)
+	}
+
+	// 2. Mark all tasks as concluido (cancelled ones stay cancelled)
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE replenishment_tasks
+		SET status = 'concluido', completed_at = NOW()
+		WHERE wave_id = $1 AND status <> 'cancelado'
+	`, waveID); err != nil {
+		return fmt.Errorf("tasks: %w", err)
+	}
+
+	// 3. Refill picking_stock for replenished locations (current_qty → max_qty)
+	// This simulates the warehouse operator completing the physical replenishment.
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO picking_stock_movements
+		  (company_id, filial, stock_id, location_id, product_code, movement_type,
+		   qty_before, qty_after, delta, min_qty, reference)
+		SELECT ps.company_id, ps.filial, ps.id, ps.location_id, ps.product_code, 'replenishment',
+		       ps.current_qty, ps.max_qty, ps.max_qty - ps.current_qty, ps.min_qty, 'wave:' || $3::text
+		FROM picking_stock ps
+		WHERE ps.company_id = $1
+		  AND ps.filial     = $2
+		  AND ps.current_qty <> ps.max_qty
+		  AND ps.location_id IN (
+		      SELECT pl.id
+		      FROM picking_locations pl
+		      INNER JOIN replenishment_tasks rt
+		          ON  rt.location_code = pl.location_code
+		          AND rt.company_id    = pl.company_id
+		          AND rt.filial        = pl.filial
+		      WHERE rt.wave_id = $3 AND rt.task_type = 'replenishment' AND rt.status <> 'cancelado'
+		  )
+	`, companyID, filial, waveID); err != nil {
+		return fmt.Errorf("refill movements: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE picking_stock ps
+		SET current_qty = ps.max_qty,
+		    last_sync_at = NOW(),
+		    updated_at   = NOW()
+		WHERE ps.company_id = $1
+		  AND ps.filial     = $2
+		  AND ps.location_id IN (
+		      SELECT pl.id
+		      FROM picking_locations pl
+		      INNER JOIN replenishment_tasks rt
+		          ON  rt.location_code = pl.location_code
+		          AND rt.company_id    = pl.company_id
+		          AND rt.filial        = pl.filial
+		      WHERE rt.wave_id = $3 AND rt.task_type = 'replenishment' AND rt.status <> 'cancelado'
+		  )
+	`, companyID, filial, waveID); err != nil {
+		return fmt.Errorf("refill stock: %w", err)
+	}
+
+	// 4. Relocation tasks (slotting): the stock row follows its product
+	// to the new location, keeping its id and movement history. A failed
+	// relocation is rolled back on its own and never holds the wave back.
+	if _, err := tx.ExecContext(ctx, `SAVEPOINT slotting`); err != nil {
+		return fmt.Errorf("savepoint: %w", err)
+	}
+	if err := relocateSlottedStock(ctx, tx, waveID); err != nil {
+		log.Printf("[Scheduler] completeWave: wave %d: slotting relocation skipped: %v", waveID, err)
+		if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT slotting`); err != nil {
+			return fmt.Errorf("rollback slotting: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// relocateSlottedStock moves the stock of each slotting task of a wave to
+// its destination. Like a manual move, a task whose destination already
+// holds the product is skipped, since a location keeps one row per product.
+func relocateSlottedStock(ctx context.Context, tx *sql.Tx, waveID int) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT ps.id, src.id, dst.id, ps.product_code, rt.location_code
+		FROM replenishment_tasks rt
+		JOIN picking_locations src
+		  ON src.company_id = rt.company_id AND src.filial = rt.filial AND src.location_code = rt.from_location_code
+		JOIN picking_locations dst
+		  ON dst.company_id = rt.company_id AND dst.filial = rt.filial AND dst.location_code = rt.location_code
+		JOIN picking_stock ps ON ps.location_id = src.id AND ps.product_code = rt.product_code
+		WHERE rt.wave_id = $1 AND rt.task_type = 'slotting'
+		ORDER BY rt.id
+	`, waveID)
+	if err != nil {
+		return err
+	}
+	type relocation struct {
+		StockID, FromID, ToID int
+		ProductCode, ToCode   string
+	}
+	var moves []relocation
+	for rows.Next() {
+		var m relocation
+		if err := rows.Scan(&m.StockID, &m.FromID, &m.ToID, &m.ProductCode, &m.ToCode); err != nil {
+			rows.Close()
+			return err
+		}
+		moves = append(moves, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
+
+	for _, m := range moves {
+		if m.FromID == m.ToID {
+			continue
+		}
+		var taken bool
+		if err := tx.QueryRowContext(ctx,
+			`SELECT EXISTS(SELECT 1 FROM picking_stock WHERE location_id=$1 AND product_code=$2)`,
+			m.ToID, m.ProductCode).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			log.Printf("[Scheduler] wave %d: product %s already at %s, relocation skipped",
+				waveID, m.ProductCode, m.ToCode)
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO picking_stock_movements
+			  (company_id, filial, stock_id, location_id, from_location_id, product_code, movement_type,
+			   qty_before, qty_after, delta, min_qty, reference)
+			SELECT company_id, filial, id, $2, $3, product_code, 'transfer',
+			       current_qty, current_qty, 0, min_qty, 'wave:' || $4::text
+			FROM picking_stock WHERE id = $1
+		`, m.StockID, m.ToID, m.FromID, waveID); err != nil {
+			return fmt.Errorf("transfer movement: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE picking_stock SET location_id=$1, updated_at=NOW() WHERE id=$2`, m.ToID, m.StockID); err != nil {
+			return fmt.Errorf("relocate stock: %w", err)
+		}
+	}
+	return nil
 }
 
-func (s *PickingScheduler) recordFragmentationScore(companyID, filial string) {
+func (s *PickingScheduler) recordFragmentationScore(ctx context.Context, companyID, filial string) {
 	// Calculate weighted fragmentation score per filial
-	// Score: weighted shortage percentage (A=3x, B=2x, C=1x weight)
-	rows, err := s.db.Query(`
+	// Score: weighted shortage percentage, weights per ABC class from settings
+	params := handlers.LoadFragmentationParams(ctx, s.db, companyID)
+	rows, err := s.db.QueryContext(ctx, `
 		SELECT current_qty, min_qty, abc_class
 		FROM picking_stock
 		WHERE company_id = $1 AND filial = $2 AND min_qty > 0
@@ -395,16 +863,7 @@ func (s *PickingScheduler) recordFragmentationScore(companyID, filial string) {
 		var abcClass string
 		rows.Scan(&currentQty, &minQty, &abcClass)
 
-		var weight float64
-		switch abcClass {
-		case "A":
-			weight = 3.0
-		case "B":
-			weight = 2.0
-		default:
-			weight = 1.0
-		}
-
+		weight := params.Weight(abcClass)
 		shortage := math.Max(0, (minQty-currentQty)/minQty) * 100
 		weightedScore += shortage * weight
 		totalWeight += weight
@@ -422,39 +881,67 @@ func (s *PickingScheduler) recordFragmentationScore(companyID, filial string) {
 		}
 	}
 
-	s.db.Exec(`
+	var previous *float64
+	var prev float64
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT score FROM fragmentation_history
+		WHERE company_id = $1 AND filial = $2
+		ORDER BY recorded_at DESC LIMIT 1
+	`, companyID, filial).Scan(&prev); err == nil {
+		previous = &prev
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
 		INSERT INTO fragmentation_history (company_id, filial, score, locations_below_min, total_active_locations)
 		VALUES ($1, $2, $3, $4, $5)
-	`, companyID, filial, score, belowMin, total)
+	`, companyID, filial, score, belowMin, total); err != nil {
+		return
+	}
+
+	// Stored score has one decimal; compare on the same precision
+	score = math.Round(score*10) / 10
+	handlers.CheckFragmentationAlert(ctx, s.db, companyID, filial, previous, score, params.AlertThreshold)
 }
 
-func (s *PickingScheduler) logSync(companyID, filial, syncType, status string, records int, errMsg string, durMs int) {
-	s.db.Exec(`
+// logSync records an outcome in winthor_sync_log. It is written even when
+// ctx is already cancelled, so an interrupted call still leaves a trace.
+func (s *PickingScheduler) logSync(ctx context.Context, companyID, filial, syncType, status string, records int, errMsg string, durMs int) {
+	s.db.ExecContext(context.WithoutCancel(ctx), `
 		INSERT INTO winthor_sync_log (company_id, filial, sync_type, status, records_processed, error_message, duration_ms)
 		VALUES ($1,$2,$3,$4,$5,$6,$7)
 	`, companyID, filial, syncType, status, records, errMsg, durMs)
 }
 
-// GenerateWaveManual is called from the API handler
-func GenerateWaveManual(db *sql.DB, companyID, filial string) error {
-	winthorSettings := loadPickingSettings(db, companyID)
-	client := handlers.NewWinthorClient(db, winthorSettings)
+func (s *PickingScheduler) logSyncCounts(ctx context.Context, companyID, filial, syncType, status string, records int, c stockSyncCounts, durMs int) {
+	s.db.ExecContext(context.WithoutCancel(ctx), `
+		INSERT INTO winthor_sync_log
+		  (company_id, filial, sync_type, status, records_processed, duration_ms,
+		   records_inserted, records_updated, records_missing)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+	`, companyID, filial, syncType, status, records, durMs, c.Inserted, c.Updated, c.Missing)
+}
 
-	sched := &PickingScheduler{db: db}
-	// First do a sync to get fresh data
-	sched.syncFilial(companyID, filial, client)
-	return nil
+// logAttempt records a single Winthor call made by the resilient client.
+// Like logSync it is written even when ctx was cancelled mid-call.
+func (s *PickingScheduler) logAttempt(ctx context.Context, a handlers.WinthorAttempt) {
+	status, errMsg := "success", ""
+	if a.Err != nil {
+		status, errMsg = "error", a.Err.Error()
+	}
+	s.db.ExecContext(context.WithoutCancel(ctx), `
+		INSERT INTO winthor_sync_log
+		  (company_id, filial, sync_type, status, records_processed, error_message, duration_ms, attempt, idempotency_key)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+	`, a.CompanyID, a.Filial, a.Operation+"_attempt", status, a.Records, errMsg,
+		int(a.Duration.Milliseconds()), a.Attempt, a.IdempotencyKey)
 }
 
-func loadPickingSettings(db *sql.DB, companyID string) handlers.PickingSettings {
+func loadPickingSettings(ctx context.Context, db *sql.DB, companyID string) handlers.PickingSettings {
 	var useMock bool
 	var apiURL, apiKey string
-	db.QueryRow(`
+	db.QueryRowContext(ctx, `
 		SELECT COALESCE(use_mock_winthor,TRUE), COALESCE(winthor_api_url,''), COALESCE(winthor_api_key,'')
 		FROM settings WHERE company_id=$1
 	`, companyID).Scan(&useMock, &apiURL, &apiKey)
 	return handlers.PickingSettings{UseMock: useMock, APIURL: apiURL, APIKey: apiKey}
 }
-
-// Suppress unused import warning for rand
-var _ = rand.Float64
@@ -0,0 +1,191 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"aprovapedido/handlers"
+
+	"github.com/lib/pq"
+)
+
+// stockSyncCounts summarises a merge of a Winthor snapshot into picking_stock.
+type stockSyncCounts struct {
+	Inserted         int // stock rows the ERP reported that did not exist yet
+	Updated          int // existing stock rows refreshed from the snapshot
+	Missing          int // stock rows of the filial absent from the snapshot
+	LocationsCreated int
+}
+
+// applyStockSnapshot merges the stock reported by Winthor for a filial,
+// keyed on (location_code, product_code). The snapshot is copied into a
+// temporary table and merged with set-based statements in a single
+// transaction, so a failed sync leaves picking_stock untouched.
+//
+// Locations and products unknown locally are created with the ERP's
+// min/max/ABC; for existing rows only current_qty is taken from the ERP,
+// since min/max are maintained locally.
+func applyStockSnapshot(ctx context.Context, db *sql.DB, companyID, filial string, items []handlers.WinthorStockItem) (stockSyncCounts, error) {
+	var counts stockSyncCounts
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return counts, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		CREATE TEMP TABLE tmp_winthor_stock (
+			location_code VARCHAR(20),
+			product_code VARCHAR(50),
+			product_description VARCHAR(500),
+			current_qty NUMERIC(15,3),
+			min_qty NUMERIC(15,3),
+			max_qty NUMERIC(15,3),
+			abc_class CHAR(1)
+		) ON COMMIT DROP
+	`); err != nil {
+		return counts, fmt.Errorf("create temp table: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("tmp_winthor_stock",
+		"location_code", "product_code", "product_description",
+		"current_qty", "min_qty", "max_qty", "abc_class"))
+	if err != nil {
+		return counts, fmt.Errorf("prepare copy: %w", err)
+	}
+
+	// The ERP may repeat a (location, product) pair; the last one wins
+	seen := make(map[string]int, len(items))
+	rows := make([]handlers.WinthorStockItem, 0, len(items))
+	for _, it := range items {
+		it.LocationCode = strings.TrimSpace(it.LocationCode)
+		it.ProductCode = strings.TrimSpace(it.ProductCode)
+		if it.LocationCode == "" || it.ProductCode == "" ||
+			len(it.LocationCode) > 20 || len(it.ProductCode) > 50 {
+			continue
+		}
+		if r := []rune(it.ProductDesc); len(r) > 500 {
+			it.ProductDesc = string(r[:500])
+		}
+		key := it.LocationCode + "|" + it.ProductCode
+		if i, ok := seen[key]; ok {
+			rows[i] = it
+			continue
+		}
+		seen[key] = len(rows)
+		rows = append(rows, it)
+	}
+
+	for _, it := range rows {
+		abc := strings.ToUpper(strings.TrimSpace(it.ABCClass))
+		if abc != "A" && abc != "B" && abc != "C" {
+			abc = "C"
+		}
+		if _, err := stmt.ExecContext(ctx, it.LocationCode, it.ProductCode, it.ProductDesc,
+			it.CurrentQty, it.MinQty, it.MaxQty, abc); err != nil {
+			stmt.Close()
+			return counts, fmt.Errorf("copy row: %w", err)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return counts, fmt.Errorf("flush copy: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return counts, err
+	}
+
+	// 1. Locations reported by the ERP that we do not know yet.
+	// Codes follow AISLE-BAY-LEVEL-POSITION; non-numeric parts fall back to defaults.
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO picking_locations (company_id, filial, location_code, aisle, bay, level, position)
+		SELECT DISTINCT $1::int, $2::varchar, t.location_code,
+		       LEFT(split_part(t.location_code, '-', 1), 5),
+		       CASE WHEN split_part(t.location_code, '-', 2) ~ '^[0-9]{1,6}$' THEN split_part(t.location_code, '-', 2)::int ELSE 0 END,
+		       CASE WHEN split_part(t.location_code, '-', 3) ~ '^[0-9]{1,6}$' THEN split_part(t.location_code, '-', 3)::int ELSE 1 END,
+		       CASE WHEN split_part(t.location_code, '-', 4) ~ '^[0-9]{1,6}$' THEN split_part(t.location_code, '-', 4)::int ELSE 1 END
+		FROM tmp_winthor_stock t
+		ON CONFLICT (company_id, filial, location_code) DO NOTHING
+	`, companyID, filial)
+	if err != nil {
+		return counts, fmt.Errorf("insert locations: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	counts.LocationsCreated = int(n)
+
+	// 2. Existing stock rows, matched on location + product. Quantity changes
+	// are recorded as sync movements before the rows are overwritten.
+	// Deactivated locations are left out of steps 2-4.
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO picking_stock_movements
+		  (company_id, filial, stock_id, location_id, product_code, movement_type,
+		   qty_before, qty_after, delta, min_qty, reference)
+		SELECT ps.company_id, ps.filial, ps.id, ps.location_id, ps.product_code, 'sync',
+		       ps.current_qty, t.current_qty, t.current_qty - ps.current_qty, ps.min_qty, 'winthor'
+		FROM picking_stock ps
+		JOIN picking_locations pl ON pl.id = ps.location_id
+		JOIN tmp_winthor_stock t
+		  ON t.location_code = pl.location_code AND t.product_code = ps.product_code
+		WHERE ps.company_id = $1 AND ps.filial = $2 AND COALESCE(pl.is_active, TRUE)
+		  AND ps.current_qty IS DISTINCT FROM t.current_qty
+	`, companyID, filial); err != nil {
+		return counts, fmt.Errorf("record movements: %w", err)
+	}
+
+	res, err = tx.ExecContext(ctx, `
+		UPDATE picking_stock ps
+		SET current_qty = t.current_qty, last_sync_at = NOW(), updated_at = NOW()
+		FROM tmp_winthor_stock t
+		JOIN picking_locations pl
+		  ON pl.company_id = $1 AND pl.filial = $2 AND pl.location_code = t.location_code
+		 AND COALESCE(pl.is_active, TRUE)
+		WHERE ps.company_id = $1 AND ps.filial = $2
+		  AND ps.location_id = pl.id AND ps.product_code = t.product_code
+	`, companyID, filial)
+	if err != nil {
+		return counts, fmt.Errorf("update stock: %w", err)
+	}
+	n, _ = res.RowsAffected()
+	counts.Updated = int(n)
+
+	// 3. Products the ERP reports in a location where we do not have them
+	res, err = tx.ExecContext(ctx, `
+		INSERT INTO picking_stock
+		  (company_id, filial, location_id, product_code, product_description,
+		   current_qty, min_qty, max_qty, abc_class, last_sync_at)
+		SELECT $1::int, $2::varchar, pl.id, t.product_code, COALESCE(t.product_description, ''),
+		       t.current_qty, COALESCE(t.min_qty, 0), COALESCE(t.max_qty, 0), t.abc_class, NOW()
+		FROM tmp_winthor_stock t
+		JOIN picking_locations pl
+		  ON pl.company_id = $1 AND pl.filial = $2 AND pl.location_code = t.location_code
+		 AND COALESCE(pl.is_active, TRUE)
+		ON CONFLICT (company_id, filial, location_id, product_code) DO NOTHING
+	`, companyID, filial)
+	if err != nil {
+		return counts, fmt.Errorf("insert stock: %w", err)
+	}
+	n, _ = res.RowsAffected()
+	counts.Inserted = int(n)
+
+	// 4. Local rows the ERP no longer reports (left as they are)
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM picking_stock ps
+		JOIN picking_locations pl ON pl.id = ps.location_id
+		WHERE ps.company_id = $1 AND ps.filial = $2 AND COALESCE(pl.is_active, TRUE)
+		  AND NOT EXISTS (
+		      SELECT 1 FROM tmp_winthor_stock t
+		      WHERE t.location_code = pl.location_code AND t.product_code = ps.product_code
+		  )
+	`, companyID, filial).Scan(&counts.Missing); err != nil {
+		return counts, fmt.Errorf("count missing: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return counts, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,304 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"aprovapedido/handlers"
+
+	"github.com/lib/pq"
+)
+
+// waveRules are the per-company wave-building settings. Zero values mean no
+// limit, so by default each generation yields one wave per filial.
+type waveRules struct {
+	SplitByZone bool
+	MaxTasks    int
+	MaxVolume   float64
+	MergeGerada bool
+	MinInterval time.Duration
+}
+
+func loadWaveRules(ctx context.Context, db *sql.DB, companyID string) waveRules {
+	var r waveRules
+	var intervalMinutes int
+	db.QueryRowContext(ctx, `
+		SELECT COALESCE(wave_split_by_zone, FALSE), COALESCE(wave_max_tasks, 0),
+		       COALESCE(wave_max_volume, 0), COALESCE(wave_merge_pending, FALSE),
+		       COALESCE(wave_min_interval_minutes, 0)
+		FROM settings WHERE company_id = $1
+	`, companyID).Scan(&r.SplitByZone, &r.MaxTasks, &r.MaxVolume, &r.MergeGerada, &intervalMinutes)
+	r.MinInterval = time.Duration(intervalMinutes) * time.Minute
+	return r
+}
+
+// fits reports whether a wave holding count tasks and volume units can take
+// one more task of qty units. An empty wave always takes a task, so a single
+// task larger than MaxVolume still gets a wave.
+func (r waveRules) fits(count int, volume, qty float64) bool {
+	if count == 0 {
+		return true
+	}
+	if r.MaxTasks > 0 && count+1 > r.MaxTasks {
+		return false
+	}
+	if r.MaxVolume > 0 && volume+qty > r.MaxVolume {
+		return false
+	}
+	return true
+}
+
+type waveTask struct {
+	ProductCode  string
+	ProductDesc  string
+	LocationCode string
+	Zone         string
+	CurrentQty   float64
+	MinQty       float64
+	MaxQty       float64
+	Qty          float64
+	ABCClass     string
+	Priority     int
+}
+
+// waveResult counts what generateWave did, for the job run step message.
+type waveResult struct {
+	Tasks   int
+	Created int // new waves
+	Merged  int // tasks appended to an existing pending wave
+}
+
+// generateWave turns the locations at or below minimum, plus the stock ids
+// in predicted, into "gerada" waves following the company's wave rules:
+// tasks are split by zone when configured, appended to a pending wave of the
+// same zone when merging is on, and spread over as many waves as the task
+// and volume caps require. dispatchWaves sends them.
+func (s *PickingScheduler) generateWave(ctx context.Context, companyID, filial, triggeredBy string, predicted []int64) (waveResult, error) {
+	var res waveResult
+	rules := loadWaveRules(ctx, s.db, companyID)
+
+	// Deactivated locations are skipped, and locations already in a pending
+	// wave are left out; they will be sent with it
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT ps.product_code, ps.product_description, pl.location_code, COALESCE(pl.zone, ''),
+		       ps.current_qty, ps.min_qty, ps.max_qty, ps.abc_class,
+		       CASE ps.abc_class WHEN 'A' THEN 1 WHEN 'B' THEN 2 ELSE 3 END as priority
+		FROM picking_stock ps
+		JOIN picking_locations pl ON pl.id = ps.location_id
+		WHERE ps.company_id = $1 AND ps.filial = $2 AND ps.min_qty > 0
+		  AND COALESCE(pl.is_active, TRUE)
+		  AND (ps.current_qty <= ps.min_qty OR ps.id = ANY($3))
+		  AND NOT EXISTS (
+		      SELECT 1 FROM replenishment_tasks rt
+		      JOIN replenishment_waves w ON w.id = rt.wave_id
+		      WHERE w.company_id = $1 AND w.filial = $2 AND w.status = 'gerada'
+		        AND rt.location_code = pl.location_code AND rt.product_code = ps.product_code
+		  )
+		ORDER BY priority ASC, (ps.min_qty - ps.current_qty) DESC
+	`, companyID, filial, pq.Array(predicted))
+	if err != nil {
+		return res, err
+	}
+
+	var zones []string
+	byZone := map[string][]waveTask{}
+	for rows.Next() {
+		var t waveTask
+		if err := rows.Scan(&t.ProductCode, &t.ProductDesc, &t.LocationCode, &t.Zone,
+			&t.CurrentQty, &t.MinQty, &t.MaxQty, &t.ABCClass, &t.Priority); err != nil {
+			continue
+		}
+		t.Qty = t.MaxQty - t.CurrentQty
+		if t.Qty <= 0 {
+			t.Qty = t.MinQty
+		}
+		if !rules.SplitByZone {
+			t.Zone = ""
+		}
+		if _, ok := byZone[t.Zone]; !ok {
+			zones = append(zones, t.Zone)
+		}
+		byZone[t.Zone] = append(byZone[t.Zone], t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+
+	for _, zone := range zones {
+		created, merged, err := s.buildZoneWaves(ctx, companyID, filial, zone, triggeredBy, byZone[zone], rules)
+		if err != nil {
+			return res, fmt.Errorf("zone %q: %w", zone, err)
+		}
+		res.Tasks += len(byZone[zone])
+		res.Created += created
+		res.Merged += merged
+	}
+	return res, nil
+}
+
+// buildZoneWaves places the tasks of one zone in a single transaction.
+func (s *PickingScheduler) buildZoneWaves(ctx context.Context, companyID, filial, zone, triggeredBy string, tasks []waveTask, rules waveRules) (created, merged int, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	waveID, count, volume := 0, 0, 0.0
+	if rules.MergeGerada {
+		err := tx.QueryRowContext(ctx, `
+			SELECT w.id, w.total_tasks,
+			       COALESCE((SELECT SUM(qty_to_replenish) FROM replenishment_tasks WHERE wave_id = w.id), 0)
+			FROM replenishment_waves w
+			WHERE w.company_id = $1 AND w.filial = $2 AND COALESCE(w.zone, '') = $3
+			  AND w.status = 'gerada' AND w.send_started_at IS NULL AND w.triggered_by <> 'slotting'
+			ORDER BY w.generated_at DESC
+			LIMIT 1
+			FOR UPDATE
+		`, companyID, filial, zone).Scan(&waveID, &count, &volume)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, 0, err
+		}
+	}
+
+	for _, t := range tasks {
+		if waveID == 0 || !rules.fits(count, volume, t.Qty) {
+			waveNumber, err := handlers.NextWaveNumber(ctx, tx, companyID, filial)
+			if err != nil {
+				return 0, 0, fmt.Errorf("wave number: %w", err)
+			}
+			if err := tx.QueryRowContext(ctx, `
+				INSERT INTO replenishment_waves (company_id, filial, wave_number, total_tasks, triggered_by, zone)
+				VALUES ($1, $2, $3, 0, $4, $5) RETURNING id
+			`, companyID, filial, waveNumber, triggeredBy, zone).Scan(&waveID); err != nil {
+				return 0, 0, fmt.Errorf("insert wave: %w", err)
+			}
+			count, volume = 0, 0
+			created++
+		} else if created == 0 {
+			merged++
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO replenishment_tasks
+			  (wave_id, company_id, filial, product_code, product_description,
+			   location_code, current_qty, min_qty, qty_to_replenish, abc_class, priority)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
+		`, waveID, companyID, filial, t.ProductCode, t.ProductDesc,
+			t.LocationCode, t.CurrentQty, t.MinQty, t.Qty, t.ABCClass, t.Priority); err != nil {
+			return 0, 0, fmt.Errorf("insert task: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE replenishment_waves SET total_tasks = total_tasks + 1 WHERE id = $1
+		`, waveID); err != nil {
+			return 0, 0, err
+		}
+		count++
+		volume += t.Qty
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	log.Printf("[Scheduler] company=%s filial=%s zone=%q: %d tasks, %d new waves, %d merged into pending wave",
+		companyID, filial, zone, len(tasks), created, merged)
+	return created, merged, nil
+}
+
+// dispatchResult counts what dispatchWaves did, for the job run step message.
+type dispatchResult struct {
+	Sent   int
+	Held   int // left for a later cycle by the minimum interval
+	Failed int
+}
+
+// dispatchWaves sends the filial's pending waves, oldest first, keeping at
+// least the configured minimum interval between two sent waves. Waves held
+// back stay "gerada" and keep accepting merged tasks until a later cycle.
+func (s *PickingScheduler) dispatchWaves(ctx context.Context, companyID, filial string, client handlers.WinthorClient) dispatchResult {
+	var res dispatchResult
+	rules := loadWaveRules(ctx, s.db, companyID)
+
+	var lastSent sql.NullTime
+	s.db.QueryRowContext(ctx, `
+		SELECT MAX(GREATEST(send_started_at, sent_to_winthor_at))
+		FROM replenishment_waves WHERE company_id = $1 AND filial = $2
+	`, companyID, filial).Scan(&lastSent)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id FROM replenishment_waves
+		WHERE company_id = $1 AND filial = $2 AND status = 'gerada' AND send_started_at IS NULL
+		ORDER BY generated_at ASC, id ASC
+	`, companyID, filial)
+	if err != nil {
+		log.Printf("[Scheduler] dispatchWaves: %v", err)
+		res.Failed++
+		return res
+	}
+	var pending []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			pending = append(pending, id)
+		}
+	}
+	rows.Close()
+
+	for i, waveID := range pending {
+		if ctx.Err() != nil {
+			return res
+		}
+		if rules.MinInterval > 0 && lastSent.Valid && time.Since(lastSent.Time) < rules.MinInterval {
+			res.Held = len(pending) - i
+			log.Printf("[Scheduler] company=%s filial=%s: %d waves held by the minimum interval",
+				companyID, filial, res.Held)
+			return res
+		}
+		sent, err := s.claimAndSendWave(ctx, companyID, waveID, client)
+		if err != nil {
+			log.Printf("[Scheduler] dispatch wave %d: %v", waveID, err)
+			res.Failed++
+		} else if sent {
+			res.Sent++
+		}
+		if sent {
+			lastSent = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+	return res
+}
+
+// claimAndSendWave marks a pending wave as being sent, so no more tasks are
+// merged into it, and sends it. Returns false if another caller claimed it.
+func (s *PickingScheduler) claimAndSendWave(ctx context.Context, companyID string, waveID int, client handlers.WinthorClient) (bool, error) {
+	var waveNumber, filial string
+	var generatedAt time.Time
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE replenishment_waves SET send_started_at = NOW()
+		WHERE id = $1 AND company_id = $2 AND status = 'gerada' AND send_started_at IS NULL
+		RETURNING wave_number, filial, generated_at
+	`, waveID, companyID).Scan(&waveNumber, &filial, &generatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	payload, err := s.loadWavePayload(ctx, waveID, waveNumber, filial, generatedAt)
+	if err != nil {
+		// Release the claim so a later cycle sends it
+		s.db.ExecContext(context.WithoutCancel(ctx),
+			`UPDATE replenishment_waves SET send_started_at = NULL WHERE id = $1 AND status = 'gerada'`, waveID)
+		return true, err
+	}
+	if len(payload.Tasks) == 0 {
+		s.db.ExecContext(ctx, `UPDATE replenishment_waves SET status='concluida', completed_at=NOW() WHERE id=$1`, waveID)
+		return true, nil
+	}
+	return true, s.sendWave(ctx, companyID, waveID, payload, client)
+}
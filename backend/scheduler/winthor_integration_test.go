@@ -0,0 +1,323 @@
+//go:build integration
+
+// Integration tests for the Winthor HTTP path. They run RealWinthorClient and
+// the scheduler against the fake server in package winthorfake:
+//
+//	go test -tags integration ./scheduler/
+//
+// Tests that need PostgreSQL are skipped unless TEST_DATABASE_URL points to a
+// disposable database; migrations are applied automatically.
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aprovapedido/handlers"
+	"aprovapedido/winthorfake"
+
+	_ "github.com/lib/pq"
+)
+
+func TestMain(m *testing.M) {
+	// Keep retries fast; the backoff shape is the same.
+	handlers.DefaultWinthorRetryPolicy = handlers.RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   10 * time.Millisecond,
+		MaxDelay:    50 * time.Millisecond,
+	}
+	os.Exit(m.Run())
+}
+
+func newFake(t *testing.T, cfg winthorfake.Config) (*winthorfake.Server, *httptest.Server) {
+	t.Helper()
+	fake := winthorfake.New(cfg)
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+func smallConfig() winthorfake.Config {
+	cfg := winthorfake.DefaultConfig()
+	cfg.APIKey = "test-key"
+	cfg.Filiais = []string{"01"}
+	cfg.LocationsPerFilial = 20
+	return cfg
+}
+
+func TestRealClientAgainstFake(t *testing.T) {
+	fake, srv := newFake(t, smallConfig())
+	client := handlers.NewRealWinthorClient(srv.URL, "test-key")
+	ctx := context.Background()
+
+	items, err := client.GetPickingStock(ctx, "1", "01")
+	if err != nil {
+		t.Fatalf("GetPickingStock: %v", err)
+	}
+	if len(items) != 20 {
+		t.Fatalf("expected 20 items, got %d", len(items))
+	}
+
+	wave := handlers.WinthorWavePayload{
+		WaveNumber: "20260101-01-001",
+		Filial:     "01",
+		Tasks: []handlers.WinthorTaskItem{{
+			LocationCode: items[0].LocationCode, ProductCode: items[0].ProductCode, QtyToReplenish: 10,
+		}},
+	}
+	first, err := client.SendReplenishmentWave(ctx, "1", wave)
+	if err != nil {
+		t.Fatalf("SendReplenishmentWave: %v", err)
+	}
+	second, err := client.SendReplenishmentWave(ctx, "1", wave)
+	if err != nil {
+		t.Fatalf("SendReplenishmentWave (replay): %v", err)
+	}
+	if first.WinthorRef != second.WinthorRef {
+		t.Fatalf("idempotent replay returned a new ref: %s != %s", first.WinthorRef, second.WinthorRef)
+	}
+
+	var keys []string
+	for _, r := range fake.Requests() {
+		if r.Path == "/replenishment" {
+			keys = append(keys, r.IdempotencyKey)
+		}
+	}
+	if len(keys) != 2 || keys[0] != wave.WaveNumber || keys[1] != wave.WaveNumber {
+		t.Fatalf("unexpected idempotency keys: %v", keys)
+	}
+
+	bad := handlers.NewRealWinthorClient(srv.URL, "wrong")
+	_, err = bad.GetPickingStock(ctx, "1", "01")
+	var statusErr *handlers.WinthorStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 status error, got %v", err)
+	}
+}
+
+func TestResilientClientRetriesAndBreaker(t *testing.T) {
+	cfg := smallConfig()
+	cfg.ErrorRate = 1
+	fake, srv := newFake(t, cfg)
+
+	var attempts int32
+	client := &handlers.ResilientWinthorClient{
+		Inner:     handlers.NewRealWinthorClient(srv.URL, "test-key"),
+		Policy:    handlers.DefaultWinthorRetryPolicy,
+		Breaker:   handlers.NewCircuitBreaker(2, time.Minute),
+		OnAttempt: func(context.Context, handlers.WinthorAttempt) { atomic.AddInt32(&attempts, 1) },
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetPickingStock(ctx, "1", "01"); err == nil {
+			t.Fatal("expected error with error rate 1")
+		}
+	}
+	if got := atomic.LoadInt32(&attempts); got != 6 {
+		t.Fatalf("expected 6 attempts (2 calls x 3), got %d", got)
+	}
+	if client.Breaker.State() != handlers.CircuitOpen {
+		t.Fatalf("expected open circuit, got %s", client.Breaker.State())
+	}
+
+	before := len(fake.Requests())
+	if _, err := client.GetPickingStock(ctx, "1", "01"); !errors.Is(err, handlers.ErrWinthorCircuitOpen) {
+		t.Fatalf("expected ErrWinthorCircuitOpen, got %v", err)
+	}
+	if len(fake.Requests()) != before {
+		t.Fatal("open circuit must not reach the server")
+	}
+
+	fake.SetErrorRate(0)
+	client.Breaker.Cooldown = 0
+	if _, err := client.GetPickingStock(ctx, "1", "01"); err != nil {
+		t.Fatalf("half-open probe: %v", err)
+	}
+	if client.Breaker.State() != handlers.CircuitClosed {
+		t.Fatalf("expected closed circuit after probe, got %s", client.Breaker.State())
+	}
+}
+
+// --- Scheduler tests (PostgreSQL) ---
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	files, _ := filepath.Glob(filepath.Join("..", "migrations", "*.sql"))
+	sort.Strings(files)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(string(data)); err != nil &&
+			!strings.Contains(err.Error(), "already exists") && !strings.Contains(err.Error(), "duplicate") {
+			t.Fatalf("migration %s: %v", f, err)
+		}
+	}
+	return db
+}
+
+// createCompany registers a company pointing at apiURL and loads the fake's
+// layout into picking_locations/picking_stock.
+func createCompany(t *testing.T, db *sql.DB, apiURL string, stock []handlers.WinthorStockItem) string {
+	t.Helper()
+	var companyID string
+	cnpj := fmt.Sprintf("T%d", time.Now().UnixNano())
+	if err := db.QueryRow(`INSERT INTO companies (cnpj, name) VALUES ($1, 'Integration') RETURNING id::text`,
+		cnpj).Scan(&companyID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO settings (company_id, picking_enabled, use_mock_winthor, winthor_api_url, winthor_api_key, active_filiais)
+		VALUES ($1, TRUE, FALSE, $2, 'test-key', '["01"]')
+	`, companyID, apiURL); err != nil {
+		t.Fatal(err)
+	}
+	for _, it := range stock {
+		var locID int
+		if err := db.QueryRow(`
+			INSERT INTO picking_locations (company_id, filial, location_code) VALUES ($1, '01', $2) RETURNING id
+		`, companyID, it.LocationCode).Scan(&locID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`
+			INSERT INTO picking_stock (company_id, filial, location_id, product_code, product_description,
+			                           current_qty, min_qty, max_qty, abc_class)
+			VALUES ($1, '01', $2, $3, $4, $5, $6, $7, $8)
+		`, companyID, locID, it.ProductCode, it.ProductDesc, it.CurrentQty, it.MinQty, it.MaxQty, it.ABCClass); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return companyID
+}
+
+func TestSchedulerSyncAgainstFake(t *testing.T) {
+	db := openTestDB(t)
+	cfg := smallConfig()
+	cfg.DepletionFactor = 4 // guarantees locations below minimum
+	fake, srv := newFake(t, cfg)
+	stock := fake.Stock("01")
+	companyID := createCompany(t, db, srv.URL, stock)
+
+	// A location the ERP knows about but we do not
+	fake.SetStock("01", append(stock, handlers.WinthorStockItem{
+		LocationCode: "Z-99-01-1", ProductCode: "NEW001", ProductDesc: "Novo",
+		CurrentQty: 80, MinQty: 20, MaxQty: 100, ABCClass: "B",
+	}))
+
+	sched := &PickingScheduler{db: db}
+	client := sched.newClient(companyID, loadPickingSettings(context.Background(), db, companyID))
+	sched.syncFilial(context.Background(), nil, companyID, "01", client)
+
+	var inserted, updated, missing int
+	if err := db.QueryRow(`
+		SELECT records_inserted, records_updated, records_missing FROM winthor_sync_log
+		WHERE company_id=$1 AND sync_type='stock_fetch' AND status='success'
+	`, companyID).Scan(&inserted, &updated, &missing); err != nil {
+		t.Fatalf("expected one successful stock_fetch: %v", err)
+	}
+	if inserted != 1 || updated != len(stock) || missing != 0 {
+		t.Fatalf("unexpected merge counts: inserted=%d updated=%d missing=%d", inserted, updated, missing)
+	}
+
+	var waveNumber, status string
+	var totalTasks int
+	if err := db.QueryRow(`SELECT wave_number, status, total_tasks FROM replenishment_waves WHERE company_id=$1`,
+		companyID).Scan(&waveNumber, &status, &totalTasks); err != nil {
+		t.Fatalf("expected a wave: %v", err)
+	}
+	if status != "enviada" || totalTasks == 0 {
+		t.Fatalf("unexpected wave state: status=%s tasks=%d", status, totalTasks)
+	}
+
+	var sent bool
+	for _, r := range fake.Requests() {
+		if r.Path == "/replenishment" && r.IdempotencyKey == waveNumber && r.Status == http.StatusOK {
+			sent = true
+		}
+	}
+	if !sent {
+		t.Fatalf("fake did not receive wave %s", waveNumber)
+	}
+}
+
+// failingReplenishment makes /replenishment answer 503 while down is set.
+type failingReplenishment struct {
+	next http.Handler
+	down atomic.Bool
+}
+
+func (f *failingReplenishment) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.down.Load() && r.URL.Path == "/replenishment" {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	f.next.ServeHTTP(w, r)
+}
+
+func TestFailedWaveIsResent(t *testing.T) {
+	db := openTestDB(t)
+	cfg := smallConfig()
+	cfg.DepletionFactor = 4
+	fake := winthorfake.New(cfg)
+	proxy := &failingReplenishment{next: fake}
+	proxy.down.Store(true)
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+	companyID := createCompany(t, db, srv.URL, fake.Stock("01"))
+
+	sched := &PickingScheduler{db: db}
+	client := sched.newClient(companyID, loadPickingSettings(context.Background(), db, companyID))
+	sched.syncFilial(context.Background(), nil, companyID, "01", client)
+
+	var waveID int
+	var status string
+	if err := db.QueryRow(`SELECT id, status FROM replenishment_waves WHERE company_id=$1`, companyID).
+		Scan(&waveID, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status != "erro" {
+		t.Fatalf("expected wave in erro, got %s", status)
+	}
+
+	var attempts int
+	db.QueryRow(`SELECT COUNT(*) FROM winthor_sync_log WHERE company_id=$1 AND sync_type='wave_send_attempt'`,
+		companyID).Scan(&attempts)
+	if attempts != handlers.DefaultWinthorRetryPolicy.MaxAttempts {
+		t.Fatalf("expected %d logged attempts, got %d", handlers.DefaultWinthorRetryPolicy.MaxAttempts, attempts)
+	}
+
+	proxy.down.Store(false)
+	db.Exec(`UPDATE replenishment_waves SET next_retry_at = NOW() - INTERVAL '1 minute' WHERE id=$1`, waveID)
+	sched.resendFailedWaves(context.Background())
+
+	db.QueryRow(`SELECT status FROM replenishment_waves WHERE id=$1`, waveID).Scan(&status)
+	if status != "enviada" {
+		t.Fatalf("expected wave re-sent, got %s", status)
+	}
+}
@@ -0,0 +1,345 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Geocode precisions, from the most to the least precise.
+const (
+	PrecisionAddress      = "address"
+	PrecisionStreet       = "street"
+	PrecisionNeighborhood = "neighborhood"
+	PrecisionCity         = "city"
+)
+
+// Geocode sources.
+const (
+	SourceNominatim      = "nominatim"
+	SourceNominatimLocal = "nominatim_local"
+	SourceFake           = "fake"
+)
+
+// ErrGeocodeNotFound is returned when no provider strategy matched the
+// address. Other errors are transient and worth retrying.
+var ErrGeocodeNotFound = errors.New("address not found")
+
+type GeocodeQuery struct {
+	Street       string
+	Number       string
+	Neighborhood string
+	City         string
+}
+
+// Key normalizes the query for caching.
+func (q GeocodeQuery) Key() string {
+	norm := func(s string) string { return strings.Join(strings.Fields(strings.ToLower(s)), " ") }
+	return norm(q.Street) + "|" + norm(q.Number) + "|" + norm(q.Neighborhood) + "|" + norm(q.City)
+}
+
+type GeocodeResult struct {
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	Precision string  `json:"precision"`
+	Source    string  `json:"source"`
+}
+
+// Geocoder turns a Brazilian address into coordinates.
+type Geocoder interface {
+	Geocode(ctx context.Context, q GeocodeQuery) (GeocodeResult, error)
+}
+
+// ReverseGeocoder finds the address at a point. Fields the provider does
+// not know are left empty.
+type ReverseGeocoder interface {
+	Reverse(ctx context.Context, p RoutePoint) (GeocodeQuery, error)
+}
+
+// NominatimGeocoder queries a Nominatim server: the public one, which
+// allows one request per second, or a local one without that limit.
+type NominatimGeocoder struct {
+	BaseURL   string
+	UserAgent string
+	Source    string
+	Client    *http.Client
+	// Minimum time between requests to BaseURL, shared by every
+	// NominatimGeocoder of the process
+	MinInterval time.Duration
+}
+
+const PublicNominatimURL = "https://nominatim.openstreetmap.org"
+
+// NewNominatimGeocoder returns a geocoder for baseURL, or for the public
+// server (rate limited) when it is empty.
+func NewNominatimGeocoder(baseURL string) *NominatimGeocoder {
+	g := &NominatimGeocoder{
+		BaseURL:   strings.TrimRight(baseURL, "/"),
+		UserAgent: "JCInteligenc/2.0 (fbinteligenc.id)",
+		Source:    SourceNominatimLocal,
+		Client:    &http.Client{Timeout: 8 * time.Second},
+	}
+	if g.BaseURL == "" {
+		g.BaseURL = PublicNominatimURL
+		g.Source = SourceNominatim
+		g.MinInterval = 1100 * time.Millisecond
+	}
+	return g
+}
+
+// rateGate spaces the requests to one server.
+type rateGate struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+var nominatimGates sync.Map // base URL -> *rateGate
+
+func (g *NominatimGeocoder) wait(ctx context.Context) error {
+	if g.MinInterval <= 0 {
+		return nil
+	}
+	v, _ := nominatimGates.LoadOrStore(g.BaseURL, &rateGate{})
+	gate := v.(*rateGate)
+	gate.mu.Lock()
+	now := time.Now()
+	at := gate.next
+	if at.Before(now) {
+		at = now
+	}
+	gate.next = at.Add(g.MinInterval)
+	gate.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// precisionFromRank maps Nominatim's place_rank to a precision.
+func precisionFromRank(rank int) string {
+	switch {
+	case rank >= 28:
+		return PrecisionAddress
+	case rank >= 26:
+		return PrecisionStreet
+	case rank >= 17:
+		return PrecisionNeighborhood
+	default:
+		return PrecisionCity
+	}
+}
+
+// get calls an endpoint of the server, respecting its rate limit, and
+// decodes the JSON response into v.
+func (g *NominatimGeocoder) get(ctx context.Context, endpoint string, params url.Values, v interface{}) error {
+	if err := g.wait(ctx); err != nil {
+		return err
+	}
+	params.Set("format", "jsonv2")
+	req, err := http.NewRequestWithContext(ctx, "GET", g.BaseURL+endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", g.UserAgent)
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("nominatim: HTTP %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("nominatim: %w", err)
+	}
+	return nil
+}
+
+func (g *NominatimGeocoder) search(ctx context.Context, params url.Values) (GeocodeResult, error) {
+	params.Set("limit", "1")
+	params.Set("countrycodes", "br")
+	var results []struct {
+		Lat       string `json:"lat"`
+		Lon       string `json:"lon"`
+		PlaceRank int    `json:"place_rank"`
+	}
+	if err := g.get(ctx, "/search", params, &results); err != nil {
+		return GeocodeResult{}, err
+	}
+	if len(results) == 0 {
+		return GeocodeResult{}, ErrGeocodeNotFound
+	}
+	lat, err1 := strconv.ParseFloat(results[0].Lat, 64)
+	lng, err2 := strconv.ParseFloat(results[0].Lon, 64)
+	if err1 != nil || err2 != nil {
+		return GeocodeResult{}, ErrGeocodeNotFound
+	}
+	return GeocodeResult{Lat: lat, Lng: lng, Precision: precisionFromRank(results[0].PlaceRank), Source: g.Source}, nil
+}
+
+// Geocode tries a structured street query first and falls back to the
+// neighborhood, which handles informal Brazilian addresses.
+func (g *NominatimGeocoder) Geocode(ctx context.Context, q GeocodeQuery) (GeocodeResult, error) {
+	if strings.TrimSpace(q.City) == "" {
+		return GeocodeResult{}, ErrGeocodeNotFound
+	}
+	if strings.TrimSpace(q.Street) != "" {
+		street := strings.TrimSpace(q.Street + " " + q.Number)
+		res, err := g.search(ctx, url.Values{"street": {street}, "city": {q.City}})
+		if !errors.Is(err, ErrGeocodeNotFound) {
+			return res, err
+		}
+	}
+	if strings.TrimSpace(q.Neighborhood) == "" {
+		return GeocodeResult{}, ErrGeocodeNotFound
+	}
+	res, err := g.search(ctx, url.Values{"q": {q.Neighborhood + ", " + q.City + ", Brasil"}})
+	if err == nil && (res.Precision == PrecisionAddress || res.Precision == PrecisionStreet) {
+		// A free-form neighborhood query is never more precise than that
+		res.Precision = PrecisionNeighborhood
+	}
+	return res, err
+}
+
+// Reverse returns the address of the nearest building or street.
+func (g *NominatimGeocoder) Reverse(ctx context.Context, p RoutePoint) (GeocodeQuery, error) {
+	params := url.Values{
+		"lat":            {strconv.FormatFloat(p.Lat, 'f', 7, 64)},
+		"lon":            {strconv.FormatFloat(p.Lng, 'f', 7, 64)},
+		"zoom":           {"18"},
+		"addressdetails": {"1"},
+	}
+	var result struct {
+		Error   string `json:"error"`
+		Address struct {
+			Road          string `json:"road"`
+			HouseNumber   string `json:"house_number"`
+			Suburb        string `json:"suburb"`
+			Neighbourhood string `json:"neighbourhood"`
+			CityDistrict  string `json:"city_district"`
+			City          string `json:"city"`
+			Town          string `json:"town"`
+			Village       string `json:"village"`
+			Municipality  string `json:"municipality"`
+		} `json:"address"`
+	}
+	if err := g.get(ctx, "/reverse", params, &result); err != nil {
+		return GeocodeQuery{}, err
+	}
+	if result.Error != "" {
+		return GeocodeQuery{}, ErrGeocodeNotFound
+	}
+	first := func(values ...string) string {
+		for _, v := range values {
+			if v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	a := result.Address
+	q := GeocodeQuery{
+		Street:       a.Road,
+		Number:       a.HouseNumber,
+		Neighborhood: first(a.Suburb, a.Neighbourhood, a.CityDistrict),
+		City:         first(a.City, a.Town, a.Village, a.Municipality),
+	}
+	if q == (GeocodeQuery{}) {
+		return q, ErrGeocodeNotFound
+	}
+	return q, nil
+}
+
+// GeocodeCache stores results by GeocodeQuery.Key. found is false for a
+// cached miss.
+type GeocodeCache interface {
+	Get(ctx context.Context, key string) (res GeocodeResult, found, ok bool)
+	Put(ctx context.Context, key string, res GeocodeResult, found bool)
+}
+
+// CachedGeocoder answers from the cache, including known misses, and
+// asks Inner otherwise. Transient errors are not cached.
+type CachedGeocoder struct {
+	Inner Geocoder
+	Cache GeocodeCache
+}
+
+func (c CachedGeocoder) Geocode(ctx context.Context, q GeocodeQuery) (GeocodeResult, error) {
+	key := q.Key()
+	if res, found, ok := c.Cache.Get(ctx, key); ok {
+		if !found {
+			return GeocodeResult{}, ErrGeocodeNotFound
+		}
+		return res, nil
+	}
+	res, err := c.Inner.Geocode(ctx, q)
+	switch {
+	case err == nil:
+		c.Cache.Put(ctx, key, res, true)
+	case errors.Is(err, ErrGeocodeNotFound):
+		c.Cache.Put(ctx, key, GeocodeResult{}, false)
+	}
+	return res, err
+}
+
+// FakeGeocoder answers without a network: Results by GeocodeQuery.Key when
+// given, otherwise a stable point within about 10 km of Center derived from
+// the address. Addresses without a city are not found. Reverse returns
+// Address, or a placeholder address when it is empty.
+type FakeGeocoder struct {
+	Center  RoutePoint
+	Results map[string]GeocodeResult
+	Address GeocodeQuery
+}
+
+func (f FakeGeocoder) Geocode(ctx context.Context, q GeocodeQuery) (GeocodeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return GeocodeResult{}, err
+	}
+	key := q.Key()
+	if res, ok := f.Results[key]; ok {
+		return res, nil
+	}
+	if strings.TrimSpace(q.City) == "" {
+		return GeocodeResult{}, ErrGeocodeNotFound
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	// ~0.09 degrees is about 10 km
+	dLat := (float64(sum&0xffff)/0xffff - 0.5) * 0.18
+	dLng := (float64(sum>>16&0xffff)/0xffff - 0.5) * 0.18
+	precision := PrecisionAddress
+	if strings.TrimSpace(q.Street) == "" {
+		precision = PrecisionNeighborhood
+	}
+	return GeocodeResult{Lat: f.Center.Lat + dLat, Lng: f.Center.Lng + dLng, Precision: precision, Source: SourceFake}, nil
+}
+
+func (f FakeGeocoder) Reverse(ctx context.Context, p RoutePoint) (GeocodeQuery, error) {
+	if err := ctx.Err(); err != nil {
+		return GeocodeQuery{}, err
+	}
+	if f.Address != (GeocodeQuery{}) {
+		return f.Address, nil
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%.5f,%.5f", p.Lat, p.Lng)
+	return GeocodeQuery{
+		Street:       "Rua Simulada",
+		Number:       strconv.Itoa(int(h.Sum32()%2000) + 1),
+		Neighborhood: "Centro",
+		City:         "Cidade Simulada",
+	}, nil
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// --- Pick List ---
+
+type PickListHeader struct {
+	WaveNumber  string
+	Filial      string
+	Zone        string
+	Status      string
+	TriggeredBy string
+	GeneratedAt string
+}
+
+type PickListLine struct {
+	Seq              int
+	LocationCode     string
+	FromLocationCode string // relocation tasks only
+	ProductCode      string
+	ProductDesc      string
+	Qty              float64
+	ABCClass         string
+}
+
+// RenderPickListPDF renders a wave as an A4 pick list: one line per task
+// with sequence, location, product, quantity and a Code128 barcode of the
+// location code, plus a checkbox for the operator.
+func RenderPickListPDF(h PickListHeader, lines []PickListLine) ([]byte, error) {
+	const (
+		margin     = 36.0
+		lineHeight = 46.0
+		top        = 120.0
+	)
+	pdf := NewPDF(A4Width, A4Height)
+	perPage := int(math.Floor((A4Height - top - margin) / lineHeight))
+	pages := (len(lines) + perPage - 1) / perPage
+	if pages == 0 {
+		pages = 1
+	}
+
+	for page := 0; page < pages; page++ {
+		pdf.AddPage()
+		pdf.Text(margin, 50, 16, true, "Lista de Reabastecimento - Onda "+h.WaveNumber)
+		sub := fmt.Sprintf("Filial %s", h.Filial)
+		if h.Zone != "" {
+			sub += "  |  Zona " + h.Zone
+		}
+		sub += fmt.Sprintf("  |  %d tarefas  |  Gerada em %s  |  Origem %s", len(lines), h.GeneratedAt, h.TriggeredBy)
+		pdf.Text(margin, 70, 9, false, sub)
+		pdf.Text(A4Width-margin-60, 50, 9, false, fmt.Sprintf("Pagina %d/%d", page+1, pages))
+
+		pdf.Text(margin, top-12, 8, true, "SEQ")
+		pdf.Text(margin+30, top-12, 8, true, "ENDERECO")
+		pdf.Text(margin+120, top-12, 8, true, "PRODUTO")
+		pdf.Text(margin+300, top-12, 8, true, "QTD")
+		pdf.Text(margin+350, top-12, 8, true, "CODIGO")
+		pdf.Text(A4Width-margin-20, top-12, 8, true, "OK")
+		pdf.Line(margin, top-6, A4Width-margin, top-6, 0.8)
+
+		end := (page + 1) * perPage
+		if end > len(lines) {
+			end = len(lines)
+		}
+		for i, l := range lines[page*perPage : end] {
+			y := top + float64(i)*lineHeight
+			pdf.Text(margin, y+18, 11, true, fmt.Sprintf("%d", l.Seq))
+			pdf.Text(margin+30, y+18, 11, true, l.LocationCode)
+			if l.FromLocationCode != "" {
+				pdf.Text(margin+30, y+32, 7, false, "de "+l.FromLocationCode)
+			}
+			pdf.Text(margin+120, y+14, 9, true, l.ProductCode+"  ("+l.ABCClass+")")
+			pdf.Text(margin+120, y+28, 8, false, TruncateText(l.ProductDesc, 38))
+			pdf.Text(margin+300, y+18, 11, true, formatQty(l.Qty))
+			if err := pdf.Code128(margin+350, y+4, 140, 28, l.LocationCode); err != nil {
+				pdf.Text(margin+350, y+18, 8, false, "(sem codigo de barras)")
+			}
+			boxX := A4Width - margin - 18
+			pdf.Line(boxX, y+6, boxX+14, y+6, 0.6)
+			pdf.Line(boxX+14, y+6, boxX+14, y+20, 0.6)
+			pdf.Line(boxX+14, y+20, boxX, y+20, 0.6)
+			pdf.Line(boxX, y+20, boxX, y+6, 0.6)
+			pdf.Line(margin, y+lineHeight-4, A4Width-margin, y+lineHeight-4, 0.2)
+		}
+	}
+
+	pdf.Text(margin, A4Height-20, 8, false, "Separador: ______________________   Conferente: ______________________")
+	return pdf.Bytes(), nil
+}
+
+func formatQty(q float64) string {
+	if q == float64(int64(q)) {
+		return fmt.Sprintf("%d", int64(q))
+	}
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", q), "0"), ".")
+}
+
+// --- Location Labels ---
+
+const (
+	SymbologyCode128 = "code128"
+	SymbologyQR      = "qr"
+)
+
+type LocationLabel struct {
+	LocationCode string
+	Filial       string
+	Caption      string // e.g. the product stored there
+}
+
+// RenderLocationLabelsPDF lays labels out on A4 sheets, 2 columns by 7
+// rows (about 99 x 38 mm each).
+func RenderLocationLabelsPDF(labels []LocationLabel, symbology string) ([]byte, error) {
+	const (
+		cols    = 2
+		rows    = 7
+		marginX = 5 * MM
+		marginY = 15 * MM
+	)
+	labelW := (A4Width - 2*marginX) / cols
+	labelH := (A4Height - 2*marginY) / rows
+
+	pdf := NewPDF(A4Width, A4Height)
+	for i, l := range labels {
+		if i%(cols*rows) == 0 {
+			pdf.AddPage()
+		}
+		slot := i % (cols * rows)
+		x := marginX + float64(slot%cols)*labelW
+		y := marginY + float64(slot/cols)*labelH
+
+		var err error
+		if symbology == SymbologyQR {
+			side := labelH - 16
+			err = pdf.QR(x+8, y+8, side, l.LocationCode)
+			pdf.Text(x+side+18, y+30, 20, true, l.LocationCode)
+			pdf.Text(x+side+18, y+48, 9, false, "Filial "+l.Filial)
+			pdf.Text(x+side+18, y+62, 8, false, TruncateText(l.Caption, 28))
+		} else {
+			pdf.Text(x+10, y+22, 18, true, l.LocationCode)
+			pdf.Text(x+labelW-70, y+22, 9, false, "Filial "+l.Filial)
+			err = pdf.Code128(x+10, y+30, labelW-20, labelH-52, l.LocationCode)
+			pdf.Text(x+10, y+labelH-10, 8, false, TruncateText(l.Caption, 50))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("label %s: %w", l.LocationCode, err)
+		}
+	}
+	return pdf.Bytes(), nil
+}
+
+// RenderLocationLabelsZPL renders one 4x2" label (203 dpi) per location for
+// Zebra printers; the printer draws the barcode itself.
+func RenderLocationLabelsZPL(labels []LocationLabel, symbology string) string {
+	var b strings.Builder
+	for _, l := range labels {
+		code := zplEscape(l.LocationCode)
+		b.WriteString("^XA^CI28^PW812^LL406\n")
+		if symbology == SymbologyQR {
+			b.WriteString("^FO30,40^BQN,2,9^FH_^FDMA," + code + "^FS\n")
+			b.WriteString("^FO330,70^A0N,70,70^FH_^FD" + code + "^FS\n")
+			b.WriteString("^FO330,160^A0N,32,32^FH_^FDFilial " + zplEscape(l.Filial) + "^FS\n")
+			b.WriteString("^FO330,210^A0N,26,26^FH_^FD" + zplEscape(TruncateText(l.Caption, 28)) + "^FS\n")
+		} else {
+			b.WriteString("^FO40,30^A0N,60,60^FH_^FD" + code + "^FS\n")
+			b.WriteString("^FO600,40^A0N,30,30^FH_^FDFilial " + zplEscape(l.Filial) + "^FS\n")
+			b.WriteString("^FO40,110^BY3^BCN,200,N,N,N^FH_^FD" + code + "^FS\n")
+			b.WriteString("^FO40,330^A0N,26,26^FH_^FD" + zplEscape(TruncateText(l.Caption, 50)) + "^FS\n")
+		}
+		b.WriteString("^XZ\n")
+	}
+	return b.String()
+}
+
+// zplEscape hex-encodes the characters ZPL treats as commands (used with ^FH_).
+func zplEscape(s string) string {
+	r := strings.NewReplacer("_", "_5F", "^", "_5E", "~", "_7E")
+	return r.Replace(s)
+}
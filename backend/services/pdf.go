@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Page sizes in points (1/72 inch).
+const (
+	A4Width  = 595.28
+	A4Height = 841.89
+	MM       = 72 / 25.4
+)
+
+// PDF is a minimal PDF 1.4 writer: text in the standard Helvetica fonts,
+// filled rectangles and lines. Coordinates are in points from the top-left
+// corner of the page, which is what the layouts here think in.
+type PDF struct {
+	width, height float64
+	pages         []*bytes.Buffer
+}
+
+func NewPDF(width, height float64) *PDF {
+	return &PDF{width: width, height: height}
+}
+
+func (p *PDF) AddPage() {
+	p.pages = append(p.pages, &bytes.Buffer{})
+}
+
+func (p *PDF) page() *bytes.Buffer {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+	return p.pages[len(p.pages)-1]
+}
+
+// Text draws s with its baseline at y.
+func (p *PDF) Text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(p.page(), "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n",
+		font, size, x, p.height-y, pdfEscape(s))
+}
+
+// Rect draws a filled black rectangle with its top-left corner at (x, y).
+func (p *PDF) Rect(x, y, w, h float64) {
+	fmt.Fprintf(p.page(), "%.3f %.3f %.3f %.3f re f\n", x, p.height-y-h, w, h)
+}
+
+// Line draws a thin line.
+func (p *PDF) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(p.page(), "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, p.height-y1, x2, p.height-y2)
+}
+
+// Code128 draws s as a Code 128 barcode fitted to width w.
+func (p *PDF) Code128(x, y, w, h float64, s string) error {
+	widths, err := Code128(s)
+	if err != nil {
+		return err
+	}
+	module := w / float64(Code128Modules(widths))
+	for i, bw := range widths {
+		if i%2 == 0 {
+			p.Rect(x, y, float64(bw)*module, h)
+		}
+		x += float64(bw) * module
+	}
+	return nil
+}
+
+// QR draws s as a QR code of side size.
+func (p *PDF) QR(x, y, size float64, s string) error {
+	q, err := EncodeQR(s)
+	if err != nil {
+		return err
+	}
+	module := size / float64(q.Size)
+	for row := 0; row < q.Size; row++ {
+		for col := 0; col < q.Size; col++ {
+			if q.Modules[row][col] {
+				p.Rect(x+float64(col)*module, y+float64(row)*module, module, module)
+			}
+		}
+	}
+	return nil
+}
+
+// Bytes serialises the document.
+func (p *PDF) Bytes() []byte {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+	var out bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// 1 catalog, 2 pages, 3-4 fonts, then a page and a content stream per page
+	n := len(p.pages)
+	kids := make([]string, n)
+	for i := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), n))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range p.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			p.width, p.height, 6+2*i))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape converts s to WinAnsi (Latin-1 for the accents used in
+// Portuguese) and escapes the string delimiters.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r >= 32 && r < 127:
+			b.WriteByte(byte(r))
+		case r == '…':
+			b.WriteString("\\205") // WinAnsi ellipsis
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// TruncateText shortens s to at most n characters.
+func TruncateText(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
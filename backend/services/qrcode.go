@@ -0,0 +1,385 @@
+package services
+
+import "fmt"
+
+// QRCode is a square matrix of modules; true is dark.
+type QRCode struct {
+	Size    int
+	Modules [][]bool
+}
+
+// qrVersionM describes versions 1-4 at error correction level M, which is
+// plenty for location codes (up to 62 bytes).
+type qrVersionM struct {
+	dataCodewords int
+	ecPerBlock    int
+	blocks        int
+	alignment     int // center of the single alignment pattern, 0 = none
+}
+
+var qrVersionsM = []qrVersionM{
+	{16, 10, 1, 0},
+	{28, 16, 1, 18},
+	{44, 26, 1, 22},
+	{64, 18, 2, 26},
+}
+
+// EncodeQR encodes data in byte mode at error correction level M, using the
+// smallest version that fits and the mask with the lowest penalty.
+func EncodeQR(data string) (*QRCode, error) {
+	payload := []byte(data)
+	version := 0
+	for i, v := range qrVersionsM {
+		// mode (4 bits) + length (8 bits) + data
+		if 12+8*len(payload) <= v.dataCodewords*8 {
+			version = i + 1
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("qrcode: %d bytes do not fit in version 4-M", len(payload))
+	}
+	spec := qrVersionsM[version-1]
+
+	codewords := qrDataCodewords(payload, spec.dataCodewords)
+	codewords = qrAddErrorCorrection(codewords, spec)
+
+	q := newQRMatrix(version, spec)
+	q.placeCodewords(codewords)
+
+	best, bestPenalty := -1, 0
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); best < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // XOR again to undo
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+
+	return &QRCode{Size: q.size, Modules: q.modules}, nil
+}
+
+// qrDataCodewords builds the byte-mode bit stream with terminator and padding.
+func qrDataCodewords(payload []byte, capacity int) []byte {
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (v>>i)&1 == 1)
+		}
+	}
+	put(0x4, 4)
+	put(len(payload), 8)
+	for _, b := range payload {
+		put(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+
+	out := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		out = append(out, b)
+	}
+	for pad := byte(0xEC); len(out) < capacity; pad ^= 0xEC ^ 0x11 {
+		out = append(out, pad)
+	}
+	return out
+}
+
+// qrAddErrorCorrection splits data into blocks, appends Reed-Solomon
+// codewords to each and interleaves them.
+func qrAddErrorCorrection(data []byte, spec qrVersionM) []byte {
+	blockLen := len(data) / spec.blocks
+	divisor := rsDivisor(spec.ecPerBlock)
+	var dataBlocks, ecBlocks [][]byte
+	for b := 0; b < spec.blocks; b++ {
+		block := data[b*blockLen : (b+1)*blockLen]
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, rsRemainder(block, divisor))
+	}
+
+	var out []byte
+	for i := 0; i < blockLen; i++ {
+		for _, block := range dataBlocks {
+			out = append(out, block[i])
+		}
+	}
+	for i := 0; i < spec.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(256) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+type qrMatrix struct {
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+func newQRMatrix(version int, spec qrVersionM) *qrMatrix {
+	size := 17 + 4*version
+	q := &qrMatrix{size: size, modules: make([][]bool, size), isFunction: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.isFunction[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(size-4, 3)
+	q.drawFinder(3, size-4)
+	if spec.alignment > 0 {
+		for dy := -2; dy <= 2; dy++ {
+			for dx := -2; dx <= 2; dx++ {
+				q.setFunction(spec.alignment+dx, spec.alignment+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+			}
+		}
+	}
+	q.drawFormat(0) // reserves the format areas
+	return q
+}
+
+func (q *qrMatrix) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+// drawFinder draws a finder pattern centred on (x, y) with its separator.
+func (q *qrMatrix) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= q.size || yy < 0 || yy >= q.size {
+				continue
+			}
+			dist := qrMax(qrAbs(dx), qrAbs(dy))
+			q.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawFormat writes both copies of the format information (level M).
+func (q *qrMatrix) drawFormat(mask int) {
+	data := mask // level M has format bits 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// placeCodewords fills the non-function modules in the zigzag order.
+func (q *qrMatrix) placeCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.isFunction[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-uint(i&7)))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrMatrix) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.isFunction[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the matrix with the four rules of the QR specification.
+func (q *qrMatrix) penalty() int {
+	n := q.size
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+
+	total := 0
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			// Rule 1: runs of five or more modules of the same color
+			run := 1
+			for x := 1; x < n; x++ {
+				if at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					total += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				total += run - 2
+			}
+
+			// Rule 3: finder-like 1:1:3:1:1 patterns next to four light modules
+			for x := 0; x+11 <= n; x++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k, dark := range pattern {
+						if at(x+k, y, vertical) != dark {
+							match = false
+							break
+						}
+					}
+					if match {
+						total += 40
+					}
+				}
+			}
+		}
+	}
+
+	// Rule 2: 2x2 blocks of the same color
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					total += 3
+				}
+			}
+		}
+	}
+
+	// Rule 4: balance of dark and light modules
+	pct := dark * 100 / (n * n)
+	total += qrAbs(pct-50) / 5 * 10
+	return total
+}
+
+func qrAbs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,319 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RoutePoint is a WGS84 coordinate in decimal degrees.
+type RoutePoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+const earthRadiusKm = 6371.0
+
+// HaversineKm returns the great-circle distance between two points.
+func HaversineKm(a, b RoutePoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// RouteStop is a customer to visit.
+type RouteStop struct {
+	Point    RoutePoint
+	Priority int // 1 = most important; values < 1 count as 1
+	// Time window in minutes after midnight. WindowEnd 0 means no window.
+	WindowStart int
+	WindowEnd   int
+	// Time spent at the customer; 0 uses RouteConfig.ServiceMinutes.
+	ServiceMinutes float64
+}
+
+// RouteConfig turns distances into times and weighs the soft constraints.
+// Costs are expressed in km so they add up with the distance driven.
+type RouteConfig struct {
+	SpeedKmh       float64 `json:"speed_kmh"`
+	ServiceMinutes float64 `json:"service_minutes"`
+	// Roads are longer than the straight line; haversine distances are
+	// multiplied by this factor.
+	DetourFactor float64 `json:"detour_factor"`
+	// Minutes after midnight the route starts.
+	StartMinute int `json:"start_minute"`
+	// Cost of each minute of arrival after a window closes.
+	LatePenaltyKm float64 `json:"late_penalty_km"`
+	// Cost of each hour a priority 1 customer waits to be visited; a
+	// priority p customer weighs 1/p of it.
+	PriorityKmPerHour float64 `json:"priority_km_per_hour"`
+}
+
+func DefaultRouteConfig() RouteConfig {
+	return RouteConfig{
+		SpeedKmh:          30,
+		ServiceMinutes:    20,
+		DetourFactor:      1.3,
+		StartMinute:       8 * 60,
+		LatePenaltyKm:     2,
+		PriorityKmPerHour: 1,
+	}
+}
+
+// PlannedStop is a stop in visiting order. Index points into the stops
+// given to OptimizeRoute.
+type PlannedStop struct {
+	Index       int     `json:"-"`
+	Sequence    int     `json:"sequence"`
+	LegKm       float64 `json:"leg_km"`
+	Arrival     string  `json:"arrival"`
+	Departure   string  `json:"departure"`
+	WaitMinutes float64 `json:"wait_minutes"`
+	LateMinutes float64 `json:"late_minutes"`
+}
+
+type RoutePlan struct {
+	Stops        []PlannedStop `json:"stops"`
+	TotalKm      float64       `json:"total_km"`
+	DriveMinutes float64       `json:"drive_minutes"`
+	TotalMinutes float64       `json:"total_minutes"`
+	EndTime      string        `json:"end_time"`
+	LateStops    int           `json:"late_stops"`
+}
+
+// maxTwoOptPasses bounds the improvement loop; routes of a day rarely need
+// more than a handful of passes.
+const maxTwoOptPasses = 50
+
+// maxTwoOptVisits bounds the stops re-scored by 2-opt in one optimization,
+// so a long customer list still answers quickly with a good enough order.
+const maxTwoOptVisits = 2_000_000
+
+// OptimizeRoute orders the stops with a nearest-neighbor construction
+// followed by 2-opt, minimising distance driven plus late arrivals and the
+// waiting of high-priority customers. Without a start point the route
+// begins at the most important stop. The route is open: it ends at the
+// last customer.
+func OptimizeRoute(start *RoutePoint, stops []RouteStop, cfg RouteConfig) RoutePlan {
+	if cfg.SpeedKmh <= 0 {
+		cfg.SpeedKmh = DefaultRouteConfig().SpeedKmh
+	}
+	if cfg.DetourFactor < 1 {
+		cfg.DetourFactor = 1
+	}
+	if len(stops) == 0 {
+		return RoutePlan{Stops: []PlannedStop{}, EndTime: clock(float64(cfg.StartMinute))}
+	}
+
+	order := nearestNeighbor(start, stops, cfg)
+	twoOpt(start, stops, order, cfg)
+	return buildPlan(start, stops, order, cfg)
+}
+
+// twoOpt improves order in place by reversing segments. Arrival times
+// depend on everything before a stop, so a reversal of i..k is scored from
+// the state before i: the prefix is kept from the current order and the
+// scoring stops as soon as it can no longer beat the best cost (every
+// visit adds a non-negative cost).
+func twoOpt(start *RoutePoint, stops []RouteStop, order []int, cfg RouteConfig) {
+	n := len(order)
+	// prefix[j] is the state after the first j stops of order
+	type state struct {
+		cur  *RoutePoint
+		now  float64
+		cost float64
+	}
+	prefix := make([]state, n+1)
+	score := func() {
+		prefix[0] = state{cur: start, now: float64(cfg.StartMinute)}
+		for j, idx := range order {
+			p := prefix[j]
+			leg, dep, c := visit(p.cur, stops[idx], p.now, cfg)
+			prefix[j+1] = state{cur: &stops[idx].Point, now: dep, cost: p.cost + leg + c}
+		}
+	}
+	score()
+
+	budget := maxTwoOptVisits
+	for pass := 0; pass < maxTwoOptPasses && budget > 0; pass++ {
+		improved := false
+		for i := 0; i < n-1 && budget > 0; i++ {
+			for k := i + 1; k < n && budget > 0; k++ {
+				best := prefix[n].cost
+				p := prefix[i]
+				cur, now, total := p.cur, p.now, p.cost
+				for j := i; j < n && total < best-1e-9; j++ {
+					pos := j
+					if j <= k {
+						pos = k - (j - i)
+					}
+					idx := order[pos]
+					leg, dep, c := visit(cur, stops[idx], now, cfg)
+					total += leg + c
+					now, cur = dep, &stops[idx].Point
+					budget--
+				}
+				if total < best-1e-9 {
+					reverse(order, i, k)
+					score()
+					improved = true
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+}
+
+// nearestNeighbor repeatedly visits the stop adding the least cost from
+// the current position and time.
+func nearestNeighbor(start *RoutePoint, stops []RouteStop, cfg RouteConfig) []int {
+	remaining := make([]int, len(stops))
+	for i := range remaining {
+		remaining[i] = i
+	}
+	var order []int
+	var cur *RoutePoint
+	now := float64(cfg.StartMinute)
+
+	if start != nil {
+		cur = start
+	} else {
+		// Most important stop first; ties go to the earliest window
+		sort.SliceStable(remaining, func(a, b int) bool {
+			sa, sb := stops[remaining[a]], stops[remaining[b]]
+			if priority(sa) != priority(sb) {
+				return priority(sa) < priority(sb)
+			}
+			return sa.WindowStart < sb.WindowStart
+		})
+		first := remaining[0]
+		remaining = remaining[1:]
+		order = append(order, first)
+		_, now, _ = visit(nil, stops[first], now, cfg)
+		cur = &stops[first].Point
+	}
+
+	for len(remaining) > 0 {
+		bestPos, bestCost := 0, math.Inf(1)
+		for pos, idx := range remaining {
+			leg, _, c := visit(cur, stops[idx], now, cfg)
+			if c+leg < bestCost {
+				bestPos, bestCost = pos, c+leg
+			}
+		}
+		idx := remaining[bestPos]
+		remaining = append(remaining[:bestPos], remaining[bestPos+1:]...)
+		order = append(order, idx)
+		_, now, _ = visit(cur, stops[idx], now, cfg)
+		cur = &stops[idx].Point
+	}
+	return order
+}
+
+// visit drives from cur (nil: already there) to s leaving at now. It
+// returns the leg distance, the departure time and the soft-constraint
+// cost of the visit.
+func visit(cur *RoutePoint, s RouteStop, now float64, cfg RouteConfig) (legKm, departure, cost float64) {
+	legKm, arrival, wait, late := arrive(cur, s, now, cfg)
+	cost = late*cfg.LatePenaltyKm +
+		(arrival+wait-float64(cfg.StartMinute))/60*cfg.PriorityKmPerHour/float64(priority(s))
+	return legKm, arrival + wait + service(s, cfg), cost
+}
+
+func arrive(cur *RoutePoint, s RouteStop, now float64, cfg RouteConfig) (legKm, arrival, wait, late float64) {
+	if cur != nil {
+		legKm = HaversineKm(*cur, s.Point) * cfg.DetourFactor
+	}
+	arrival = now + legKm/cfg.SpeedKmh*60
+	if s.WindowEnd > 0 {
+		if arrival < float64(s.WindowStart) {
+			wait = float64(s.WindowStart) - arrival
+		}
+		if arrival > float64(s.WindowEnd) {
+			late = arrival - float64(s.WindowEnd)
+		}
+	}
+	return legKm, arrival, wait, late
+}
+
+func buildPlan(start *RoutePoint, stops []RouteStop, order []int, cfg RouteConfig) RoutePlan {
+	plan := RoutePlan{Stops: make([]PlannedStop, 0, len(order))}
+	cur := start
+	now := float64(cfg.StartMinute)
+	for seq, idx := range order {
+		s := stops[idx]
+		leg, arrival, wait, late := arrive(cur, s, now, cfg)
+		now = arrival + wait + service(s, cfg)
+		plan.Stops = append(plan.Stops, PlannedStop{
+			Index:       idx,
+			Sequence:    seq + 1,
+			LegKm:       round1(leg),
+			Arrival:     clock(arrival),
+			Departure:   clock(now),
+			WaitMinutes: math.Round(wait),
+			LateMinutes: math.Round(late),
+		})
+		plan.TotalKm += leg
+		if late > 0 {
+			plan.LateStops++
+		}
+		cur = &stops[idx].Point
+	}
+	plan.DriveMinutes = math.Round(plan.TotalKm / cfg.SpeedKmh * 60)
+	plan.TotalMinutes = math.Round(now - float64(cfg.StartMinute))
+	plan.TotalKm = round1(plan.TotalKm)
+	plan.EndTime = clock(now)
+	return plan
+}
+
+func reverse(order []int, i, k int) {
+	for ; i < k; i, k = i+1, k-1 {
+		order[i], order[k] = order[k], order[i]
+	}
+}
+
+func priority(s RouteStop) int {
+	if s.Priority < 1 {
+		return 1
+	}
+	return s.Priority
+}
+
+func service(s RouteStop, cfg RouteConfig) float64 {
+	if s.ServiceMinutes > 0 {
+		return s.ServiceMinutes
+	}
+	return cfg.ServiceMinutes
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// clock formats minutes after midnight as HH:MM, wrapping past midnight.
+func clock(minutes float64) string {
+	m := int(math.Round(minutes))
+	return fmt.Sprintf("%02d:%02d", (m/60)%24, m%60)
+}
+
+// ParseClockMinutes parses "HH:MM" or "HH:MM:SS" into minutes after
+// midnight.
+func ParseClockMinutes(s string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("horario invalido: %q", s)
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("horario invalido: %q", s)
+	}
+	return h*60 + m, nil
+}
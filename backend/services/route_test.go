@@ -0,0 +1,233 @@
+package services
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// testRouteConfig drives 2 minutes per km in a straight line.
+func testRouteConfig() RouteConfig {
+	cfg := DefaultRouteConfig()
+	cfg.DetourFactor = 1
+	return cfg
+}
+
+func TestOptimizeRoute(t *testing.T) {
+	origin := pointAt(0, 0)
+	tests := []struct {
+		name      string
+		start     *RoutePoint
+		stops     []RouteStop
+		wantOrder []int
+		wantLate  int
+	}{
+		{
+			name:  "nearest first along a line",
+			start: &origin,
+			stops: []RouteStop{
+				{Point: pointAt(3000, 0)}, {Point: pointAt(1000, 0)}, {Point: pointAt(2000, 0)},
+			},
+			wantOrder: []int{1, 2, 0},
+		},
+		{
+			name:  "closing window goes first",
+			start: &origin,
+			stops: []RouteStop{
+				{Point: pointAt(-1000, 0)},
+				{Point: pointAt(1000, 0), WindowStart: 8 * 60, WindowEnd: 8*60 + 5},
+			},
+			wantOrder: []int{1, 0},
+		},
+		{
+			name:  "window opening later goes last",
+			start: &origin,
+			stops: []RouteStop{
+				{Point: pointAt(1000, 0), WindowStart: 11 * 60, WindowEnd: 12 * 60},
+				{Point: pointAt(-1000, 0)},
+				{Point: pointAt(-2000, 0)},
+			},
+			wantOrder: []int{1, 2, 0},
+		},
+		{
+			name:  "unreachable window is reported late",
+			start: &origin,
+			stops: []RouteStop{
+				{Point: pointAt(60000, 0), WindowStart: 8 * 60, WindowEnd: 8*60 + 30},
+			},
+			wantOrder: []int{0},
+			wantLate:  1,
+		},
+		{
+			name:  "higher priority first at equal distance",
+			start: &origin,
+			stops: []RouteStop{
+				{Point: pointAt(-1000, 0), Priority: 5},
+				{Point: pointAt(1000, 0), Priority: 1},
+			},
+			wantOrder: []int{1, 0},
+		},
+		{
+			name: "without a start the most important stop begins",
+			stops: []RouteStop{
+				{Point: pointAt(0, 0), Priority: 3},
+				{Point: pointAt(2000, 0), Priority: 1},
+				{Point: pointAt(1000, 0), Priority: 2},
+			},
+			wantOrder: []int{1, 2, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := OptimizeRoute(tt.start, tt.stops, testRouteConfig())
+			var order []int
+			for _, s := range plan.Stops {
+				order = append(order, s.Index)
+			}
+			if !reflect.DeepEqual(order, tt.wantOrder) {
+				t.Errorf("order = %v, want %v", order, tt.wantOrder)
+			}
+			if plan.LateStops != tt.wantLate {
+				t.Errorf("late stops = %d, want %d", plan.LateStops, tt.wantLate)
+			}
+		})
+	}
+}
+
+func TestOptimizeRoutePlan(t *testing.T) {
+	origin := pointAt(0, 0)
+	stops := []RouteStop{
+		{Point: pointAt(1000, 0)},
+		{Point: pointAt(2000, 0), WindowStart: 9 * 60, WindowEnd: 10 * 60},
+		{Point: pointAt(3000, 0), WindowStart: 8 * 60, WindowEnd: 9 * 60, ServiceMinutes: 5},
+	}
+	plan := OptimizeRoute(&origin, stops, testRouteConfig())
+
+	// The third stop's window closes before the second one's opens, so it
+	// is worth driving past the second one and coming back
+	want := []PlannedStop{
+		{Index: 0, Sequence: 1, LegKm: 1, Arrival: "08:02", Departure: "08:22"},
+		{Index: 2, Sequence: 2, LegKm: 2, Arrival: "08:26", Departure: "08:31"},
+		{Index: 1, Sequence: 3, LegKm: 1, Arrival: "08:33", Departure: "09:20", WaitMinutes: 27},
+	}
+	if !reflect.DeepEqual(plan.Stops, want) {
+		t.Fatalf("stops = %+v\nwant    %+v", plan.Stops, want)
+	}
+	if plan.TotalKm != 4 || plan.DriveMinutes != 8 || plan.TotalMinutes != 80 || plan.EndTime != "09:20" || plan.LateStops != 0 {
+		t.Errorf("plan = %+v", plan)
+	}
+}
+
+func TestOptimizeRouteEmpty(t *testing.T) {
+	plan := OptimizeRoute(nil, nil, testRouteConfig())
+	if len(plan.Stops) != 0 || plan.EndTime != "08:00" {
+		t.Errorf("plan = %+v", plan)
+	}
+}
+
+// routeCost scores a whole route from scratch.
+func routeCost(start *RoutePoint, stops []RouteStop, order []int, cfg RouteConfig) float64 {
+	cur := start
+	now := float64(cfg.StartMinute)
+	total := 0.0
+	for _, idx := range order {
+		leg, dep, c := visit(cur, stops[idx], now, cfg)
+		total += leg + c
+		now = dep
+		cur = &stops[idx].Point
+	}
+	return total
+}
+
+// twoOptFull is the plain 2-opt that re-scores the whole route for every
+// move; twoOpt must make the same moves.
+func twoOptFull(start *RoutePoint, stops []RouteStop, order []int, cfg RouteConfig) {
+	best := routeCost(start, stops, order, cfg)
+	for pass := 0; pass < maxTwoOptPasses; pass++ {
+		improved := false
+		for i := 0; i < len(order)-1; i++ {
+			for k := i + 1; k < len(order); k++ {
+				reverse(order, i, k)
+				if c := routeCost(start, stops, order, cfg); c < best-1e-9 {
+					best = c
+					improved = true
+				} else {
+					reverse(order, i, k)
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+}
+
+func TestTwoOptMatchesFullScoring(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	cfg := testRouteConfig()
+	for n := 2; n <= 12; n++ {
+		for round := 0; round < 20; round++ {
+			stops := make([]RouteStop, n)
+			for i := range stops {
+				stops[i] = RouteStop{
+					Point:    pointAt(rng.Float64()*20000-10000, rng.Float64()*20000-10000),
+					Priority: 1 + rng.Intn(5),
+				}
+				if rng.Intn(3) == 0 {
+					open := 8*60 + rng.Intn(6*60)
+					stops[i].WindowStart, stops[i].WindowEnd = open, open+30+rng.Intn(90)
+				}
+			}
+			start := pointAt(0, 0)
+			for _, st := range []*RoutePoint{&start, nil} {
+				order := nearestNeighbor(st, stops, cfg)
+				want := append([]int(nil), order...)
+				twoOptFull(st, stops, want, cfg)
+				twoOpt(st, stops, order, cfg)
+				if !reflect.DeepEqual(order, want) {
+					t.Fatalf("n=%d round=%d: order %v, want %v", n, round, order, want)
+				}
+			}
+		}
+	}
+}
+
+func TestOptimizeRouteLargeIsBounded(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	stops := make([]RouteStop, 400)
+	for i := range stops {
+		stops[i] = RouteStop{Point: pointAt(rng.Float64()*40000, rng.Float64()*40000)}
+	}
+	plan := OptimizeRoute(nil, stops, testRouteConfig())
+	seen := map[int]bool{}
+	for _, s := range plan.Stops {
+		seen[s.Index] = true
+	}
+	if len(plan.Stops) != len(stops) || len(seen) != len(stops) {
+		t.Fatalf("planned %d stops (%d distinct), want %d", len(plan.Stops), len(seen), len(stops))
+	}
+}
+
+func TestParseClockMinutes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"08:00", 480, false},
+		{"8:05", 485, false},
+		{" 23:59 ", 1439, false},
+		{"12:30:45", 750, false},
+		{"24:00", 0, true},
+		{"12:60", 0, true},
+		{"12", 0, true},
+		{"ab:cd", 0, true},
+		{"1:2:3:4", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseClockMinutes(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseClockMinutes(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
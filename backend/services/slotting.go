@@ -0,0 +1,214 @@
+package services
+
+import (
+	"math"
+	"sort"
+)
+
+// SlottingConfig weighs the two costs of picking from a location: walking
+// to it and reaching its level.
+type SlottingConfig struct {
+	// Level at waist height; picking there has no reach cost.
+	GoldenLevel int `json:"golden_level"`
+	// Cost of each level above or below the golden level, in bays walked.
+	LevelWeight float64 `json:"level_weight"`
+	// Cost of each aisle further from the start of the path, in bays walked.
+	AisleWeight float64 `json:"aisle_weight"`
+	// Maximum number of location swaps proposed.
+	MaxMoves int `json:"max_moves"`
+	// Swaps that lower the score by less than this percentage are ignored.
+	MinGainPct float64 `json:"min_gain_pct"`
+}
+
+func DefaultSlottingConfig() SlottingConfig {
+	return SlottingConfig{GoldenLevel: 2, LevelWeight: 3, AisleWeight: 10, MaxMoves: 30, MinGainPct: 0.1}
+}
+
+type SlotLocation struct {
+	ID       int
+	Code     string
+	Aisle    string
+	Bay      int
+	Level    int
+	Capacity float64 // 0 = unknown, not enforced
+}
+
+type SlotProduct struct {
+	StockID     int
+	ProductCode string
+	ProductDesc string
+	ABCClass    string
+	Demand      float64 // picks or units per hour
+	MaxQty      float64
+	LocationID  int
+}
+
+type SlotMove struct {
+	StockID          int     `json:"stock_id"`
+	ProductCode      string  `json:"product_code"`
+	ProductDesc      string  `json:"product_description"`
+	FromLocationID   int     `json:"from_location_id"`
+	FromLocationCode string  `json:"from_location_code"`
+	ToLocationID     int     `json:"to_location_id"`
+	ToLocationCode   string  `json:"to_location_code"`
+	SwapGroup        int     `json:"swap_group"`
+	Demand           float64 `json:"demand"`
+	Gain             float64 `json:"gain"`
+}
+
+type SlottingResult struct {
+	CurrentScore   float64    `json:"current_score"`
+	ProposedScore  float64    `json:"proposed_score"`
+	ImprovementPct float64    `json:"improvement_pct"`
+	Moves          []SlotMove `json:"moves"`
+}
+
+// abcDemand is used as demand for all products when the filial has no
+// consumption history yet.
+var abcDemand = map[string]float64{"A": 3, "B": 2, "C": 1}
+
+// slot is the content of a location: every product stored in it moves
+// together, so a swap exchanges the whole content of two locations.
+type slot struct {
+	loc      SlotLocation
+	cost     float64
+	products []SlotProduct
+	demand   float64
+	maxQty   float64
+	moved    bool
+}
+
+// LocationCost is the expected effort of one pick at loc: aisles are walked
+// in code order from the first aisle, bays in increasing order.
+func LocationCost(loc SlotLocation, aisleIndex int, cfg SlottingConfig) float64 {
+	reach := math.Abs(float64(loc.Level - cfg.GoldenLevel))
+	return float64(aisleIndex)*cfg.AisleWeight + float64(loc.Bay) + reach*cfg.LevelWeight
+}
+
+// OptimizeSlotting scores the current layout (sum of demand x location cost)
+// and proposes up to cfg.MaxMoves swaps of location contents, best gain
+// first. Empty locations take part, so a swap with one is a plain move.
+// A content is only moved into a location whose capacity holds its max, and
+// each location takes part in at most one swap so moves never chain.
+func OptimizeSlotting(locations []SlotLocation, products []SlotProduct, cfg SlottingConfig) SlottingResult {
+	aisles := map[string]int{}
+	var aisleNames []string
+	for _, l := range locations {
+		if _, ok := aisles[l.Aisle]; !ok {
+			aisles[l.Aisle] = 0
+			aisleNames = append(aisleNames, l.Aisle)
+		}
+	}
+	sort.Strings(aisleNames)
+	for i, a := range aisleNames {
+		aisles[a] = i
+	}
+
+	useABC := true
+	for _, p := range products {
+		if p.Demand > 0 {
+			useABC = false
+			break
+		}
+	}
+
+	slots := make([]*slot, 0, len(locations))
+	byLocation := map[int]*slot{}
+	for _, l := range locations {
+		s := &slot{loc: l, cost: LocationCost(l, aisles[l.Aisle], cfg)}
+		slots = append(slots, s)
+		byLocation[l.ID] = s
+	}
+	for _, p := range products {
+		s, ok := byLocation[p.LocationID]
+		if !ok {
+			continue
+		}
+		if useABC {
+			p.Demand = abcDemand[p.ABCClass]
+		}
+		s.products = append(s.products, p)
+		s.demand += p.Demand
+		s.maxQty += p.MaxQty
+	}
+
+	score := func() float64 {
+		total := 0.0
+		for _, s := range slots {
+			total += s.demand * s.cost
+		}
+		return total
+	}
+	fits := func(s *slot, capacity float64) bool {
+		return capacity <= 0 || s.maxQty <= capacity
+	}
+
+	result := SlottingResult{CurrentScore: round2(score())}
+	minGain := result.CurrentScore * cfg.MinGainPct / 100
+	current := result.CurrentScore
+
+	for group := 1; group <= cfg.MaxMoves; group++ {
+		// Swapping contents of i and j changes the score by
+		// (d_i - d_j) * (c_j - c_i); look for the most negative.
+		bestGain, bi, bj := 0.0, -1, -1
+		for i, a := range slots {
+			if a.moved || len(a.products) == 0 {
+				continue
+			}
+			for j, b := range slots {
+				if i == j || b.moved || b.demand >= a.demand {
+					continue
+				}
+				gain := (a.demand - b.demand) * (a.cost - b.cost)
+				if gain <= bestGain || gain < minGain {
+					continue
+				}
+				if !fits(a, b.loc.Capacity) || !fits(b, a.loc.Capacity) {
+					continue
+				}
+				bestGain, bi, bj = gain, i, j
+			}
+		}
+		if bi < 0 {
+			break
+		}
+
+		a, b := slots[bi], slots[bj]
+		for _, p := range a.products {
+			result.Moves = append(result.Moves, newSlotMove(p, a.loc, b.loc, group, bestGain))
+		}
+		for _, p := range b.products {
+			result.Moves = append(result.Moves, newSlotMove(p, b.loc, a.loc, group, bestGain))
+		}
+		a.products, b.products = b.products, a.products
+		a.demand, b.demand = b.demand, a.demand
+		a.maxQty, b.maxQty = b.maxQty, a.maxQty
+		a.moved, b.moved = true, true
+		current -= bestGain
+	}
+
+	result.ProposedScore = round2(current)
+	if result.CurrentScore > 0 {
+		result.ImprovementPct = round2((result.CurrentScore - result.ProposedScore) / result.CurrentScore * 100)
+	}
+	return result
+}
+
+func newSlotMove(p SlotProduct, from, to SlotLocation, group int, gain float64) SlotMove {
+	return SlotMove{
+		StockID:          p.StockID,
+		ProductCode:      p.ProductCode,
+		ProductDesc:      p.ProductDesc,
+		FromLocationID:   from.ID,
+		FromLocationCode: from.Code,
+		ToLocationID:     to.ID,
+		ToLocationCode:   to.Code,
+		SwapGroup:        group,
+		Demand:           p.Demand,
+		Gain:             round2(gain),
+	}
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
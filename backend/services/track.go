@@ -0,0 +1,128 @@
+package services
+
+import (
+	"math"
+	"time"
+)
+
+// TrackPoint is a GPS reading of a device.
+type TrackPoint struct {
+	RoutePoint
+	Time time.Time `json:"time"`
+	// Radius of the reading's uncertainty; 0 when unknown
+	AccuracyM float64 `json:"accuracy_m,omitempty"`
+}
+
+const (
+	// Movement below this is treated as GPS noise while standing still
+	minTrackStepM = 25.0
+	// Readings implying a faster jump than this are glitches
+	maxTrackSpeedKmh = 180.0
+)
+
+// TrackDistanceKm is the distance driven along a track, in time order. A
+// reading only counts once the device moved farther than its accuracy (at
+// least minTrackStepM) from the last counted one, so a parked phone does
+// not add kilometers, and jumps faster than maxTrackSpeedKmh are ignored.
+// Until a step is counted the first reading may itself be the glitch, so
+// the reading that jumped away from it is kept as an alternative anchor.
+func TrackDistanceKm(points []TrackPoint) float64 {
+	if len(points) < 2 {
+		return 0
+	}
+	total := 0.0
+	anchor := points[0]
+	var alt *TrackPoint
+	confirmed := false
+	for i := 1; i < len(points); i++ {
+		p := points[i]
+		d, ok := trackStep(anchor, p)
+		if d == 0 {
+			continue
+		}
+		if !ok {
+			if confirmed {
+				continue
+			}
+			if alt != nil {
+				if d, ok = trackStep(*alt, p); d == 0 {
+					continue
+				} else if ok {
+					total += d
+					anchor, alt, confirmed = p, nil, true
+					continue
+				}
+			}
+			alt = &points[i]
+			continue
+		}
+		total += d
+		anchor, alt, confirmed = p, nil, true
+	}
+	return total
+}
+
+// trackStep returns the distance from a to b in km, 0 when it is within
+// the noise of b's reading, and whether it is plausible in speed.
+func trackStep(a, b TrackPoint) (float64, bool) {
+	d := HaversineKm(a.RoutePoint, b.RoutePoint)
+	if d*1000 < math.Max(minTrackStepM, b.AccuracyM) {
+		return 0, true
+	}
+	if hours := b.Time.Sub(a.Time).Hours(); hours > 0 && d/hours > maxTrackSpeedKmh {
+		return d, false
+	}
+	return d, true
+}
+
+// SimplifyPath reduces a track with the Douglas-Peucker algorithm, keeping
+// the points farther than toleranceM from the simplified line. The first
+// and last points are always kept.
+func SimplifyPath(points []TrackPoint, toleranceM float64) []TrackPoint {
+	if len(points) < 3 || toleranceM <= 0 {
+		return points
+	}
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	// Iterative to avoid deep recursion on long days
+	type span struct{ first, last int }
+	stack := []span{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		maxDist, index := 0.0, -1
+		for i := s.first + 1; i < s.last; i++ {
+			if d := segmentDistanceM(points[i].RoutePoint, points[s.first].RoutePoint, points[s.last].RoutePoint); d > maxDist {
+				maxDist, index = d, i
+			}
+		}
+		if index >= 0 && maxDist > toleranceM {
+			keep[index] = true
+			stack = append(stack, span{s.first, index}, span{index, s.last})
+		}
+	}
+
+	out := make([]TrackPoint, 0, len(points)/4+2)
+	for i, p := range points {
+		if keep[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// segmentDistanceM is the distance in meters from p to the segment a-b, on
+// an equirectangular projection around a; accurate at city scale.
+func segmentDistanceM(p, a, b RoutePoint) float64 {
+	kx := earthRadiusKm * 1000 * math.Pi / 180 * math.Cos(a.Lat*math.Pi/180)
+	ky := earthRadiusKm * 1000 * math.Pi / 180
+	px, py := (p.Lng-a.Lng)*kx, (p.Lat-a.Lat)*ky
+	bx, by := (b.Lng-a.Lng)*kx, (b.Lat-a.Lat)*ky
+	l2 := bx*bx + by*by
+	if l2 == 0 {
+		return math.Hypot(px, py)
+	}
+	t := math.Max(0, math.Min(1, (px*bx+py*by)/l2))
+	return math.Hypot(px-t*bx, py-t*by)
+}
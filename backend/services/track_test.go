@@ -0,0 +1,165 @@
+package services
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var trackStart = time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+
+// pointAt returns the point northM meters north and eastM meters east of a
+// fixed base.
+func pointAt(northM, eastM float64) RoutePoint {
+	const base, baseLng = -23.55, -46.63
+	kLat := earthRadiusKm * 1000 * math.Pi / 180
+	kLng := kLat * math.Cos(base*math.Pi/180)
+	return RoutePoint{Lat: base + northM/kLat, Lng: baseLng + eastM/kLng}
+}
+
+// trackAt returns the reading at pointAt(northM, eastM), taken minutes
+// after trackStart.
+func trackAt(northM, eastM float64, minutes float64) TrackPoint {
+	return TrackPoint{
+		RoutePoint: pointAt(northM, eastM),
+		Time:       trackStart.Add(time.Duration(minutes * float64(time.Minute))),
+	}
+}
+
+func TestTrackDistanceKm(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []TrackPoint
+		want   float64
+	}{
+		{"empty", nil, 0},
+		{"single point", []TrackPoint{trackAt(0, 0, 0)}, 0},
+		{
+			name: "straight drive",
+			points: []TrackPoint{
+				trackAt(0, 0, 0), trackAt(1000, 0, 2), trackAt(2000, 0, 4), trackAt(3000, 0, 6),
+			},
+			want: 3,
+		},
+		{
+			name: "parked phone jitter",
+			points: []TrackPoint{
+				trackAt(0, 0, 0), trackAt(8, -5, 1), trackAt(-6, 10, 2), trackAt(12, 3, 3), trackAt(0, -15, 4),
+			},
+			want: 0,
+		},
+		{
+			name: "jitter within the reported accuracy",
+			points: []TrackPoint{
+				trackAt(0, 0, 0),
+				func() TrackPoint { p := trackAt(60, 0, 1); p.AccuracyM = 80; return p }(),
+				trackAt(1000, 0, 3),
+			},
+			want: 1,
+		},
+		{
+			name: "glitch in the middle",
+			points: []TrackPoint{
+				trackAt(0, 0, 0), trackAt(1000, 0, 2), trackAt(50000, 0, 3), trackAt(2000, 0, 4),
+			},
+			want: 2,
+		},
+		{
+			name: "glitch first breadcrumb",
+			points: []TrackPoint{
+				trackAt(80000, 0, 0), trackAt(0, 0, 1), trackAt(1000, 0, 3), trackAt(2000, 0, 5),
+			},
+			want: 2,
+		},
+		{
+			name: "first breadcrumb glitch then parked",
+			points: []TrackPoint{
+				trackAt(80000, 0, 0), trackAt(0, 0, 1), trackAt(10, 5, 3), trackAt(-5, 10, 5),
+			},
+			want: 0,
+		},
+		{
+			name: "glitch second breadcrumb",
+			points: []TrackPoint{
+				trackAt(0, 0, 0), trackAt(80000, 0, 1), trackAt(1000, 0, 3), trackAt(2000, 0, 5),
+			},
+			want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TrackDistanceKm(tt.points); math.Abs(got-tt.want) > 0.01 {
+				t.Errorf("TrackDistanceKm = %.3f, want %.3f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimplifyPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		points     []TrackPoint
+		toleranceM float64
+		want       []int // indexes of the points kept
+	}{
+		{
+			name:       "two points",
+			points:     []TrackPoint{trackAt(0, 0, 0), trackAt(100, 0, 1)},
+			toleranceM: 10,
+			want:       []int{0, 1},
+		},
+		{
+			name: "collinear points",
+			points: []TrackPoint{
+				trackAt(0, 0, 0), trackAt(100, 0, 1), trackAt(200, 0, 2), trackAt(300, 0, 3), trackAt(400, 0, 4),
+			},
+			toleranceM: 10,
+			want:       []int{0, 4},
+		},
+		{
+			name: "noise within the tolerance",
+			points: []TrackPoint{
+				trackAt(0, 0, 0), trackAt(100, 4, 1), trackAt(200, -3, 2), trackAt(300, 0, 3),
+			},
+			toleranceM: 10,
+			want:       []int{0, 3},
+		},
+		{
+			name: "corner is kept",
+			points: []TrackPoint{
+				trackAt(0, 0, 0), trackAt(250, 0, 1), trackAt(500, 0, 2), trackAt(500, 250, 3), trackAt(500, 500, 4),
+			},
+			toleranceM: 10,
+			want:       []int{0, 2, 4},
+		},
+		{
+			name: "glitch is kept",
+			points: []TrackPoint{
+				trackAt(0, 0, 0), trackAt(100, 0, 1), trackAt(200, 3000, 2), trackAt(300, 0, 3), trackAt(400, 0, 4),
+			},
+			toleranceM: 10,
+			want:       []int{0, 1, 2, 3, 4},
+		},
+		{
+			name: "zero tolerance keeps everything",
+			points: []TrackPoint{
+				trackAt(0, 0, 0), trackAt(100, 0, 1), trackAt(200, 0, 2),
+			},
+			toleranceM: 0,
+			want:       []int{0, 1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SimplifyPath(tt.points, tt.toleranceM)
+			if len(got) != len(tt.want) {
+				t.Fatalf("kept %d points, want %d", len(got), len(tt.want))
+			}
+			for i, idx := range tt.want {
+				if got[i] != tt.points[idx] {
+					t.Errorf("point %d = %+v, want input point %d", i, got[i], idx)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package services
+
+import "math"
+
+// TrendFit is an ordinary least-squares line y = Intercept + Slope*x with a
+// 95% confidence interval for the slope.
+type TrendFit struct {
+	Slope      float64 `json:"slope"`
+	Intercept  float64 `json:"intercept"`
+	SlopeLower float64 `json:"slope_lower"`
+	SlopeUpper float64 `json:"slope_upper"`
+	R2         float64 `json:"r2"`
+	N          int     `json:"n"`
+}
+
+// LinearTrend fits y over x. With fewer than two distinct x values the fit
+// is flat; with exactly two points the bounds equal the slope.
+func LinearTrend(x, y []float64) TrendFit {
+	n := len(x)
+	if len(y) < n {
+		n = len(y)
+	}
+	fit := TrendFit{N: n}
+	if n == 0 {
+		return fit
+	}
+
+	var meanX, meanY float64
+	for i := 0; i < n; i++ {
+		meanX += x[i]
+		meanY += y[i]
+	}
+	meanX /= float64(n)
+	meanY /= float64(n)
+
+	var sxx, sxy, syy float64
+	for i := 0; i < n; i++ {
+		dx, dy := x[i]-meanX, y[i]-meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	fit.Intercept = meanY
+	if sxx == 0 {
+		return fit
+	}
+
+	fit.Slope = sxy / sxx
+	fit.Intercept = meanY - fit.Slope*meanX
+	if syy > 0 {
+		fit.R2 = (sxy * sxy) / (sxx * syy)
+	}
+	fit.SlopeLower, fit.SlopeUpper = fit.Slope, fit.Slope
+	if n > 2 {
+		sse := math.Max(0, syy-fit.Slope*sxy)
+		stdErr := math.Sqrt(sse/float64(n-2)) / math.Sqrt(sxx)
+		margin := tCritical95(n-2) * stdErr
+		fit.SlopeLower = fit.Slope - margin
+		fit.SlopeUpper = fit.Slope + margin
+	}
+	return fit
+}
+
+// tCritical95 returns the two-sided 95% Student t critical value.
+func tCritical95(df int) float64 {
+	table := []float64{12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+		2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+		2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042}
+	switch {
+	case df < 1:
+		return math.Inf(1)
+	case df <= len(table):
+		return table[df-1]
+	case df <= 60:
+		return 2.000
+	case df <= 120:
+		return 1.980
+	default:
+		return 1.960
+	}
+}
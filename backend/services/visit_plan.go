@@ -0,0 +1,89 @@
+package services
+
+import (
+	"fmt"
+	"time"
+)
+
+// Visit frequencies of a customer. Weekdays is Monday to Friday; daily
+// includes weekends.
+const (
+	FrequencyWeekdays = "weekdays"
+	FrequencyDaily    = "daily"
+	FrequencyWeekly   = "weekly"
+	FrequencyInterval = "interval"
+	FrequencyMonthly  = "monthly"
+)
+
+// VisitRule says on which days a customer is visited. An empty Frequency
+// means weekdays.
+type VisitRule struct {
+	Frequency string `json:"frequency"`
+	// weekly: 0 = Sunday ... 6 = Saturday
+	Weekday int `json:"weekday,omitempty"`
+	// interval: every IntervalDays days from Anchor
+	IntervalDays int       `json:"interval_days,omitempty"`
+	Anchor       time.Time `json:"-"`
+	// monthly: 1-31; past the end of a month means its last day
+	MonthDay int `json:"month_day,omitempty"`
+}
+
+// Validate checks that the fields required by the frequency are set.
+func (r VisitRule) Validate() error {
+	switch r.Frequency {
+	case "", FrequencyWeekdays, FrequencyDaily:
+	case FrequencyWeekly:
+		if r.Weekday < 0 || r.Weekday > 6 {
+			return fmt.Errorf("visit_weekday deve estar entre 0 (domingo) e 6 (sabado)")
+		}
+	case FrequencyInterval:
+		if r.IntervalDays < 1 {
+			return fmt.Errorf("visit_interval_days deve ser maior que zero")
+		}
+		if r.Anchor.IsZero() {
+			return fmt.Errorf("visit_anchor_date e obrigatorio para a frequencia interval")
+		}
+	case FrequencyMonthly:
+		if r.MonthDay < 1 || r.MonthDay > 31 {
+			return fmt.Errorf("visit_month_day deve estar entre 1 e 31")
+		}
+	default:
+		return fmt.Errorf("visit_frequency invalida: %q", r.Frequency)
+	}
+	return nil
+}
+
+// Due reports whether the customer is to be visited on date. Only the
+// calendar day of date is considered.
+func (r VisitRule) Due(date time.Time) bool {
+	day := dateOnly(date)
+	switch r.Frequency {
+	case "", FrequencyWeekdays:
+		return day.Weekday() != time.Saturday && day.Weekday() != time.Sunday
+	case FrequencyDaily:
+		return true
+	case FrequencyWeekly:
+		return int(day.Weekday()) == r.Weekday
+	case FrequencyInterval:
+		if r.IntervalDays < 1 || r.Anchor.IsZero() {
+			return false
+		}
+		days := int(day.Sub(dateOnly(r.Anchor)).Hours()/24 + 0.5)
+		return days >= 0 && days%r.IntervalDays == 0
+	case FrequencyMonthly:
+		target := r.MonthDay
+		if last := daysInMonth(day); target > last {
+			target = last
+		}
+		return day.Day() == target
+	}
+	return false
+}
+
+func dateOnly(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func daysInMonth(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
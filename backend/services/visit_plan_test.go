@@ -0,0 +1,115 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestVisitRuleDue(t *testing.T) {
+	weeklyMonday := VisitRule{Frequency: FrequencyWeekly, Weekday: 1}
+	biweekly := VisitRule{Frequency: FrequencyInterval, IntervalDays: 14, Anchor: day("2026-12-14")}
+	tests := []struct {
+		name string
+		rule VisitRule
+		date string
+		want bool
+	}{
+		// Default: business days
+		{"default on a friday", VisitRule{}, "2027-01-01", true},
+		{"default on a saturday", VisitRule{}, "2027-01-02", false},
+		{"default on a sunday", VisitRule{}, "2027-01-03", false},
+		{"weekdays on a monday", VisitRule{Frequency: FrequencyWeekdays}, "2027-01-04", true},
+		{"weekdays on a saturday", VisitRule{Frequency: FrequencyWeekdays}, "2026-02-28", false},
+		{"daily on a saturday", VisitRule{Frequency: FrequencyDaily}, "2027-01-02", true},
+
+		// Weekly across a year boundary
+		{"weekly monday before new year", weeklyMonday, "2026-12-28", true},
+		{"weekly on new year's thursday", weeklyMonday, "2026-12-31", false},
+		{"weekly first monday of the year", weeklyMonday, "2027-01-04", true},
+		{"weekly sunday", VisitRule{Frequency: FrequencyWeekly, Weekday: 0}, "2027-01-03", true},
+
+		// Every two weeks from a December anchor
+		{"biweekly on the anchor", biweekly, "2026-12-14", true},
+		{"biweekly off week", biweekly, "2026-12-21", false},
+		{"biweekly second visit", biweekly, "2026-12-28", true},
+		{"biweekly off week in the new year", biweekly, "2027-01-04", false},
+		{"biweekly across the year", biweekly, "2027-01-11", true},
+		{"biweekly a month later", biweekly, "2027-01-25", true},
+		{"biweekly before the anchor", biweekly, "2026-11-30", false},
+		{"biweekly across february", VisitRule{Frequency: FrequencyInterval, IntervalDays: 14, Anchor: day("2026-02-16")}, "2026-03-02", true},
+		{"interval without anchor", VisitRule{Frequency: FrequencyInterval, IntervalDays: 14}, "2026-12-14", false},
+
+		// Monthly, past the end of short months
+		{"monthly 31 on january 31", VisitRule{Frequency: FrequencyMonthly, MonthDay: 31}, "2027-01-31", true},
+		{"monthly 31 on february 28", VisitRule{Frequency: FrequencyMonthly, MonthDay: 31}, "2026-02-28", true},
+		{"monthly 30 on a leap february 29", VisitRule{Frequency: FrequencyMonthly, MonthDay: 30}, "2024-02-29", true},
+		{"monthly 29 on a leap february 28", VisitRule{Frequency: FrequencyMonthly, MonthDay: 29}, "2024-02-28", false},
+		{"monthly 31 on april 30", VisitRule{Frequency: FrequencyMonthly, MonthDay: 31}, "2026-04-30", true},
+		{"monthly 1 on december 1", VisitRule{Frequency: FrequencyMonthly, MonthDay: 1}, "2026-12-01", true},
+
+		{"unknown frequency", VisitRule{Frequency: "yearly"}, "2027-01-04", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Due(day(tt.date)); got != tt.want {
+				t.Errorf("Due(%s) = %v, want %v", tt.date, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVisitRuleDueUsesCalendarDay(t *testing.T) {
+	// Late evening in a zone behind UTC is still the local day
+	brt := time.FixedZone("BRT", -3*60*60)
+	biweekly := VisitRule{Frequency: FrequencyInterval, IntervalDays: 14, Anchor: day("2026-12-14")}
+	tests := []struct {
+		date time.Time
+		want bool
+	}{
+		{time.Date(2026, 12, 28, 23, 30, 0, 0, brt), true},
+		{time.Date(2026, 12, 28, 0, 10, 0, 0, brt), true},
+		{time.Date(2026, 12, 29, 1, 0, 0, 0, brt), false},
+	}
+	for _, tt := range tests {
+		if got := biweekly.Due(tt.date); got != tt.want {
+			t.Errorf("Due(%s) = %v, want %v", tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestVisitRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    VisitRule
+		wantErr bool
+	}{
+		{"empty", VisitRule{}, false},
+		{"weekdays", VisitRule{Frequency: FrequencyWeekdays}, false},
+		{"daily", VisitRule{Frequency: FrequencyDaily}, false},
+		{"weekly sunday", VisitRule{Frequency: FrequencyWeekly, Weekday: 0}, false},
+		{"weekly saturday", VisitRule{Frequency: FrequencyWeekly, Weekday: 6}, false},
+		{"weekly out of range", VisitRule{Frequency: FrequencyWeekly, Weekday: 7}, true},
+		{"interval", VisitRule{Frequency: FrequencyInterval, IntervalDays: 14, Anchor: day("2026-12-14")}, false},
+		{"interval without days", VisitRule{Frequency: FrequencyInterval, Anchor: day("2026-12-14")}, true},
+		{"interval without anchor", VisitRule{Frequency: FrequencyInterval, IntervalDays: 14}, true},
+		{"monthly", VisitRule{Frequency: FrequencyMonthly, MonthDay: 31}, false},
+		{"monthly zero", VisitRule{Frequency: FrequencyMonthly}, true},
+		{"monthly 32", VisitRule{Frequency: FrequencyMonthly, MonthDay: 32}, true},
+		{"unknown", VisitRule{Frequency: "yearly"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+// Package winthorfake implements the Winthor picking API contract
+// (/picking-stock and /replenishment) as an in-memory HTTP server, so that
+// RealWinthorClient and the scheduler can be exercised end to end without
+// the ERP. It is used by cmd/fakewinthor and by the integration tests.
+package winthorfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"aprovapedido/handlers"
+)
+
+type Config struct {
+	// APIKey, when set, must be sent as "Authorization: Bearer <key>".
+	APIKey string
+	// Latency is added to every API request, plus a random value up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// ErrorRate is the fraction (0..1) of API requests answered with 503.
+	ErrorRate float64
+	// Seed drives both the generated stock and the depletion model, so two
+	// servers with the same config behave the same way.
+	Seed               int64
+	Filiais            []string
+	LocationsPerFilial int
+	// DepletionFactor scales how much stock is consumed on each
+	// /picking-stock read (1.0 = same rates as MockWinthorClient).
+	DepletionFactor float64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Seed:               42,
+		Filiais:            []string{"01", "02", "03"},
+		LocationsPerFilial: 200,
+		DepletionFactor:    1.0,
+	}
+}
+
+// RecordedRequest is a request received on the API endpoints.
+type RecordedRequest struct {
+	Method         string          `json:"method"`
+	Path           string          `json:"path"`
+	Query          string          `json:"query"`
+	CompanyID      string          `json:"company_id"`
+	IdempotencyKey string          `json:"idempotency_key"`
+	Body           json.RawMessage `json:"body,omitempty"`
+	Status         int             `json:"status"`
+	ReceivedAt     time.Time       `json:"received_at"`
+}
+
+type Server struct {
+	mu        sync.Mutex
+	cfg       Config
+	rng       *rand.Rand
+	stock     map[string][]*handlers.WinthorStockItem
+	waves     map[string]handlers.WinthorWaveResponse
+	requests  []RecordedRequest
+	waveCount int
+}
+
+func New(cfg Config) *Server {
+	s := &Server{cfg: cfg}
+	s.reset()
+	return s
+}
+
+func (s *Server) reset() {
+	s.rng = rand.New(rand.NewSource(s.cfg.Seed))
+	s.stock = map[string][]*handlers.WinthorStockItem{}
+	s.waves = map[string]handlers.WinthorWaveResponse{}
+	s.requests = nil
+	s.waveCount = 0
+	for _, filial := range s.cfg.Filiais {
+		s.stock[filial] = generateStock(s.rng, filial, s.cfg.LocationsPerFilial)
+	}
+}
+
+// generateStock builds a deterministic layout: aisles A..E, 20% class A,
+// 30% class B, the rest C, with stock somewhere between min and max.
+func generateStock(rng *rand.Rand, filial string, n int) []*handlers.WinthorStockItem {
+	items := make([]*handlers.WinthorStockItem, 0, n)
+	for i := 0; i < n; i++ {
+		abc := "C"
+		switch {
+		case i%10 < 2:
+			abc = "A"
+		case i%10 < 5:
+			abc = "B"
+		}
+		maxQty := float64(50 + rng.Intn(151))
+		minQty := float64(int(maxQty * 0.3))
+		items = append(items, &handlers.WinthorStockItem{
+			FilialCode:   filial,
+			LocationCode: fmt.Sprintf("%c-%02d-%02d-1", 'A'+rune(i/40%5), i/4%10+1, i%4+1),
+			ProductCode:  fmt.Sprintf("P%05d", i+1),
+			ProductDesc:  fmt.Sprintf("Produto teste %d", i+1),
+			CurrentQty:   minQty + float64(rng.Intn(int(maxQty-minQty)+1)),
+			MinQty:       minQty,
+			MaxQty:       maxQty,
+			ABCClass:     abc,
+		})
+	}
+	return items
+}
+
+// Stock returns a copy of the current stock of a filial.
+func (s *Server) Stock(filial string) []handlers.WinthorStockItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]handlers.WinthorStockItem, 0, len(s.stock[filial]))
+	for _, it := range s.stock[filial] {
+		out = append(out, *it)
+	}
+	return out
+}
+
+// SetStock replaces the stock of a filial.
+func (s *Server) SetStock(filial string, items []handlers.WinthorStockItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*handlers.WinthorStockItem, 0, len(items))
+	for i := range items {
+		it := items[i]
+		it.FilialCode = filial
+		list = append(list, &it)
+	}
+	s.stock[filial] = list
+}
+
+func (s *Server) SetErrorRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.ErrorRate = rate
+}
+
+// Requests returns the API requests received so far.
+func (s *Server) Requests() []RecordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RecordedRequest(nil), s.requests...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/picking-stock" && r.Method == http.MethodGet:
+		s.api(w, r, s.handleStock)
+	case r.URL.Path == "/replenishment" && r.Method == http.MethodPost:
+		s.api(w, r, s.handleReplenishment)
+	case r.URL.Path == "/_fake/requests" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Requests())
+	case r.URL.Path == "/_fake/reset" && r.Method == http.MethodPost:
+		s.mu.Lock()
+		s.reset()
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]string{"message": "reset"})
+	case r.URL.Path == "/_fake/stock":
+		s.handleAdminStock(w, r)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// api wraps the contract endpoints with auth, latency, error injection and
+// request recording.
+func (s *Server) api(w http.ResponseWriter, r *http.Request, h func([]byte, *http.Request) (int, interface{})) {
+	body, _ := io.ReadAll(r.Body)
+	rec := RecordedRequest{
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		Query:          r.URL.RawQuery,
+		CompanyID:      r.Header.Get("X-Company-ID"),
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
+		ReceivedAt:     time.Now(),
+	}
+	if len(body) > 0 && json.Valid(body) {
+		rec.Body = body
+	}
+
+	s.mu.Lock()
+	delay := s.cfg.Latency
+	if s.cfg.Jitter > 0 {
+		delay += time.Duration(s.rng.Int63n(int64(s.cfg.Jitter)))
+	}
+	fail := s.cfg.ErrorRate > 0 && s.rng.Float64() < s.cfg.ErrorRate
+	apiKey := s.cfg.APIKey
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	status, resp := http.StatusOK, interface{}(nil)
+	switch {
+	case apiKey != "" && r.Header.Get("Authorization") != "Bearer "+apiKey:
+		status, resp = http.StatusUnauthorized, map[string]string{"message": "invalid api key"}
+	case fail:
+		status, resp = http.StatusServiceUnavailable, map[string]string{"message": "injected failure"}
+	default:
+		status, resp = h(body, r)
+	}
+
+	rec.Status = status
+	s.mu.Lock()
+	s.requests = append(s.requests, rec)
+	s.mu.Unlock()
+
+	writeJSON(w, status, resp)
+}
+
+func (s *Server) handleStock(_ []byte, r *http.Request) (int, interface{}) {
+	filial := r.URL.Query().Get("filial")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, ok := s.stock[filial]
+	if !ok {
+		return http.StatusNotFound, map[string]string{"message": "filial not found"}
+	}
+
+	// Depletion model: same ranges as MockWinthorClient, driven by the seed
+	out := make([]handlers.WinthorStockItem, 0, len(list))
+	for _, it := range list {
+		var pct float64
+		switch it.ABCClass {
+		case "A":
+			pct = 0.10 + s.rng.Float64()*0.15
+		case "B":
+			pct = 0.05 + s.rng.Float64()*0.10
+		default:
+			pct = 0.02 + s.rng.Float64()*0.06
+		}
+		it.CurrentQty -= it.MaxQty * pct * s.cfg.DepletionFactor
+		if it.CurrentQty < 0 {
+			it.CurrentQty = 0
+		}
+		out = append(out, *it)
+	}
+	return http.StatusOK, out
+}
+
+func (s *Server) handleReplenishment(body []byte, r *http.Request) (int, interface{}) {
+	var wave handlers.WinthorWavePayload
+	if err := json.Unmarshal(body, &wave); err != nil {
+		return http.StatusBadRequest, map[string]string{"message": "invalid payload: " + err.Error()}
+	}
+	if wave.WaveNumber == "" || len(wave.Tasks) == 0 {
+		return http.StatusUnprocessableEntity, handlers.WinthorWaveResponse{
+			Success: false, Message: "wave_number and tasks are required",
+		}
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = wave.WaveNumber
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.waves[key]; ok {
+		return http.StatusOK, prev
+	}
+
+	// Replenishment is applied immediately: each task refills its location
+	index := map[string]*handlers.WinthorStockItem{}
+	for _, it := range s.stock[wave.Filial] {
+		index[it.LocationCode+"|"+it.ProductCode] = it
+	}
+	for _, t := range wave.Tasks {
+		if it, ok := index[t.LocationCode+"|"+t.ProductCode]; ok {
+			it.CurrentQty += t.QtyToReplenish
+			if it.CurrentQty > it.MaxQty {
+				it.CurrentQty = it.MaxQty
+			}
+		}
+	}
+
+	s.waveCount++
+	resp := handlers.WinthorWaveResponse{
+		Success:    true,
+		WinthorRef: fmt.Sprintf("FAKE-%s-%04d", wave.Filial, s.waveCount),
+		Message:    fmt.Sprintf("Onda %s aceita (fake). %d tarefas geradas.", wave.WaveNumber, len(wave.Tasks)),
+	}
+	s.waves[key] = resp
+	return http.StatusOK, resp
+}
+
+func (s *Server) handleAdminStock(w http.ResponseWriter, r *http.Request) {
+	filial := r.URL.Query().Get("filial")
+	switch r.Method {
+	case http.MethodGet:
+		if filial == "" {
+			s.mu.Lock()
+			filiais := make([]string, 0, len(s.stock))
+			for f := range s.stock {
+				filiais = append(filiais, f)
+			}
+			s.mu.Unlock()
+			sort.Strings(filiais)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"filiais": filiais})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Stock(filial))
+	case http.MethodPut:
+		if strings.TrimSpace(filial) == "" {
+			http.Error(w, "filial is required", http.StatusBadRequest)
+			return
+		}
+		var items []handlers.WinthorStockItem
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		s.SetStock(filial, items)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"filial": filial, "items": len(items)})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}